@@ -0,0 +1,87 @@
+package main
+
+import (
+	"github.com/datarhei/joy4/codec/aacparser"
+)
+
+// adtsFrame - один AAC кадр без ADTS заголовка с собственной меткой времени (тики 90 кГц)
+type adtsFrame struct {
+	Config  aacparser.MPEG4AudioConfig
+	Payload []byte
+	Ticks   int64
+	Samples int
+}
+
+// adtsSplitter режет аудио PES на отдельные ADTS кадры.
+// Энкодеры часто кладут несколько AAC кадров в один PES, а иногда
+// кадр разрывается между двумя PES - хвост сохраняется до следующего PES.
+type adtsSplitter struct {
+	pending   []byte
+	nextTicks int64 // ожидаемая метка кадра, начатого в предыдущем PES
+}
+
+// Split возвращает кадры из очередного PES. ptsTicks - развёрнутый PTS этого PES,
+// он относится к первому кадру, который начинается внутри PES.
+func (a *adtsSplitter) Split(data []byte, ptsTicks int64) []adtsFrame {
+	carried := len(a.pending)
+	buf := data
+	if carried > 0 {
+		buf = append(a.pending, data...)
+		a.pending = nil
+	}
+
+	var frames []adtsFrame
+	var samples int64 // сэмплов от начала отсчёта текущей метки
+	baseTicks := a.nextTicks
+	rebased := carried == 0
+	if rebased {
+		baseTicks = ptsTicks
+	}
+
+	offset := 0
+	for len(buf)-offset >= aacparser.ADTSHeaderLength {
+		// Ищем синхрослово, если поток повреждён
+		if buf[offset] != 0xFF || buf[offset+1]&0xF0 != 0xF0 {
+			offset++
+			continue
+		}
+		if !rebased && offset >= carried {
+			// Первый кадр, начавшийся в новом PES, получает его PTS
+			baseTicks = ptsTicks
+			samples = 0
+			rebased = true
+		}
+
+		cfg, hdrlen, framelen, frameSamples, err := aacparser.ParseADTSHeader(buf[offset:])
+		if err != nil || framelen <= hdrlen {
+			offset++
+			continue
+		}
+		if framelen > len(buf)-offset {
+			break // кадр продолжится в следующем PES
+		}
+
+		ticks := baseTicks
+		if cfg.SampleRate > 0 {
+			ticks += samples * ptsClockRate / int64(cfg.SampleRate)
+			samples += int64(frameSamples)
+			a.nextTicks = baseTicks + samples*ptsClockRate/int64(cfg.SampleRate)
+		}
+		frames = append(frames, adtsFrame{
+			Config:  cfg,
+			Payload: buf[offset+hdrlen : offset+framelen],
+			Ticks:   ticks,
+			Samples: frameSamples,
+		})
+		offset += framelen
+	}
+
+	if offset < len(buf) {
+		a.pending = append([]byte(nil), buf[offset:]...)
+		if offset >= carried && (!rebased || samples == 0) {
+			// Хвост - первый кадр, начатый в этом PES: он получит PTS этого PES
+			a.nextTicks = ptsTicks
+		}
+	}
+	return frames
+}
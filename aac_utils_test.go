@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+// adtsTestFrame - ADTS кадр AAC-LC 48 кГц стерео с заданной полезной нагрузкой
+func adtsTestFrame(payload []byte) []byte {
+	n := 7 + len(payload)
+	header := []byte{
+		0xFF, 0xF1,
+		0x40 | 3<<2, // AAC-LC, 48000 Гц
+		2<<6 | byte(n>>11)&0x03,
+		byte(n >> 3),
+		byte(n&0x07)<<5 | 0x1F,
+		0xFC,
+	}
+	return append(header, payload...)
+}
+
+func TestADTSSplitter(t *testing.T) {
+	a := adtsTestFrame([]byte{1, 1, 1})
+	b := adtsTestFrame([]byte{2, 2, 2, 2})
+	c := adtsTestFrame([]byte{3, 3})
+	const frameTicks = 1024 * ptsClockRate / 48000
+
+	type call struct {
+		data  []byte
+		pts   int64
+		ticks []int64
+		first []byte // первый байт полезной нагрузки каждого кадра
+	}
+	tests := []struct {
+		name  string
+		calls []call
+	}{
+		{
+			name: "несколько кадров в одном PES",
+			calls: []call{
+				{data: concatBytes(a, b, c), pts: 9000, ticks: []int64{9000, 9000 + frameTicks, 9000 + 2*frameTicks}, first: []byte{1, 2, 3}},
+			},
+		},
+		{
+			name: "кадр разрезан между PES",
+			calls: []call{
+				{data: concatBytes(a, b[:5]), pts: 9000, ticks: []int64{9000}, first: []byte{1}},
+				{data: concatBytes(b[5:], c), pts: 20000, ticks: []int64{9000 + frameTicks, 20000}, first: []byte{2, 3}},
+			},
+		},
+		{
+			name: "мусор перед синхрословом",
+			calls: []call{
+				{data: concatBytes([]byte{0x00, 0x12, 0xFF}, a), pts: 100, ticks: []int64{100}, first: []byte{1}},
+			},
+		},
+		{
+			name: "хвост начинается в новом PES",
+			calls: []call{
+				{data: a[:3], pts: 500, ticks: nil},
+				{data: a[3:], pts: 900, ticks: []int64{500}, first: []byte{1}},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var s adtsSplitter
+			for i, c := range tt.calls {
+				frames := s.Split(c.data, c.pts)
+				if len(frames) != len(c.ticks) {
+					t.Fatalf("call %d: got %d frames, want %d", i, len(frames), len(c.ticks))
+				}
+				for j, f := range frames {
+					if f.Ticks != c.ticks[j] {
+						t.Errorf("call %d frame %d: ticks %d, want %d", i, j, f.Ticks, c.ticks[j])
+					}
+					if f.Payload[0] != c.first[j] {
+						t.Errorf("call %d frame %d: payload %v", i, j, f.Payload)
+					}
+					if f.Samples != 1024 || f.Config.SampleRate != 48000 {
+						t.Errorf("call %d frame %d: samples %d, rate %d", i, j, f.Samples, f.Config.SampleRate)
+					}
+				}
+			}
+		})
+	}
+}
+
+// Непрерывный ADTS поток (stdout ffmpeg) режется на чтения произвольной длины:
+// каждый кадр должен выйти ровно один раз, а сумма сэмплов - дать непрерывную шкалу
+func TestADTSSplitterContinuousStream(t *testing.T) {
+	var stream []byte
+	for i := 0; i < 20; i++ {
+		stream = append(stream, adtsTestFrame(bytes.Repeat([]byte{byte(i)}, 10+i*7))...)
+	}
+
+	for _, chunkSize := range []int{1, 7, 37, 100, 4096} {
+		var s adtsSplitter
+		var got []byte
+		var samples int
+		for off := 0; off < len(stream); off += chunkSize {
+			end := min(off+chunkSize, len(stream))
+			for _, f := range s.Split(stream[off:end], 0) {
+				got = append(got, f.Payload[0])
+				samples += f.Samples
+			}
+		}
+		if len(got) != 20 || samples != 20*1024 {
+			t.Fatalf("chunk %d: %d frames, %d samples", chunkSize, len(got), samples)
+		}
+		for i, b := range got {
+			if b != byte(i) {
+				t.Fatalf("chunk %d: frame %d out of order (%d)", chunkSize, i, b)
+			}
+		}
+	}
+}
+
+func concatBytes(parts ...[]byte) []byte {
+	var out []byte
+	for _, p := range parts {
+		out = append(out, p...)
+	}
+	return out
+}
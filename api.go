@@ -5,11 +5,16 @@ import (
 	"embed"
 	"encoding/base64"
 	"encoding/json"
+	"fmt"
 	"io"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
+	"slices"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	"gopkg.in/yaml.v3"
@@ -22,6 +27,8 @@ type APIServer struct {
 	SM       *StreamManager
 	User     string
 	Password string
+	SRT      *SRTServer  // демуксинг MPEG-TS для /ingest/
+	WHIP     *WHIPServer // слои simulcast для /api/inputs/whip_layer
 }
 
 func NewAPIServer(sm *StreamManager, user, password string) *APIServer {
@@ -72,11 +79,17 @@ func (api *APIServer) routes() http.Handler {
 	// Health check endpoint (без аутентификации)
 	mux.HandleFunc("/health", api.handleHealthCheck)
 
+	// Приём потока HTTP POST и WebSocket (авторизация - publish_token входа)
+	mux.HandleFunc("/ingest/", api.handleIngest)
+	mux.HandleFunc("/ws/", api.handleWSIngest)
+
 	// API маршруты
 	mux.HandleFunc("/api/inputs", api.basicAuth(api.handleListInputs))                      // GET
 	mux.HandleFunc("/api/inputs/add", api.basicAuth(api.handleAddInput))                    // POST
 	mux.HandleFunc("/api/inputs/remove", api.basicAuth(api.handleRemoveInput))              // GET ?name=
 	mux.HandleFunc("/api/inputs/update_outputs", api.basicAuth(api.handleUpdateOutputs))    // POST
+	mux.HandleFunc("/api/inputs/whip_layer", api.basicAuth(api.handleSetWHIPLayer))         // POST
+	mux.HandleFunc("/api/inputs/srt_passphrase", api.basicAuth(api.handleSetSRTPassphrase)) // POST
 	mux.HandleFunc("/api/status", api.basicAuth(api.handleGetStatus))                       // GET ?name=
 	mux.HandleFunc("/api/status/all", api.basicAuth(api.handleGetAllStatuses))              // GET
 	mux.HandleFunc("/api/outputs/reconnect", api.basicAuth(api.handleForceReconnectOutput)) // POST
@@ -84,6 +97,7 @@ func (api *APIServer) routes() http.Handler {
 	mux.HandleFunc("/api/outputs/remove", api.basicAuth(api.handleRemoveOutput))            // POST
 	mux.HandleFunc("/api/settings", api.basicAuth(api.handleSettings))                      // GET/PUT
 	mux.HandleFunc("/api/settings/reload", api.basicAuth(api.handleReloadSettings))         // POST
+	mux.HandleFunc("/api/analysis", api.basicAuth(api.handleStreamAnalysis))                // GET ?name=
 
 	return mux
 }
@@ -139,9 +153,35 @@ func (api *APIServer) handleHealthCheck(w http.ResponseWriter, r *http.Request)
 	json.NewEncoder(w).Encode(healthStatus)
 }
 
+// inputView - вход для ответа API: вместо секретов только признак их наличия
+type inputView struct {
+	InputCfg
+	HasPublishToken  bool     `json:"has_publish_token,omitempty"`
+	HasSRTPassphrase bool     `json:"has_srt_passphrase,omitempty"`
+	SRTUsers         []string `json:"srt_users,omitempty"`
+}
+
+func newInputView(input InputCfg) inputView {
+	view := inputView{
+		InputCfg:         input,
+		HasPublishToken:  input.PublishToken != "",
+		HasSRTPassphrase: input.SRTPassphrase != "",
+	}
+	view.Pull = redactPullURL(input.Pull)
+	for user := range input.SRTUsers {
+		view.SRTUsers = append(view.SRTUsers, user)
+	}
+	sort.Strings(view.SRTUsers)
+	return view
+}
+
 func (api *APIServer) handleListInputs(w http.ResponseWriter, r *http.Request) {
 	inputs := api.SM.ListInputs()
-	writeJSON(w, inputs)
+	views := make([]inputView, 0, len(inputs))
+	for _, input := range inputs {
+		views = append(views, newInputView(input))
+	}
+	writeJSON(w, views)
 }
 
 func (api *APIServer) handleAddInput(w http.ResponseWriter, r *http.Request) {
@@ -157,14 +197,41 @@ func (api *APIServer) handleAddInput(w http.ResponseWriter, r *http.Request) {
 
 	r.Body = http.MaxBytesReader(w, r.Body, 1024*1024) // Ограничиваем тело запроса 1 МБ
 
-	var input InputCfg
-	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+	// Секреты у InputCfg скрыты от JSON, поэтому принимаются отдельными полями
+	var req struct {
+		InputCfg
+		PublishToken  string            `json:"publish_token"`
+		SRTPassphrase string            `json:"srt_passphrase"`
+		SRTUsers      map[string]string `json:"srt_users"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		http.Error(w, "Invalid JSON", http.StatusBadRequest)
 		return
 	}
+	input := req.InputCfg
+	input.PublishToken = req.PublishToken
+	input.SRTPassphrase = req.SRTPassphrase
+	input.SRTUsers = req.SRTUsers
+
+	// exec:// и file:// задаются только в config.yaml
+	if pullConfigOnly(input.Pull) {
+		http.Error(w, "exec:// and file:// sources can only be set in config.yaml", http.StatusForbidden)
+		return
+	}
+	for _, outURL := range input.Outputs {
+		if isExecURL(outURL) {
+			http.Error(w, "exec:// outputs can only be set in config.yaml", http.StatusForbidden)
+			return
+		}
+	}
 
-	if input.Name == "" || input.URLPath == "" {
-		http.Error(w, "Input name and URL path are required", http.StatusBadRequest)
+	// Те же проверки входа, что и для config.yaml
+	inputNames := make(map[string]struct{})
+	for _, existing := range api.SM.ListInputs() {
+		inputNames[existing.Name] = struct{}{}
+	}
+	if err := input.Validate(inputNames); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
@@ -174,7 +241,6 @@ func (api *APIServer) handleAddInput(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Валидация всех выходов
 	for _, outURL := range input.Outputs {
 		if err := validateRTMPURL(outURL); err != nil {
 			http.Error(w, "Invalid output URL: "+err.Error(), http.StatusBadRequest)
@@ -199,6 +265,11 @@ func (api *APIServer) handleRemoveInput(w http.ResponseWriter, r *http.Request)
 
 // Обновление списка выходов у входа
 func (api *APIServer) handleUpdateOutputs(w http.ResponseWriter, r *http.Request) {
+	// Только JSON: простая форма или text/plain с чужой страницы сюда не пройдут
+	if r.Header.Get("Content-Type") != "application/json" {
+		http.Error(w, "Content-Type must be application/json", http.StatusBadRequest)
+		return
+	}
 	var req struct {
 		Name    string   `json:"name"`
 		Outputs []string `json:"outputs"`
@@ -208,6 +279,15 @@ func (api *APIServer) handleUpdateOutputs(w http.ResponseWriter, r *http.Request
 		return
 	}
 
+	// exec:// выходы из config.yaml можно оставить в списке, но не добавить новые
+	current := api.SM.GetInputOutputs(req.Name)
+	for _, outURL := range req.Outputs {
+		if isExecURL(outURL) && !slices.Contains(current, outURL) {
+			http.Error(w, "exec:// outputs can only be set in config.yaml", http.StatusForbidden)
+			return
+		}
+	}
+
 	// Обновляем Outputs потокобезопасно
 	if ok := api.SM.UpdateInputOutputs(req.Name, req.Outputs); !ok {
 		http.Error(w, "Input not found", http.StatusNotFound)
@@ -225,6 +305,87 @@ func (api *APIServer) handleUpdateOutputs(w http.ResponseWriter, r *http.Request
 	w.WriteHeader(http.StatusOK)
 }
 
+// handleSetWHIPLayer выбирает слой simulcast WHIP, который идёт во вход ("rid": "" - самый высокий)
+func (api *APIServer) handleSetWHIPLayer(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if r.Header.Get("Content-Type") != "application/json" {
+		http.Error(w, "Content-Type must be application/json", http.StatusBadRequest)
+		return
+	}
+	var req struct {
+		Name string `json:"name"`
+		RID  string `json:"rid"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if api.SM.GetInputByName(req.Name) == nil {
+		http.Error(w, "Input not found", http.StatusNotFound)
+		return
+	}
+	if req.RID != "" {
+		if !validWHIPRID(req.RID) {
+			http.Error(w, "Invalid rid", http.StatusBadRequest)
+			return
+		}
+		// Идёт simulcast публикация - слой должен быть в её offer
+		if api.WHIP != nil {
+			if rids, ok := api.WHIP.SimulcastLayers(req.Name); ok && !slices.Contains(rids, req.RID) {
+				http.Error(w, fmt.Sprintf("Layer %q is not offered by the current session (layers: %s)", req.RID, strings.Join(rids, ", ")), http.StatusBadRequest)
+				return
+			}
+		}
+	}
+	if ok := api.SM.SetInputWHIPLayer(req.Name, req.RID); !ok {
+		http.Error(w, "Input not found", http.StatusNotFound)
+		return
+	}
+	log.Printf("[API] WHIP layer for input %s set to %q", req.Name, req.RID)
+	// Выбор слоя сохраняется в whip_layer входа в config.yaml
+	go api.saveInputsToConfig()
+	w.WriteHeader(http.StatusOK)
+}
+
+// handleSetSRTPassphrase задаёт пароли SRT публикации входа; пустые значения снимают
+// пароль входа, и действует общий srt_settings.passphrase
+func (api *APIServer) handleSetSRTPassphrase(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if r.Header.Get("Content-Type") != "application/json" {
+		http.Error(w, "Content-Type must be application/json", http.StatusBadRequest)
+		return
+	}
+	var req struct {
+		Name       string            `json:"name"`
+		Passphrase string            `json:"passphrase"`
+		Users      map[string]string `json:"users"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if err := validateSRTInputAuth(req.Passphrase, req.Users); err != nil {
+		http.Error(w, "Invalid SRT passphrase: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if ok := api.SM.SetInputSRTPassphrase(req.Name, req.Passphrase, req.Users); !ok {
+		http.Error(w, "Input not found", http.StatusNotFound)
+		return
+	}
+	// Сами пароли в лог не пишем
+	log.Printf("[API] SRT passphrase for input %s updated (input passphrase: %t, users: %d)",
+		req.Name, req.Passphrase != "", len(req.Users))
+	// Сохраняем в config.yaml, чтобы отозванный ключ не вернулся после перезапуска
+	go api.saveInputsToConfig()
+	w.WriteHeader(http.StatusOK)
+}
+
 func (api *APIServer) handleGetStatus(w http.ResponseWriter, r *http.Request) {
 	name := r.URL.Query().Get("name")
 	if name == "" {
@@ -244,6 +405,32 @@ func (api *APIServer) handleGetAllStatuses(w http.ResponseWriter, r *http.Reques
 	writeJSON(w, statuses)
 }
 
+// Анализ входящего потока: программы и PID'ы MPEG-TS (для SRT входов)
+func (api *APIServer) handleStreamAnalysis(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	name := r.URL.Query().Get("name")
+	if name == "" {
+		http.Error(w, "Missing 'name' parameter", http.StatusBadRequest)
+		return
+	}
+	inputCfg := api.SM.GetInputByName(name)
+	if inputCfg == nil {
+		http.Error(w, "Input not found", http.StatusNotFound)
+		return
+	}
+	programs := api.SM.GetInputPrograms(name)
+	if programs == nil {
+		programs = []TSProgramInfo{}
+	}
+	writeJSON(w, map[string]interface{}{
+		"name":     name,
+		"programs": programs,
+	})
+}
+
 func (api *APIServer) handleForceReconnectOutput(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
@@ -266,6 +453,14 @@ func (api *APIServer) handleForceReconnectOutput(w http.ResponseWriter, r *http.
 }
 
 func (api *APIServer) handleAddOutput(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if r.Header.Get("Content-Type") != "application/json" {
+		http.Error(w, "Content-Type must be application/json", http.StatusBadRequest)
+		return
+	}
 	var req struct {
 		Name string `json:"name"`
 		URL  string `json:"url"`
@@ -274,6 +469,15 @@ func (api *APIServer) handleAddOutput(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Invalid JSON", http.StatusBadRequest)
 		return
 	}
+	if _, err := url.ParseRequestURI(req.URL); err != nil {
+		http.Error(w, "Invalid output URL", http.StatusBadRequest)
+		return
+	}
+	// Команды запускаются только из config.yaml с allow_exec
+	if isExecURL(req.URL) {
+		http.Error(w, "exec:// outputs can only be set in config.yaml", http.StatusForbidden)
+		return
+	}
 
 	ok, alreadyExists := api.SM.AddOutputToInput(req.Name, req.URL)
 	if !ok {
@@ -287,7 +491,7 @@ func (api *APIServer) handleAddOutput(w http.ResponseWriter, r *http.Request) {
 
 	api.SM.RegisterOutput(req.Name, req.URL)
 	// Обновляем config.yaml, используя безопасную копию
-	go updateInputsInConfig(api.SM.GetInputsCopy())
+	go api.saveInputsToConfig()
 	w.WriteHeader(http.StatusOK)
 }
 
@@ -309,7 +513,7 @@ func (api *APIServer) handleRemoveOutput(w http.ResponseWriter, r *http.Request)
 	// Очищаем неактуальные выходы
 	api.SM.CleanupRemovedOutputs(req.Name)
 	// Обновляем config.yaml, используя безопасную копию
-	go updateInputsInConfig(api.SM.GetInputsCopy())
+	go api.saveInputsToConfig()
 	w.WriteHeader(http.StatusOK)
 }
 
@@ -409,7 +613,14 @@ func (api *APIServer) handleReloadSettings(w http.ResponseWriter, r *http.Reques
 	w.WriteHeader(http.StatusOK)
 }
 
+// configFileMu сериализует перезапись config.yaml: обработчики API сохраняют его
+// в фоне, и без блокировки один мог прочитать файл, пока другой его обрезал
+var configFileMu sync.Mutex
+
 func (api *APIServer) saveSettingsToConfig(settings *Config) {
+	configFileMu.Lock()
+	defer configFileMu.Unlock()
+
 	// Читаем текущий config.yaml
 	data, err := os.ReadFile("config.yaml")
 	if err != nil {
@@ -450,6 +661,14 @@ func writeJSON(w http.ResponseWriter, data interface{}) {
 	}
 }
 
+// saveInputsToConfig сохраняет текущие входы в config.yaml. Снимок берётся под
+// блокировкой файла, чтобы более старый снимок не записался последним.
+func (api *APIServer) saveInputsToConfig() {
+	configFileMu.Lock()
+	defer configFileMu.Unlock()
+	updateInputsInConfig(api.SM.GetInputsCopy())
+}
+
 // updateInputsInConfig обновляет только секцию inputs в config.yaml, сохраняя комментарии.
 func updateInputsInConfig(inputs map[string]*InputCfg) {
 	data, err := os.ReadFile("config.yaml")
@@ -466,7 +685,7 @@ func updateInputsInConfig(inputs map[string]*InputCfg) {
 
 	// Находим узел 'inputs'
 	var inputsNode *yaml.Node
-	if root.Content[0].Kind == yaml.MappingNode {
+	if len(root.Content) > 0 && root.Content[0].Kind == yaml.MappingNode {
 		for i := 0; i < len(root.Content[0].Content); i += 2 {
 			if root.Content[0].Content[i].Value == "inputs" {
 				inputsNode = root.Content[0].Content[i+1]
@@ -498,19 +717,27 @@ func updateInputsInConfig(inputs map[string]*InputCfg) {
 			}
 		}
 
-		if name != "" && outputsNode != nil {
-			if memInput, ok := inputs[name]; ok {
-				// Создаем новый узел для outputs
-				newOutputsNode := yaml.Node{Kind: yaml.SequenceNode}
-				for _, outURL := range memInput.Outputs {
-					newOutputsNode.Content = append(newOutputsNode.Content, &yaml.Node{
-						Kind:  yaml.ScalarNode,
-						Value: outURL,
-					})
-				}
-				*outputsNode = newOutputsNode
+		memInput, ok := inputs[name]
+		if name == "" || !ok {
+			continue
+		}
+		if outputsNode != nil {
+			// Создаем новый узел для outputs
+			newOutputsNode := yaml.Node{Kind: yaml.SequenceNode}
+			for _, outURL := range memInput.Outputs {
+				newOutputsNode.Content = append(newOutputsNode.Content, &yaml.Node{
+					Kind:  yaml.ScalarNode,
+					Value: outURL,
+				})
 			}
+			*outputsNode = newOutputsNode
 		}
+		updateInputSecretsNode(inputNode, memInput)
+		var whipLayer *yaml.Node
+		if memInput.WHIPLayer != "" {
+			whipLayer = &yaml.Node{Kind: yaml.ScalarNode, Value: memInput.WHIPLayer}
+		}
+		setYAMLMappingKey(inputNode, "whip_layer", whipLayer)
 	}
 
 	// Сохраняем обновленный YAML
@@ -531,6 +758,41 @@ func updateInputsInConfig(inputs map[string]*InputCfg) {
 	log.Printf("[API] config.yaml updated preserving comments.")
 }
 
+// updateInputSecretsNode переносит пароли SRT входа в его узел config.yaml; пустые удаляются
+func updateInputSecretsNode(inputNode *yaml.Node, input *InputCfg) {
+	var passphrase, users *yaml.Node
+	if input.SRTPassphrase != "" {
+		passphrase = &yaml.Node{Kind: yaml.ScalarNode, Style: yaml.DoubleQuotedStyle, Value: input.SRTPassphrase}
+	}
+	if len(input.SRTUsers) > 0 {
+		users = &yaml.Node{}
+		if err := users.Encode(input.SRTUsers); err != nil {
+			log.Printf("[API] Failed to encode srt_users of input %s: %v", input.Name, err)
+			return
+		}
+	}
+	setYAMLMappingKey(inputNode, "srt_passphrase", passphrase)
+	setYAMLMappingKey(inputNode, "srt_users", users)
+}
+
+// setYAMLMappingKey задаёт значение ключа в отображении; nil удаляет ключ
+func setYAMLMappingKey(mapping *yaml.Node, key string, value *yaml.Node) {
+	for i := 0; i+1 < len(mapping.Content); i += 2 {
+		if mapping.Content[i].Value != key {
+			continue
+		}
+		if value == nil {
+			mapping.Content = append(mapping.Content[:i], mapping.Content[i+2:]...)
+		} else {
+			mapping.Content[i+1] = value
+		}
+		return
+	}
+	if value != nil {
+		mapping.Content = append(mapping.Content, &yaml.Node{Kind: yaml.ScalarNode, Value: key}, value)
+	}
+}
+
 // Обработчик веб-интерфейса
 func (api *APIServer) handleWebInterface(w http.ResponseWriter, r *http.Request) {
 	// Если запрос к API - пропускаем
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHandleSetWHIPLayer(t *testing.T) {
+	// updateInputsInConfig пишет config.yaml в текущий каталог
+	dir := t.TempDir()
+	wd, _ := os.Getwd()
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+	config := "inputs:\n  - name: cam\n    url_path: /live/cam\n    outputs: []\n"
+	if err := os.WriteFile("config.yaml", []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	sm := NewStreamManager([]InputCfg{{Name: "cam", URLPath: "/live/cam"}, {Name: "idle", URLPath: "/live/idle"}}, &Config{})
+	whip := NewWHIPServer(0, sm)
+	session := &WHIPSession{id: "s1", inputName: "cam"}
+	session.simulcast = newWHIPSimulcast(whip, session, []string{"h", "m", "l"})
+	whip.sessions[session.id] = session
+	api := &APIServer{SM: sm, WHIP: whip}
+
+	post := func(contentType, body string) int {
+		req := httptest.NewRequest(http.MethodPost, "/api/inputs/whip_layer", strings.NewReader(body))
+		req.Header.Set("Content-Type", contentType)
+		rec := httptest.NewRecorder()
+		api.handleSetWHIPLayer(rec, req)
+		return rec.Code
+	}
+
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+		code        int
+	}{
+		{"не JSON", "text/plain", `{"name":"cam","rid":"l"}`, http.StatusBadRequest},
+		{"неизвестный вход", "application/json", `{"name":"missing","rid":"l"}`, http.StatusNotFound},
+		{"недопустимый RID", "application/json", `{"name":"cam","rid":"l 1"}`, http.StatusBadRequest},
+		{"слоя нет в offer", "application/json", `{"name":"cam","rid":"q"}`, http.StatusBadRequest},
+		{"вход без сессии", "application/json", `{"name":"idle","rid":"q"}`, http.StatusOK},
+		{"самый высокий", "application/json", `{"name":"cam","rid":""}`, http.StatusOK},
+		{"слой из offer", "application/json", `{"name":"cam","rid":"l"}`, http.StatusOK},
+	}
+	for _, tt := range tests {
+		if code := post(tt.contentType, tt.body); code != tt.code {
+			t.Errorf("%s: status %d, want %d", tt.name, code, tt.code)
+		}
+	}
+	if got := sm.GetInputWHIPLayer("cam"); got != "l" {
+		t.Errorf("whip_layer = %q, want l", got)
+	}
+
+	// Выбор сохраняется в config.yaml
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		data, _ := os.ReadFile("config.yaml")
+		if strings.Contains(string(data), "whip_layer: l") {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("whip_layer not saved:\n%s", data)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -4,7 +4,9 @@ import (
 	"errors"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"net/url"
+	"strconv"
 
 	"gopkg.in/yaml.v3"
 )
@@ -17,6 +19,16 @@ type SRTSettings struct {
 	StreamID       string `yaml:"streamid"`
 }
 
+// SRTListener - SRT порт, публикация на который всегда идёт во вход Input
+type SRTListener struct {
+	Port       int    `yaml:"port"`
+	Input      string `yaml:"input"`
+	Passphrase string `yaml:"passphrase,omitempty"`
+	PBKeylen   int    `yaml:"pbkeylen,omitempty"` // 16, 24 или 32; 0 - 16
+	Latency    int    `yaml:"latency,omitempty"`  // мс; 0 - из srt_settings
+	MaxBW      int64  `yaml:"max_bw,omitempty"`   // байт/с; 0 - без ограничения
+}
+
 type ServerConfig struct {
 	Port            int    `yaml:"port"`
 	RTMPPort        int    `yaml:"rtmp_port"`
@@ -24,10 +36,40 @@ type ServerConfig struct {
 	WHIPPort        int    `yaml:"whip_port"`
 	APIAuthUser     string `yaml:"api_username"`
 	APIAuthPassword string `yaml:"api_password"`
+
+	// RTMP/RTMPS слушатели; если список пуст - один RTMP на всех интерфейсах с портом rtmp_port
+	RTMPListeners []RTMPListener `yaml:"rtmp_listeners,omitempty"`
+}
+
+// RTMPListener - RTMP (или RTMPS при заданных tls_cert/tls_key) на отдельном адресе
+type RTMPListener struct {
+	Addr       string `yaml:"addr"`                  // адрес:порт, например 10.0.0.5:1935 или [::]:443
+	TLSCert    string `yaml:"tls_cert,omitempty"`    // сертификат PEM (цепочка)
+	TLSKey     string `yaml:"tls_key,omitempty"`     // ключ PEM
+	DefaultApp string `yaml:"default_app,omitempty"` // app для публикаций без app (rtmp://host/key)
 }
 
 type WHIPSettings struct {
-	ICEServers []string `yaml:"ice_servers"`
+	ICEServers     []string     `yaml:"ice_servers"`
+	TURNServers    []TURNServer `yaml:"turn_servers,omitempty"`
+	Audio          string       `yaml:"audio,omitempty"`            // aac (Opus перекодируется в AAC), opus или none
+	JitterBufferMs int          `yaml:"jitter_buffer_ms,omitempty"` // сколько ждать опоздавшие RTP пакеты видео
+
+	// Запрашивать ключевой кадр (PLI/FIR) каждые N секунд, 0 - только при старте и подключении выходов
+	KeyframeInterval int `yaml:"keyframe_interval,omitempty"`
+
+	// Сеть ICE (применяется при запуске сервера)
+	ICEUDPPort int      `yaml:"ice_udp_port,omitempty"` // один UDP порт для всех сессий, 0 - случайные порты
+	ICETCPPort int      `yaml:"ice_tcp_port,omitempty"` // ICE-TCP порт, 0 - выключен
+	NAT1To1IPs []string `yaml:"nat_1to1_ips,omitempty"` // внешние адреса вместо локальных в хост-кандидатах
+	ICELite    bool     `yaml:"ice_lite,omitempty"`
+}
+
+// TURNServer - TURN сервер с учётными данными
+type TURNServer struct {
+	URLs       []string `yaml:"urls"`
+	Username   string   `yaml:"username,omitempty"`
+	Credential string   `yaml:"credential,omitempty"`
 }
 
 type Config struct {
@@ -42,12 +84,54 @@ type Config struct {
 	APIAuthPassword   string       `yaml:"api_auth_password" json:"-"`
 	SRTSettings       SRTSettings  `yaml:"srt_settings"`
 	WHIPSettings      WHIPSettings `yaml:"whip_settings"`
+
+	// Отдельные SRT порты для энкодеров без stream ID: каждый порт ведёт в свой вход
+	SRTListeners []SRTListener `yaml:"srt_listeners,omitempty"`
+
+	// Повтор SPS/PPS+AUD перед каждым IDR при прямой ретрансляции SRT → SRT (по умолчанию включён).
+	// Выходы через TS муксер получают SPS/PPS перед ключевыми кадрами всегда.
+	// Для отдельного выхода переопределяется параметром ?repeat_param_sets=0|1 в URL.
+	RepeatParamSets *bool `yaml:"repeat_param_sets,omitempty"`
+
+	// Разрешить exec:// выходы и входы (запуск команд сервером). Они задаются только
+	// в config.yaml, через API их добавить нельзя.
+	AllowExec bool `yaml:"allow_exec,omitempty"`
 }
 
 type InputCfg struct {
-	Name    string   `yaml:"name"`
-	URLPath string   `yaml:"url_path"`
-	Outputs []string `yaml:"outputs"`
+	Name    string   `yaml:"name" json:"name"`
+	URLPath string   `yaml:"url_path" json:"url_path"`
+	Outputs []string `yaml:"outputs" json:"outputs"`
+
+	// Токен публикации для RTMP и WebSocket (?token=), WHIP и HTTP ingest (Authorization: Bearer); пусто - без проверки
+	PublishToken string `yaml:"publish_token,omitempty" json:"-"`
+	// Пароль SRT публикации во вход (вместо srt_settings.passphrase) и пароли по
+	// пользователю stream ID (u=); с srt_users публикация без известного u= отклоняется.
+	// Секреты не попадают в JSON: API показывает только их наличие (inputView).
+	SRTPassphrase string            `yaml:"srt_passphrase,omitempty" json:"-"`
+	SRTUsers      map[string]string `yaml:"srt_users,omitempty" json:"-"`
+
+	// Источник, который сервер забирает сам (rtmp://, srt://, rtsp://, udp://, HLS по http(s)://, файлы file://, stdout команды exec://), вместо ожидания публикации
+	Pull string `yaml:"pull,omitempty" json:"pull,omitempty"`
+	// Транспорт RTP для pull: rtsp:// - tcp (по умолчанию, interleaved) или udp
+	RTSPTransport string `yaml:"rtsp_transport,omitempty" json:"rtsp_transport,omitempty"`
+	// Верхняя граница битрейта варианта HLS (бит/с); 0 - самый качественный
+	HLSMaxBandwidth int `yaml:"hls_max_bandwidth,omitempty" json:"hls_max_bandwidth,omitempty"`
+
+	// Выбор программы и PID'ов для MPEG-TS входов (SRT). 0/пусто - автоматически.
+	Program   int    `yaml:"program,omitempty" json:"program,omitempty"`
+	VideoPID  int    `yaml:"video_pid,omitempty" json:"video_pid,omitempty"`
+	AudioPID  int    `yaml:"audio_pid,omitempty" json:"audio_pid,omitempty"`
+	AudioLang string `yaml:"audio_lang,omitempty" json:"audio_lang,omitempty"`
+
+	// Кодеки, которые вход WHIP принимает при согласовании (h264, h265, vp8, vp9, av1, opus).
+	// Пусто - h264 и opus.
+	WHIPCodecs []string `yaml:"whip_codecs,omitempty" json:"whip_codecs,omitempty"`
+
+	// Simulcast WHIP: какой слой (RID) идёт во вход - пусто означает самый высокий,
+	// и какие слои дополнительно отдаются в другие входы (RID -> имя входа)
+	WHIPLayer  string            `yaml:"whip_layer,omitempty" json:"whip_layer,omitempty"`
+	WHIPLayers map[string]string `yaml:"whip_layers,omitempty" json:"whip_layers,omitempty"`
 }
 
 func LoadConfig(path string) (*Config, error) {
@@ -99,38 +183,160 @@ srt_settings:
 	return &cfg, nil
 }
 
+// RepeatParamSetsFor сообщает, нужно ли вставлять параметры кодека в сырой TS на выходе outputURL
+func (cfg *Config) RepeatParamSetsFor(outputURL string) bool {
+	if u, err := url.Parse(outputURL); err == nil {
+		if v := u.Query().Get("repeat_param_sets"); v != "" {
+			if enabled, err := strconv.ParseBool(v); err == nil {
+				return enabled
+			}
+		}
+	}
+	if cfg.RepeatParamSets != nil {
+		return *cfg.RepeatParamSets
+	}
+	return true
+}
+
 func (cfg *Config) Validate() error {
 	if cfg.Server.Port <= 0 || cfg.Server.Port > 65535 {
 		return errors.New("server.port must be between 1 and 65535")
 	}
-	if cfg.Server.RTMPPort <= 0 || cfg.Server.RTMPPort > 65535 {
+	if len(cfg.Server.RTMPListeners) == 0 && (cfg.Server.RTMPPort <= 0 || cfg.Server.RTMPPort > 65535) {
 		return errors.New("server.rtmp_port must be between 1 and 65535")
 	}
+	seenListeners := make(map[string]struct{})
+	for i, l := range cfg.Server.RTMPListeners {
+		if err := l.Validate(); err != nil {
+			return fmt.Errorf("server.rtmp_listeners[%d]: %w", i, err)
+		}
+		if _, dup := seenListeners[l.Addr]; dup {
+			return fmt.Errorf("server.rtmp_listeners[%d]: duplicate addr %s", i, l.Addr)
+		}
+		seenListeners[l.Addr] = struct{}{}
+	}
 	if cfg.Server.SRTPort != 0 && (cfg.Server.SRTPort < 1 || cfg.Server.SRTPort > 65535) {
 		return errors.New("server.srt_port must be between 1 and 65535")
 	}
+	seenSRTPorts := map[int]struct{}{cfg.Server.SRTPort: {}}
+	for i, l := range cfg.SRTListeners {
+		if err := l.Validate(cfg); err != nil {
+			return fmt.Errorf("srt_listeners[%d]: %w", i, err)
+		}
+		if _, dup := seenSRTPorts[l.Port]; dup {
+			return fmt.Errorf("srt_listeners[%d]: port %d is already used", i, l.Port)
+		}
+		seenSRTPorts[l.Port] = struct{}{}
+	}
 	if cfg.ReconnectInterval < 1 {
 		return errors.New("reconnect_interval must be > 0")
 	}
+	switch cfg.WHIPSettings.Audio {
+	case "", whipAudioAAC, whipAudioOpus, whipAudioNone:
+	default:
+		return fmt.Errorf("whip_settings.audio must be %q, %q or %q", whipAudioAAC, whipAudioOpus, whipAudioNone)
+	}
+	if cfg.WHIPSettings.JitterBufferMs < 0 {
+		return errors.New("whip_settings.jitter_buffer_ms must be >= 0")
+	}
+	if cfg.WHIPSettings.KeyframeInterval < 0 {
+		return errors.New("whip_settings.keyframe_interval must be >= 0")
+	}
+	if cfg.WHIPSettings.ICEUDPPort < 0 || cfg.WHIPSettings.ICEUDPPort > 65535 {
+		return errors.New("whip_settings.ice_udp_port must be between 0 and 65535")
+	}
+	if cfg.WHIPSettings.ICETCPPort < 0 || cfg.WHIPSettings.ICETCPPort > 65535 {
+		return errors.New("whip_settings.ice_tcp_port must be between 0 and 65535")
+	}
+	for _, ip := range cfg.WHIPSettings.NAT1To1IPs {
+		if net.ParseIP(ip) == nil {
+			return fmt.Errorf("invalid IP in whip_settings.nat_1to1_ips: %s", ip)
+		}
+	}
+	for _, turn := range cfg.WHIPSettings.TURNServers {
+		if len(turn.URLs) == 0 {
+			return errors.New("whip_settings.turn_servers entry must have urls")
+		}
+	}
 	seenPaths := make(map[string]struct{})
+	inputNames := make(map[string]struct{})
 	for _, input := range cfg.Inputs {
-		if input.Name == "" {
-			return errors.New("input name cannot be empty")
-		}
-		if input.URLPath == "" || input.URLPath[0] != '/' {
-			return fmt.Errorf("invalid url_path in input %s", input.Name)
+		inputNames[input.Name] = struct{}{}
+	}
+	for _, input := range cfg.Inputs {
+		if err := input.Validate(inputNames); err != nil {
+			return err
 		}
 		if _, ok := seenPaths[input.URLPath]; ok {
 			return fmt.Errorf("duplicate url_path: %s", input.URLPath)
 		}
 		seenPaths[input.URLPath] = struct{}{}
 
+		if isExecURL(input.Pull) && !cfg.AllowExec {
+			return fmt.Errorf("exec pull in input %s requires allow_exec: true", input.Name)
+		}
 		for _, out := range input.Outputs {
-			if _, err := url.ParseRequestURI(out); err != nil {
-				return fmt.Errorf("invalid output URL '%s' in input %s", out, input.Name)
+			if isExecURL(out) && !cfg.AllowExec {
+				return fmt.Errorf("exec output in input %s requires allow_exec: true", input.Name)
 			}
 		}
 	}
 
 	return nil
 }
+
+// Validate проверяет настройки одного входа; общие для config.yaml и API.
+// inputNames - имена всех входов, на которые могут ссылаться whip_layers.
+func (input *InputCfg) Validate(inputNames map[string]struct{}) error {
+	if input.Name == "" {
+		return errors.New("input name cannot be empty")
+	}
+	if input.URLPath == "" || input.URLPath[0] != '/' {
+		return fmt.Errorf("invalid url_path in input %s", input.Name)
+	}
+
+	if input.Pull != "" {
+		if err := validatePullURL(input.Pull); err != nil {
+			return fmt.Errorf("invalid pull in input %s: %v", input.Name, err)
+		}
+	}
+	switch input.RTSPTransport {
+	case "", rtspTransportTCP, rtspTransportUDP:
+	default:
+		return fmt.Errorf("invalid rtsp_transport in input %s: must be %q or %q", input.Name, rtspTransportTCP, rtspTransportUDP)
+	}
+	if input.HLSMaxBandwidth < 0 {
+		return fmt.Errorf("invalid hls_max_bandwidth in input %s", input.Name)
+	}
+	if err := validateSRTInputAuth(input.SRTPassphrase, input.SRTUsers); err != nil {
+		return fmt.Errorf("invalid SRT passphrase in input %s: %v", input.Name, err)
+	}
+
+	if input.Program < 0 || input.Program > 0xFFFF {
+		return fmt.Errorf("invalid program in input %s", input.Name)
+	}
+	if input.VideoPID < 0 || input.VideoPID > 0x1FFF || input.AudioPID < 0 || input.AudioPID > 0x1FFF {
+		return fmt.Errorf("invalid video_pid/audio_pid in input %s", input.Name)
+	}
+
+	for _, codec := range input.WHIPCodecs {
+		if _, _, err := whipCodecParameters(codec); err != nil {
+			return fmt.Errorf("invalid whip_codecs in input %s: %v", input.Name, err)
+		}
+	}
+	if input.WHIPLayer != "" && !validWHIPRID(input.WHIPLayer) {
+		return fmt.Errorf("invalid whip_layer in input %s", input.Name)
+	}
+	for rid, target := range input.WHIPLayers {
+		if _, ok := inputNames[target]; !ok || target == input.Name || !validWHIPRID(rid) {
+			return fmt.Errorf("invalid whip_layers entry %q -> %q in input %s", rid, target, input.Name)
+		}
+	}
+
+	for _, out := range input.Outputs {
+		if _, err := url.ParseRequestURI(out); err != nil {
+			return fmt.Errorf("invalid output URL '%s' in input %s", out, input.Name)
+		}
+	}
+	return nil
+}
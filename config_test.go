@@ -0,0 +1,48 @@
+package main
+
+import "testing"
+
+func TestInputCfgValidate(t *testing.T) {
+	names := map[string]struct{}{"main": {}, "low": {}}
+	valid := InputCfg{
+		Name:       "main",
+		URLPath:    "/live/main",
+		Outputs:    []string{"rtmp://example.com/live/key"},
+		Program:    2,
+		VideoPID:   0x100,
+		AudioPID:   0x101,
+		WHIPCodecs: []string{"h264", "opus"},
+		WHIPLayers: map[string]string{"q": "low"},
+	}
+	if err := valid.Validate(names); err != nil {
+		t.Fatalf("valid input rejected: %v", err)
+	}
+
+	tests := map[string]func(*InputCfg){
+		"пустое имя":              func(in *InputCfg) { in.Name = "" },
+		"url_path без слеша":      func(in *InputCfg) { in.URLPath = "live" },
+		"program больше 0xFFFF":   func(in *InputCfg) { in.Program = 0x10000 },
+		"отрицательный program":   func(in *InputCfg) { in.Program = -1 },
+		"video_pid больше 0x1FFF": func(in *InputCfg) { in.VideoPID = 0x2000 },
+		"отрицательный audio_pid": func(in *InputCfg) { in.AudioPID = -1 },
+		"неизвестный кодек WHIP":  func(in *InputCfg) { in.WHIPCodecs = []string{"mpeg2"} },
+		"слой в неизвестный вход": func(in *InputCfg) { in.WHIPLayers = map[string]string{"q": "missing"} },
+		"слой в этот же вход":     func(in *InputCfg) { in.WHIPLayers = map[string]string{"q": "main"} },
+		"недопустимый whip_layer": func(in *InputCfg) { in.WHIPLayer = "h/1" },
+		"слой без RID":            func(in *InputCfg) { in.WHIPLayers = map[string]string{"": "low"} },
+		"неверный rtsp_transport": func(in *InputCfg) { in.RTSPTransport = "sctp" },
+		"отрицательный bandwidth": func(in *InputCfg) { in.HLSMaxBandwidth = -1 },
+		"короткий srt_passphrase": func(in *InputCfg) { in.SRTPassphrase = "short" },
+		"неподдерживаемый pull":   func(in *InputCfg) { in.Pull = "gopher://example.com/" },
+		"выход не URL":            func(in *InputCfg) { in.Outputs = []string{"not a url"} },
+	}
+	for name, modify := range tests {
+		t.Run(name, func(t *testing.T) {
+			input := valid
+			modify(&input)
+			if err := input.Validate(names); err == nil {
+				t.Error("expected error")
+			}
+		})
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"log"
+	"os/exec"
+	"sync"
+	"time"
+
+	"github.com/datarhei/joy4/av"
+	"github.com/datarhei/joy4/format/flv"
+)
+
+// Pull-вход exec://команда?args=...&format=flv|mpegts: сервер запускает команду
+// (ffmpeg с тестовым источником, захват и т.п.) и читает поток из её stdout.
+// Перезапуск с нарастающей паузой делает PullManager, как для сетевых источников.
+
+// execInput - запущенный процесс и демуксер его stdout
+type execInput struct {
+	av.Demuxer
+	url        string
+	cmd        *exec.Cmd
+	stderrDone chan struct{}
+	waitOnce   sync.Once
+	exited     chan struct{}
+	exitErr    error
+}
+
+func startExecInput(sm *StreamManager, pullURL string, inputCfg *InputCfg) (*execInput, error) {
+	if !sm.ExecAllowed() {
+		return nil, errors.New("exec sources are disabled: allow_exec is not set")
+	}
+	spec, err := parseExecOutputURL(pullURL)
+	if err != nil {
+		return nil, err
+	}
+
+	cmd := exec.Command(spec.Command, spec.Args...)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	log.Printf("[EXEC] Started %s %v (pid %d) for input '%s'", spec.Command, spec.Args, cmd.Process.Pid, inputCfg.Name)
+
+	in := &execInput{
+		url:        pullURL,
+		cmd:        cmd,
+		stderrDone: make(chan struct{}),
+		exited:     make(chan struct{}),
+	}
+	go func() {
+		defer close(in.stderrDone)
+		scanner := bufio.NewScanner(stderr)
+		for scanner.Scan() {
+			log.Printf("[EXEC] Input '%s': %s", inputCfg.Name, scanner.Text())
+		}
+	}()
+
+	r := bufio.NewReader(stdout)
+	if spec.Format == "flv" {
+		in.Demuxer = flv.NewDemuxer(r)
+	} else {
+		in.Demuxer = newTSDemuxer(r, sm, inputCfg.Name)
+	}
+	return in, nil
+}
+
+// Streams и ReadPacket дополняют ошибку чтения кодом завершения процесса
+func (in *execInput) Streams() ([]av.CodecData, error) {
+	streams, err := in.Demuxer.Streams()
+	if err != nil {
+		return nil, in.exitError(err)
+	}
+	return streams, nil
+}
+
+func (in *execInput) ReadPacket() (av.Packet, error) {
+	pkt, err := in.Demuxer.ReadPacket()
+	if err != nil {
+		return pkt, in.exitError(err)
+	}
+	return pkt, nil
+}
+
+// wait вызывает cmd.Wait один раз. Wait закрывает pipe'ы, поэтому его можно звать только
+// после того, как демуксер дочитал stdout (или процесс убит), а stderr прочитан до конца.
+func (in *execInput) wait() {
+	in.waitOnce.Do(func() {
+		go func() {
+			<-in.stderrDone
+			in.exitErr = in.cmd.Wait()
+			close(in.exited)
+		}()
+	})
+}
+
+// exitError ждёт завершения процесса после того, как stdout дочитан, и описывает его
+func (in *execInput) exitError(readErr error) error {
+	in.wait()
+	select {
+	case <-in.exited:
+	case <-time.After(time.Second):
+		return readErr
+	}
+	if in.exitErr != nil {
+		return fmt.Errorf("process exited: %v", in.exitErr)
+	}
+	return fmt.Errorf("process exited: exit status 0")
+}
+
+// Close завершает процесс
+func (in *execInput) Close() error {
+	select {
+	case <-in.exited:
+		return nil
+	default:
+	}
+	in.cmd.Process.Kill()
+	in.wait()
+	select {
+	case <-in.exited:
+	case <-time.After(5 * time.Second):
+		log.Printf("[EXEC] Process for %s did not exit after kill", redactPullURL(in.url))
+	}
+	return nil
+}
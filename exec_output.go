@@ -0,0 +1,324 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/datarhei/joy4/av"
+	"github.com/datarhei/joy4/format/flv"
+	"github.com/datarhei/joy4/format/ts"
+)
+
+// Состояния процесса exec:// выхода (OutputStatus.ProcessState)
+const (
+	processStarting   = "starting"
+	processRunning    = "running"
+	processRestarting = "restarting"
+	processStopped    = "stopped"
+	processFailed     = "failed"
+)
+
+const (
+	execMinBackoff = 1 * time.Second
+	execMaxBackoff = 30 * time.Second
+	// Процесс, проработавший дольше этого времени, считается стабильным - задержка сбрасывается
+	execStableRun = 30 * time.Second
+)
+
+// ffmpegBinary возвращает путь к ffmpeg: рядом с сервером (bin/ffmpeg.exe) или из PATH
+func ffmpegBinary() string {
+	if _, err := os.Stat("./bin/ffmpeg.exe"); err == nil {
+		return "./bin/ffmpeg.exe"
+	}
+	return "ffmpeg"
+}
+
+// execOutputSpec - разобранный URL вида exec://команда?args=...&format=flv|mpegts
+// (используется и для exec:// входов). Аргументы из args делятся по пробелам;
+// аргумент с пробелами можно передать отдельным параметром arg=.
+type execOutputSpec struct {
+	Command string
+	Args    []string
+	Format  string
+}
+
+// isExecURL сообщает, запускает ли URL команду (exec://)
+func isExecURL(raw string) bool {
+	return len(raw) >= 7 && strings.EqualFold(raw[:7], "exec://")
+}
+
+func parseExecOutputURL(raw string) (*execOutputSpec, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, fmt.Errorf("invalid exec URL: %w", err)
+	}
+	if u.Scheme != "exec" {
+		return nil, fmt.Errorf("not an exec URL: %s", raw)
+	}
+
+	spec := &execOutputSpec{Command: u.Host + u.Path}
+	if spec.Command == "" {
+		return nil, fmt.Errorf("exec URL without command: %s", raw)
+	}
+	if spec.Command == "ffmpeg" {
+		spec.Command = ffmpegBinary()
+	}
+
+	q := u.Query()
+	spec.Args = strings.Fields(q.Get("args"))
+	spec.Args = append(spec.Args, q["arg"]...)
+
+	spec.Format = strings.ToLower(q.Get("format"))
+	switch spec.Format {
+	case "":
+		spec.Format = "mpegts"
+	case "ts":
+		spec.Format = "mpegts"
+	case "flv", "mpegts":
+	default:
+		return nil, fmt.Errorf("unsupported exec format %q (flv or mpegts)", spec.Format)
+	}
+	return spec, nil
+}
+
+// newExecMuxer создаёт муксер выбранного контейнера поверх stdin процесса
+func newExecMuxer(format string, w io.Writer) av.Muxer {
+	if format == "flv" {
+		return flv.NewMuxer(w)
+	}
+	return ts.NewMuxer(w)
+}
+
+// execProcess запускает внешнюю команду, отдаёт её stdin для записи,
+// пишет её stderr в лог и публикует состояние процесса в OutputStatus
+type execProcess struct {
+	spec      *execOutputSpec
+	sm        *StreamManager
+	inputName string
+	url       string
+
+	cmd       *exec.Cmd
+	stdin     io.WriteCloser
+	exited    chan struct{}
+	exitErr   error
+	startedAt time.Time
+	backoff   time.Duration
+}
+
+func newExecProcess(sm *StreamManager, inputName, url string, spec *execOutputSpec) *execProcess {
+	return &execProcess{
+		spec:      spec,
+		sm:        sm,
+		inputName: inputName,
+		url:       url,
+		backoff:   execMinBackoff,
+	}
+}
+
+func (p *execProcess) start() error {
+	p.sm.SetOutputProcess(p.inputName, p.url, processStarting, 0, "")
+
+	cmd := exec.Command(p.spec.Command, p.spec.Args...)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		p.sm.SetOutputProcess(p.inputName, p.url, processFailed, 0, err.Error())
+		return err
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		p.sm.SetOutputProcess(p.inputName, p.url, processFailed, 0, err.Error())
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		p.sm.SetOutputProcess(p.inputName, p.url, processFailed, 0, err.Error())
+		return err
+	}
+
+	p.cmd = cmd
+	p.stdin = stdin
+	p.exitErr = nil
+	p.exited = make(chan struct{})
+	p.startedAt = time.Now()
+	log.Printf("[EXEC] Started %s %v (pid %d) for %s", p.spec.Command, p.spec.Args, cmd.Process.Pid, p.url)
+	p.sm.SetOutputProcess(p.inputName, p.url, processRunning, cmd.Process.Pid, "")
+
+	exited := p.exited
+	go func() {
+		// Wait можно вызывать только после того, как stderr прочитан до конца
+		scanner := bufio.NewScanner(stderr)
+		for scanner.Scan() {
+			log.Printf("[EXEC] %s: %s", p.url, scanner.Text())
+		}
+		p.exitErr = cmd.Wait()
+		close(exited)
+	}()
+	return nil
+}
+
+// stop закрывает stdin и ждёт завершения процесса, при зависании - убивает его
+func (p *execProcess) stop() {
+	if p.cmd == nil {
+		return
+	}
+	p.stdin.Close()
+	select {
+	case <-p.exited:
+	case <-time.After(5 * time.Second):
+		log.Printf("[EXEC] Process for %s did not exit after stdin close, killing", p.url)
+		p.cmd.Process.Kill()
+		<-p.exited
+	}
+	p.cmd = nil
+}
+
+// lastExit описывает, как завершился процесс
+func (p *execProcess) lastExit() string {
+	if p.exitErr != nil {
+		return p.exitErr.Error()
+	}
+	return "exit status 0"
+}
+
+// waitRestart ждёт перед перезапуском с нарастающей задержкой.
+// Возвращает false, если выход остановлен во время ожидания.
+func (p *execProcess) waitRestart(stop <-chan struct{}) bool {
+	if !p.startedAt.IsZero() && time.Since(p.startedAt) > execStableRun {
+		p.backoff = execMinBackoff
+	}
+	delay := p.backoff
+	p.backoff *= 2
+	if p.backoff > execMaxBackoff {
+		p.backoff = execMaxBackoff
+	}
+
+	p.sm.SetOutputProcess(p.inputName, p.url, processRestarting, 0, "")
+	log.Printf("[EXEC] Restarting %s in %v", p.url, delay)
+	select {
+	case <-stop:
+		p.sm.SetOutputProcess(p.inputName, p.url, processStopped, 0, "")
+		return false
+	case <-time.After(delay):
+		return true
+	}
+}
+
+// finish останавливает процесс и сохраняет результат его работы
+func (p *execProcess) finish(state string) {
+	if p.cmd != nil {
+		p.stop()
+		p.sm.SetOutputProcess(p.inputName, p.url, state, 0, p.lastExit())
+	} else {
+		p.sm.SetOutputProcess(p.inputName, p.url, state, 0, "")
+	}
+}
+
+// runExecPacketOutput - exec:// выход для av.Packet публикаций (RTMP, WHIP)
+func runExecPacketOutput(sm *StreamManager, inputName, outputURL string, header *streamHeader, ch <-chan av.Packet, stop <-chan struct{}) {
+	if !sm.ExecAllowed() {
+		log.Printf("[EXEC] Output %s is disabled: allow_exec is not set", outputURL)
+		sm.SetOutputProcess(inputName, outputURL, processFailed, 0, "allow_exec is not set")
+		return
+	}
+	spec, err := parseExecOutputURL(outputURL)
+	if err != nil {
+		log.Printf("[EXEC] %v", err)
+		sm.SetOutputProcess(inputName, outputURL, processFailed, 0, err.Error())
+		return
+	}
+	proc := newExecProcess(sm, inputName, outputURL, spec)
+
+	var totalBytes int64
+	var lastBitrateUpdateTime time.Time
+
+	for {
+		if err := proc.start(); err != nil {
+			log.Printf("[EXEC] Failed to start %s for %s: %v", spec.Command, outputURL, err)
+			sm.IncrementOutputError(inputName, outputURL)
+			if !proc.waitRestart(stop) {
+				return
+			}
+			continue
+		}
+
+		// Opus (WHIP с whip_settings.audio: opus) муксеры joy4 не несут - команда получает только видео
+		streams, headerVersion := header.Get()
+		streams = withoutOpus(streams)
+		// Для TS счётчики и версия PMT продолжаются при пересоздании муксера
+		out := io.Writer(proc.stdin)
+		var tsOut *tsContinuityWriter
+		if spec.Format == "mpegts" {
+			tsOut = newTSContinuityWriter(proc.stdin)
+			out = tsOut
+		}
+		muxer := newExecMuxer(spec.Format, out)
+		err := muxer.WriteHeader(streams)
+		if err == nil {
+			sm.SetOutputActive(inputName, outputURL, true)
+		}
+
+		for err == nil {
+			select {
+			case <-stop:
+				muxer.WriteTrailer()
+				proc.finish(processStopped)
+				sm.SetOutputActive(inputName, outputURL, false)
+				return
+			case <-proc.exited:
+				err = fmt.Errorf("process exited: %s", proc.lastExit())
+			case pkt, ok := <-ch:
+				if !ok {
+					muxer.WriteTrailer()
+					proc.finish(processStopped)
+					sm.SetOutputActive(inputName, outputURL, false)
+					return
+				}
+
+				if int(pkt.Idx) >= len(streams) {
+					continue
+				}
+
+				// Для TS внутрипотоковые SPS/PPS/AUD убираем: муксер пишет их сам перед ключевыми кадрами
+				if spec.Format == "mpegts" && streams[pkt.Idx].Type() == av.H264 && !normalizeTSVideoPacket(&pkt) {
+					continue
+				}
+
+				// В TS можно начать заново с новыми PAT/PMT, в FLV второй заголовок посреди потока недопустим -
+				// там параметры приходят внутри кадров
+				if spec.Format == "mpegts" && pkt.IsKeyFrame && header.Version() != headerVersion {
+					streams, headerVersion = header.Get()
+					streams = withoutOpus(streams)
+					tsOut.Restart()
+					muxer = newExecMuxer(spec.Format, out)
+					if err = muxer.WriteHeader(streams); err != nil {
+						break
+					}
+				}
+
+				if err = muxer.WritePacket(pkt); err != nil {
+					break
+				}
+				totalBytes += int64(len(pkt.Data))
+				now := time.Now()
+				if now.Sub(lastBitrateUpdateTime) > 1*time.Second {
+					sm.UpdateOutputBitrate(inputName, outputURL, totalBytes)
+					lastBitrateUpdateTime = now
+				}
+			}
+		}
+
+		log.Printf("[EXEC] Output %s failed: %v", outputURL, err)
+		proc.finish(processRestarting)
+		sm.SetOutputActive(inputName, outputURL, false)
+		sm.IncrementOutputError(inputName, outputURL)
+		if !proc.waitRestart(stop) {
+			return
+		}
+	}
+}
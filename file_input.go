@@ -0,0 +1,360 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/asticode/go-astits"
+	"github.com/datarhei/joy4/av"
+	"github.com/datarhei/joy4/codec/aacparser"
+	"github.com/datarhei/joy4/codec/h264parser"
+	"github.com/datarhei/joy4/format/flv"
+	"github.com/datarhei/joy4/format/mp4"
+)
+
+// Виртуальный вход из файлов (pull: file:///path/show.mp4 или file:///path/list.m3u):
+// файлы FLV/TS/MP4 проигрываются по кругу в реальном времени. Метки времени
+// сшиваются между файлами, так что для выходов это обычная непрерывная публикация.
+
+// fileInputKind определяет тип файла по расширению: "flv", "ts", "mp4", "playlist"
+func fileInputKind(path string) string {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".flv":
+		return "flv"
+	case ".ts", ".m2ts", ".mts":
+		return "ts"
+	case ".mp4", ".m4v", ".mov":
+		return "mp4"
+	case ".m3u", ".m3u8", ".txt":
+		return "playlist"
+	}
+	return ""
+}
+
+// fileSourcePath достаёт путь из file:// URL: file:///media/a.ts -> /media/a.ts,
+// file:///C:/media/a.ts -> C:/media/a.ts, file://media/a.ts -> media/a.ts (от рабочего каталога)
+func fileSourcePath(u *url.URL) string {
+	path := u.Host + u.Path
+	if u.Host == "" && len(path) >= 3 && path[0] == '/' && path[2] == ':' {
+		path = path[1:]
+	}
+	return path
+}
+
+func validateFileSource(path string) error {
+	if path == "" {
+		return errors.New("file URL has no path")
+	}
+	if fileInputKind(path) == "" {
+		return fmt.Errorf("unsupported file type %q (flv, ts, mp4 or m3u playlist)", filepath.Ext(path))
+	}
+	return nil
+}
+
+// readFilePlaylist читает список файлов: по одному пути на строку, # - комментарии,
+// относительные пути - от каталога плейлиста
+func readFilePlaylist(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var items []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(strings.TrimPrefix(scanner.Text(), "\ufeff"))
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if len(line) > 7 && strings.EqualFold(line[:7], "file://") {
+			if u, err := url.Parse(line); err == nil {
+				line = fileSourcePath(u)
+			}
+		}
+		if !filepath.IsAbs(line) {
+			line = filepath.Join(filepath.Dir(path), line)
+		}
+		items = append(items, line)
+	}
+	return items, scanner.Err()
+}
+
+// fileDemuxer отдаёт файлы как av.Demuxer для servePublish
+type fileDemuxer struct {
+	sm        *StreamManager
+	inputName string
+	path      string
+	closed    chan struct{}
+	closeOnce sync.Once
+
+	streams  []av.CodecData
+	videoIdx int
+	audioIdx int
+
+	queue   []string
+	file    *os.File
+	item    av.Demuxer
+	itemMap []int // индекс потока файла -> индекс в streams, -1 - не нужен
+	played  bool  // хотя бы один файл за проход дал пакеты
+	videoOn bool  // в текущем файле уже было видео
+
+	// Сшивка меток: время файла приводится к offset + (t - base)
+	offset    time.Duration
+	base      time.Duration
+	baseSet   bool
+	lastTime  []time.Duration
+	videoStep time.Duration
+	paramSets []byte // SPS/PPS нового файла для первого ключевого кадра
+
+	start time.Time // момент, соответствующий нулевой метке
+}
+
+func newFileDemuxer(sm *StreamManager, path string, inputCfg *InputCfg) *fileDemuxer {
+	return &fileDemuxer{
+		sm:        sm,
+		inputName: inputCfg.Name,
+		path:      path,
+		closed:    make(chan struct{}),
+		videoIdx:  -1,
+		audioIdx:  -1,
+	}
+}
+
+// nextItem открывает следующий файл; список перечитывается на каждом круге
+func (d *fileDemuxer) nextItem() error {
+	if d.file != nil {
+		d.file.Close()
+		d.file, d.item = nil, nil
+	}
+	for {
+		if d.isClosed() {
+			return errors.New("input closed")
+		}
+		if len(d.queue) == 0 {
+			if d.streams != nil && !d.played {
+				return errors.New("no playable files")
+			}
+			d.played = false
+			if fileInputKind(d.path) == "playlist" {
+				items, err := readFilePlaylist(d.path)
+				if err != nil {
+					return err
+				}
+				if len(items) == 0 {
+					return errors.New("playlist is empty")
+				}
+				d.queue = items
+			} else {
+				d.queue = []string{d.path}
+			}
+		}
+		path := d.queue[0]
+		d.queue = d.queue[1:]
+		if err := d.open(path); err != nil {
+			log.Printf("[FILE] Input '%s': skipping %s: %v", d.inputName, path, err)
+			if d.streams == nil && len(d.queue) == 0 {
+				return err
+			}
+			continue
+		}
+		log.Printf("[FILE] Input '%s' playing %s", d.inputName, path)
+		return nil
+	}
+}
+
+// open открывает файл и сопоставляет его потоки с потоками входа
+func (d *fileDemuxer) open(path string) error {
+	kind := fileInputKind(path)
+	if kind == "" || kind == "playlist" {
+		return errors.New("unsupported file type")
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	var item av.Demuxer
+	switch kind {
+	case "flv":
+		item = flv.NewDemuxer(bufio.NewReader(f))
+	case "ts":
+		item = newTSDemuxer(bufio.NewReader(f), d.sm, d.inputName)
+	case "mp4":
+		item = mp4.NewDemuxer(f)
+	}
+	streams, err := item.Streams()
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	// Потоки входа задаёт первый файл: H.264 видео и AAC аудио
+	if d.streams == nil {
+		for _, codec := range streams {
+			switch {
+			case codec.Type() == av.H264 && d.videoIdx < 0:
+				d.videoIdx = len(d.streams)
+				d.streams = append(d.streams, codec)
+			case codec.Type() == av.AAC && d.audioIdx < 0:
+				d.audioIdx = len(d.streams)
+				d.streams = append(d.streams, codec)
+			}
+		}
+		if d.streams == nil {
+			f.Close()
+			return errors.New("no H.264 or AAC streams")
+		}
+		d.lastTime = make([]time.Duration, len(d.streams))
+	} else {
+		d.offset = d.nextTime()
+	}
+
+	d.itemMap = make([]int, len(streams))
+	d.paramSets = nil
+	matched := false
+	for i, codec := range streams {
+		d.itemMap[i] = -1
+		switch {
+		case codec.Type() == av.H264 && d.videoIdx >= 0:
+			d.itemMap[i] = d.videoIdx
+			if h264, ok := codec.(h264parser.CodecData); ok {
+				d.paramSets = appendAVCCNALU(appendAVCCNALU(nil, h264.SPS()), h264.PPS())
+			}
+		case codec.Type() == av.AAC && d.audioIdx >= 0:
+			d.itemMap[i] = d.audioIdx
+			prev, _ := d.streams[d.audioIdx].(aacparser.CodecData)
+			if aac, ok := codec.(aacparser.CodecData); ok && (aac.SampleRate() != prev.SampleRate() || aac.ChannelLayout() != prev.ChannelLayout()) {
+				log.Printf("[FILE] Input '%s': %s has different audio parameters, outputs may not follow", d.inputName, path)
+			}
+		default:
+			continue
+		}
+		matched = true
+	}
+	if !matched {
+		f.Close()
+		return errors.New("no H.264 or AAC streams")
+	}
+
+	d.file, d.item = f, item
+	d.baseSet = false
+	d.videoOn = false
+	return nil
+}
+
+// nextTime - метка, с которой продолжится следующий файл
+func (d *fileDemuxer) nextTime() time.Duration {
+	next := d.offset
+	for idx, t := range d.lastTime {
+		if idx == d.videoIdx {
+			t += d.videoStep
+		}
+		if t > next {
+			next = t
+		}
+	}
+	return next
+}
+
+func (d *fileDemuxer) Streams() ([]av.CodecData, error) {
+	if d.streams == nil {
+		if err := d.nextItem(); err != nil {
+			return nil, err
+		}
+		d.start = time.Now()
+	}
+	return d.streams, nil
+}
+
+func (d *fileDemuxer) ReadPacket() (av.Packet, error) {
+	if _, err := d.Streams(); err != nil {
+		return av.Packet{}, err
+	}
+	for {
+		if d.isClosed() {
+			d.file.Close()
+			return av.Packet{}, errors.New("input closed")
+		}
+		pkt, err := d.item.ReadPacket()
+		if err != nil {
+			if !errors.Is(err, io.EOF) && !errors.Is(err, astits.ErrNoMorePackets) {
+				log.Printf("[FILE] Input '%s': read error: %v", d.inputName, err)
+			}
+			if err := d.nextItem(); err != nil {
+				return av.Packet{}, err
+			}
+			continue
+		}
+		if int(pkt.Idx) >= len(d.itemMap) || d.itemMap[pkt.Idx] < 0 {
+			continue
+		}
+		idx := d.itemMap[pkt.Idx]
+		isVideo := idx == d.videoIdx
+
+		// Начало файла - первый ключевой кадр видео (или первый аудиокадр без видео)
+		if !d.baseSet {
+			if (d.videoIdx >= 0 && !isVideo) || (isVideo && !pkt.IsKeyFrame) {
+				continue
+			}
+			d.base = pkt.Time
+			d.baseSet = true
+		}
+		if isVideo && pkt.IsKeyFrame && d.paramSets != nil {
+			pkt.Data = append(append([]byte(nil), d.paramSets...), pkt.Data...)
+			d.paramSets = nil
+		}
+
+		t := d.offset + pkt.Time - d.base
+		if t < d.offset {
+			t = d.offset
+		}
+		if last := d.lastTime[idx]; t < last {
+			t = last
+		} else if isVideo && d.videoOn && t > last {
+			d.videoStep = t - last
+		}
+		if isVideo {
+			d.videoOn = true
+		}
+		d.lastTime[idx] = t
+		d.played = true
+		pkt.Idx = int8(idx)
+		pkt.Time = t
+
+		// Отдаём пакеты в темпе их меток
+		if wait := time.Until(d.start.Add(t)); wait > 0 {
+			select {
+			case <-time.After(wait):
+			case <-d.closed:
+				d.file.Close()
+				return av.Packet{}, errors.New("input closed")
+			}
+		}
+		return pkt, nil
+	}
+}
+
+func (d *fileDemuxer) isClosed() bool {
+	select {
+	case <-d.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// Close останавливает чтение; файл закрывается в ReadPacket. Вызывается и сторожем pull,
+// и при выходе из pullOnce, поэтому закрытие канала защищено sync.Once.
+func (d *fileDemuxer) Close() error {
+	d.closeOnce.Do(func() { close(d.closed) })
+	return nil
+}
@@ -6,7 +6,11 @@ require (
 	github.com/asticode/go-astits v1.13.0
 	github.com/datarhei/gosrt v0.9.0
 	github.com/datarhei/joy4 v0.0.0-20250229143024-b140734
+	github.com/pion/interceptor v0.1.29
+	github.com/pion/rtcp v1.2.14
+	github.com/pion/rtp v1.8.20
 	github.com/pion/webrtc/v3 v3.3.5
+	golang.org/x/net v0.22.0
 	gopkg.in/yaml.v3 v3.0.1
 )
 
@@ -27,12 +31,9 @@ require (
 	github.com/pion/datachannel v1.5.8 // indirect
 	github.com/pion/dtls/v2 v2.2.12 // indirect
 	github.com/pion/ice/v2 v2.3.36 // indirect
-	github.com/pion/interceptor v0.1.29 // indirect
 	github.com/pion/logging v0.2.2 // indirect
 	github.com/pion/mdns v0.0.12 // indirect
 	github.com/pion/randutil v0.1.0 // indirect
-	github.com/pion/rtcp v1.2.14 // indirect
-	github.com/pion/rtp v1.8.20 // indirect
 	github.com/pion/sctp v1.8.19 // indirect
 	github.com/pion/sdp/v3 v3.0.9 // indirect
 	github.com/pion/srtp/v2 v2.0.20 // indirect
@@ -44,7 +45,6 @@ require (
 	github.com/webview/webview_go v0.0.0-20240831120633-6173450d4dd6 // indirect
 	github.com/wlynxg/anet v0.0.3 // indirect
 	golang.org/x/crypto v0.39.0 // indirect
-	golang.org/x/net v0.22.0 // indirect
 	golang.org/x/sys v0.33.0 // indirect
 )
 
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"sync"
+
+	"github.com/datarhei/joy4/av"
+	"github.com/datarhei/joy4/codec/h264parser"
+	"github.com/datarhei/joy4/format/rtmp"
+)
+
+// h264ParamTracker следит за SPS/PPS внутри H.264 пакетов (AVCC или Annex B)
+// и сообщает, когда энкодер сменил параметры (разрешение, профиль) посреди потока
+type h264ParamTracker struct {
+	sps, pps []byte
+}
+
+func newH264ParamTracker(codec av.CodecData) *h264ParamTracker {
+	t := &h264ParamTracker{}
+	if h264, ok := codec.(h264parser.CodecData); ok {
+		t.sps = h264.SPS()
+		t.pps = h264.PPS()
+	}
+	return t
+}
+
+// Update возвращает новые CodecData, если в пакете пришли SPS/PPS, отличные от текущих
+func (t *h264ParamTracker) Update(data []byte) (h264parser.CodecData, bool) {
+	nalus, _ := h264parser.SplitNALUs(data)
+	var sps, pps []byte
+	for _, nalu := range nalus {
+		if len(nalu) == 0 {
+			continue
+		}
+		switch nalu[0] & 0x1f {
+		case 7:
+			sps = nalu
+		case 8:
+			pps = nalu
+		}
+	}
+	if sps == nil && pps == nil {
+		return h264parser.CodecData{}, false
+	}
+	if sps == nil {
+		sps = t.sps
+	}
+	if pps == nil {
+		pps = t.pps
+	}
+	if sps == nil || pps == nil || (bytes.Equal(sps, t.sps) && bytes.Equal(pps, t.pps)) {
+		return h264parser.CodecData{}, false
+	}
+
+	codec, err := h264parser.NewCodecDataFromSPSAndPPS(sps, pps)
+	if err != nil {
+		return h264parser.CodecData{}, false
+	}
+	t.sps = append([]byte(nil), sps...)
+	t.pps = append([]byte(nil), pps...)
+	return codec, true
+}
+
+// UpdateRecord - то же для AVCDecoderConfigurationRecord из RTMP sequence header
+func (t *h264ParamTracker) UpdateRecord(record []byte) (h264parser.CodecData, bool) {
+	codec, err := h264parser.NewCodecDataFromAVCDecoderConfRecord(record)
+	if err != nil || (bytes.Equal(codec.SPS(), t.sps) && bytes.Equal(codec.PPS(), t.pps)) {
+		return h264parser.CodecData{}, false
+	}
+	t.sps = append([]byte(nil), codec.SPS()...)
+	t.pps = append([]byte(nil), codec.PPS()...)
+	return codec, true
+}
+
+// videoConfigSource - источник, который передаёт новые параметры видео вне пакетов
+// (AVC sequence header в RTMP)
+type videoConfigSource interface {
+	VideoConfig(videoPackets int64) ([]byte, bool)
+}
+
+// rtmpPublishSource - RTMP публикация вместе с sequence header'ами из rtmpTapConn
+type rtmpPublishSource struct {
+	*rtmp.Conn
+	tap *rtmpTapConn
+}
+
+func (s rtmpPublishSource) VideoConfig(videoPackets int64) ([]byte, bool) {
+	return s.tap.VideoConfig(videoPackets)
+}
+
+// streamHeader хранит актуальные CodecData публикации. Версия растёт при каждой
+// смене параметров, чтобы выходы могли заново отправить заголовки на ближайшем ключевом кадре.
+type streamHeader struct {
+	mu      sync.RWMutex
+	streams []av.CodecData
+	version int
+}
+
+func newStreamHeader(streams []av.CodecData) *streamHeader {
+	return &streamHeader{streams: streams}
+}
+
+// Get возвращает копию CodecData и их версию
+func (h *streamHeader) Get() ([]av.CodecData, int) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	streams := make([]av.CodecData, len(h.streams))
+	copy(streams, h.streams)
+	return streams, h.version
+}
+
+// Version возвращает текущую версию без копирования CodecData
+func (h *streamHeader) Version() int {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.version
+}
+
+// Update заменяет CodecData потока idx
+func (h *streamHeader) Update(idx int, codec av.CodecData) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if idx < 0 || idx >= len(h.streams) {
+		return
+	}
+	streams := make([]av.CodecData, len(h.streams))
+	copy(streams, h.streams)
+	streams[idx] = codec
+	h.streams = streams
+	h.version++
+}
+
+// videoStreamIndex возвращает индекс H.264 потока или -1
+func videoStreamIndex(streams []av.CodecData) int {
+	for i, codec := range streams {
+		if codec.Type() == av.H264 {
+			return i
+		}
+	}
+	return -1
+}
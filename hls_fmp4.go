@@ -0,0 +1,552 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/datarhei/joy4/av"
+	"github.com/datarhei/joy4/codec/aacparser"
+	"github.com/datarhei/joy4/codec/h264parser"
+)
+
+// Разбор fMP4 (CMAF) сегментов HLS: init сегмент (moov) даёт кодеки дорожек,
+// медиа сегменты (moof+mdat) - сэмплы с метками из tfdt/trun.
+
+// Флаги сэмпла: sample_is_non_sync_sample
+const fmp4NonSyncSample = 0x10000
+
+// fmp4Track - дорожка из init сегмента
+type fmp4Track struct {
+	id        uint32
+	timescale uint32
+	codec     av.CodecData
+
+	// Значения по умолчанию из trex
+	defaultDuration uint32
+	defaultSize     uint32
+	defaultFlags    uint32
+}
+
+// fmp4Sample - сэмпл медиа сегмента; dts и cto в единицах timescale дорожки
+type fmp4Sample struct {
+	track *fmp4Track
+	dts   uint64
+	cto   int32
+	key   bool
+	data  []byte
+}
+
+// mp4Boxes вызывает fn для каждого бокса в data; offset - начало бокса в data
+func mp4Boxes(data []byte, fn func(typ string, body []byte, offset int) error) error {
+	for off := 0; off+8 <= len(data); {
+		size := uint64(binary.BigEndian.Uint32(data[off:]))
+		typ := string(data[off+4 : off+8])
+		header := uint64(8)
+		switch size {
+		case 0:
+			size = uint64(len(data) - off)
+		case 1:
+			if off+16 > len(data) {
+				return fmt.Errorf("truncated mp4 box %s", typ)
+			}
+			size = binary.BigEndian.Uint64(data[off+8:])
+			header = 16
+		}
+		// size из 64-битного заголовка может быть любым - сравниваем с остатком без сложения
+		if size < header || size > uint64(len(data)-off) {
+			return fmt.Errorf("truncated mp4 box %s", typ)
+		}
+		if err := fn(typ, data[uint64(off)+header:uint64(off)+size], off); err != nil {
+			return err
+		}
+		off += int(size)
+	}
+	return nil
+}
+
+// parseFMP4Init возвращает дорожки H.264 и AAC из init сегмента
+func parseFMP4Init(data []byte) ([]*fmp4Track, error) {
+	var tracks []*fmp4Track
+	trex := make(map[uint32][3]uint32)
+
+	err := mp4Boxes(data, func(typ string, moov []byte, _ int) error {
+		if typ != "moov" {
+			return nil
+		}
+		return mp4Boxes(moov, func(typ string, body []byte, _ int) error {
+			switch typ {
+			case "trak":
+				track, err := parseFMP4Trak(body)
+				if err != nil {
+					return err
+				}
+				if track != nil {
+					tracks = append(tracks, track)
+				}
+			case "mvex":
+				return mp4Boxes(body, func(typ string, b []byte, _ int) error {
+					if typ == "trex" && len(b) >= 24 {
+						trex[binary.BigEndian.Uint32(b[4:])] = [3]uint32{
+							binary.BigEndian.Uint32(b[12:]),
+							binary.BigEndian.Uint32(b[16:]),
+							binary.BigEndian.Uint32(b[20:]),
+						}
+					}
+					return nil
+				})
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(tracks) == 0 {
+		return nil, errors.New("no H.264 or AAC tracks in init segment")
+	}
+	for _, track := range tracks {
+		if defaults, ok := trex[track.id]; ok {
+			track.defaultDuration, track.defaultSize, track.defaultFlags = defaults[0], defaults[1], defaults[2]
+		}
+	}
+	return tracks, nil
+}
+
+// parseFMP4Trak разбирает trak; дорожки с другими кодеками пропускаются (nil)
+func parseFMP4Trak(trak []byte) (*fmp4Track, error) {
+	track := &fmp4Track{}
+	var stsd []byte
+	err := mp4Boxes(trak, func(typ string, body []byte, _ int) error {
+		switch typ {
+		case "tkhd":
+			if len(body) >= 24 && body[0] == 1 {
+				track.id = binary.BigEndian.Uint32(body[20:])
+			} else if len(body) >= 16 {
+				track.id = binary.BigEndian.Uint32(body[12:])
+			}
+		case "mdia":
+			return mp4Boxes(body, func(typ string, body []byte, _ int) error {
+				switch typ {
+				case "mdhd":
+					if len(body) >= 24 && body[0] == 1 {
+						track.timescale = binary.BigEndian.Uint32(body[20:])
+					} else if len(body) >= 16 {
+						track.timescale = binary.BigEndian.Uint32(body[12:])
+					}
+				case "minf":
+					return mp4Boxes(body, func(typ string, body []byte, _ int) error {
+						if typ != "stbl" {
+							return nil
+						}
+						return mp4Boxes(body, func(typ string, body []byte, _ int) error {
+							if typ == "stsd" && len(body) >= 8 {
+								stsd = body[8:]
+							}
+							return nil
+						})
+					})
+				}
+				return nil
+			})
+		}
+		return nil
+	})
+	if err != nil || stsd == nil || track.timescale == 0 {
+		return nil, err
+	}
+
+	err = mp4Boxes(stsd, func(typ string, entry []byte, _ int) error {
+		if track.codec != nil {
+			return nil
+		}
+		switch typ {
+		case "avc1", "avc3":
+			// VisualSampleEntry: 78 байт полей до дочерних боксов
+			if len(entry) < 78 {
+				return nil
+			}
+			return mp4Boxes(entry[78:], func(typ string, body []byte, _ int) error {
+				if typ == "avcC" {
+					codec, err := h264parser.NewCodecDataFromAVCDecoderConfRecord(body)
+					if err != nil {
+						return err
+					}
+					track.codec = codec
+				}
+				return nil
+			})
+		case "mp4a":
+			// AudioSampleEntry: 28 байт полей до дочерних боксов
+			if len(entry) < 28 {
+				return nil
+			}
+			return mp4Boxes(entry[28:], func(typ string, body []byte, _ int) error {
+				if typ != "esds" || len(body) < 4 {
+					return nil
+				}
+				config := esdsAudioConfig(body[4:])
+				if config == nil {
+					return errors.New("no AudioSpecificConfig in esds")
+				}
+				codec, err := aacparser.NewCodecDataFromMPEG4AudioConfigBytes(config)
+				if err != nil {
+					return err
+				}
+				track.codec = codec
+				return nil
+			})
+		}
+		return nil
+	})
+	if err != nil || track.codec == nil {
+		return nil, err
+	}
+	return track, nil
+}
+
+// esdsAudioConfig достаёт DecoderSpecificInfo (AudioSpecificConfig) из ES_Descriptor
+func esdsAudioConfig(data []byte) []byte {
+	for len(data) >= 2 {
+		tag := data[0]
+		size, n := 0, 1
+		for ; n <= 4 && n < len(data); n++ {
+			size = size<<7 | int(data[n]&0x7f)
+			if data[n]&0x80 == 0 {
+				n++
+				break
+			}
+		}
+		body := data[n:]
+		if size > len(body) {
+			return nil
+		}
+		switch tag {
+		case 0x03: // ES_Descriptor: ES_ID, флаги и необязательные поля
+			if len(body) < 3 {
+				return nil
+			}
+			flags := body[2]
+			skip := 3
+			if flags&0x80 != 0 {
+				skip += 2
+			}
+			if flags&0x40 != 0 && len(body) > skip {
+				skip += 1 + int(body[skip])
+			}
+			if flags&0x20 != 0 {
+				skip += 2
+			}
+			if skip > size {
+				return nil
+			}
+			data = body[skip:size]
+		case 0x04: // DecoderConfigDescriptor: 13 байт полей, затем DecoderSpecificInfo
+			if size < 13 {
+				return nil
+			}
+			data = body[13:size]
+		case 0x05:
+			return body[:size]
+		default:
+			data = body[size:]
+		}
+	}
+	return nil
+}
+
+// parseFMP4Segment возвращает сэмплы медиа сегмента в порядке их следования
+func parseFMP4Segment(data []byte, tracks []*fmp4Track) ([]fmp4Sample, error) {
+	var samples []fmp4Sample
+	err := mp4Boxes(data, func(typ string, moof []byte, moofOffset int) error {
+		if typ != "moof" {
+			return nil
+		}
+		return mp4Boxes(moof, func(typ string, traf []byte, _ int) error {
+			if typ != "traf" {
+				return nil
+			}
+			trafSamples, err := parseFMP4Traf(data, moofOffset, traf, tracks)
+			samples = append(samples, trafSamples...)
+			return err
+		})
+	})
+	return samples, err
+}
+
+func parseFMP4Traf(data []byte, moofOffset int, traf []byte, tracks []*fmp4Track) ([]fmp4Sample, error) {
+	var track *fmp4Track
+	var samples []fmp4Sample
+	base := uint64(moofOffset)
+	var decodeTime uint64
+	var defaultDuration, defaultSize, defaultFlags uint32
+
+	err := mp4Boxes(traf, func(typ string, b []byte, _ int) error {
+		switch typ {
+		case "tfhd":
+			if len(b) < 8 {
+				return errors.New("invalid tfhd")
+			}
+			flags := binary.BigEndian.Uint32(b) & 0xffffff
+			id := binary.BigEndian.Uint32(b[4:])
+			for _, t := range tracks {
+				if t.id == id {
+					track = t
+				}
+			}
+			if track == nil {
+				return nil
+			}
+			defaultDuration, defaultSize, defaultFlags = track.defaultDuration, track.defaultSize, track.defaultFlags
+			pos := 8
+			read := func(n int) uint64 {
+				if pos+n > len(b) {
+					return 0
+				}
+				v := b[pos : pos+n]
+				pos += n
+				if n == 8 {
+					return binary.BigEndian.Uint64(v)
+				}
+				return uint64(binary.BigEndian.Uint32(v))
+			}
+			if flags&0x01 != 0 {
+				base = read(8)
+			}
+			if flags&0x02 != 0 {
+				read(4)
+			}
+			if flags&0x08 != 0 {
+				defaultDuration = uint32(read(4))
+			}
+			if flags&0x10 != 0 {
+				defaultSize = uint32(read(4))
+			}
+			if flags&0x20 != 0 {
+				defaultFlags = uint32(read(4))
+			}
+		case "tfdt":
+			if len(b) >= 12 && b[0] == 1 {
+				decodeTime = binary.BigEndian.Uint64(b[4:])
+			} else if len(b) >= 8 {
+				decodeTime = uint64(binary.BigEndian.Uint32(b[4:]))
+			}
+		case "trun":
+			if track == nil {
+				return nil
+			}
+			if len(b) < 8 {
+				return errors.New("invalid trun")
+			}
+			flags := binary.BigEndian.Uint32(b) & 0xffffff
+			count := int(binary.BigEndian.Uint32(b[4:]))
+			if count > len(data) {
+				return errors.New("invalid trun")
+			}
+			pos := 8
+			offset := base
+			if flags&0x01 != 0 {
+				if pos+4 > len(b) {
+					return errors.New("invalid trun")
+				}
+				offset = uint64(int64(base) + int64(int32(binary.BigEndian.Uint32(b[pos:]))))
+				pos += 4
+			}
+			firstFlags, hasFirstFlags := uint32(0), flags&0x04 != 0
+			if hasFirstFlags {
+				if pos+4 > len(b) {
+					return errors.New("invalid trun")
+				}
+				firstFlags = binary.BigEndian.Uint32(b[pos:])
+				pos += 4
+			}
+			for i := 0; i < count; i++ {
+				duration, size, sampleFlags, cto := defaultDuration, defaultSize, defaultFlags, int32(0)
+				if pos+trunSampleSize(flags) > len(b) {
+					return errors.New("invalid trun")
+				}
+				if flags&0x100 != 0 {
+					duration = binary.BigEndian.Uint32(b[pos:])
+					pos += 4
+				}
+				if flags&0x200 != 0 {
+					size = binary.BigEndian.Uint32(b[pos:])
+					pos += 4
+				}
+				if flags&0x400 != 0 {
+					sampleFlags = binary.BigEndian.Uint32(b[pos:])
+					pos += 4
+				}
+				if flags&0x800 != 0 {
+					cto = int32(binary.BigEndian.Uint32(b[pos:]))
+					pos += 4
+				}
+				if i == 0 && hasFirstFlags {
+					sampleFlags = firstFlags
+				}
+				// data_offset бывает отрицательным: offset может "завернуться", поэтому без сложения
+				if offset > uint64(len(data)) || uint64(size) > uint64(len(data))-offset {
+					return errors.New("sample data outside of segment")
+				}
+				samples = append(samples, fmp4Sample{
+					track: track,
+					dts:   decodeTime,
+					cto:   cto,
+					key:   sampleFlags&fmp4NonSyncSample == 0,
+					data:  data[offset : offset+uint64(size)],
+				})
+				offset += uint64(size)
+				decodeTime += uint64(duration)
+			}
+		}
+		return nil
+	})
+	return samples, err
+}
+
+// trunSampleSize - размер записи сэмпла в trun по флагам
+func trunSampleSize(flags uint32) int {
+	size := 0
+	for _, bit := range []uint32{0x100, 0x200, 0x400, 0x800} {
+		if flags&bit != 0 {
+			size += 4
+		}
+	}
+	return size
+}
+
+// mediaTime переводит значение в единицах timescale во время без переполнения
+func mediaTime(v uint64, timescale uint32) time.Duration {
+	ts := uint64(timescale)
+	return time.Duration(v/ts)*time.Second + time.Duration(v%ts)*time.Second/time.Duration(ts)
+}
+
+// fmp4Packetizer переводит сэмплы фрагментов в пакеты с непрерывными метками:
+// время отсчитывается от первого ключевого кадра и продолжается с resume
+type fmp4Packetizer struct {
+	tracks   []*fmp4Track
+	streams  []av.CodecData // раскладка, построенная по init (nil, если задана снаружи)
+	trackIdx map[*fmp4Track]int
+
+	resume    time.Duration
+	base      time.Duration
+	baseSet   bool
+	lastTime  map[int]time.Duration
+	videoStep time.Duration
+	videoIdx  int
+	// При продолжении потока SPS/PPS кладутся в первый ключевой кадр, чтобы servePublish
+	// заметил смену параметров
+	paramSets []byte
+}
+
+// newFMP4Packetizer сопоставляет дорожки с раскладкой layout; без неё раскладка
+// строится по дорожкам: H.264 видео, затем AAC аудио
+func newFMP4Packetizer(tracks []*fmp4Track, layout []av.CodecData, resume time.Duration) *fmp4Packetizer {
+	p := &fmp4Packetizer{
+		tracks:   tracks,
+		trackIdx: make(map[*fmp4Track]int),
+		resume:   resume,
+		lastTime: make(map[int]time.Duration),
+		videoIdx: -1,
+	}
+	resumed := layout != nil
+	if !resumed {
+		for _, kind := range []av.CodecType{av.H264, av.AAC} {
+			for _, track := range tracks {
+				if track.codec.Type() == kind {
+					layout = append(layout, track.codec)
+					break
+				}
+			}
+		}
+		p.streams = layout
+	}
+	for i, stream := range layout {
+		for _, track := range tracks {
+			if _, used := p.trackIdx[track]; !used && track.codec.Type() == stream.Type() {
+				p.trackIdx[track] = i
+				if stream.Type() == av.H264 {
+					p.videoIdx = i
+					if resumed {
+						if h264, ok := track.codec.(h264parser.CodecData); ok {
+							p.paramSets = appendAVCCNALU(appendAVCCNALU(nil, h264.SPS()), h264.PPS())
+						}
+					}
+				}
+				break
+			}
+		}
+	}
+	return p
+}
+
+// nextTime - метка, с которой продолжится следующий участок
+func (p *fmp4Packetizer) nextTime() time.Duration {
+	next := p.resume
+	for idx, t := range p.lastTime {
+		if idx == p.videoIdx {
+			t += p.videoStep
+		}
+		if t > next {
+			next = t
+		}
+	}
+	return next
+}
+
+// packets переводит сэмплы фрагмента в пакеты в порядке времени
+func (p *fmp4Packetizer) packets(samples []fmp4Sample) []av.Packet {
+	type timed struct {
+		pkt av.Packet
+		t   time.Duration
+	}
+	var timedPackets []timed
+	for _, s := range samples {
+		idx, ok := p.trackIdx[s.track]
+		if !ok {
+			continue
+		}
+		isVideo := idx == p.videoIdx
+		t := mediaTime(s.dts, s.track.timescale)
+		// Базовое время - первый ключевой кадр видео (или первый аудиокадр без видео)
+		if !p.baseSet {
+			if (p.videoIdx >= 0 && !isVideo) || (isVideo && !s.key) {
+				continue
+			}
+			p.base = t
+			p.baseSet = true
+		}
+		pkt := av.Packet{Idx: int8(idx), Data: s.data, IsKeyFrame: isVideo && s.key}
+		if s.cto > 0 {
+			pkt.CompositionTime = mediaTime(uint64(s.cto), s.track.timescale)
+		}
+		if isVideo && pkt.IsKeyFrame && p.paramSets != nil {
+			pkt.Data = append(append([]byte(nil), p.paramSets...), s.data...)
+			p.paramSets = nil
+		}
+		timedPackets = append(timedPackets, timed{pkt: pkt, t: t})
+	}
+	// Дорожки идут во фрагменте блоками (traf), для выходов нужен порядок по времени
+	sort.SliceStable(timedPackets, func(i, j int) bool { return timedPackets[i].t < timedPackets[j].t })
+
+	out := make([]av.Packet, 0, len(timedPackets))
+	for _, tp := range timedPackets {
+		pkt := tp.pkt
+		pkt.Time = p.resume + tp.t - p.base
+		if pkt.Time < p.resume {
+			pkt.Time = p.resume
+		}
+		last, seen := p.lastTime[int(pkt.Idx)]
+		if seen && pkt.Time < last {
+			pkt.Time = last
+		}
+		if seen && int(pkt.Idx) == p.videoIdx && pkt.Time > last {
+			p.videoStep = pkt.Time - last
+		}
+		p.lastTime[int(pkt.Idx)] = pkt.Time
+		out = append(out, pkt)
+	}
+	return out
+}
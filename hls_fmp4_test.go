@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/datarhei/joy4/av"
+)
+
+// mp4TestBox собирает бокс из типа и содержимого
+func mp4TestBox(typ string, parts ...[]byte) []byte {
+	body := concatBytes(parts...)
+	b := make([]byte, 8, 8+len(body))
+	binary.BigEndian.PutUint32(b, uint32(8+len(body)))
+	copy(b[4:], typ)
+	return append(b, body...)
+}
+
+func be32(values ...uint32) []byte {
+	b := make([]byte, 4*len(values))
+	for i, v := range values {
+		binary.BigEndian.PutUint32(b[4*i:], v)
+	}
+	return b
+}
+
+// fmp4TestInit - init сегмент с одной AAC дорожкой (AAC-LC 44.1 кГц стерео)
+func fmp4TestInit(trackID, timescale uint32) []byte {
+	asc := []byte{0x05, 0x02, 0x12, 0x10}
+	decoderConfig := concatBytes([]byte{0x04, byte(13 + len(asc)), 0x40, 0x15}, make([]byte, 11), asc)
+	esDescriptor := concatBytes([]byte{0x03, byte(3 + len(decoderConfig)), 0x00, 0x01, 0x00}, decoderConfig)
+	mp4a := mp4TestBox("mp4a", make([]byte, 28), mp4TestBox("esds", be32(0), esDescriptor))
+
+	trak := mp4TestBox("trak",
+		mp4TestBox("tkhd", be32(0, 0, 0, trackID), make([]byte, 68)),
+		mp4TestBox("mdia",
+			mp4TestBox("mdhd", be32(0, 0, 0, timescale, 0), make([]byte, 4)),
+			mp4TestBox("hdlr", be32(0, 0), []byte("soun"), make([]byte, 13)),
+			mp4TestBox("minf", mp4TestBox("stbl", mp4TestBox("stsd", be32(0, 1), mp4a))),
+		),
+	)
+	// trex: track_ID, sample_description_index, duration, size, flags
+	mvex := mp4TestBox("mvex", mp4TestBox("trex", be32(0, trackID, 1, 1024, 0, fmp4NonSyncSample)))
+	return concatBytes(
+		mp4TestBox("ftyp", []byte("iso6"), be32(0)),
+		mp4TestBox("moov", mp4TestBox("mvhd", make([]byte, 100)), trak, mvex),
+	)
+}
+
+func TestParseFMP4Init(t *testing.T) {
+	tracks, err := parseFMP4Init(fmp4TestInit(2, 44100))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tracks) != 1 {
+		t.Fatalf("got %d tracks", len(tracks))
+	}
+	tr := tracks[0]
+	if tr.id != 2 || tr.timescale != 44100 || tr.defaultDuration != 1024 || tr.defaultFlags != fmp4NonSyncSample {
+		t.Errorf("track %+v", tr)
+	}
+	if tr.codec == nil || tr.codec.Type() != av.AAC {
+		t.Errorf("codec %v", tr.codec)
+	}
+
+	errorCases := map[string][]byte{
+		"без дорожек":     concatBytes(mp4TestBox("ftyp", []byte("iso6")), mp4TestBox("moov", mp4TestBox("mvhd", make([]byte, 100)))),
+		"обрезанный бокс": fmp4TestInit(2, 44100)[:60],
+		// 64-битный размер, который переполнил бы off+size
+		"огромный largesize":      concatBytes(be32(1), []byte("moov"), []byte{0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xF0}),
+		"размер меньше заголовка": concatBytes(be32(4), []byte("moov")),
+	}
+	for name, data := range errorCases {
+		t.Run(name, func(t *testing.T) {
+			if _, err := parseFMP4Init(data); err == nil {
+				t.Error("expected error")
+			}
+		})
+	}
+}
+
+// fmp4TestSegment - moof+mdat с одним trun; dataOffset считается от начала moof
+func fmp4TestSegment(trackID uint32, decodeTime uint64, dataOffset int32, sizes []uint32, mdat []byte) []byte {
+	trun := concatBytes(
+		be32(0x000001|0x000004|0x000100|0x000200, uint32(len(sizes)), uint32(dataOffset), 0),
+	)
+	for _, size := range sizes {
+		trun = append(trun, be32(1000, size)...)
+	}
+	tfdt := make([]byte, 12)
+	tfdt[0] = 1
+	binary.BigEndian.PutUint64(tfdt[4:], decodeTime)
+	moof := mp4TestBox("moof",
+		mp4TestBox("mfhd", be32(0, 1)),
+		mp4TestBox("traf",
+			mp4TestBox("tfhd", be32(0, trackID)),
+			mp4TestBox("tfdt", tfdt),
+			mp4TestBox("trun", trun),
+		),
+	)
+	return concatBytes(moof, mp4TestBox("mdat", mdat))
+}
+
+func TestParseFMP4Segment(t *testing.T) {
+	track := &fmp4Track{id: 1, timescale: 90000, defaultFlags: fmp4NonSyncSample}
+	tracks := []*fmp4Track{track}
+
+	// Размер moof не зависит от значений полей - считаем его по пробной сборке
+	mdat := []byte{1, 2, 3, 4, 5}
+	probe := fmp4TestSegment(1, 0, 0, []uint32{3, 2}, mdat)
+	moofSize := int32(len(probe) - 8 - len(mdat))
+
+	samples, err := parseFMP4Segment(fmp4TestSegment(1, 1<<40, moofSize+8, []uint32{3, 2}, mdat), tracks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(samples) != 2 {
+		t.Fatalf("got %d samples", len(samples))
+	}
+	if s := samples[0]; s.track != track || s.dts != 1<<40 || !s.key || !bytes.Equal(s.data, []byte{1, 2, 3}) {
+		t.Errorf("sample 0: dts=%d key=%v data=%v", s.dts, s.key, s.data)
+	}
+	if s := samples[1]; s.dts != 1<<40+1000 || s.key || !bytes.Equal(s.data, []byte{4, 5}) {
+		t.Errorf("sample 1: dts=%d key=%v data=%v", s.dts, s.key, s.data)
+	}
+
+	// Дорожки нет в init - сэмплы пропускаются без ошибки
+	if samples, err := parseFMP4Segment(fmp4TestSegment(7, 0, moofSize+8, []uint32{3, 2}, mdat), tracks); err != nil || len(samples) != 0 {
+		t.Errorf("unknown track: %d samples, err %v", len(samples), err)
+	}
+
+	errorCases := []struct {
+		name   string
+		offset int32
+		sizes  []uint32
+	}{
+		{"сэмпл за концом сегмента", moofSize + 8, []uint32{3, 100}},
+		{"отрицательный data_offset до начала данных", -8, []uint32{16}},
+		{"огромный размер сэмпла", moofSize + 8, []uint32{0xFFFFFFFF}},
+	}
+	for _, tt := range errorCases {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := parseFMP4Segment(fmp4TestSegment(1, 0, tt.offset, tt.sizes, mdat), tracks); err == nil {
+				t.Error("expected error")
+			}
+		})
+	}
+
+	// Сегмент после другого бокса: отрицательный data_offset "заворачивает" смещение
+	t.Run("data_offset с переполнением", func(t *testing.T) {
+		data := concatBytes(mp4TestBox("styp", []byte("msdh")), fmp4TestSegment(1, 0, -100, []uint32{16}, mdat))
+		if _, err := parseFMP4Segment(data, tracks); err == nil {
+			t.Error("expected error")
+		}
+	})
+
+	t.Run("trun с огромным числом сэмплов", func(t *testing.T) {
+		seg := fmp4TestSegment(1, 0, moofSize+8, []uint32{3, 2}, mdat)
+		// sample_count - второе поле trun после version/flags
+		i := bytes.Index(seg, []byte("trun"))
+		binary.BigEndian.PutUint32(seg[i+8:], 0xFFFFFFFF)
+		if _, err := parseFMP4Segment(seg, tracks); err == nil {
+			t.Error("expected error")
+		}
+	})
+}
+
+func TestMediaTime(t *testing.T) {
+	if got := mediaTime(1<<40, 90000); got != ticksToDuration(1<<40) {
+		t.Errorf("mediaTime = %v, want %v", got, ticksToDuration(1<<40))
+	}
+	if got := mediaTime(44100*3+22050, 44100); got.Seconds() != 3.5 {
+		t.Errorf("mediaTime = %v", got)
+	}
+}
@@ -0,0 +1,638 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/datarhei/joy4/av"
+)
+
+// Pull-вход HLS (pull: https://.../playlist.m3u8): опрос плейлиста, выбор варианта
+// по битрейту, загрузка сегментов (MPEG-TS или fMP4) по порядку. Сегменты между
+// разрывами (EXT-X-DISCONTINUITY, пропуск сегментов, смена init) демуксятся
+// как непрерывный поток; после разрыва метки продолжаются с последней выданной.
+
+const (
+	hlsRequestTimeout = 20 * time.Second
+	// С живого края начинаем с трёх последних сегментов (RFC 8216, 6.3.3)
+	hlsLiveEdgeSegments = 3
+	// Сколько загруженных сегментов ждут демуксера
+	hlsSegmentQueue = 3
+)
+
+// hlsSegment - загруженный сегмент
+type hlsSegment struct {
+	data          []byte
+	init          []byte // init сегмент fMP4 (EXT-X-MAP), nil для MPEG-TS
+	discontinuity bool   // метки не продолжают предыдущий сегмент
+}
+
+// hlsPlaylist - разобранный m3u8 (master или media)
+type hlsPlaylist struct {
+	variants       []hlsVariant
+	targetDuration time.Duration
+	segments       []hlsSegmentRef
+	endList        bool
+}
+
+type hlsVariant struct {
+	url       string
+	bandwidth int
+}
+
+type hlsSegmentRef struct {
+	url           string
+	seq           int64
+	discontinuity bool
+	mapURL        string
+	key           *hlsKey
+}
+
+// hlsKey - шифрование сегмента (EXT-X-KEY METHOD=AES-128)
+type hlsKey struct {
+	url string
+	iv  []byte // nil - IV из номера сегмента
+}
+
+// parseHLSPlaylist разбирает m3u8; относительные URI разрешаются от base
+func parseHLSPlaylist(data []byte, base *url.URL) (*hlsPlaylist, error) {
+	resolve := func(ref string) (string, error) {
+		u, err := base.Parse(strings.TrimSpace(ref))
+		if err != nil {
+			return "", err
+		}
+		return u.String(), nil
+	}
+
+	pl := &hlsPlaylist{}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	first := true
+	var seq int64
+	var pendingVariant *hlsVariant
+	var discontinuity bool
+	var mapURL string
+	var key *hlsKey
+
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if first {
+			if !strings.HasPrefix(line, "#EXTM3U") {
+				return nil, errors.New("not an m3u8 playlist")
+			}
+			first = false
+			continue
+		}
+		tag, value, _ := strings.Cut(line, ":")
+		switch {
+		case line == "":
+		case tag == "#EXT-X-STREAM-INF":
+			attrs := parseHLSAttributes(value)
+			bandwidth, _ := strconv.Atoi(attrs["BANDWIDTH"])
+			pendingVariant = &hlsVariant{bandwidth: bandwidth}
+		case tag == "#EXT-X-TARGETDURATION":
+			seconds, _ := strconv.ParseFloat(value, 64)
+			pl.targetDuration = time.Duration(seconds * float64(time.Second))
+		case tag == "#EXT-X-MEDIA-SEQUENCE":
+			seq, _ = strconv.ParseInt(value, 10, 64)
+		case tag == "#EXT-X-DISCONTINUITY":
+			discontinuity = true
+		case tag == "#EXT-X-ENDLIST":
+			pl.endList = true
+		case tag == "#EXT-X-BYTERANGE":
+			return nil, errors.New("byte-range segments are not supported")
+		case tag == "#EXT-X-MAP":
+			attrs := parseHLSAttributes(value)
+			if attrs["BYTERANGE"] != "" {
+				return nil, errors.New("byte-range init segments are not supported")
+			}
+			u, err := resolve(attrs["URI"])
+			if err != nil {
+				return nil, err
+			}
+			mapURL = u
+		case tag == "#EXT-X-KEY":
+			attrs := parseHLSAttributes(value)
+			switch attrs["METHOD"] {
+			case "NONE":
+				key = nil
+			case "AES-128":
+				u, err := resolve(attrs["URI"])
+				if err != nil {
+					return nil, err
+				}
+				key = &hlsKey{url: u}
+				if iv := attrs["IV"]; iv != "" {
+					b, err := hex.DecodeString(strings.TrimPrefix(strings.TrimPrefix(iv, "0x"), "0X"))
+					if err != nil || len(b) != aes.BlockSize {
+						return nil, fmt.Errorf("invalid IV %q", iv)
+					}
+					key.iv = b
+				}
+			default:
+				return nil, fmt.Errorf("unsupported encryption %q", attrs["METHOD"])
+			}
+		case strings.HasPrefix(line, "#"):
+			// EXTINF и остальные теги не нужны
+		default:
+			u, err := resolve(line)
+			if err != nil {
+				return nil, err
+			}
+			if pendingVariant != nil {
+				pendingVariant.url = u
+				pl.variants = append(pl.variants, *pendingVariant)
+				pendingVariant = nil
+				continue
+			}
+			pl.segments = append(pl.segments, hlsSegmentRef{
+				url:           u,
+				seq:           seq,
+				discontinuity: discontinuity,
+				mapURL:        mapURL,
+				key:           key,
+			})
+			seq++
+			discontinuity = false
+		}
+	}
+	if first {
+		return nil, errors.New("empty playlist")
+	}
+	return pl, scanner.Err()
+}
+
+// parseHLSAttributes разбирает список атрибутов: KEY=VALUE,KEY="VALUE, с запятой"
+func parseHLSAttributes(s string) map[string]string {
+	attrs := make(map[string]string)
+	for s != "" {
+		key, rest, ok := strings.Cut(s, "=")
+		if !ok {
+			break
+		}
+		var value string
+		if strings.HasPrefix(rest, `"`) {
+			end := strings.Index(rest[1:], `"`)
+			if end < 0 {
+				value, rest = rest[1:], ""
+			} else {
+				value, rest = rest[1:end+1], rest[end+2:]
+			}
+			rest = strings.TrimPrefix(rest, ",")
+		} else {
+			value, rest, _ = strings.Cut(rest, ",")
+		}
+		attrs[strings.TrimSpace(key)] = value
+		s = rest
+	}
+	return attrs
+}
+
+// selectHLSVariant выбирает вариант с наибольшим битрейтом не выше maxBandwidth
+// (0 - без ограничения); если ни один не подходит - самый лёгкий
+func selectHLSVariant(variants []hlsVariant, maxBandwidth int) hlsVariant {
+	sorted := append([]hlsVariant(nil), variants...)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].bandwidth < sorted[j].bandwidth })
+	chosen := sorted[0]
+	for _, v := range sorted {
+		if maxBandwidth <= 0 || v.bandwidth <= maxBandwidth {
+			chosen = v
+		}
+	}
+	return chosen
+}
+
+// hlsFetcher опрашивает плейлист и отдаёт загруженные сегменты по порядку
+type hlsFetcher struct {
+	client       *http.Client
+	inputName    string
+	url          string
+	maxBandwidth int
+	out          chan<- *hlsSegment
+
+	inits map[string][]byte
+	keys  map[string][]byte
+}
+
+func (f *hlsFetcher) get(ctx context.Context, rawURL string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET %s: %s", redactPullURL(rawURL), resp.Status)
+	}
+	return io.ReadAll(resp.Body)
+}
+
+func (f *hlsFetcher) playlist(ctx context.Context, rawURL string) (*hlsPlaylist, error) {
+	data, err := f.get(ctx, rawURL)
+	if err != nil {
+		return nil, err
+	}
+	base, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	return parseHLSPlaylist(data, base)
+}
+
+// run загружает сегменты до остановки или конца плейлиста (EXT-X-ENDLIST)
+func (f *hlsFetcher) run(ctx context.Context) error {
+	mediaURL := f.url
+	pl, err := f.playlist(ctx, mediaURL)
+	if err != nil {
+		return err
+	}
+	if len(pl.variants) > 0 {
+		variant := selectHLSVariant(pl.variants, f.maxBandwidth)
+		mediaURL = variant.url
+		log.Printf("[HLS] Input '%s': variant %d bps of %d", f.inputName, variant.bandwidth, len(pl.variants))
+		if pl, err = f.playlist(ctx, mediaURL); err != nil {
+			return err
+		}
+	}
+
+	nextSeq := int64(-1)
+	lastMap := ""
+	lost := false
+	for {
+		if len(pl.variants) > 0 {
+			return errors.New("variant playlist is a master playlist")
+		}
+		if nextSeq < 0 && len(pl.segments) > 0 {
+			start := 0
+			if !pl.endList && len(pl.segments) > hlsLiveEdgeSegments {
+				start = len(pl.segments) - hlsLiveEdgeSegments
+			}
+			nextSeq = pl.segments[start].seq
+		}
+		if len(pl.segments) > 0 && nextSeq < pl.segments[0].seq {
+			log.Printf("[HLS] Input '%s': %d segment(s) left the playlist before download", f.inputName, pl.segments[0].seq-nextSeq)
+			nextSeq = pl.segments[0].seq
+			lost = true
+		}
+
+		added := 0
+		for _, ref := range pl.segments {
+			if ref.seq < nextSeq {
+				continue
+			}
+			segment, err := f.download(ctx, ref)
+			if err != nil {
+				if ctx.Err() != nil {
+					return ctx.Err()
+				}
+				log.Printf("[HLS] Input '%s': segment %d skipped: %v", f.inputName, ref.seq, err)
+				nextSeq = ref.seq + 1
+				lost = true
+				continue
+			}
+			segment.discontinuity = ref.discontinuity || lost || ref.mapURL != lastMap
+			select {
+			case f.out <- segment:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+			nextSeq = ref.seq + 1
+			lastMap = ref.mapURL
+			lost = false
+			added++
+		}
+		if pl.endList {
+			return errors.New("playlist ended")
+		}
+
+		// Без новых сегментов перечитываем плейлист через половину target duration
+		wait := pl.targetDuration
+		if wait <= 0 {
+			wait = 2 * time.Second
+		}
+		if added == 0 {
+			wait /= 2
+		}
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		if pl, err = f.playlist(ctx, mediaURL); err != nil {
+			return err
+		}
+	}
+}
+
+// download загружает сегмент, его init (кэшируется) и расшифровывает AES-128
+func (f *hlsFetcher) download(ctx context.Context, ref hlsSegmentRef) (*hlsSegment, error) {
+	segment := &hlsSegment{}
+	if ref.mapURL != "" {
+		init, ok := f.inits[ref.mapURL]
+		if !ok {
+			var err error
+			if init, err = f.get(ctx, ref.mapURL); err != nil {
+				return nil, err
+			}
+			f.inits = map[string][]byte{ref.mapURL: init}
+		}
+		segment.init = init
+	}
+
+	data, err := f.get(ctx, ref.url)
+	if err != nil {
+		return nil, err
+	}
+	if ref.key != nil {
+		key, ok := f.keys[ref.key.url]
+		if !ok {
+			if key, err = f.get(ctx, ref.key.url); err != nil {
+				return nil, err
+			}
+			if len(key) != aes.BlockSize {
+				return nil, errors.New("invalid AES-128 key length")
+			}
+			f.keys = map[string][]byte{ref.key.url: key}
+		}
+		if data, err = decryptHLSSegment(data, key, ref.key.iv, ref.seq); err != nil {
+			return nil, err
+		}
+	}
+	segment.data = data
+	return segment, nil
+}
+
+// decryptHLSSegment расшифровывает AES-128-CBC с PKCS7; без IV в теге IV - номер сегмента
+func decryptHLSSegment(data, key, iv []byte, seq int64) ([]byte, error) {
+	if len(data) == 0 || len(data)%aes.BlockSize != 0 {
+		return nil, errors.New("encrypted segment is not block aligned")
+	}
+	if iv == nil {
+		iv = make([]byte, aes.BlockSize)
+		binary.BigEndian.PutUint64(iv[8:], uint64(seq))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]byte, len(data))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(out, data)
+	pad := int(out[len(out)-1])
+	if pad == 0 || pad > aes.BlockSize {
+		return nil, errors.New("invalid segment padding")
+	}
+	return out[:len(out)-pad], nil
+}
+
+// hlsRun - демуксер непрерывного участка потока между разрывами
+type hlsRun interface {
+	Streams() ([]av.CodecData, error)
+	ReadPacket() (av.Packet, error)
+	nextTime() time.Duration
+}
+
+// hlsDemuxer отдаёт HLS источник как av.Demuxer для servePublish
+type hlsDemuxer struct {
+	sm        *StreamManager
+	inputName string
+	ctx       context.Context
+	cancel    context.CancelFunc
+	segments  chan *hlsSegment
+	fetchErr  error
+	wg        sync.WaitGroup
+
+	streams []av.CodecData
+	run     hlsRun
+	runs    int
+	pending *hlsSegment // первый сегмент следующего участка
+
+	// Пакеты отдаются в темпе их меток от первого пакета, а не со скоростью загрузки
+	start    time.Time
+	baseTime time.Duration
+}
+
+func newHLSDemuxer(sm *StreamManager, pullURL string, inputCfg *InputCfg) *hlsDemuxer {
+	ctx, cancel := context.WithCancel(context.Background())
+	segments := make(chan *hlsSegment, hlsSegmentQueue)
+	d := &hlsDemuxer{
+		sm:        sm,
+		inputName: inputCfg.Name,
+		ctx:       ctx,
+		cancel:    cancel,
+		segments:  segments,
+	}
+	fetcher := &hlsFetcher{
+		client:       &http.Client{Timeout: hlsRequestTimeout},
+		inputName:    inputCfg.Name,
+		url:          pullURL,
+		maxBandwidth: inputCfg.HLSMaxBandwidth,
+		out:          segments,
+	}
+	d.wg.Add(1)
+	go func() {
+		defer d.wg.Done()
+		d.fetchErr = fetcher.run(ctx)
+		close(segments)
+	}()
+	return d
+}
+
+// next возвращает следующий сегмент; после закрытия очереди - ошибку загрузчика
+func (d *hlsDemuxer) next() (*hlsSegment, error) {
+	if seg := d.pending; seg != nil {
+		d.pending = nil
+		return seg, nil
+	}
+	seg, ok := <-d.segments
+	if !ok {
+		return nil, d.fetchErr
+	}
+	return seg, nil
+}
+
+// startRun начинает новый участок с очередного сегмента
+func (d *hlsDemuxer) startRun() error {
+	seg, err := d.next()
+	if err != nil {
+		return err
+	}
+	d.pending = seg
+
+	var resume time.Duration
+	if d.run != nil {
+		resume = d.run.nextTime()
+	}
+	if seg.init != nil {
+		run, err := newHLSFMP4Run(d, seg.init, resume)
+		if err != nil {
+			return err
+		}
+		d.run = run
+	} else {
+		run := newTSDemuxer(&hlsTSReader{demuxer: d}, d.sm, d.inputName)
+		if d.streams != nil {
+			run.resumeAt(d.streams, resume)
+		}
+		d.run = run
+	}
+	if d.runs > 0 {
+		log.Printf("[HLS] Input '%s': discontinuity, timestamps continue from %v", d.inputName, resume)
+	}
+	d.runs++
+	return nil
+}
+
+func (d *hlsDemuxer) Streams() ([]av.CodecData, error) {
+	if d.streams != nil {
+		return d.streams, nil
+	}
+	if err := d.startRun(); err != nil {
+		return nil, err
+	}
+	streams, err := d.run.Streams()
+	if err != nil {
+		return nil, err
+	}
+	d.streams = streams
+	return streams, nil
+}
+
+func (d *hlsDemuxer) ReadPacket() (av.Packet, error) {
+	if _, err := d.Streams(); err != nil {
+		return av.Packet{}, err
+	}
+	for {
+		pkt, err := d.run.ReadPacket()
+		if err == nil {
+			return pkt, d.pace(pkt.Time)
+		}
+		// Участок закончился на разрыве - продолжаем со следующего
+		if d.pending == nil {
+			return av.Packet{}, err
+		}
+		if err := d.startRun(); err != nil {
+			return av.Packet{}, err
+		}
+	}
+}
+
+// pace ждёт момента отдачи пакета. Без этого очередь сегментов от живого края
+// (или весь VOD плейлист) ушла бы в выходы залпом со скоростью загрузки.
+func (d *hlsDemuxer) pace(t time.Duration) error {
+	if d.start.IsZero() {
+		d.start = time.Now()
+		d.baseTime = t
+		return nil
+	}
+	wait := time.Until(d.start.Add(t - d.baseTime))
+	if wait <= 0 {
+		return nil
+	}
+	select {
+	case <-time.After(wait):
+		return nil
+	case <-d.ctx.Done():
+		return errors.New("input closed")
+	}
+}
+
+func (d *hlsDemuxer) Close() error {
+	d.cancel()
+	// Освобождаем загрузчик, если он ждёт места в очереди
+	go func() {
+		for range d.segments {
+		}
+	}()
+	d.wg.Wait()
+	return nil
+}
+
+// hlsTSReader склеивает MPEG-TS сегменты участка; на разрыве отдаёт io.EOF
+type hlsTSReader struct {
+	demuxer *hlsDemuxer
+	buf     []byte
+	started bool
+}
+
+func (r *hlsTSReader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		seg, err := r.demuxer.next()
+		if err != nil {
+			return 0, err
+		}
+		if r.started && (seg.discontinuity || seg.init != nil) {
+			r.demuxer.pending = seg
+			return 0, io.EOF
+		}
+		r.started = true
+		r.buf = seg.data
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+// hlsFMP4Run - участок из fMP4 сегментов с одним init
+type hlsFMP4Run struct {
+	*fmp4Packetizer
+	demuxer *hlsDemuxer
+	started bool
+	queue   []av.Packet
+}
+
+func newHLSFMP4Run(d *hlsDemuxer, init []byte, resume time.Duration) (*hlsFMP4Run, error) {
+	tracks, err := parseFMP4Init(init)
+	if err != nil {
+		return nil, fmt.Errorf("init segment: %w", err)
+	}
+	// Раскладка потоков - как у первого участка
+	return &hlsFMP4Run{
+		fmp4Packetizer: newFMP4Packetizer(tracks, d.streams, resume),
+		demuxer:        d,
+	}, nil
+}
+
+func (r *hlsFMP4Run) Streams() ([]av.CodecData, error) {
+	return r.streams, nil
+}
+
+func (r *hlsFMP4Run) ReadPacket() (av.Packet, error) {
+	for len(r.queue) == 0 {
+		seg, err := r.demuxer.next()
+		if err != nil {
+			return av.Packet{}, err
+		}
+		if r.started && seg.discontinuity {
+			r.demuxer.pending = seg
+			return av.Packet{}, io.EOF
+		}
+		r.started = true
+		samples, err := parseFMP4Segment(seg.data, r.tracks)
+		if err != nil {
+			log.Printf("[HLS] Input '%s': bad fMP4 segment: %v", r.demuxer.inputName, err)
+			continue
+		}
+		r.queue = append(r.queue, r.packets(samples)...)
+	}
+	pkt := r.queue[0]
+	r.queue = r.queue[1:]
+	return pkt, nil
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseHLSPlaylist(t *testing.T) {
+	base, _ := url.Parse("http://example.com/live/index.m3u8")
+
+	t.Run("master", func(t *testing.T) {
+		pl, err := parseHLSPlaylist([]byte(`#EXTM3U
+#EXT-X-STREAM-INF:BANDWIDTH=800000,RESOLUTION=640x360,CODECS="avc1.4d401e,mp4a.40.2"
+low/index.m3u8
+#EXT-X-STREAM-INF:BANDWIDTH=2500000,RESOLUTION=1280x720
+http://cdn.example.com/hd/index.m3u8
+`), base)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := []hlsVariant{
+			{url: "http://example.com/live/low/index.m3u8", bandwidth: 800000},
+			{url: "http://cdn.example.com/hd/index.m3u8", bandwidth: 2500000},
+		}
+		if !reflect.DeepEqual(pl.variants, want) {
+			t.Errorf("variants = %+v", pl.variants)
+		}
+	})
+
+	t.Run("media", func(t *testing.T) {
+		pl, err := parseHLSPlaylist([]byte(`#EXTM3U
+#EXT-X-VERSION:7
+#EXT-X-TARGETDURATION:6
+#EXT-X-MEDIA-SEQUENCE:41
+#EXT-X-MAP:URI="init.mp4"
+#EXTINF:6.0,
+seg41.m4s
+#EXT-X-KEY:METHOD=AES-128,URI="/keys/k1",IV=0x000102030405060708090a0b0c0d0e0f
+#EXTINF:6.0,
+seg42.m4s
+#EXT-X-DISCONTINUITY
+#EXT-X-KEY:METHOD=NONE
+#EXTINF:6.0,
+seg43.m4s
+#EXT-X-ENDLIST
+`), base)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if pl.targetDuration != 6*time.Second || !pl.endList || len(pl.variants) != 0 {
+			t.Errorf("targetDuration=%v endList=%v variants=%d", pl.targetDuration, pl.endList, len(pl.variants))
+		}
+		key := &hlsKey{url: "http://example.com/keys/k1", iv: []byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15}}
+		init := "http://example.com/live/init.mp4"
+		want := []hlsSegmentRef{
+			{url: "http://example.com/live/seg41.m4s", seq: 41, mapURL: init},
+			{url: "http://example.com/live/seg42.m4s", seq: 42, mapURL: init, key: key},
+			{url: "http://example.com/live/seg43.m4s", seq: 43, mapURL: init, discontinuity: true},
+		}
+		if !reflect.DeepEqual(pl.segments, want) {
+			t.Errorf("segments = %+v", pl.segments)
+		}
+	})
+
+	errorCases := map[string]string{
+		"пустой":            "",
+		"не m3u8":           "#EXTINF:6,\nseg.ts\n",
+		"byte-range":        "#EXTM3U\n#EXT-X-BYTERANGE:1000@0\nseg.ts\n",
+		"byte-range в MAP":  "#EXTM3U\n#EXT-X-MAP:URI=\"init.mp4\",BYTERANGE=\"100@0\"\n",
+		"SAMPLE-AES":        "#EXTM3U\n#EXT-X-KEY:METHOD=SAMPLE-AES,URI=\"k\"\n",
+		"IV неверной длины": "#EXTM3U\n#EXT-X-KEY:METHOD=AES-128,URI=\"k\",IV=0x0102\n",
+	}
+	for name, data := range errorCases {
+		t.Run(name, func(t *testing.T) {
+			if _, err := parseHLSPlaylist([]byte(data), base); err == nil {
+				t.Error("expected error")
+			}
+		})
+	}
+}
+
+func TestParseHLSAttributes(t *testing.T) {
+	got := parseHLSAttributes(`BANDWIDTH=1280000,CODECS="avc1.4d401f,mp4a.40.2",RESOLUTION=1280x720,URI="a,b"`)
+	want := map[string]string{"BANDWIDTH": "1280000", "CODECS": "avc1.4d401f,mp4a.40.2", "RESOLUTION": "1280x720", "URI": "a,b"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v", got)
+	}
+}
+
+func TestSelectHLSVariant(t *testing.T) {
+	variants := []hlsVariant{{url: "mid", bandwidth: 1500000}, {url: "low", bandwidth: 500000}, {url: "high", bandwidth: 4000000}}
+	tests := []struct {
+		max  int
+		want string
+	}{
+		{0, "high"},
+		{5000000, "high"},
+		{4000000, "high"},
+		{2000000, "mid"},
+		{500000, "low"},
+		{100000, "low"}, // ни один не подходит - самый лёгкий
+	}
+	for _, tt := range tests {
+		if got := selectHLSVariant(variants, tt.max); got.url != tt.want {
+			t.Errorf("max %d: got %s, want %s", tt.max, got.url, tt.want)
+		}
+	}
+	if variants[0].url != "mid" {
+		t.Error("input slice was reordered")
+	}
+}
+
+// encryptHLSTestSegment шифрует данные AES-128-CBC с PKCS7, как это делает упаковщик HLS
+func encryptHLSTestSegment(t *testing.T, data, key, iv []byte) []byte {
+	t.Helper()
+	pad := aes.BlockSize - len(data)%aes.BlockSize
+	plain := append(append([]byte(nil), data...), bytes.Repeat([]byte{byte(pad)}, pad)...)
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := make([]byte, len(plain))
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(out, plain)
+	return out
+}
+
+func TestDecryptHLSSegment(t *testing.T) {
+	key := []byte("0123456789abcdef")
+	explicitIV := []byte("fedcba9876543210")
+	seqIV := make([]byte, aes.BlockSize)
+	binary.BigEndian.PutUint64(seqIV[8:], 1234)
+
+	for _, size := range []int{1, 15, 16, 17, 188 * 7} {
+		data := bytes.Repeat([]byte{0x47}, size)
+
+		got, err := decryptHLSSegment(encryptHLSTestSegment(t, data, key, explicitIV), key, explicitIV, 1234)
+		if err != nil || !bytes.Equal(got, data) {
+			t.Errorf("size %d, explicit IV: err=%v, equal=%v", size, err, bytes.Equal(got, data))
+		}
+		// Без IV в теге IV - номер сегмента
+		got, err = decryptHLSSegment(encryptHLSTestSegment(t, data, key, seqIV), key, nil, 1234)
+		if err != nil || !bytes.Equal(got, data) {
+			t.Errorf("size %d, sequence IV: err=%v, equal=%v", size, err, bytes.Equal(got, data))
+		}
+	}
+
+	badPadding := make([]byte, aes.BlockSize)
+	block, _ := aes.NewCipher(key)
+	cipher.NewCBCEncrypter(block, explicitIV).CryptBlocks(badPadding, bytes.Repeat([]byte{0x20}, aes.BlockSize))
+	errorCases := map[string][]byte{
+		"пустой":              nil,
+		"не кратен блоку":     make([]byte, 20),
+		"неверное дополнение": badPadding,
+	}
+	for name, data := range errorCases {
+		if _, err := decryptHLSSegment(data, key, explicitIV, 0); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+	if _, err := decryptHLSSegment(make([]byte, 16), []byte("short"), explicitIV, 0); err == nil {
+		t.Error("short key: expected error")
+	}
+}
+
+// Загрузчик HLS против httptest сервера: master -> вариант -> сегменты с ключом
+func TestHLSFetcherEndToEnd(t *testing.T) {
+	key := []byte("0123456789abcdef")
+	iv := make([]byte, aes.BlockSize)
+	binary.BigEndian.PutUint64(iv[8:], 11)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/live/master.m3u8", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("#EXTM3U\n" +
+			"#EXT-X-STREAM-INF:BANDWIDTH=3000000\nhigh.m3u8\n" +
+			"#EXT-X-STREAM-INF:BANDWIDTH=900000\nlow.m3u8\n"))
+	})
+	mux.HandleFunc("/live/low.m3u8", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("#EXTM3U\n#EXT-X-TARGETDURATION:2\n#EXT-X-MEDIA-SEQUENCE:10\n" +
+			"#EXTINF:2,\nseg10.ts\n" +
+			"#EXT-X-KEY:METHOD=AES-128,URI=\"/keys/main\"\n#EXTINF:2,\nseg11.ts\n" +
+			"#EXT-X-KEY:METHOD=NONE\n#EXTINF:2,\nmissing.ts\n" +
+			"#EXTINF:2,\nseg13.ts\n#EXT-X-ENDLIST\n"))
+	})
+	mux.HandleFunc("/live/high.m3u8", func(w http.ResponseWriter, r *http.Request) {
+		t.Error("variant above max bandwidth was requested")
+	})
+	mux.HandleFunc("/keys/main", func(w http.ResponseWriter, r *http.Request) {
+		w.Write(key)
+	})
+	mux.HandleFunc("/live/seg10.ts", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("segment-10"))
+	})
+	mux.HandleFunc("/live/seg11.ts", func(w http.ResponseWriter, r *http.Request) {
+		w.Write(encryptHLSTestSegment(t, []byte("segment-11"), key, iv))
+	})
+	mux.HandleFunc("/live/seg13.ts", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("segment-13"))
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	out := make(chan *hlsSegment, 10)
+	fetcher := &hlsFetcher{
+		client:       server.Client(),
+		inputName:    "test",
+		url:          server.URL + "/live/master.m3u8",
+		maxBandwidth: 1000000,
+		out:          out,
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	err := fetcher.run(ctx)
+	if err == nil || err.Error() != "playlist ended" {
+		t.Fatalf("run() = %v, want \"playlist ended\"", err)
+	}
+	close(out)
+
+	type result struct {
+		data          string
+		discontinuity bool
+	}
+	var got []result
+	for seg := range out {
+		got = append(got, result{string(seg.data), seg.discontinuity})
+	}
+	// Недоступный сегмент пропускается, следующий помечается разрывом
+	want := []result{{"segment-10", false}, {"segment-11", false}, {"segment-13", true}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("segments = %+v, want %+v", got, want)
+	}
+}
+
+func TestHLSDemuxerPace(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	d := &hlsDemuxer{ctx: ctx, cancel: cancel}
+
+	begin := time.Now()
+	if err := d.pace(10 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+	// Пакет раньше первого (аудио перед ключевым кадром) не ждёт
+	if err := d.pace(9 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.pace(10*time.Second + 100*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(begin); elapsed < 90*time.Millisecond || elapsed > time.Second {
+		t.Errorf("paced 100ms of media in %v", elapsed)
+	}
+
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		cancel()
+	}()
+	if err := d.pace(time.Hour); err == nil {
+		t.Error("pace returned without error after Close")
+	}
+}
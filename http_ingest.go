@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/datarhei/joy4/format/flv"
+)
+
+// Приём MPEG-TS/FLV длинным HTTP POST (chunked), например
+// ffmpeg -f mpegts -method POST http://server:8080/ingest/live/stream.
+// Для сетей, где наружу открыт только HTTP(S): TLS даёт обратный прокси перед API портом.
+
+// Без данных дольше этого времени загрузка считается оборванной
+const httpIngestReadTimeout = 30 * time.Second
+
+// publishTokenOK проверяет токен публикации входа (publish_token); без токена вход открыт
+func publishTokenOK(inputCfg *InputCfg, token string) bool {
+	if inputCfg.PublishToken == "" {
+		return true
+	}
+	return subtle.ConstantTimeCompare([]byte(inputCfg.PublishToken), []byte(token)) == 1
+}
+
+// httpPublishToken достаёт токен из Authorization: Bearer или параметра ?token=
+func httpPublishToken(r *http.Request) string {
+	if auth := r.Header.Get("Authorization"); len(auth) > 7 && strings.EqualFold(auth[:7], "Bearer ") {
+		return strings.TrimSpace(auth[7:])
+	}
+	return r.URL.Query().Get("token")
+}
+
+// httpIngestConn - тело запроса как источник для serveTS;
+// таймаут чтения ставится через ResponseController
+type httpIngestConn struct {
+	r  io.Reader
+	rc *http.ResponseController
+}
+
+func (c *httpIngestConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+func (c *httpIngestConn) SetReadDeadline(t time.Time) error {
+	return c.rc.SetReadDeadline(t)
+}
+
+// deadlineReader продлевает таймаут перед каждым чтением (для FLV, где serveTS не участвует)
+type deadlineReader struct {
+	conn    tsConn
+	timeout time.Duration
+}
+
+func (d *deadlineReader) Read(p []byte) (int, error) {
+	d.conn.SetReadDeadline(time.Now().Add(d.timeout))
+	return d.conn.Read(p)
+}
+
+// handleIngest принимает POST /ingest/{url_path}; формат определяется по первым байтам
+func (api *APIServer) handleIngest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost && r.Method != http.MethodPut {
+		w.Header().Set("Allow", "POST, PUT")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	path := strings.TrimPrefix(r.URL.Path, "/ingest")
+	inputCfg := api.SM.GetInputByPath(path)
+	if inputCfg == nil {
+		http.Error(w, "Input not found in config", http.StatusNotFound)
+		return
+	}
+	if inputCfg.Pull != "" {
+		http.Error(w, "Input pulls from a remote source", http.StatusConflict)
+		return
+	}
+	if !publishTokenOK(inputCfg, httpPublishToken(r)) {
+		log.Printf("[INGEST] Rejecting %s: invalid publish token for input %s", r.RemoteAddr, inputCfg.Name)
+		w.Header().Set("WWW-Authenticate", `Bearer realm="ingest"`)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if api.SRT == nil {
+		http.Error(w, "Ingest is not available", http.StatusServiceUnavailable)
+		return
+	}
+	if !api.SM.TryAcquirePublish(inputCfg.Name) {
+		http.Error(w, "Stream is already being published", http.StatusConflict)
+		return
+	}
+	defer api.SM.SetStatusActive(inputCfg.Name, false)
+
+	conn := &httpIngestConn{rc: http.NewResponseController(w)}
+	conn.SetReadDeadline(time.Now().Add(httpIngestReadTimeout))
+	br := bufio.NewReaderSize(r.Body, 64*1024)
+	conn.r = br
+	head, err := br.Peek(3)
+	if err != nil {
+		http.Error(w, "Empty body", http.StatusBadRequest)
+		return
+	}
+
+	source := fmt.Sprintf("http://%s (%s)", r.RemoteAddr, inputCfg.Name)
+	switch {
+	case head[0] == 0x47:
+		log.Printf("[INGEST] MPEG-TS upload from %s to input %s", r.RemoteAddr, inputCfg.Name)
+		err = api.SRT.serveTS(conn, inputCfg, source, httpIngestReadTimeout)
+	case string(head) == "FLV":
+		log.Printf("[INGEST] FLV upload from %s to input %s", r.RemoteAddr, inputCfg.Name)
+		demuxer := flv.NewDemuxer(&deadlineReader{conn: conn, timeout: httpIngestReadTimeout})
+		servePublish(api.SM, inputCfg, demuxer, source, nil)
+	default:
+		http.Error(w, "Body must be MPEG-TS or FLV", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	if err != nil && err != io.EOF {
+		log.Printf("[INGEST] Upload to input %s ended: %v", inputCfg.Name, err)
+	} else {
+		log.Printf("[INGEST] Upload to input %s finished", inputCfg.Name)
+	}
+	conn.SetReadDeadline(time.Time{})
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -10,8 +10,6 @@ import (
 	"strconv"
 	"syscall"
 	"time"
-
-	"github.com/datarhei/joy4/format/rtmp"
 )
 
 func main() {
@@ -39,22 +37,19 @@ func main() {
 
 	sm := NewStreamManager(cfg.Inputs, cfg)
 
-	// RTMP сервер
-	rtmpServer := &rtmp.Server{}
-	rtmpServer.HandlePublish = handlePublish(sm, cfg)
-	rtmpServer.HandlePlay = func(conn *rtmp.Conn) {
-		log.Printf("Play started: %s", conn.URL)
-		conn.Close()
-	}
-
 	// SRT сервер
 	srtServer := NewSRTServer(cfg.Server.SRTPort, cfg, sm)
 
 	// WHIP сервер
 	whipServer := NewWHIPServer(cfg.Server.WHIPPort, sm)
 
+	// Pull-входы (сервер сам забирает поток у источника)
+	pullManager := NewPullManager(sm, srtServer)
+
 	// HTTP API сервер
 	apiServer := NewAPIServer(sm, cfg.Server.APIAuthUser, cfg.Server.APIAuthPassword)
+	apiServer.SRT = srtServer
+	apiServer.WHIP = whipServer
 	httpServer := &http.Server{
 		Addr:    ":" + strconv.Itoa(cfg.Server.Port),
 		Handler: apiServer.routes(),
@@ -117,21 +112,8 @@ func main() {
 		}
 	}()
 
-	// Запуск RTMP сервера
-	go func() {
-		defer func() {
-			if r := recover(); r != nil {
-				log.Printf("[PANIC] RTMP server panic: %v", r)
-			}
-			log.Printf("[DEBUG] RTMP server goroutine finished")
-		}()
-
-		addr := ":" + strconv.Itoa(cfg.Server.RTMPPort)
-		log.Printf("[RTMP] server started on %s", addr)
-		if err := rtmpServer.ListenAndServe(); err != nil && err.Error() != "use of closed network connection" {
-			log.Fatalf("RTMP server error: %v", err)
-		}
-	}()
+	// Запуск RTMP/RTMPS слушателей
+	startRTMPListeners(sm, cfg)
 
 	// Запуск SRT сервера
 	go func() {
@@ -162,6 +144,9 @@ func main() {
 		}
 	}()
 
+	// Запуск pull-входов
+	pullManager.Start()
+
 	// Запуск HTTP API сервера
 	go func() {
 		defer func() {
@@ -194,6 +179,11 @@ func main() {
 		log.Printf("HTTP server shutdown error: %v", err)
 	}
 
+	// Останавливаем pull-входы до серверов, через которые они принимают поток
+	if err := pullManager.Stop(); err != nil {
+		log.Printf("Pull inputs shutdown error: %v", err)
+	}
+
 	// Завершаем SRT сервер
 	if err := srtServer.Stop(); err != nil {
 		log.Printf("SRT server shutdown error: %v", err)
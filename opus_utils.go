@@ -0,0 +1,151 @@
+package main
+
+import (
+	"errors"
+	"time"
+
+	"github.com/datarhei/joy4/av"
+)
+
+// Opus из WHIP без перекодирования (whip_settings.audio: opus).
+// В joy4 нет кодека Opus, поэтому тип заводится здесь. Муксеры joy4 (FLV, MPEG-TS)
+// его не принимают: на SRT выходах Opus пишется в TS отдельно (opusTSPackets),
+// остальные выходы получают только видео.
+
+const (
+	opusSampleRate = 48000
+	// PID Opus на SRT выходах: муксер joy4 раздаёт PID'ы потокам с 0x100
+	tsOpusPID = 0x1F0
+)
+
+var opusCodecType = av.MakeAudioCodecType(0x4F505553) // "OPUS"
+
+type opusCodecData struct {
+	channels int
+}
+
+func (c opusCodecData) Type() av.CodecType            { return opusCodecType }
+func (c opusCodecData) SampleFormat() av.SampleFormat { return av.FLTP }
+func (c opusCodecData) SampleRate() int               { return opusSampleRate }
+
+func (c opusCodecData) ChannelLayout() av.ChannelLayout {
+	if c.channels == 1 {
+		return av.CH_MONO
+	}
+	return av.CH_STEREO
+}
+
+func (c opusCodecData) PacketDuration(data []byte) (time.Duration, error) {
+	return opusPacketDuration(data)
+}
+
+// Длительность кадра по номеру конфигурации TOC (RFC 6716, 3.1)
+var (
+	opusSILKFrames   = []time.Duration{10 * time.Millisecond, 20 * time.Millisecond, 40 * time.Millisecond, 60 * time.Millisecond}
+	opusHybridFrames = []time.Duration{10 * time.Millisecond, 20 * time.Millisecond}
+	opusCELTFrames   = []time.Duration{2500 * time.Microsecond, 5 * time.Millisecond, 10 * time.Millisecond, 20 * time.Millisecond}
+)
+
+// opusPacketDuration считает длительность пакета Opus по TOC байту
+func opusPacketDuration(data []byte) (time.Duration, error) {
+	if len(data) == 0 {
+		return 0, errors.New("empty opus packet")
+	}
+	config := data[0] >> 3
+	var frame time.Duration
+	switch {
+	case config < 12:
+		frame = opusSILKFrames[config&3]
+	case config < 16:
+		frame = opusHybridFrames[config&1]
+	default:
+		frame = opusCELTFrames[config&3]
+	}
+
+	frames := 1
+	switch data[0] & 3 {
+	case 1, 2:
+		frames = 2
+	case 3:
+		if len(data) < 2 {
+			return 0, errors.New("opus packet without frame count")
+		}
+		frames = int(data[1] & 0x3F)
+	}
+	return time.Duration(frames) * frame, nil
+}
+
+// withoutOpus убирает Opus из списка потоков для муксеров joy4.
+// Аудио WHIP всегда идёт после видео, поэтому индексы остальных потоков не меняются,
+// а пакеты с индексом за пределами списка выходы просто пропускают.
+func withoutOpus(streams []av.CodecData) []av.CodecData {
+	res := make([]av.CodecData, 0, len(streams))
+	for _, s := range streams {
+		if s.Type() != opusCodecType {
+			res = append(res, s)
+		}
+	}
+	return res
+}
+
+// opusStreamIndex возвращает индекс потока Opus или -1
+func opusStreamIndex(streams []av.CodecData) int {
+	for i, s := range streams {
+		if s.Type() == opusCodecType {
+			return i
+		}
+	}
+	return -1
+}
+
+// opusPMTEntry - описание потока Opus для PMT: private PES с registration
+// descriptor "Opus" и extension descriptor с числом каналов
+func opusPMTEntry(pid uint16, channels int) []byte {
+	if channels < 1 || channels > 2 {
+		channels = 2
+	}
+	return []byte{
+		0x06, 0xE0 | byte(pid>>8), byte(pid), 0xF0, 10,
+		0x05, 4, 'O', 'p', 'u', 's',
+		0x7F, 2, 0x80, byte(channels),
+	}
+}
+
+// opusTSPackets упаковывает один пакет Opus в PES (private_stream_1) с PTS
+// и режет его на TS пакеты. Continuity counter проставляет tsContinuityWriter.
+func opusTSPackets(pid uint16, data []byte, pts int64) []byte {
+	// Заголовок управления Opus: префикс 0x3ff и размер кадра кусками по 255
+	au := []byte{0x7F, 0xE0}
+	for n := len(data); ; n -= 255 {
+		if n < 255 {
+			au = append(au, byte(n))
+			break
+		}
+		au = append(au, 0xFF)
+	}
+
+	pts &= maxPTS
+	pesLen := 3 + 5 + len(au) + len(data)
+	pes := make([]byte, 0, 6+pesLen)
+	pes = append(pes, 0x00, 0x00, 0x01, 0xBD, byte(pesLen>>8), byte(pesLen), 0x80, 0x80, 5,
+		0x21|byte(pts>>29)&0x0E, byte(pts>>22), byte(pts>>14)|0x01, byte(pts>>7), byte(pts<<1)|0x01)
+	pes = append(pes, au...)
+	pes = append(pes, data...)
+
+	out := make([]byte, 0, (len(pes)/(tsPacketSize-4)+1)*tsPacketSize)
+	first := true
+	for len(pes) > 0 {
+		header := []byte{0x47, byte(pid>>8) & 0x1F, byte(pid), 0x10}
+		if first {
+			header[1] |= 0x40
+			first = false
+		}
+		n := tsPacketSize - 4
+		if n > len(pes) {
+			n = len(pes)
+		}
+		out = append(out, padTSPacket(append(header, pes[:n]...))...)
+		pes = pes[n:]
+	}
+	return out
+}
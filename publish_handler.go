@@ -3,6 +3,7 @@ package main
 import (
 	"bytes"
 	"context"
+	"fmt"
 	"io"
 	"log"
 	"os"
@@ -13,6 +14,7 @@ import (
 
 	srt "github.com/datarhei/gosrt"
 	"github.com/datarhei/joy4/av"
+	"github.com/datarhei/joy4/codec/h264parser"
 	"github.com/datarhei/joy4/format/flv"
 	"github.com/datarhei/joy4/format/rtmp"
 	"github.com/datarhei/joy4/format/ts"
@@ -70,7 +72,9 @@ func (om *OutputManager) AllOutputs() map[string]*outputWorker {
 	return res
 }
 
-func handlePublish(sm *StreamManager, cfg *Config) func(conn *rtmp.Conn) {
+// handlePublish обслуживает RTMP публикации слушателя; defaultApp подставляется
+// в URL без app (rtmp://host/key)
+func handlePublish(sm *StreamManager, cfg *Config, defaultApp string) func(conn *rtmp.Conn) {
 	return func(srcConn *rtmp.Conn) {
 		// Добавляем обработку паники
 		defer func() {
@@ -82,9 +86,20 @@ func handlePublish(sm *StreamManager, cfg *Config) func(conn *rtmp.Conn) {
 
 		log.Printf("Publish started: %s", srcConn.URL)
 
-		inputCfg := sm.GetInputByPath(srcConn.URL.Path)
+		path := rtmpPublishPath(srcConn.URL, defaultApp)
+		inputCfg := sm.GetInputByPath(path)
 		if inputCfg == nil {
-			log.Printf("Unknown input URL path: %s. Rejecting publish.", srcConn.URL.Path)
+			log.Printf("Unknown input URL path: %s. Rejecting publish.", path)
+			srcConn.Close()
+			return
+		}
+		if inputCfg.Pull != "" {
+			log.Printf("Input %s pulls from %s. Rejecting publish.", inputCfg.Name, redactPullURL(inputCfg.Pull))
+			srcConn.Close()
+			return
+		}
+		if !publishTokenOK(inputCfg, srcConn.URL.Query().Get("token")) {
+			log.Printf("Invalid publish token for input %s. Rejecting publish.", inputCfg.Name)
 			srcConn.Close()
 			return
 		}
@@ -94,153 +109,197 @@ func handlePublish(sm *StreamManager, cfg *Config) func(conn *rtmp.Conn) {
 		log.Printf("[DEBUG] Starting publish handling for input: %s", inputCfg.Name)
 		log.Printf("[DEBUG] Output URLs: %v", activeOutputsList)
 
-		sm.SetStatusActive(inputCfg.Name, true)
+		if !sm.TryAcquirePublish(inputCfg.Name) {
+			log.Printf("Input %s is already being published. Rejecting publish.", inputCfg.Name)
+			srcConn.Close()
+			return
+		}
 		defer sm.SetStatusActive(inputCfg.Name, false)
 
-		streams, err := srcConn.Streams()
-		if err != nil {
-			log.Printf("Failed to get streams from source: %v", err)
-			return
+		var src av.Demuxer = srcConn
+		if tap, ok := srcConn.NetConn().(*rtmpTapConn); ok {
+			src = rtmpPublishSource{Conn: srcConn, tap: tap}
 		}
+		servePublish(sm, inputCfg, src, srcConn.URL.String(), nil)
+	}
+}
 
-		stopChan := make(chan struct{})
-		outputMgr := NewOutputManager()
-		bufSize := 5000 // Увеличили с 3000 до 5000 для лучшей устойчивости
+// servePublish раздаёт пакеты источника по выходам входа inputCfg.
+// Общий конвейер для всех способов приёма (RTMP, SRT): поток демуксится один раз,
+// смена параметров кодека и выходы обрабатываются одинаково.
+// rawOutput отмечает выходы, которые источник обслуживает сам (сырой MPEG-TS), их здесь пропускаем.
+func servePublish(sm *StreamManager, inputCfg *InputCfg, src av.Demuxer, source string, rawOutput func(url string) bool) {
+	streams, err := src.Streams()
+	if err != nil {
+		log.Printf("Failed to get streams from source: %v", err)
+		return
+	}
 
-		// Heartbeat для отслеживания состояния трансляции
-		heartbeatCtx, heartbeatCancel := context.WithCancel(context.Background())
-		defer heartbeatCancel()
+	// Актуальные CodecData публикации: при смене SPS/PPS посреди потока
+	// выходы переотправляют заголовки на ближайшем ключевом кадре
+	header := newStreamHeader(streams)
+	videoIdx := videoStreamIndex(streams)
+	var paramTracker *h264ParamTracker
+	if videoIdx >= 0 {
+		paramTracker = newH264ParamTracker(streams[videoIdx])
+	}
+	configSrc, _ := src.(videoConfigSource)
+	var videoPackets int64
 
-		go func() {
-			ticker := time.NewTicker(2 * time.Minute)
-			defer ticker.Stop()
+	stopChan := make(chan struct{})
+	outputMgr := NewOutputManager()
+	bufSize := 5000 // Увеличили с 3000 до 5000 для лучшей устойчивости
 
-			startTime := time.Now()
-			log.Printf("[HEARTBEAT] Publish started for '%s' at %v", inputCfg.Name, startTime)
+	// Heartbeat для отслеживания состояния трансляции
+	heartbeatCtx, heartbeatCancel := context.WithCancel(context.Background())
+	defer heartbeatCancel()
 
-			for {
-				select {
-				case <-heartbeatCtx.Done():
-					return
-				case <-ticker.C:
-					uptime := time.Since(startTime)
-					outputs := outputMgr.AllOutputs()
-					activeOutputs := 0
-					for range outputs {
-						activeOutputs++
-					}
-					log.Printf("[HEARTBEAT] Publish '%s' uptime: %v, Active outputs: %d/%d",
-						inputCfg.Name, uptime, activeOutputs, len(sm.GetInputOutputs(inputCfg.Name)))
-
-					// Проверяем состояние соединений
-					for url, w := range outputs {
-						bufferSize := len(w.ch)
-						// Логируем только если буфер заполнен больше чем на 50%
-						if bufferSize > bufSize/2 {
-							log.Printf("[WARNING] Output %s buffer filling up: %d/%d", url, bufferSize, bufSize)
-						}
+	go func() {
+		ticker := time.NewTicker(2 * time.Minute)
+		defer ticker.Stop()
+
+		startTime := time.Now()
+		log.Printf("[HEARTBEAT] Publish started for '%s' at %v", inputCfg.Name, startTime)
+
+		for {
+			select {
+			case <-heartbeatCtx.Done():
+				return
+			case <-ticker.C:
+				uptime := time.Since(startTime)
+				outputs := outputMgr.AllOutputs()
+				activeOutputs := 0
+				for range outputs {
+					activeOutputs++
+				}
+				log.Printf("[HEARTBEAT] Publish '%s' uptime: %v, Active outputs: %d/%d",
+					inputCfg.Name, uptime, activeOutputs, len(sm.GetInputOutputs(inputCfg.Name)))
+
+				// Проверяем состояние соединений
+				for url, w := range outputs {
+					bufferSize := len(w.ch)
+					// Логируем только если буфер заполнен больше чем на 50%
+					if bufferSize > bufSize/2 {
+						log.Printf("[WARNING] Output %s buffer filling up: %d/%d", url, bufferSize, bufSize)
 					}
 				}
 			}
-		}()
+		}
+	}()
+
+	// Функция для старта push-горутины для выхода
+	startPush := func(url string) func(<-chan av.Packet, <-chan struct{}) {
+		return func(ch <-chan av.Packet, stop <-chan struct{}) {
+			// Добавляем обработку паники для output горутин
+			defer func() {
+				if r := recover(); r != nil {
+					log.Printf("[PANIC] Output goroutine panic for %s: %v", url, r)
+				}
+				log.Printf("[DEBUG] Output goroutine finished for: %s", url)
+			}()
 
-		// Функция для старта push-горутины для выхода
-		startPush := func(url string) func(<-chan av.Packet, <-chan struct{}) {
-			return func(ch <-chan av.Packet, stop <-chan struct{}) {
-				// Добавляем обработку паники для output горутин
-				defer func() {
-					if r := recover(); r != nil {
-						log.Printf("[PANIC] Output goroutine panic for %s: %v", url, r)
-					}
-					log.Printf("[DEBUG] Output goroutine finished for: %s", url)
-				}()
-
-				var totalBytes int64
-				var lastBitrateUpdateTime time.Time
-				var packetCount int64
-				var lastLogTime time.Time
-
-				for {
-					select {
-					case <-stop:
-						log.Printf("Output stopped: %s", url)
-						return
-					default:
-					}
+			var totalBytes int64
+			var lastBitrateUpdateTime time.Time
+			var packetCount int64
+			var lastLogTime time.Time
 
-					// Убираем спам логи подключения
-					// log.Printf("[DEBUG] Attempting to connect to output URL: %s", url)
+			for {
+				select {
+				case <-stop:
+					log.Printf("Output stopped: %s", url)
+					return
+				default:
+				}
+
+				// Убираем спам логи подключения
+				// log.Printf("[DEBUG] Attempting to connect to output URL: %s", url)
 
-					if strings.HasPrefix(url, "file://") {
-						log.Printf("[DEBUG] Detected file output for URL: %s", url)
-						filename := strings.TrimPrefix(url, "file://")
-						isMp4 := strings.HasSuffix(strings.ToLower(filename), ".mp4")
+				if strings.HasPrefix(url, "exec://") {
+					runExecPacketOutput(sm, inputCfg.Name, url, header, ch, stop)
+					return
+				}
 
-						var ffmpegCmd *exec.Cmd
-						var writeCloser io.WriteCloser
-						var file *os.File
-						var muxer *flv.Muxer
+				if strings.HasPrefix(url, "file://") {
+					log.Printf("[DEBUG] Detected file output for URL: %s", url)
+					filename := strings.TrimPrefix(url, "file://")
+					isMp4 := strings.HasSuffix(strings.ToLower(filename), ".mp4")
+
+					var ffmpegCmd *exec.Cmd
+					var writeCloser io.WriteCloser
+					var file *os.File
+					var muxer *flv.Muxer
+
+					if isMp4 {
+						args := []string{
+							"-y",
+							"-f", "flv",
+							"-i", "pipe:0",
+							"-c", "copy",
+							"-movflags", "frag_keyframe+empty_moov",
+							filename,
+						}
+						ffmpegCmd = exec.Command(ffmpegBinary(), args...)
+						var err error
+						writeCloser, err = ffmpegCmd.StdinPipe()
+						if err != nil {
+							log.Printf("[ERROR] Failed to create ffmpeg stdin pipe for %s: %v", filename, err)
+							time.Sleep(5 * time.Second)
+							return
+						}
+						if err := ffmpegCmd.Start(); err != nil {
+							log.Printf("[ERROR] Failed to start ffmpeg for %s: %v", filename, err)
+							time.Sleep(5 * time.Second)
+							return
+						}
+						log.Printf("[DEBUG] Writing fragmented MP4 via ffmpeg to: %s", filename)
+						muxer = flv.NewMuxer(writeCloser)
+					} else {
+						log.Printf("[DEBUG] Creating file: %s", filename)
+						var err error
+						file, err = os.Create(filename)
+						if err != nil {
+							log.Printf("[ERROR] Failed to create file %s: %v", filename, err)
+							time.Sleep(5 * time.Second)
+							return
+						}
+						log.Printf("[DEBUG] Writing FLV directly to file: %s", filename)
+						muxer = flv.NewMuxer(file)
+					}
 
+					sm.SetOutputActive(inputCfg.Name, url, true)
+					fileStreams, _ := header.Get()
+					err = muxer.WriteHeader(fileStreams)
+					if err != nil {
+						log.Printf("[ERROR] Failed to write header: %v", err)
 						if isMp4 {
-							ffmpegPath := "ffmpeg"
-							if _, err := os.Stat("./bin/ffmpeg.exe"); err == nil {
-								ffmpegPath = "./bin/ffmpeg.exe"
-							}
-							args := []string{
-								"-y",
-								"-f", "flv",
-								"-i", "pipe:0",
-								"-c", "copy",
-								"-movflags", "frag_keyframe+empty_moov",
-								filename,
-							}
-							ffmpegCmd = exec.Command(ffmpegPath, args...)
-							var err error
-							writeCloser, err = ffmpegCmd.StdinPipe()
-							if err != nil {
-								log.Printf("[ERROR] Failed to create ffmpeg stdin pipe for %s: %v", filename, err)
-								time.Sleep(5 * time.Second)
-								return
-							}
-							if err := ffmpegCmd.Start(); err != nil {
-								log.Printf("[ERROR] Failed to start ffmpeg for %s: %v", filename, err)
-								time.Sleep(5 * time.Second)
-								return
-							}
-							log.Printf("[DEBUG] Writing fragmented MP4 via ffmpeg to: %s", filename)
-							muxer = flv.NewMuxer(writeCloser)
+							writeCloser.Close()
+							ffmpegCmd.Process.Kill()
 						} else {
-							log.Printf("[DEBUG] Creating file: %s", filename)
-							var err error
-							file, err = os.Create(filename)
-							if err != nil {
-								log.Printf("[ERROR] Failed to create file %s: %v", filename, err)
-								time.Sleep(5 * time.Second)
-								return
-							}
-							log.Printf("[DEBUG] Writing FLV directly to file: %s", filename)
-							muxer = flv.NewMuxer(file)
+							file.Close()
 						}
+						sm.SetOutputActive(inputCfg.Name, url, false)
+						time.Sleep(5 * time.Second)
+						return
+					}
 
-						sm.SetOutputActive(inputCfg.Name, url, true)
-						err = muxer.WriteHeader(streams)
-						if err != nil {
-							log.Printf("[ERROR] Failed to write header: %v", err)
+					fileDone := false
+					for !fileDone {
+						select {
+						case <-stop:
+							if err := muxer.WriteTrailer(); err != nil {
+								log.Printf("Failed to write trailer: %v", err)
+							}
 							if isMp4 {
 								writeCloser.Close()
-								ffmpegCmd.Process.Kill()
+								ffmpegCmd.Wait()
 							} else {
 								file.Close()
 							}
 							sm.SetOutputActive(inputCfg.Name, url, false)
-							time.Sleep(5 * time.Second)
-							return
-						}
-
-						fileDone := false
-						for !fileDone {
-							select {
-							case <-stop:
+							log.Printf("File output stopped: %s", filename)
+							fileDone = true
+						case pkt, ok := <-ch:
+							if !ok {
 								if err := muxer.WriteTrailer(); err != nil {
 									log.Printf("Failed to write trailer: %v", err)
 								}
@@ -251,122 +310,115 @@ func handlePublish(sm *StreamManager, cfg *Config) func(conn *rtmp.Conn) {
 									file.Close()
 								}
 								sm.SetOutputActive(inputCfg.Name, url, false)
-								log.Printf("File output stopped: %s", filename)
 								fileDone = true
-							case pkt, ok := <-ch:
-								if !ok {
-									if err := muxer.WriteTrailer(); err != nil {
-										log.Printf("Failed to write trailer: %v", err)
-									}
-									if isMp4 {
-										writeCloser.Close()
-										ffmpegCmd.Wait()
-									} else {
-										file.Close()
-									}
-									sm.SetOutputActive(inputCfg.Name, url, false)
-									fileDone = true
-									break
-								}
-								err = muxer.WritePacket(pkt)
-								if err != nil {
-									log.Printf("Write error to output: %v", err)
-									if err := muxer.WriteTrailer(); err != nil {
-										log.Printf("Failed to write trailer: %v", err)
-									}
-									if isMp4 {
-										writeCloser.Close()
-										ffmpegCmd.Wait()
-									} else {
-										file.Close()
-									}
-									sm.SetOutputActive(inputCfg.Name, url, false)
-									time.Sleep(5 * time.Second)
-									fileDone = true
-									break
+								break
+							}
+							err = muxer.WritePacket(pkt)
+							if err != nil {
+								log.Printf("Write error to output: %v", err)
+								if err := muxer.WriteTrailer(); err != nil {
+									log.Printf("Failed to write trailer: %v", err)
 								}
-								totalBytes += int64(len(pkt.Data))
-								now := time.Now()
-								if now.Sub(lastBitrateUpdateTime) > 1*time.Second {
-									sm.UpdateOutputBitrate(inputCfg.Name, url, totalBytes)
-									lastBitrateUpdateTime = now
+								if isMp4 {
+									writeCloser.Close()
+									ffmpegCmd.Wait()
+								} else {
+									file.Close()
 								}
+								sm.SetOutputActive(inputCfg.Name, url, false)
+								time.Sleep(5 * time.Second)
+								fileDone = true
+								break
 							}
-						}
-						return
-					} else if strings.HasPrefix(url, "rtmp://") {
-						dstConn, err := rtmp.Dial(url, rtmp.DialOptions{})
-						if err != nil {
-							log.Printf("Failed to connect to %s: %v", url, err)
-							// Получаем актуальный интервал переподключения
-							sm.mu.RLock()
-							reconnectInterval := sm.config.ReconnectInterval
-							sm.mu.RUnlock()
-							select {
-							case <-stop:
-								return
-							case <-time.After(time.Duration(reconnectInterval) * time.Second):
+							totalBytes += int64(len(pkt.Data))
+							now := time.Now()
+							if now.Sub(lastBitrateUpdateTime) > 1*time.Second {
+								sm.UpdateOutputBitrate(inputCfg.Name, url, totalBytes)
+								lastBitrateUpdateTime = now
 							}
-							continue
 						}
-						sm.SetOutputActive(inputCfg.Name, url, true)
-						err = dstConn.WriteHeader(streams)
-						if err != nil {
-							log.Printf("Failed to write header to %s: %v", url, err)
+					}
+					return
+				} else if strings.HasPrefix(url, "rtmp://") {
+					dstConn, err := rtmp.Dial(url, rtmp.DialOptions{})
+					if err != nil {
+						log.Printf("Failed to connect to %s: %v", url, err)
+						// Получаем актуальный интервал переподключения
+						sm.mu.RLock()
+						reconnectInterval := sm.config.ReconnectInterval
+						sm.mu.RUnlock()
+						select {
+						case <-stop:
+							return
+						case <-time.After(time.Duration(reconnectInterval) * time.Second):
+						}
+						continue
+					}
+					sm.SetOutputActive(inputCfg.Name, url, true)
+					rtmpStreams, headerVersion := header.Get()
+					err = dstConn.WriteHeader(rtmpStreams)
+					if err != nil {
+						log.Printf("Failed to write header to %s: %v", url, err)
+						dstConn.Close()
+						sm.SetOutputActive(inputCfg.Name, url, false)
+						// Получаем актуальный интервал переподключения
+						sm.mu.RLock()
+						reconnectInterval := sm.config.ReconnectInterval
+						sm.mu.RUnlock()
+						select {
+						case <-stop:
+							return
+						case <-time.After(time.Duration(reconnectInterval) * time.Second):
+						}
+						continue
+					}
+				rtmpLoop:
+					for {
+						select {
+						case <-stop:
 							dstConn.Close()
 							sm.SetOutputActive(inputCfg.Name, url, false)
-							// Получаем актуальный интервал переподключения
-							sm.mu.RLock()
-							reconnectInterval := sm.config.ReconnectInterval
-							sm.mu.RUnlock()
-							select {
-							case <-stop:
-								return
-							case <-time.After(time.Duration(reconnectInterval) * time.Second):
-							}
-							continue
-						}
-					rtmpLoop:
-						for {
-							select {
-							case <-stop:
+							return
+						case pkt, ok := <-ch:
+							if !ok {
 								dstConn.Close()
 								sm.SetOutputActive(inputCfg.Name, url, false)
 								return
-							case pkt, ok := <-ch:
-								if !ok {
+							}
+
+							// Параметры кодека сменились - отправляем новый AVC sequence header перед ключевым кадром.
+							// Повторный WriteHeader в joy4 пишет onMetaData и заголовки кодеков в то же соединение.
+							if pkt.IsKeyFrame && header.Version() != headerVersion {
+								rtmpStreams, headerVersion = header.Get()
+								if err = dstConn.WriteHeader(rtmpStreams); err != nil {
+									log.Printf("Failed to write updated header to %s: %v", url, err)
 									dstConn.Close()
 									sm.SetOutputActive(inputCfg.Name, url, false)
-									return
+									sm.mu.RLock()
+									reconnectInterval := sm.config.ReconnectInterval
+									sm.mu.RUnlock()
+									select {
+									case <-stop:
+										return
+									case <-time.After(time.Duration(reconnectInterval) * time.Second):
+									}
+									break rtmpLoop
 								}
+								log.Printf("Sent updated codec header to %s", url)
+							}
 
-								// Обработка временных меток для RTMP
-								validateTiming(&pkt)
+							// Обработка временных меток для RTMP
+							validateTiming(&pkt)
 
-								writeDone := make(chan error, 1)
-								go func() {
-									writeDone <- dstConn.WritePacket(pkt)
-								}()
+							writeDone := make(chan error, 1)
+							go func() {
+								writeDone <- dstConn.WritePacket(pkt)
+							}()
 
-								select {
-								case err = <-writeDone:
-									if err != nil {
-										log.Printf("Write error to %s: %v", url, err)
-										dstConn.Close()
-										sm.SetOutputActive(inputCfg.Name, url, false)
-										// Получаем актуальный интервал переподключения
-										sm.mu.RLock()
-										reconnectInterval := sm.config.ReconnectInterval
-										sm.mu.RUnlock()
-										select {
-										case <-stop:
-											return
-										case <-time.After(time.Duration(reconnectInterval) * time.Second):
-										}
-										break rtmpLoop
-									}
-								case <-time.After(5 * time.Second):
-									log.Printf("RTMP write timeout for %s, forcing reconnect", url)
+							select {
+							case err = <-writeDone:
+								if err != nil {
+									log.Printf("Write error to %s: %v", url, err)
 									dstConn.Close()
 									sm.SetOutputActive(inputCfg.Name, url, false)
 									// Получаем актуальный интервал переподключения
@@ -380,64 +432,97 @@ func handlePublish(sm *StreamManager, cfg *Config) func(conn *rtmp.Conn) {
 									}
 									break rtmpLoop
 								}
-
-								totalBytes += int64(len(pkt.Data))
-								now := time.Now()
-								if now.Sub(lastBitrateUpdateTime) > 1*time.Second {
-									sm.UpdateOutputBitrate(inputCfg.Name, url, totalBytes)
-									lastBitrateUpdateTime = now
+							case <-time.After(5 * time.Second):
+								log.Printf("RTMP write timeout for %s, forcing reconnect", url)
+								dstConn.Close()
+								sm.SetOutputActive(inputCfg.Name, url, false)
+								// Получаем актуальный интервал переподключения
+								sm.mu.RLock()
+								reconnectInterval := sm.config.ReconnectInterval
+								sm.mu.RUnlock()
+								select {
+								case <-stop:
+									return
+								case <-time.After(time.Duration(reconnectInterval) * time.Second):
 								}
+								break rtmpLoop
 							}
-						}
-					} else if strings.HasPrefix(url, "srt://") {
-						srtAddr := strings.TrimPrefix(url, "srt://")
-						if idx := strings.Index(srtAddr, "?"); idx != -1 {
-							srtAddr = srtAddr[:idx]
-						}
-						cfgSRT := srt.DefaultConfig()
-
-						// Получаем актуальные настройки SRT из StreamManager
-						sm.mu.RLock()
-						srtSettings := sm.config.SRTSettings
-						reconnectInterval := sm.config.ReconnectInterval
-						sm.mu.RUnlock()
 
-						if srtSettings.Latency > 0 {
-							cfgSRT.Latency = time.Duration(srtSettings.Latency) * time.Millisecond
-						}
-						if srtSettings.Passphrase != "" {
-							cfgSRT.Passphrase = srtSettings.Passphrase
-						}
-						if srtSettings.StreamID != "" {
-							cfgSRT.StreamId = srtSettings.StreamID
-						}
-						if srtSettings.ConnectTimeout > 0 {
-							cfgSRT.ConnectionTimeout = time.Duration(srtSettings.ConnectTimeout) * time.Millisecond
-						}
-						log.Printf("SRT connecting to %s with latency=%v, streamid=%s, timeout=%v", srtAddr, cfgSRT.Latency, cfgSRT.StreamId, cfgSRT.ConnectionTimeout)
-						conn, err := srt.Dial("srt", srtAddr, cfgSRT)
-						if err != nil {
-							log.Printf("Failed to connect to SRT %s: %v", url, err)
-							select {
-							case <-stop:
-								return
-							case <-time.After(time.Duration(reconnectInterval) * time.Second):
+							totalBytes += int64(len(pkt.Data))
+							now := time.Now()
+							if now.Sub(lastBitrateUpdateTime) > 1*time.Second {
+								sm.UpdateOutputBitrate(inputCfg.Name, url, totalBytes)
+								lastBitrateUpdateTime = now
 							}
-							continue
 						}
+					}
+				} else if strings.HasPrefix(url, "srt://") {
+					srtAddr := strings.TrimPrefix(url, "srt://")
+					if idx := strings.Index(srtAddr, "?"); idx != -1 {
+						srtAddr = srtAddr[:idx]
+					}
+					cfgSRT := srt.DefaultConfig()
+
+					// Получаем актуальные настройки SRT из StreamManager
+					sm.mu.RLock()
+					srtSettings := sm.config.SRTSettings
+					reconnectInterval := sm.config.ReconnectInterval
+					sm.mu.RUnlock()
 
-						// Проверяем состояние соединения
-						sm.SetOutputActive(inputCfg.Name, url, true)
+					if srtSettings.Latency > 0 {
+						cfgSRT.Latency = time.Duration(srtSettings.Latency) * time.Millisecond
+					}
+					if srtSettings.Passphrase != "" {
+						cfgSRT.Passphrase = srtSettings.Passphrase
+					}
+					if srtSettings.StreamID != "" {
+						cfgSRT.StreamId = srtSettings.StreamID
+					}
+					if srtSettings.ConnectTimeout > 0 {
+						cfgSRT.ConnectionTimeout = time.Duration(srtSettings.ConnectTimeout) * time.Millisecond
+					}
+					log.Printf("SRT connecting to %s with latency=%v, streamid=%s, timeout=%v", srtAddr, cfgSRT.Latency, cfgSRT.StreamId, cfgSRT.ConnectionTimeout)
+					conn, err := srt.Dial("srt", srtAddr, cfgSRT)
+					if err != nil {
+						log.Printf("Failed to connect to SRT %s: %v", url, err)
+						select {
+						case <-stop:
+							return
+						case <-time.After(time.Duration(reconnectInterval) * time.Second):
+						}
+						continue
+					}
 
-						// Правильная обработка временных меток для SRT
-						timingProcessor := NewTimingProcessor()
+					// Проверяем состояние соединения
+					sm.SetOutputActive(inputCfg.Name, url, true)
+
+					// Правильная обработка временных меток для SRT
+					timingProcessor := NewTimingProcessor()
+
+					// Используем буферизованный подход для стабильности
+					var tsBuf bytes.Buffer
+					tsOut := newTSContinuityWriter(&tsBuf)
+					muxer := ts.NewMuxer(tsOut)
+					tsStreams, headerVersion := header.Get()
+					err = muxer.WriteHeader(tsStreams)
+					if err != nil {
+						log.Printf("TS WriteHeader error for %s: %v", url, err)
+						conn.Close()
+						sm.SetOutputActive(inputCfg.Name, url, false)
+						select {
+						case <-stop:
+							return
+						case <-time.After(time.Duration(reconnectInterval) * time.Second):
+						}
+						continue
+					}
 
-						// Используем буферизованный подход для стабильности
-						var tsBuf bytes.Buffer
-						muxer := ts.NewMuxer(&tsBuf)
-						err = muxer.WriteHeader(streams)
+					// Отправляем заголовок TS сразу
+					headerData := tsBuf.Bytes()
+					if len(headerData) > 0 {
+						_, err = conn.Write(headerData)
 						if err != nil {
-							log.Printf("TS WriteHeader error for %s: %v", url, err)
+							log.Printf("SRT Write header error for %s: %v", url, err)
 							conn.Close()
 							sm.SetOutputActive(inputCfg.Name, url, false)
 							select {
@@ -447,121 +532,101 @@ func handlePublish(sm *StreamManager, cfg *Config) func(conn *rtmp.Conn) {
 							}
 							continue
 						}
+						totalBytes += int64(len(headerData))
+						tsBuf.Reset()
+					}
 
-						// Отправляем заголовок TS сразу
-						headerData := tsBuf.Bytes()
-						if len(headerData) > 0 {
-							_, err = conn.Write(headerData)
-							if err != nil {
-								log.Printf("SRT Write header error for %s: %v", url, err)
+				srtLoop:
+					for {
+						select {
+						case <-stop:
+							conn.Close()
+							sm.SetOutputActive(inputCfg.Name, url, false)
+							return
+						case pkt, ok := <-ch:
+							if !ok {
 								conn.Close()
 								sm.SetOutputActive(inputCfg.Name, url, false)
-								select {
-								case <-stop:
-									return
-								case <-time.After(time.Duration(reconnectInterval) * time.Second):
-								}
-								continue
+								return
 							}
-							totalBytes += int64(len(headerData))
-							tsBuf.Reset()
-						}
 
-					srtLoop:
-						for {
-							select {
-							case <-stop:
-								conn.Close()
-								sm.SetOutputActive(inputCfg.Name, url, false)
-								return
-							case pkt, ok := <-ch:
-								if !ok {
-									conn.Close()
-									sm.SetOutputActive(inputCfg.Name, url, false)
-									return
-								}
+							// Обработка временных меток для SRT с TimingProcessor
+							timingProcessor.Process(&pkt)
 
-								// Обработка временных меток для SRT с TimingProcessor
-								timingProcessor.Process(&pkt)
+							// Внутрипотоковые SPS/PPS/AUD убираем: муксер пишет их сам перед каждым
+							// ключевым кадром, чтобы декодер мог подключиться посреди потока
+							if int(pkt.Idx) < len(tsStreams) && tsStreams[pkt.Idx].Type() == av.H264 && !normalizeTSVideoPacket(&pkt) {
+								continue
+							}
 
-								// Записываем пакет в TS муксер
-								err = muxer.WritePacket(pkt)
-								if err != nil {
-									log.Printf("TS WritePacket error for %s: %v", url, err)
+							// Параметры кодека сменились - новый муксер пишет PAT/PMT (tsOut поднимает
+							// версию PMT и продолжает счётчики), а SPS/PPS берёт из новых CodecData
+							if pkt.IsKeyFrame && header.Version() != headerVersion {
+								tsStreams, headerVersion = header.Get()
+								tsOut.Restart()
+								muxer = ts.NewMuxer(tsOut)
+								if err = muxer.WriteHeader(tsStreams); err != nil {
+									log.Printf("TS WriteHeader error for %s: %v", url, err)
 									conn.Close()
 									sm.SetOutputActive(inputCfg.Name, url, false)
 									time.Sleep(time.Duration(reconnectInterval) * time.Second)
 									break srtLoop
 								}
+								log.Printf("Sent updated PAT/PMT and parameter sets to %s", url)
+							}
 
-								// Логируем обработку пакетов для диагностики блокировки
-								//if pkt.IsKeyFrame {
-								//	log.Printf("[DEBUG] Processing keyframe for %s", url)
-								//}
-
-								// Подсчитываем статистику
-								packetCount++
-								if time.Since(lastLogTime) > 30*time.Second {
-									log.Printf("[DEBUG] Output %s processed %d packets in 30s", url, packetCount)
-									packetCount = 0
-									lastLogTime = time.Now()
-								}
+							// Записываем пакет в TS муксер
+							err = muxer.WritePacket(pkt)
+							if err != nil {
+								log.Printf("TS WritePacket error for %s: %v", url, err)
+								conn.Close()
+								sm.SetOutputActive(inputCfg.Name, url, false)
+								time.Sleep(time.Duration(reconnectInterval) * time.Second)
+								break srtLoop
+							}
 
-								// Отправляем все данные из буфера с таймаутом
-								tsData := tsBuf.Bytes()
-								if len(tsData) > 0 {
-									// Неблокирующая запись с таймаутом
-									writeDone := make(chan error, 1)
+							// Логируем обработку пакетов для диагностики блокировки
+							//if pkt.IsKeyFrame {
+							//	log.Printf("[DEBUG] Processing keyframe for %s", url)
+							//}
+
+							// Подсчитываем статистику
+							packetCount++
+							if time.Since(lastLogTime) > 30*time.Second {
+								log.Printf("[DEBUG] Output %s processed %d packets in 30s", url, packetCount)
+								packetCount = 0
+								lastLogTime = time.Now()
+							}
 
-									go func() {
-										conn.SetWriteDeadline(time.Now().Add(2 * time.Second))
-										_, err := conn.Write(tsData)
-										writeDone <- err
-									}()
+							// Отправляем все данные из буфера с таймаутом
+							tsData := tsBuf.Bytes()
+							if len(tsData) > 0 {
+								// Неблокирующая запись с таймаутом
+								writeDone := make(chan error, 1)
 
-									// Ждем результат с таймаутом
-									select {
-									case err := <-writeDone:
-										if err != nil {
-											log.Printf("SRT Write error for %s: %v", url, err)
-
-											// Детальная диагностика ошибки
-											if strings.Contains(err.Error(), "timeout") {
-												log.Printf("[ERROR] SRT write timeout for %s - connection may be slow", url)
-											} else if strings.Contains(err.Error(), "connection") {
-												log.Printf("[ERROR] SRT connection lost for %s", url)
-											} else if strings.Contains(err.Error(), "broken") {
-												log.Printf("[ERROR] SRT pipe broken for %s", url)
-											} else {
-												log.Printf("[ERROR] SRT unknown error for %s: %T", url, err)
-											}
-
-											conn.Close()
-											sm.SetOutputActive(inputCfg.Name, url, false)
-											select {
-											case <-stop:
-												return
-											case <-time.After(time.Duration(reconnectInterval) * time.Second):
-											}
-											break srtLoop
-										}
+								go func() {
+									conn.SetWriteDeadline(time.Now().Add(2 * time.Second))
+									_, err := conn.Write(tsData)
+									writeDone <- err
+								}()
 
-										now := time.Now()
-										if now.Sub(lastBitrateUpdateTime) > 1*time.Second {
-											totalBytes += int64(len(tsData))
-											sm.UpdateOutputBitrate(inputCfg.Name, url, totalBytes)
-											lastBitrateUpdateTime = now
+								// Ждем результат с таймаутом
+								select {
+								case err := <-writeDone:
+									if err != nil {
+										log.Printf("SRT Write error for %s: %v", url, err)
+
+										// Детальная диагностика ошибки
+										if strings.Contains(err.Error(), "timeout") {
+											log.Printf("[ERROR] SRT write timeout for %s - connection may be slow", url)
+										} else if strings.Contains(err.Error(), "connection") {
+											log.Printf("[ERROR] SRT connection lost for %s", url)
+										} else if strings.Contains(err.Error(), "broken") {
+											log.Printf("[ERROR] SRT pipe broken for %s", url)
 										} else {
-											totalBytes += int64(len(tsData))
+											log.Printf("[ERROR] SRT unknown error for %s: %T", url, err)
 										}
-										tsBuf.Reset()
 
-										// Небольшая задержка для стабильности SRT - убираем, т.к. вносит ненужную задержку
-										// time.Sleep(1 * time.Millisecond)
-
-									case <-time.After(3 * time.Second):
-										// Таймаут записи - закрываем соединение
-										log.Printf("[ERROR] SRT write timeout for %s - forcing reconnect", url)
 										conn.Close()
 										sm.SetOutputActive(inputCfg.Name, url, false)
 										select {
@@ -571,119 +636,173 @@ func handlePublish(sm *StreamManager, cfg *Config) func(conn *rtmp.Conn) {
 										}
 										break srtLoop
 									}
-								} else {
-									// Если буфер пустой, ничего не делаем, просто ждем следующий пакет.
-									// Задержка здесь приводила к замедлению всего пайплайна.
-									// time.Sleep(10 * time.Millisecond)
+
+									now := time.Now()
+									if now.Sub(lastBitrateUpdateTime) > 1*time.Second {
+										totalBytes += int64(len(tsData))
+										sm.UpdateOutputBitrate(inputCfg.Name, url, totalBytes)
+										lastBitrateUpdateTime = now
+									} else {
+										totalBytes += int64(len(tsData))
+									}
+									tsBuf.Reset()
+
+									// Небольшая задержка для стабильности SRT - убираем, т.к. вносит ненужную задержку
+									// time.Sleep(1 * time.Millisecond)
+
+								case <-time.After(3 * time.Second):
+									// Таймаут записи - закрываем соединение
+									log.Printf("[ERROR] SRT write timeout for %s - forcing reconnect", url)
+									conn.Close()
+									sm.SetOutputActive(inputCfg.Name, url, false)
+									select {
+									case <-stop:
+										return
+									case <-time.After(time.Duration(reconnectInterval) * time.Second):
+									}
+									break srtLoop
 								}
+							} else {
+								// Если буфер пустой, ничего не делаем, просто ждем следующий пакет.
+								// Задержка здесь приводила к замедлению всего пайплайна.
+								// time.Sleep(10 * time.Millisecond)
 							}
 						}
 					}
 				}
 			}
 		}
+	}
 
-		// Инициализация выходов из inputCfg
-		for _, url := range sm.GetInputOutputs(inputCfg.Name) {
-			sm.RegisterOutput(inputCfg.Name, url)
-			outputMgr.AddOutput(url, bufSize, startPush(url))
+	// Инициализация выходов из inputCfg
+	for _, url := range sm.GetInputOutputs(inputCfg.Name) {
+		if rawOutput != nil && rawOutput(url) {
+			continue
 		}
+		sm.RegisterOutput(inputCfg.Name, url)
+		outputMgr.AddOutput(url, bufSize, startPush(url))
+	}
 
-		// Горутина для динамического обновления выходов
-		updateTicker := time.NewTicker(2 * time.Second)
-		defer updateTicker.Stop()
+	// Горутина для динамического обновления выходов
+	updateTicker := time.NewTicker(2 * time.Second)
+	defer updateTicker.Stop()
 
-		// Горутина мониторинга буферов
-		bufferMonitorTicker := time.NewTicker(30 * time.Second)
-		defer bufferMonitorTicker.Stop()
+	// Горутина мониторинга буферов
+	bufferMonitorTicker := time.NewTicker(30 * time.Second)
+	defer bufferMonitorTicker.Stop()
 
-		go func() {
-			for {
-				select {
-				case <-stopChan:
-					return
-				case <-updateTicker.C:
-					// Синхронизируем выходы с inputCfg.Outputs
-					current := make(map[string]struct{})
-					for _, url := range sm.GetInputOutputs(inputCfg.Name) {
-						current[url] = struct{}{}
-						sm.RegisterOutput(inputCfg.Name, url)
-						outputMgr.AddOutput(url, bufSize, startPush(url))
-					}
-					for url := range outputMgr.AllOutputs() {
-						if _, ok := current[url]; !ok {
-							outputMgr.RemoveOutput(url)
-						}
+	go func() {
+		for {
+			select {
+			case <-stopChan:
+				return
+			case <-updateTicker.C:
+				// Синхронизируем выходы с inputCfg.Outputs
+				current := make(map[string]struct{})
+				for _, url := range sm.GetInputOutputs(inputCfg.Name) {
+					if rawOutput != nil && rawOutput(url) {
+						continue
 					}
-				case <-bufferMonitorTicker.C:
-					// Мониторинг состояния буферов каждые 30 секунд
-					outputs := outputMgr.AllOutputs()
-					for url, w := range outputs {
-						bufferSize := len(w.ch)
-						fillPercentage := (bufferSize * 100) / bufSize
-
-						if bufferSize > bufSize*3/4 {
-							log.Printf("[WARNING] Output buffer for %s is %d%% full: %d/%d packets", url, fillPercentage, bufferSize, bufSize)
-						} else {
-							log.Printf("[MONITOR] Output buffer for %s is %d%% full: %d/%d packets", url, fillPercentage, bufferSize, bufSize)
-						}
+					current[url] = struct{}{}
+					sm.RegisterOutput(inputCfg.Name, url)
+					outputMgr.AddOutput(url, bufSize, startPush(url))
+				}
+				for url := range outputMgr.AllOutputs() {
+					if _, ok := current[url]; !ok {
+						outputMgr.RemoveOutput(url)
 					}
 				}
-			}
-		}()
+			case <-bufferMonitorTicker.C:
+				// Мониторинг состояния буферов каждые 30 секунд
+				outputs := outputMgr.AllOutputs()
+				for url, w := range outputs {
+					bufferSize := len(w.ch)
+					fillPercentage := (bufferSize * 100) / bufSize
 
-		// Горутина чтения пакетов из источника и рассылки по выходам
-		for {
-			pkt, err := srcConn.ReadPacket()
-			if err != nil {
-				log.Printf("Source disconnected or error: %v", err)
-				close(stopChan)
-				break
+					if bufferSize > bufSize*3/4 {
+						log.Printf("[WARNING] Output buffer for %s is %d%% full: %d/%d packets", url, fillPercentage, bufferSize, bufSize)
+					} else {
+						log.Printf("[MONITOR] Output buffer for %s is %d%% full: %d/%d packets", url, fillPercentage, bufferSize, bufSize)
+					}
+				}
 			}
+		}
+	}()
 
-			// Неблокирующая отправка пакетов в выходы
-			outputs := outputMgr.AllOutputs()
-			droppedCount := 0
-
-			for _, w := range outputs {
-				select {
-				case w.ch <- pkt:
-					// Успешно отправлен
-				default:
-					// буфер заполнен — дропаем пакет для этого выхода
-					droppedCount++
-					log.Printf("[WARNING] Output buffer full, dropping packet for output")
+	// Горутина чтения пакетов из источника и рассылки по выходам
+	for {
+		pkt, err := src.ReadPacket()
+		if err != nil {
+			log.Printf("Source disconnected or error: %v", err)
+			close(stopChan)
+			break
+		}
 
-					// Логируем размер буфера для диагностики
-					log.Printf("[DEBUG] Channel buffer size: %d", len(w.ch))
+		// Проверяем ключевые кадры на новые SPS/PPS (смена разрешения/профиля в энкодере):
+		// из sequence header'а, пришедшего до кадра (RTMP), и из самого кадра
+		if int(pkt.Idx) == videoIdx {
+			videoPackets++
+		}
+		if paramTracker != nil && pkt.IsKeyFrame && int(pkt.Idx) == videoIdx {
+			var codec h264parser.CodecData
+			var changed bool
+			if configSrc != nil {
+				if record, ok := configSrc.VideoConfig(videoPackets); ok {
+					codec, changed = paramTracker.UpdateRecord(record)
 				}
 			}
+			if inband, ok := paramTracker.Update(pkt.Data); ok {
+				codec, changed = inband, true
+			}
+			if changed {
+				header.Update(videoIdx, codec)
+				sm.AddInputEvent(inputCfg.Name, "codec_change",
+					fmt.Sprintf("H.264 parameters changed: %dx%d", codec.Width(), codec.Height()))
+			}
+		}
 
-			// Если дропнули пакеты для всех выходов, это серьезная проблема
-			if droppedCount == len(outputs) && len(outputs) > 0 {
-				log.Printf("[ERROR] All outputs are blocked! Dropped packet for all %d outputs", len(outputs))
+		// Неблокирующая отправка пакетов в выходы
+		outputs := outputMgr.AllOutputs()
+		droppedCount := 0
+
+		for _, w := range outputs {
+			select {
+			case w.ch <- pkt:
+				// Успешно отправлен
+			default:
+				// буфер заполнен — дропаем пакет для этого выхода
+				droppedCount++
+				log.Printf("[WARNING] Output buffer full, dropping packet for output")
+
+				// Логируем размер буфера для диагностики
+				log.Printf("[DEBUG] Channel buffer size: %d", len(w.ch))
+			}
+		}
 
-				// Логируем состояние всех выходов для диагностики
-				for url, w := range outputs {
-					bufferSize := len(w.ch)
-					log.Printf("[DEBUG] Output %s buffer state: %d/%d packets", url, bufferSize, bufSize)
-				}
+		// Если дропнули пакеты для всех выходов, это серьезная проблема
+		if droppedCount == len(outputs) && len(outputs) > 0 {
+			log.Printf("[ERROR] All outputs are blocked! Dropped packet for all %d outputs", len(outputs))
 
-				// Не очищаем буферы - это может сломать выходы
-				// Вместо этого просто логируем проблему
-				log.Printf("[WARNING] All outputs are slow, packets will be dropped until they catch up")
+			// Логируем состояние всех выходов для диагностики
+			for url, w := range outputs {
+				bufferSize := len(w.ch)
+				log.Printf("[DEBUG] Output %s buffer state: %d/%d packets", url, bufferSize, bufSize)
 			}
-		}
-		log.Printf("Publish finished: %s", srcConn.URL)
 
-		// Сбрасываем статус всех выходов при завершении трансляции
-		for _, url := range sm.GetInputOutputs(inputCfg.Name) {
-			sm.SetOutputActive(inputCfg.Name, url, false)
+			// Не очищаем буферы - это может сломать выходы
+			// Вместо этого просто логируем проблему
+			log.Printf("[WARNING] All outputs are slow, packets will be dropped until they catch up")
 		}
-		// ЯВНО закрываем все выходные каналы, чтобы завершились все горутины записи
-		for _, w := range outputMgr.AllOutputs() {
-			close(w.ch)
-		}
-		log.Printf("[DEBUG] All output channels closed for: %s", srcConn.URL)
 	}
+	log.Printf("Publish finished: %s", source)
+
+	// Сбрасываем статус всех выходов при завершении трансляции
+	for _, url := range sm.GetInputOutputs(inputCfg.Name) {
+		sm.SetOutputActive(inputCfg.Name, url, false)
+	}
+	// ЯВНО закрываем все выходные каналы, чтобы завершились все горутины записи
+	for _, w := range outputMgr.AllOutputs() {
+		close(w.ch)
+	}
+	log.Printf("[DEBUG] All output channels closed for: %s", source)
 }
@@ -0,0 +1,448 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	srt "github.com/datarhei/gosrt"
+	"github.com/datarhei/joy4/av"
+	"github.com/datarhei/joy4/format/rtmp"
+)
+
+// Pull-входы: сервер сам подключается к удалённому источнику (pull: в конфиге входа)
+// и раздаёт поток по выходам так же, как принятую публикацию (servePublish).
+
+const (
+	pullStateConnecting = "connecting"
+	pullStatePlaying    = "playing"
+	pullStateRetrying   = "retrying"
+	pullStateWaiting    = "waiting" // UDP: сокет открыт, данных нет
+
+	// Интервал синхронизации pull-входов с конфигом (как у выходов)
+	pullSyncInterval = 2 * time.Second
+	// Потолок паузы между попытками подключения
+	pullMaxBackoff = 60 * time.Second
+	// Сессия дольше этого считается удачной, пауза сбрасывается к reconnect_interval
+	pullStableAfter = 30 * time.Second
+	// Источник без пакетов дольше этого считается зависшим и переподключается
+	pullStallTimeout = 15 * time.Second
+)
+
+// PullStatus - состояние pull-входа для API (GET /api/status)
+type PullStatus struct {
+	URL         string     `json:"url"`
+	State       string     `json:"state"`
+	Attempts    int        `json:"attempts"`
+	Reconnects  int        `json:"reconnects"`
+	LastError   string     `json:"last_error,omitempty"`
+	ConnectedAt *time.Time `json:"connected_at,omitempty"`
+	NextRetry   *time.Time `json:"next_retry,omitempty"`
+}
+
+// pullConfigOnly - источники, которые задаются только в config.yaml: exec:// запускает
+// команду, file:// читает локальные файлы сервера
+func pullConfigOnly(raw string) bool {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return false
+	}
+	scheme := strings.ToLower(u.Scheme)
+	return scheme == "exec" || scheme == "file"
+}
+
+// validatePullURL проверяет источник pull-входа
+func validatePullURL(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return err
+	}
+	switch strings.ToLower(u.Scheme) {
+	case "rtmp", "rtsp", "rtsps", "http", "https":
+	case "file":
+		return validateFileSource(fileSourcePath(u))
+	case "exec":
+		_, err := parseExecOutputURL(raw)
+		return err
+	case "udp":
+		if _, err := parseUDPSource(raw); err != nil {
+			return err
+		}
+	case "srt":
+		cfg := srt.DefaultConfig()
+		if _, err := cfg.UnmarshalURL(raw); err != nil {
+			return err
+		}
+		if err := cfg.Validate(); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unsupported pull scheme %q", u.Scheme)
+	}
+	if u.Host == "" {
+		return errors.New("pull URL has no host")
+	}
+	return nil
+}
+
+// redactPullURL скрывает пароль источника (passphrase SRT, пароль в userinfo) для логов и API
+func redactPullURL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return raw
+	}
+	if _, ok := u.User.Password(); ok {
+		u.User = url.UserPassword(u.User.Username(), "***")
+	}
+	q := u.Query()
+	if q.Get("passphrase") != "" {
+		q.Set("passphrase", "***")
+		u.RawQuery = q.Encode()
+	}
+	return u.String()
+}
+
+// PullManager запускает и останавливает pull-входы по текущему конфигу
+type PullManager struct {
+	manager *StreamManager
+	srt     *SRTServer // SRT pull идёт через тот же приём MPEG-TS, что и SRT публикация
+	ctx     context.Context
+	cancel  context.CancelFunc
+	wg      sync.WaitGroup
+
+	mu      sync.Mutex
+	pullers map[string]*puller // по имени входа
+}
+
+type puller struct {
+	url    string
+	cancel context.CancelFunc
+}
+
+func NewPullManager(manager *StreamManager, srtServer *SRTServer) *PullManager {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &PullManager{
+		manager: manager,
+		srt:     srtServer,
+		ctx:     ctx,
+		cancel:  cancel,
+		pullers: make(map[string]*puller),
+	}
+}
+
+func (p *PullManager) Start() {
+	p.sync()
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		ticker := time.NewTicker(pullSyncInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-p.ctx.Done():
+				return
+			case <-ticker.C:
+				p.sync()
+			}
+		}
+	}()
+}
+
+func (p *PullManager) Stop() error {
+	p.cancel()
+	p.wg.Wait()
+	log.Printf("[PULL] All pull inputs stopped")
+	return nil
+}
+
+// sync запускает pull для новых входов, перезапускает при смене URL и останавливает удалённые
+func (p *PullManager) sync() {
+	wanted := make(map[string]string)
+	for name, input := range p.manager.GetInputsCopy() {
+		if input.Pull != "" {
+			wanted[name] = input.Pull
+		}
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for name, pl := range p.pullers {
+		if wanted[name] != pl.url {
+			pl.cancel()
+			delete(p.pullers, name)
+		}
+	}
+	for name, pullURL := range wanted {
+		if _, ok := p.pullers[name]; ok {
+			continue
+		}
+		ctx, cancel := context.WithCancel(p.ctx)
+		p.pullers[name] = &puller{url: pullURL, cancel: cancel}
+		p.wg.Add(1)
+		go func(name, pullURL string) {
+			defer p.wg.Done()
+			p.runPuller(ctx, name, pullURL)
+		}(name, pullURL)
+	}
+}
+
+// runPuller держит подключение к источнику, переподключаясь с растущей паузой
+func (p *PullManager) runPuller(ctx context.Context, name, pullURL string) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("[PANIC] Pull input '%s' panic: %v", name, r)
+		}
+		p.manager.SetPullStatus(name, nil)
+	}()
+	source := redactPullURL(pullURL)
+	log.Printf("[PULL] Input '%s' pulls from %s", name, source)
+
+	status := PullStatus{URL: source}
+	backoff := p.baseBackoff()
+	for {
+		status.State = pullStateConnecting
+		status.NextRetry = nil
+		p.manager.SetPullStatus(name, &status)
+
+		started := time.Now()
+		err := p.pullOnce(ctx, name, pullURL, &status)
+		if ctx.Err() != nil {
+			log.Printf("[PULL] Input '%s' stopped", name)
+			return
+		}
+		if status.ConnectedAt != nil && time.Since(started) > pullStableAfter {
+			backoff = p.baseBackoff()
+			status.Attempts = 0
+		}
+		status.Attempts++
+		status.ConnectedAt = nil
+		if err != nil {
+			status.LastError = err.Error()
+			log.Printf("[PULL] Input '%s' source %s failed: %v, retry in %v", name, source, err, backoff)
+			p.manager.IncrementError(name)
+		}
+		next := time.Now().Add(backoff)
+		status.State = pullStateRetrying
+		status.NextRetry = &next
+		p.manager.SetPullStatus(name, &status)
+
+		select {
+		case <-ctx.Done():
+			log.Printf("[PULL] Input '%s' stopped", name)
+			return
+		case <-time.After(backoff):
+		}
+		status.Reconnects++
+		backoff *= 2
+		if backoff > pullMaxBackoff {
+			backoff = pullMaxBackoff
+		}
+	}
+}
+
+func (p *PullManager) baseBackoff() time.Duration {
+	p.manager.mu.RLock()
+	defer p.manager.mu.RUnlock()
+	if p.manager.config == nil || p.manager.config.ReconnectInterval <= 0 {
+		return 5 * time.Second
+	}
+	return time.Duration(p.manager.config.ReconnectInterval) * time.Second
+}
+
+// pullOnce подключается к источнику и раздаёт поток до его обрыва
+func (p *PullManager) pullOnce(ctx context.Context, name, pullURL string, status *PullStatus) error {
+	inputCfg := p.manager.GetInputByName(name)
+	if inputCfg == nil {
+		return fmt.Errorf("input %s not found", name)
+	}
+	switch {
+	case strings.HasPrefix(strings.ToLower(pullURL), "srt://"):
+		return p.pullSRT(ctx, inputCfg, pullURL, status)
+	case strings.HasPrefix(strings.ToLower(pullURL), "udp://"):
+		return p.pullUDP(ctx, inputCfg, pullURL, status)
+	}
+
+	src, closer, err := dialPullSource(p.manager, pullURL, inputCfg)
+	if err != nil {
+		return err
+	}
+	demuxer := &pullDemuxer{Demuxer: src}
+	demuxer.touch()
+
+	// Закрываем источник при остановке входа или если он перестал слать пакеты
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ctx.Done():
+				closer.Close()
+				return
+			case <-ticker.C:
+				if demuxer.idle() > pullStallTimeout {
+					log.Printf("[PULL] Input '%s' source stalled for %v, reconnecting", name, pullStallTimeout)
+					demuxer.setErr(errors.New("source stalled"))
+					closer.Close()
+					return
+				}
+			}
+		}
+	}()
+	defer closer.Close()
+
+	// Для RTMP Streams() отправляет play и ждёт заголовки кодеков
+	if _, err := demuxer.Streams(); err != nil {
+		return err
+	}
+
+	if !p.manager.TryAcquirePublish(name) {
+		return errors.New("input is already being published")
+	}
+	defer p.manager.SetStatusActive(name, false)
+	p.markPlaying(name, status)
+	servePublish(p.manager, inputCfg, demuxer, status.URL, nil)
+
+	if err := demuxer.err(); err != nil {
+		return err
+	}
+	return errors.New("source ended")
+}
+
+// pullSRT подключается к SRT источнику в режиме caller. Параметры соединения
+// (streamid, passphrase, latency, ...) берутся из query URL, по умолчанию - latency
+// и connect_timeout из srt_settings. Пароль listener'а сервера не подставляется.
+func (p *PullManager) pullSRT(ctx context.Context, inputCfg *InputCfg, pullURL string, status *PullStatus) error {
+	if p.srt == nil {
+		return errors.New("SRT server is not available")
+	}
+
+	cfg := srt.DefaultConfig()
+	p.manager.mu.RLock()
+	settings := p.manager.config.SRTSettings
+	p.manager.mu.RUnlock()
+	if settings.Latency > 0 {
+		cfg.Latency = time.Duration(settings.Latency) * time.Millisecond
+	}
+	if settings.ConnectTimeout > 0 {
+		cfg.ConnectionTimeout = time.Duration(settings.ConnectTimeout) * time.Millisecond
+	}
+	addr, err := cfg.UnmarshalURL(pullURL)
+	if err != nil {
+		return err
+	}
+
+	conn, err := srt.Dial("srt", addr, cfg)
+	if err != nil {
+		return err
+	}
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+	defer conn.Close()
+
+	if !p.manager.TryAcquirePublish(inputCfg.Name) {
+		return errors.New("input is already being published")
+	}
+	defer p.manager.SetStatusActive(inputCfg.Name, false)
+	p.markPlaying(inputCfg.Name, status)
+
+	if err := p.srt.serveTS(conn, inputCfg, status.URL, pullStallTimeout); err != nil {
+		return err
+	}
+	return errors.New("source ended")
+}
+
+func (p *PullManager) markPlaying(name string, status *PullStatus) {
+	now := time.Now()
+	status.State = pullStatePlaying
+	status.ConnectedAt = &now
+	status.NextRetry = nil
+	p.manager.SetPullStatus(name, status)
+	log.Printf("[PULL] Input '%s' playing %s", name, status.URL)
+}
+
+// dialPullSource открывает источник по схеме URL
+func dialPullSource(sm *StreamManager, pullURL string, inputCfg *InputCfg) (av.Demuxer, io.Closer, error) {
+	u, err := url.Parse(pullURL)
+	if err != nil {
+		return nil, nil, err
+	}
+	switch strings.ToLower(u.Scheme) {
+	case "rtmp":
+		conn, err := rtmp.Dial(pullURL, rtmp.DialOptions{})
+		if err != nil {
+			return nil, nil, err
+		}
+		return conn, conn, nil
+	case "rtsp", "rtsps":
+		demuxer, err := dialRTSP(pullURL, inputCfg)
+		if err != nil {
+			return nil, nil, err
+		}
+		return demuxer, demuxer, nil
+	case "http", "https":
+		demuxer := newHLSDemuxer(sm, pullURL, inputCfg)
+		return demuxer, demuxer, nil
+	case "file":
+		demuxer := newFileDemuxer(sm, fileSourcePath(u), inputCfg)
+		return demuxer, demuxer, nil
+	case "exec":
+		demuxer, err := startExecInput(sm, pullURL, inputCfg)
+		if err != nil {
+			return nil, nil, err
+		}
+		return demuxer, demuxer, nil
+	}
+	return nil, nil, fmt.Errorf("unsupported pull scheme %q", u.Scheme)
+}
+
+// pullDemuxer запоминает время последнего пакета и ошибку чтения источника
+type pullDemuxer struct {
+	av.Demuxer
+	last    atomic.Int64
+	mu      sync.Mutex
+	readErr error
+}
+
+func (d *pullDemuxer) ReadPacket() (av.Packet, error) {
+	pkt, err := d.Demuxer.ReadPacket()
+	if err != nil {
+		d.setErr(err)
+		return pkt, err
+	}
+	d.touch()
+	return pkt, nil
+}
+
+func (d *pullDemuxer) touch() {
+	d.last.Store(time.Now().UnixNano())
+}
+
+func (d *pullDemuxer) idle() time.Duration {
+	return time.Since(time.Unix(0, d.last.Load()))
+}
+
+// setErr сохраняет первую ошибку: причина обрыва важнее последствий закрытия
+func (d *pullDemuxer) setErr(err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.readErr == nil && err != io.EOF {
+		d.readErr = err
+	}
+}
+
+func (d *pullDemuxer) err() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.readErr
+}
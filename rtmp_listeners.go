@@ -0,0 +1,118 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/datarhei/joy4/format/rtmp"
+)
+
+// Validate проверяет адрес и пару сертификат/ключ слушателя
+func (l RTMPListener) Validate() error {
+	host, portStr, err := net.SplitHostPort(l.Addr)
+	if err != nil {
+		return fmt.Errorf("invalid addr %q: %v", l.Addr, err)
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port < 1 || port > 65535 {
+		return fmt.Errorf("invalid port in addr %q", l.Addr)
+	}
+	if host != "" && net.ParseIP(host) == nil {
+		return fmt.Errorf("addr %q must use an IP address", l.Addr)
+	}
+	if (l.TLSCert == "") != (l.TLSKey == "") {
+		return errors.New("tls_cert and tls_key must be set together")
+	}
+	if strings.Contains(l.DefaultApp, "/") {
+		return fmt.Errorf("default_app %q must not contain '/'", l.DefaultApp)
+	}
+	return nil
+}
+
+func (l RTMPListener) scheme() string {
+	if l.TLSCert != "" {
+		return "rtmps"
+	}
+	return "rtmp"
+}
+
+// rtmpListeners возвращает слушателей из конфига; без них - прежний RTMP на rtmp_port
+func rtmpListeners(cfg *Config) []RTMPListener {
+	if len(cfg.Server.RTMPListeners) > 0 {
+		return cfg.Server.RTMPListeners
+	}
+	return []RTMPListener{{Addr: ":" + strconv.Itoa(cfg.Server.RTMPPort)}}
+}
+
+// rtmpPublishPath дополняет путь без app (rtmp://host/key -> /key) app слушателя по умолчанию
+func rtmpPublishPath(u *url.URL, defaultApp string) string {
+	path := u.Path
+	if defaultApp != "" && !strings.Contains(strings.Trim(path, "/"), "/") {
+		path = "/" + defaultApp + "/" + strings.Trim(path, "/")
+	}
+	return path
+}
+
+// newRTMPServer создаёт joy4 сервер и сокет слушателя. Соединения принимаются
+// через rtmpTapListener, чтобы видеть AVC sequence header'ы посреди потока.
+func newRTMPServer(l RTMPListener, sm *StreamManager, cfg *Config) (*rtmp.Server, net.Listener, error) {
+	var tlsConfig *tls.Config
+	if l.TLSCert != "" {
+		// Сертификат проверяем сразу, чтобы ошибка была видна при старте, а не на первом клиенте
+		cert, err := tls.LoadX509KeyPair(l.TLSCert, l.TLSKey)
+		if err != nil {
+			return nil, nil, fmt.Errorf("load certificate for %s: %w", l.Addr, err)
+		}
+		tlsConfig = &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	}
+
+	server := &rtmp.Server{Addr: l.Addr}
+	server.HandlePublish = handlePublish(sm, cfg, l.DefaultApp)
+	server.HandlePlay = func(conn *rtmp.Conn) {
+		log.Printf("Play started: %s", conn.URL)
+		conn.Close()
+	}
+
+	listener, err := net.Listen("tcp", l.Addr)
+	if err != nil {
+		return nil, nil, err
+	}
+	if tlsConfig != nil {
+		// TLS снимается до разбора чанков: rtmpTapConn видит открытый поток
+		listener = tls.NewListener(listener, tlsConfig)
+	}
+	return server, rtmpTapListener{listener}, nil
+}
+
+// startRTMPListeners запускает всех RTMP/RTMPS слушателей
+func startRTMPListeners(sm *StreamManager, cfg *Config) {
+	for _, l := range rtmpListeners(cfg) {
+		server, listener, err := newRTMPServer(l, sm, cfg)
+		if err != nil {
+			log.Fatalf("RTMP server error on %s: %v", l.Addr, err)
+		}
+		go func(l RTMPListener, server *rtmp.Server, listener net.Listener) {
+			defer func() {
+				if r := recover(); r != nil {
+					log.Printf("[PANIC] RTMP server panic: %v", r)
+				}
+				log.Printf("[DEBUG] RTMP server goroutine on %s finished", l.Addr)
+			}()
+
+			if l.DefaultApp != "" {
+				log.Printf("[RTMP] %s server started on %s (default app %q)", l.scheme(), l.Addr, l.DefaultApp)
+			} else {
+				log.Printf("[RTMP] %s server started on %s", l.scheme(), l.Addr)
+			}
+			if err := server.Serve(listener); err != nil && err.Error() != "use of closed network connection" {
+				log.Fatalf("RTMP server error on %s: %v", l.Addr, err)
+			}
+		}(l, server, listener)
+	}
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"log"
+	"net"
+	"sync"
+)
+
+// Смена параметров H.264 в RTMP публикации.
+// Энкодеры (OBS, аппаратные) сообщают о новых SPS/PPS новым AVC sequence header,
+// но joy4 разбирает только первый и дальше такие сообщения из ReadPacket не отдаёт.
+// rtmpTapConn пассивно разбирает поток чанков от клиента и запоминает sequence
+// header'ы вместе с числом видео сообщений до них; servePublish применяет их
+// на первом ключевом кадре после заголовка.
+
+const (
+	rtmpHandshakeSize    = 1 + 1536 + 1536 // C0 + C1 + C2
+	rtmpDefaultChunkSize = 128
+	rtmpMaxKeptMessage   = 64 * 1024 // sequence header заведомо меньше
+	rtmpMaxPendingConfig = 8
+)
+
+// rtmpTapListener оборачивает принятые соединения в rtmpTapConn
+type rtmpTapListener struct {
+	net.Listener
+}
+
+func (l rtmpTapListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return newRTMPTapConn(conn), nil
+}
+
+type rtmpTapConn struct {
+	net.Conn
+	parser rtmpChunkParser
+
+	mu            sync.Mutex
+	videoMessages int64 // видео сообщения с кадрами (AVC NALU)
+	configs       []rtmpVideoConfig
+}
+
+type rtmpVideoConfig struct {
+	after  int64  // сколько видео сообщений с кадрами пришло до заголовка
+	record []byte // AVCDecoderConfigurationRecord
+}
+
+func newRTMPTapConn(conn net.Conn) *rtmpTapConn {
+	c := &rtmpTapConn{Conn: conn}
+	c.parser = newRTMPChunkParser(c.handleMessage)
+	return c
+}
+
+func (c *rtmpTapConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		c.parser.Feed(p[:n])
+	}
+	return n, err
+}
+
+func (c *rtmpTapConn) handleMessage(typ uint8, length int, data []byte) {
+	// Видео сообщение H.264: байт кодека (7 = AVC) и AVCPacketType
+	if typ != 9 || len(data) < 2 || data[0]&0x0F != 7 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	switch data[1] {
+	case 1:
+		c.videoMessages++
+	case 0:
+		if len(data) != length || length < 6 {
+			return
+		}
+		c.configs = append(c.configs, rtmpVideoConfig{after: c.videoMessages, record: append([]byte(nil), data[5:]...)})
+		if len(c.configs) > rtmpMaxPendingConfig {
+			c.configs = c.configs[1:]
+		}
+	}
+}
+
+// VideoConfig возвращает последний AVC sequence header, пришедший раньше
+// видео пакета с номером videoPackets (считая с 1), и забывает все такие заголовки
+func (c *rtmpTapConn) VideoConfig(videoPackets int64) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var record []byte
+	i := 0
+	for ; i < len(c.configs) && c.configs[i].after < videoPackets; i++ {
+		record = c.configs[i].record
+	}
+	c.configs = c.configs[i:]
+	return record, record != nil
+}
+
+// rtmpChunkParser разбирает поток чанков RTMP от клиента ровно настолько,
+// чтобы не потерять границы сообщений: данные хранятся только у видео
+// сообщений (до rtmpMaxKeptMessage байт) и у Set Chunk Size
+type rtmpChunkParser struct {
+	handshakeLeft int
+	header        []byte // неполный заголовок чанка
+	chunkSize     int
+	streams       map[uint32]*rtmpChunkStream
+	cur           *rtmpChunkStream
+	payloadLeft   int // сколько байт полезной нагрузки текущего чанка осталось
+	failed        bool
+
+	onMessage func(typ uint8, length int, data []byte)
+}
+
+type rtmpChunkStream struct {
+	typ      uint8
+	length   int
+	left     int  // сколько байт сообщения ещё не пришло
+	extended bool // в заголовке была расширенная метка времени
+	extTime  [4]byte
+	keep     bool
+	data     []byte
+}
+
+// Максимальный заголовок чанка: 3 байта basic header, 11 - message header, 4 - расширенная метка
+const rtmpMaxChunkHeader = 3 + 11 + 4
+
+func newRTMPChunkParser(onMessage func(typ uint8, length int, data []byte)) rtmpChunkParser {
+	return rtmpChunkParser{
+		handshakeLeft: rtmpHandshakeSize,
+		chunkSize:     rtmpDefaultChunkSize,
+		streams:       make(map[uint32]*rtmpChunkStream),
+		onMessage:     onMessage,
+	}
+}
+
+// Feed принимает очередные байты от клиента
+func (p *rtmpChunkParser) Feed(data []byte) {
+	if p.handshakeLeft > 0 {
+		n := len(data)
+		if n > p.handshakeLeft {
+			n = p.handshakeLeft
+		}
+		p.handshakeLeft -= n
+		data = data[n:]
+	}
+	for len(data) > 0 && !p.failed {
+		if p.payloadLeft > 0 {
+			n := len(data)
+			if n > p.payloadLeft {
+				n = p.payloadLeft
+			}
+			p.consumePayload(data[:n])
+			data = data[n:]
+			continue
+		}
+
+		prev := len(p.header)
+		take := rtmpMaxChunkHeader - prev
+		if take > len(data) {
+			take = len(data)
+		}
+		p.header = append(p.header, data[:take]...)
+		n, ok := p.parseHeader(p.header)
+		if !ok {
+			data = data[take:]
+			continue
+		}
+		if n >= prev {
+			data = data[n-prev:]
+		} else {
+			// Ожидаемой расширенной метки не оказалось - накопленные байты уже нагрузка
+			data = append(append([]byte(nil), p.header[n:prev]...), data...)
+		}
+		p.header = p.header[:0]
+	}
+}
+
+// parseHeader разбирает заголовок чанка; ok = false, если байт пока не хватает
+func (p *rtmpChunkParser) parseHeader(b []byte) (int, bool) {
+	if len(b) < 1 {
+		return 0, false
+	}
+	fmtType := b[0] >> 6
+	csid := uint32(b[0] & 0x3F)
+	n := 1
+	switch csid {
+	case 0:
+		if len(b) < 2 {
+			return 0, false
+		}
+		csid, n = 64+uint32(b[1]), 2
+	case 1:
+		if len(b) < 3 {
+			return 0, false
+		}
+		csid, n = 64+uint32(b[1])+uint32(b[2])*256, 3
+	}
+	hdrLen := [4]int{11, 7, 3, 0}[fmtType]
+	if len(b) < n+hdrLen {
+		return 0, false
+	}
+
+	cs := p.streams[csid]
+	if cs == nil {
+		if fmtType == 3 {
+			p.fail("continuation chunk for unknown chunk stream")
+			return 0, false
+		}
+		cs = &rtmpChunkStream{}
+		p.streams[csid] = cs
+	}
+	h := b[n : n+hdrLen]
+	n += hdrLen
+
+	newMessage := cs.left == 0
+	if fmtType <= 1 {
+		// Заголовки 0 и 1 всегда начинают новое сообщение
+		cs.length = int(h[3])<<16 | int(h[4])<<8 | int(h[5])
+		cs.typ = h[6]
+		newMessage = true
+	}
+	if fmtType < 3 {
+		cs.extended = h[0] == 0xFF && h[1] == 0xFF && h[2] == 0xFF
+	}
+	if cs.extended {
+		if len(b) < n+4 {
+			return 0, false
+		}
+		switch {
+		case fmtType < 3 || newMessage:
+			copy(cs.extTime[:], b[n:n+4])
+			n += 4
+		case bytes.Equal(b[n:n+4], cs.extTime[:]):
+			// Продолжение сообщения: одни реализации повторяют метку, другие нет
+			n += 4
+		}
+	}
+
+	if newMessage {
+		cs.left = cs.length
+		cs.keep = cs.typ == 1 || cs.typ == 9
+		cs.data = cs.data[:0]
+	}
+	p.cur = cs
+	p.payloadLeft = cs.left
+	if p.payloadLeft > p.chunkSize {
+		p.payloadLeft = p.chunkSize
+	}
+	if cs.left == 0 {
+		p.finish(cs)
+	}
+	return n, true
+}
+
+func (p *rtmpChunkParser) consumePayload(b []byte) {
+	cs := p.cur
+	if cs.keep {
+		keep := rtmpMaxKeptMessage - len(cs.data)
+		if keep > len(b) {
+			keep = len(b)
+		}
+		cs.data = append(cs.data, b[:keep]...)
+	}
+	cs.left -= len(b)
+	p.payloadLeft -= len(b)
+	if cs.left == 0 {
+		p.finish(cs)
+	}
+}
+
+func (p *rtmpChunkParser) finish(cs *rtmpChunkStream) {
+	if cs.typ == 1 {
+		// Set Chunk Size
+		if len(cs.data) < 4 {
+			p.fail("short Set Chunk Size message")
+			return
+		}
+		size := binary.BigEndian.Uint32(cs.data) & 0x7FFFFFFF
+		if size == 0 {
+			p.fail("zero chunk size")
+			return
+		}
+		p.chunkSize = int(size)
+		return
+	}
+	if cs.keep && p.onMessage != nil {
+		p.onMessage(cs.typ, cs.length, cs.data)
+	}
+}
+
+// fail отключает разбор: публикация продолжается, но смена параметров
+// через sequence header больше не отслеживается
+func (p *rtmpChunkParser) fail(reason string) {
+	log.Printf("[RTMP] Chunk stream tap stopped: %s", reason)
+	p.failed = true
+	p.payloadLeft = 0
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+// rtmpTestMessage режет сообщение на чанки: первый с заголовком fmtType, остальные - fmt 3.
+// Метки от 0xFFFFFF пишутся расширенными; repeatExt повторяет их в чанках продолжения.
+func rtmpTestMessage(fmtType, csid, typ byte, ts uint32, data []byte, chunkSize int, repeatExt bool) []byte {
+	ext := ts >= 0xFFFFFF
+	tsField := ts
+	if ext {
+		tsField = 0xFFFFFF
+	}
+	var hdr []byte
+	switch fmtType {
+	case 0:
+		hdr = []byte{byte(tsField >> 16), byte(tsField >> 8), byte(tsField), byte(len(data) >> 16), byte(len(data) >> 8), byte(len(data)), typ, 1, 0, 0, 0}
+	case 1:
+		hdr = []byte{byte(tsField >> 16), byte(tsField >> 8), byte(tsField), byte(len(data) >> 16), byte(len(data) >> 8), byte(len(data)), typ}
+	case 2:
+		hdr = []byte{byte(tsField >> 16), byte(tsField >> 8), byte(tsField)}
+	}
+
+	var out []byte
+	for first := true; first || len(data) > 0; first = false {
+		n := chunkSize
+		if n > len(data) {
+			n = len(data)
+		}
+		if first {
+			out = append(out, fmtType<<6|csid)
+			out = append(out, hdr...)
+			if ext {
+				out = append(out, be32(ts)...)
+			}
+		} else {
+			out = append(out, 3<<6|csid)
+			if ext && repeatExt {
+				out = append(out, be32(ts)...)
+			}
+		}
+		out = append(out, data[:n]...)
+		data = data[n:]
+	}
+	return out
+}
+
+func rtmpTestVideo(key bool, avcPacketType byte, size int) []byte {
+	data := bytes.Repeat([]byte{0x55}, size)
+	data[0], data[1] = 0x27, avcPacketType
+	if key {
+		data[0] = 0x17
+	}
+	return data
+}
+
+func TestRTMPChunkParser(t *testing.T) {
+	rec1 := []byte{0x01, 0x42, 0x00, 0x1F, 0xFF, 0xE1, 0x00, 0x04, 0x67, 0x42, 0x00, 0x1F}
+	rec2 := []byte{0x01, 0x64, 0x00, 0x28, 0xFF, 0xE1, 0x00, 0x04, 0x67, 0x64, 0x00, 0x28}
+	rec3 := []byte{0x01, 0x4D, 0x00, 0x29, 0xFF, 0xE1, 0x00, 0x04, 0x67, 0x4D, 0x00, 0x29}
+	seqHeader := func(record []byte) []byte {
+		return concatBytes([]byte{0x17, 0x00, 0x00, 0x00, 0x00}, record)
+	}
+
+	// Первое видео сообщение прерывается чанком аудио из другого chunk stream
+	interleaved := rtmpTestMessage(1, 6, 9, 40, rtmpTestVideo(true, 1, 5000), 4096, false)
+	audio := rtmpTestMessage(0, 4, 8, 40, []byte{0xAF, 0x01, 0x21, 0x10}, 4096, false)
+	split := 1 + 7 + 4096
+
+	stream := concatBytes(
+		bytes.Repeat([]byte{0x03}, rtmpHandshakeSize),
+		rtmpTestMessage(0, 3, 20, 0, bytes.Repeat([]byte{0x02}, 200), 128, false),
+		rtmpTestMessage(0, 2, 1, 0, be32(4096), 128, false),
+		rtmpTestMessage(0, 6, 9, 0, seqHeader(rec1), 4096, false),
+		interleaved[:split], audio, interleaved[split:],
+		rtmpTestMessage(2, 6, 9, 40, rtmpTestVideo(false, 1, 5000), 4096, false),
+		rtmpTestMessage(3, 6, 9, 0, rtmpTestVideo(false, 1, 5000), 4096, false),
+		rtmpTestMessage(0, 6, 9, 0x01000000, seqHeader(rec2), 4096, true),
+		rtmpTestMessage(1, 6, 9, 0x01000028, rtmpTestVideo(true, 1, 5000), 4096, true),
+		rtmpTestMessage(1, 6, 9, 0x01000050, rtmpTestVideo(false, 1, 5000), 4096, false),
+		rtmpTestMessage(1, 6, 9, 40, rtmpTestVideo(false, 1, 70000), 4096, false),
+		rtmpTestMessage(0, 6, 9, 0x02000000, seqHeader(rec3), 4096, false),
+		rtmpTestMessage(0, 6, 9, 0x02000000, []byte{0x17, 0x02, 0, 0, 0}, 4096, false), // end of sequence
+	)
+
+	for _, step := range []int{1, 7, 1000, len(stream)} {
+		t.Run(fmt.Sprintf("по %d байт", step), func(t *testing.T) {
+			c := newRTMPTapConn(nil)
+			for i := 0; i < len(stream); i += step {
+				end := i + step
+				if end > len(stream) {
+					end = len(stream)
+				}
+				c.parser.Feed(stream[i:end])
+			}
+			if c.parser.failed {
+				t.Fatal("parser failed")
+			}
+			if c.videoMessages != 6 {
+				t.Errorf("video messages = %d, want 6", c.videoMessages)
+			}
+			want := []rtmpVideoConfig{{0, rec1}, {3, rec2}, {6, rec3}}
+			if len(c.configs) != len(want) {
+				t.Fatalf("got %d configs", len(c.configs))
+			}
+			for i, cfg := range c.configs {
+				if cfg.after != want[i].after || !bytes.Equal(cfg.record, want[i].record) {
+					t.Errorf("config %d: after %d record %x", i, cfg.after, cfg.record)
+				}
+			}
+		})
+	}
+
+	t.Run("VideoConfig", func(t *testing.T) {
+		c := newRTMPTapConn(nil)
+		c.parser.Feed(stream)
+		tests := []struct {
+			packet int64
+			want   []byte
+		}{
+			{1, rec1},
+			{2, nil},
+			{3, nil},
+			{4, rec2},
+			{7, rec3},
+			{8, nil},
+		}
+		for _, tt := range tests {
+			got, ok := c.VideoConfig(tt.packet)
+			if ok != (tt.want != nil) || !bytes.Equal(got, tt.want) {
+				t.Errorf("VideoConfig(%d) = %x, %v", tt.packet, got, ok)
+			}
+		}
+
+		// Несколько заголовков до одного кадра - берётся последний
+		c = newRTMPTapConn(nil)
+		c.parser.Feed(stream)
+		if got, _ := c.VideoConfig(7); !bytes.Equal(got, rec3) {
+			t.Errorf("VideoConfig(7) = %x, want last record", got)
+		}
+	})
+
+	t.Run("битый поток", func(t *testing.T) {
+		c := newRTMPTapConn(nil)
+		c.parser.Feed(concatBytes(bytes.Repeat([]byte{0x03}, rtmpHandshakeSize), []byte{3<<6 | 9, 0x00}))
+		if !c.parser.failed {
+			t.Error("continuation for unknown chunk stream accepted")
+		}
+	})
+}
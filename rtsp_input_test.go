@@ -0,0 +1,133 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseRTSPTracks(t *testing.T) {
+	sdp := strings.Join([]string{
+		"v=0",
+		"o=- 0 0 IN IP4 192.168.1.10",
+		"s=Camera",
+		"a=control:*",
+		"m=video 0 RTP/AVP 96",
+		"a=rtpmap:96 H264/90000",
+		"a=fmtp:96 packetization-mode=1; profile-level-id=42E01F; sprop-parameter-sets=Z0IAH5WoFAFuQA==,aM48gA==",
+		"a=control:trackID=1",
+		"m=audio 0 RTP/AVP 97",
+		"a=rtpmap:97 MPEG4-GENERIC/48000/2",
+		"a=fmtp:97 streamtype=5;mode=AAC-hbr;config=1190;SizeLength=13",
+		"a=control:rtsp://192.168.1.10/stream1/trackID=2",
+		"m=application 0 RTP/AVP 107",
+		"a=rtpmap:107 vnd.onvif.metadata/90000",
+		"m=audio 0 RTP/AVP 0",
+	}, "\r\n") + "\r\n"
+
+	tracks := parseRTSPTracks(sdp, "rtsp://192.168.1.10/stream1")
+	if len(tracks) != 3 {
+		t.Fatalf("got %d tracks, want 3", len(tracks))
+	}
+
+	tests := []struct {
+		kind, codec string
+		pt          uint8
+		clockRate   int
+		control     string
+		fmtp        map[string]string
+	}{
+		{"video", "h264", 96, 90000, "rtsp://192.168.1.10/stream1/trackID=1",
+			map[string]string{"packetization-mode": "1", "profile-level-id": "42E01F", "sprop-parameter-sets": "Z0IAH5WoFAFuQA==,aM48gA=="}},
+		{"audio", "mpeg4-generic", 97, 48000, "rtsp://192.168.1.10/stream1/trackID=2",
+			map[string]string{"streamtype": "5", "mode": "AAC-hbr", "config": "1190", "sizelength": "13"}},
+		{"audio", "", 0, 0, "rtsp://192.168.1.10/stream1", map[string]string{}},
+	}
+	for i, tt := range tests {
+		tr := tracks[i]
+		if tr.kind != tt.kind || tr.codec != tt.codec || tr.payloadType != tt.pt || tr.clockRate != tt.clockRate || tr.control != tt.control {
+			t.Errorf("track %d: got %s %s pt=%d rate=%d control=%s", i, tr.kind, tr.codec, tr.payloadType, tr.clockRate, tr.control)
+		}
+		if len(tr.fmtp) != len(tt.fmtp) {
+			t.Errorf("track %d: fmtp %v, want %v", i, tr.fmtp, tt.fmtp)
+		}
+		for k, v := range tt.fmtp {
+			if tr.fmtp[k] != v {
+				t.Errorf("track %d: fmtp[%s] = %q, want %q", i, k, tr.fmtp[k], v)
+			}
+		}
+	}
+}
+
+func TestRTSPControlURL(t *testing.T) {
+	tests := []struct{ base, control, want string }{
+		{"rtsp://cam/live", "", "rtsp://cam/live"},
+		{"rtsp://cam/live", "*", "rtsp://cam/live"},
+		{"rtsp://cam/live", "track1", "rtsp://cam/live/track1"},
+		{"rtsp://cam/live/", "track1", "rtsp://cam/live/track1"},
+		{"rtsp://cam/live", "RTSP://other/track", "RTSP://other/track"},
+	}
+	for _, tt := range tests {
+		if got := rtspControlURL(tt.base, tt.control); got != tt.want {
+			t.Errorf("rtspControlURL(%q, %q) = %q, want %q", tt.base, tt.control, got, tt.want)
+		}
+	}
+}
+
+func TestRTSPAuthHeader(t *testing.T) {
+	// Пример из RFC 2617, 3.5
+	const (
+		user     = "Mufasa"
+		password = "Circle Of Life"
+		uri      = "/dir/index.html"
+	)
+	challenge := `Digest realm="testrealm@host.com", qop="auth,auth-int", nonce="dcd98b7102dd2f0e8b11d0f600bfb0c093", opaque="5ccc069c403ebaf9f0171e9517f40e41"`
+
+	t.Run("basic", func(t *testing.T) {
+		auth := parseRTSPAuth([]string{`Basic realm="cam"`})
+		if got := auth.header("Aladdin", "open sesame", "DESCRIBE", uri); got != "Basic QWxhZGRpbjpvcGVuIHNlc2FtZQ==" {
+			t.Errorf("got %q", got)
+		}
+	})
+
+	t.Run("digest предпочтительнее basic", func(t *testing.T) {
+		auth := parseRTSPAuth([]string{`Basic realm="cam"`, challenge})
+		if !auth.digest || !auth.qopAuth || auth.realm != "testrealm@host.com" || auth.opaque != "5ccc069c403ebaf9f0171e9517f40e41" {
+			t.Fatalf("parsed %+v", auth)
+		}
+	})
+
+	t.Run("digest qop=auth", func(t *testing.T) {
+		auth := parseRTSPAuth([]string{challenge})
+		for nc := 1; nc <= 2; nc++ {
+			params := parseAuthParams(strings.TrimPrefix(auth.header(user, password, "GET", uri), "Digest "))
+			if params["username"] != user || params["uri"] != uri || params["qop"] != "auth" || params["opaque"] != auth.opaque {
+				t.Fatalf("header params %v", params)
+			}
+			if want := []string{"00000001", "00000002"}[nc-1]; params["nc"] != want {
+				t.Errorf("nc = %s, want %s", params["nc"], want)
+			}
+			ha1 := md5Hex(user + ":" + auth.realm + ":" + password)
+			ha2 := md5Hex("GET:" + uri)
+			want := md5Hex(ha1 + ":" + auth.nonce + ":" + params["nc"] + ":" + params["cnonce"] + ":auth:" + ha2)
+			if params["response"] != want {
+				t.Errorf("response = %s, want %s", params["response"], want)
+			}
+		}
+		// Та же формула на значениях из RFC даёт ответ из RFC
+		ha1 := md5Hex(user + ":" + auth.realm + ":" + password)
+		ha2 := md5Hex("GET:" + uri)
+		if got := md5Hex(ha1 + ":" + auth.nonce + ":00000001:0a4f113b:auth:" + ha2); got != "6629fae49393a05397450978507c4ef1" {
+			t.Errorf("RFC 2617 response = %s", got)
+		}
+	})
+
+	t.Run("digest без qop", func(t *testing.T) {
+		auth := parseRTSPAuth([]string{`Digest realm="cam", nonce="abc"`})
+		got := auth.header("admin", "secret", "DESCRIBE", "rtsp://cam/live")
+		response := md5Hex(md5Hex("admin:cam:secret") + ":abc:" + md5Hex("DESCRIBE:rtsp://cam/live"))
+		want := `Digest username="admin", realm="cam", nonce="abc", uri="rtsp://cam/live", response="` + response + `"`
+		if got != want {
+			t.Errorf("got  %s\nwant %s", got, want)
+		}
+	})
+}
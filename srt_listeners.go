@@ -0,0 +1,141 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	srt "github.com/datarhei/gosrt"
+)
+
+// Отдельные SRT порты (srt_listeners): многие аппаратные энкодеры не умеют задавать
+// stream ID, и различить их потоки можно только по порту. Stream ID на таком порту
+// не нужен - публикация всегда идёт во вход слушателя.
+
+// Validate проверяет слушателя; вход должен быть в конфиге
+func (l SRTListener) Validate(cfg *Config) error {
+	if l.Port < 1 || l.Port > 65535 {
+		return errors.New("port must be between 1 and 65535")
+	}
+	if l.Input == "" {
+		return errors.New("input is required")
+	}
+	found := false
+	for _, input := range cfg.Inputs {
+		if input.Name == l.Input {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return fmt.Errorf("input %s not found", l.Input)
+	}
+	if l.Latency < 0 {
+		return errors.New("latency must be >= 0")
+	}
+	if l.MaxBW < 0 {
+		return errors.New("max_bw must be >= 0")
+	}
+	switch l.PBKeylen {
+	case 0, 16, 24, 32:
+	default:
+		return errors.New("pbkeylen must be 16, 24 or 32")
+	}
+	srtCfg := l.srtConfig(cfg.SRTSettings)
+	return srtCfg.Validate()
+}
+
+// srtConfig собирает настройки gosrt слушателя; незаданное берётся из srt_settings
+func (l SRTListener) srtConfig(defaults SRTSettings) srt.Config {
+	cfg := srt.DefaultConfig()
+	latency := l.Latency
+	if latency == 0 {
+		latency = defaults.Latency
+	}
+	if latency > 0 {
+		cfg.Latency = time.Duration(latency) * time.Millisecond
+	}
+	cfg.Passphrase = l.Passphrase
+	if l.PBKeylen != 0 {
+		cfg.PBKeylen = l.PBKeylen
+	}
+	if l.MaxBW > 0 {
+		cfg.MaxBW = l.MaxBW
+	}
+	return cfg
+}
+
+// startListeners запускает слушателей srt_listeners
+func (s *SRTServer) startListeners() error {
+	for _, l := range s.config.SRTListeners {
+		l := l
+		serverConfig := l.srtConfig(s.config.SRTSettings)
+		server := &srt.Server{
+			Addr:   fmt.Sprintf(":%d", l.Port),
+			Config: &serverConfig,
+			HandleConnect: func(req srt.ConnRequest) srt.ConnType {
+				return s.handleListenerConnect(req, l)
+			},
+			HandlePublish: func(conn srt.Conn) {
+				s.mu.Lock()
+				s.connections[conn.RemoteAddr().String()] = conn
+				s.mu.Unlock()
+				s.wg.Add(1)
+				go s.handleConnection(conn, l.Input)
+			},
+		}
+		if err := server.Listen(); err != nil {
+			return fmt.Errorf("SRT listener on port %d: %w", l.Port, err)
+		}
+		s.listeners = append(s.listeners, server)
+		log.Printf("[SRT] Listener on :%d publishes to input %s", l.Port, l.Input)
+
+		go func() {
+			if err := server.Serve(); err != nil && s.ctx.Err() == nil {
+				log.Printf("[SRT] Listener on :%d error: %v", l.Port, err)
+			}
+		}()
+	}
+	return nil
+}
+
+// handleListenerConnect принимает публикацию на порт слушателя в его вход
+func (s *SRTServer) handleListenerConnect(req srt.ConnRequest, l SRTListener) srt.ConnType {
+	log.Printf("[SRT] Incoming connection from %s on port %d", req.RemoteAddr(), l.Port)
+
+	// Stream ID необязателен, но режим чтения на порту публикации не поддерживается
+	var user string
+	if sid, err := parseSRTStreamID(req.StreamId()); err == nil {
+		if sid.Mode != "publish" {
+			log.Printf("[SRT] Rejecting %s: mode %q is not supported", req.RemoteAddr(), sid.Mode)
+			req.Reject(srt.REJX_BAD_MODE)
+			return srt.REJECT
+		}
+		user = sid.User
+	}
+
+	inputCfg := s.manager.GetInputByName(l.Input)
+	if inputCfg == nil {
+		log.Printf("[SRT] Rejecting %s: input %s of port %d was removed", req.RemoteAddr(), l.Input, l.Port)
+		req.Reject(srt.REJX_NOTFOUND)
+		return srt.REJECT
+	}
+	if inputCfg.Pull != "" {
+		log.Printf("[SRT] Rejecting %s: input %s pulls from %s", req.RemoteAddr(), inputCfg.Name, redactPullURL(inputCfg.Pull))
+		req.Reject(srt.REJX_CONFLICT)
+		return srt.REJECT
+	}
+	if status := s.manager.GetStatus(inputCfg.Name); status != nil && status.Active {
+		log.Printf("[SRT] Rejecting %s: input %s is already being published", req.RemoteAddr(), inputCfg.Name)
+		req.Reject(srt.REJX_CONFLICT)
+		return srt.REJECT
+	}
+	// Пароли входа (srt_passphrase, srt_users) важнее пароля слушателя
+	if !s.checkInputPassphrase(req, inputCfg.Name, user, l.Passphrase) {
+		return srt.REJECT
+	}
+
+	log.Printf("[SRT] Accepted publish on port %d to input %s", l.Port, inputCfg.Name)
+	return srt.PUBLISH
+}
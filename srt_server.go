@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -10,13 +11,7 @@ import (
 	"sync"
 	"time"
 
-	"github.com/asticode/go-astits"
 	srt "github.com/datarhei/gosrt"
-	"github.com/datarhei/joy4/av"
-	"github.com/datarhei/joy4/codec/aacparser"
-	"github.com/datarhei/joy4/codec/h264parser"
-	"github.com/datarhei/joy4/format/rtmp"
-	"os/exec"
 )
 
 type SRTServer struct {
@@ -27,6 +22,7 @@ type SRTServer struct {
 	cancel      context.CancelFunc
 	wg          sync.WaitGroup
 	server      *srt.Server
+	listeners   []*srt.Server // srt_listeners: порт - фиксированный вход
 	connections map[string]srt.Conn
 	mu          sync.RWMutex
 }
@@ -54,21 +50,20 @@ func (s *SRTServer) Start() error {
 	}
 
 	s.server = &srt.Server{
-		Addr:   fmt.Sprintf(":%d", s.port),
-		Config: &serverConfig,
-		HandleConnect: func(req srt.ConnRequest) srt.ConnType {
-			streamID := req.StreamId()
-			log.Printf("[SRT] Incoming connection with streamID: %s", streamID)
-			return srt.PUBLISH
-		},
+		Addr:          fmt.Sprintf(":%d", s.port),
+		Config:        &serverConfig,
+		HandleConnect: s.handleConnect,
 		HandlePublish: func(conn srt.Conn) {
 			s.mu.Lock()
 			s.connections[conn.RemoteAddr().String()] = conn
 			s.mu.Unlock()
 			s.wg.Add(1)
-			go s.handleConnection(conn)
+			go s.handleConnection(conn, "")
 		},
 	}
+	if err := s.startListeners(); err != nil {
+		return err
+	}
 
 	// Heartbeat для отслеживания состояния SRT сервера
 	go func() {
@@ -105,17 +100,118 @@ func (s *SRTServer) Start() error {
 	return nil
 }
 
+// handleConnect разбирает stream ID и решает, принимать ли подключение.
+// Неизвестные потоки отклоняются кодами SRT (REJX_*), а не создают новые входы.
+func (s *SRTServer) handleConnect(req srt.ConnRequest) srt.ConnType {
+	streamID := req.StreamId()
+	log.Printf("[SRT] Incoming connection from %s with streamID: %s", req.RemoteAddr(), streamID)
+
+	sid, err := parseSRTStreamID(streamID)
+	if err != nil {
+		log.Printf("[SRT] Rejecting %s: %v", req.RemoteAddr(), err)
+		req.Reject(srt.REJX_BAD_REQUEST)
+		return srt.REJECT
+	}
+	if sid.Mode != "publish" {
+		log.Printf("[SRT] Rejecting %s: mode %q is not supported", req.RemoteAddr(), sid.Mode)
+		req.Reject(srt.REJX_BAD_MODE)
+		return srt.REJECT
+	}
+
+	inputCfg := s.manager.findInputForStreamID(sid.Resource)
+	if inputCfg == nil {
+		log.Printf("[SRT] Rejecting %s: no input for stream %q", req.RemoteAddr(), sid.Resource)
+		req.Reject(srt.REJX_NOTFOUND)
+		return srt.REJECT
+	}
+	if inputCfg.Pull != "" {
+		log.Printf("[SRT] Rejecting %s: input %s pulls from %s", req.RemoteAddr(), inputCfg.Name, redactPullURL(inputCfg.Pull))
+		req.Reject(srt.REJX_CONFLICT)
+		return srt.REJECT
+	}
+	if status := s.manager.GetStatus(inputCfg.Name); status != nil && status.Active {
+		log.Printf("[SRT] Rejecting %s: input %s is already being published", req.RemoteAddr(), inputCfg.Name)
+		req.Reject(srt.REJX_CONFLICT)
+		return srt.REJECT
+	}
+
+	if !s.checkInputPassphrase(req, inputCfg.Name, sid.User, s.config.SRTSettings.Passphrase) {
+		return srt.REJECT
+	}
+
+	if sid.User != "" {
+		log.Printf("[SRT] Accepted publish of %s (user %s) to input %s", sid.Resource, sid.User, inputCfg.Name)
+	} else {
+		log.Printf("[SRT] Accepted publish of %s to input %s", sid.Resource, inputCfg.Name)
+	}
+	return srt.PUBLISH
+}
+
+// checkInputPassphrase проверяет ключ публикации во вход: пароль пользователя из srt_users,
+// пароль входа или fallback (общий либо пароль слушателя)
+func (s *SRTServer) checkInputPassphrase(req srt.ConnRequest, inputName, user, fallback string) bool {
+	passphrase, ok := s.manager.GetInputSRTPassphrase(inputName, user, fallback)
+	if !ok {
+		log.Printf("[SRT] Rejecting %s: unknown user %q for input %s", req.RemoteAddr(), user, inputName)
+		req.Reject(srt.REJX_UNAUTHORIZED)
+		return false
+	}
+	return checkSRTPassphrase(req, passphrase, inputName)
+}
+
+// validateSRTInputAuth проверяет пароли входа: gosrt принимает от 10 до 79 символов
+func validateSRTInputAuth(passphrase string, users map[string]string) error {
+	if passphrase != "" && (len(passphrase) < 10 || len(passphrase) > 79) {
+		return errors.New("srt_passphrase must be 10 to 79 characters long")
+	}
+	for user, p := range users {
+		if user == "" {
+			return errors.New("srt_users: empty user name")
+		}
+		if len(p) < 10 || len(p) > 79 {
+			return fmt.Errorf("srt_users: passphrase of user %q must be 10 to 79 characters long", user)
+		}
+	}
+	return nil
+}
+
+// checkSRTPassphrase проверяет шифрование подключения; при отказе отклоняет запрос
+func checkSRTPassphrase(req srt.ConnRequest, passphrase, inputName string) bool {
+	if passphrase != "" {
+		if !req.IsEncrypted() {
+			log.Printf("[SRT] Rejecting %s: encryption required for input %s", req.RemoteAddr(), inputName)
+			req.Reject(srt.REJX_UNAUTHORIZED)
+			return false
+		}
+		if err := req.SetPassphrase(passphrase); err != nil {
+			log.Printf("[SRT] Rejecting %s: wrong passphrase for input %s", req.RemoteAddr(), inputName)
+			req.Reject(srt.REJ_BADSECRET)
+			return false
+		}
+	} else if req.IsEncrypted() {
+		log.Printf("[SRT] Rejecting %s: encrypted stream but no passphrase configured", req.RemoteAddr())
+		req.Reject(srt.REJ_BADSECRET)
+		return false
+	}
+	return true
+}
+
 func (s *SRTServer) Stop() error {
 	s.cancel()
 	if s.server != nil {
 		s.server.Shutdown()
 	}
+	for _, listener := range s.listeners {
+		listener.Shutdown()
+	}
 	s.wg.Wait()
 	log.Printf("[SRT] SRT server stopped")
 	return nil
 }
 
-func (s *SRTServer) handleConnection(conn srt.Conn) {
+// handleConnection обслуживает публикацию; fixedInput - вход слушателя srt_listeners,
+// иначе вход ищется по stream ID
+func (s *SRTServer) handleConnection(conn srt.Conn, fixedInput string) {
 	defer func() {
 		s.mu.Lock()
 		delete(s.connections, conn.RemoteAddr().String())
@@ -125,102 +221,112 @@ func (s *SRTServer) handleConnection(conn srt.Conn) {
 	}()
 
 	streamID := conn.StreamId()
-	inputName := "obs"
-	if streamID != "" {
-		inputName = streamID
-	}
 	log.Printf("[SRT] New SRT connection from %s with streamID: %s", conn.RemoteAddr(), streamID)
 
-	inputCfg := s.manager.GetInputByName(inputName)
-	if inputCfg == nil {
-		log.Printf("[SRT] No input config found for %s, creating default", inputName)
-		inputCfg = &InputCfg{
-			Name:    inputName,
-			URLPath: "/live/stream",
-			Outputs: []string{},
-		}
-		s.manager.AddInput(*inputCfg)
+	// Stream ID уже проверен в handleConnect, но вход могли удалить за это время
+	var inputCfg *InputCfg
+	if fixedInput != "" {
+		inputCfg = s.manager.GetInputByName(fixedInput)
+	} else if sid, err := parseSRTStreamID(streamID); err == nil {
+		inputCfg = s.manager.findInputForStreamID(sid.Resource)
 	}
-
-	s.manager.SetStatusActive(inputName, true)
-	defer s.manager.SetStatusActive(inputName, false)
-
-	// Находим SRT и RTMP выходы
-	var srtOutputs, rtmpOutputs, fileOutputs []string
-	for _, output := range s.manager.GetInputOutputs(inputName) {
-		if strings.HasPrefix(output, "srt://") {
-			srtOutputs = append(srtOutputs, output)
-		} else if strings.HasPrefix(output, "rtmp://") {
-			rtmpOutputs = append(rtmpOutputs, output)
-		} else if strings.HasPrefix(output, "file://") {
-			fileOutputs = append(fileOutputs, output)
-		}
+	if inputCfg == nil {
+		log.Printf("[SRT] No input found for streamID %q, closing connection", streamID)
+		return
 	}
-
-	if len(srtOutputs) == 0 && len(rtmpOutputs) == 0 && len(fileOutputs) == 0 {
-		log.Printf("[SRT] No outputs configured for %s", inputName)
+	// handleConnect уже отклонил занятый вход, но два издателя могли пройти его одновременно
+	if !s.manager.TryAcquirePublish(inputCfg.Name) {
+		log.Printf("[SRT] Closing %s: input %s is already being published", conn.RemoteAddr(), inputCfg.Name)
 		return
 	}
+	defer s.manager.SetStatusActive(inputCfg.Name, false)
 
-	if len(srtOutputs) > 0 {
-		log.Printf("[SRT] Found %d SRT outputs for %s", len(srtOutputs), inputName)
-		for _, outputURL := range srtOutputs {
-			s.manager.RegisterOutput(inputName, outputURL)
-		}
-	}
-	if len(rtmpOutputs) > 0 {
-		log.Printf("[SRT] Found %d RTMP outputs for %s", len(rtmpOutputs), inputName)
-		for _, outputURL := range rtmpOutputs {
-			s.manager.RegisterOutput(inputName, outputURL)
-		}
-	}
-	if len(fileOutputs) > 0 {
-		log.Printf("[SRT] Found %d file outputs for %s", len(fileOutputs), inputName)
-		for _, outputURL := range fileOutputs {
-			s.manager.RegisterOutput(inputName, outputURL)
+	s.serveTS(conn, inputCfg, fmt.Sprintf("srt://%s (%s)", conn.RemoteAddr(), inputCfg.Name), 30*time.Second)
+	log.Printf("[SRT] Connection closed: %s", conn.RemoteAddr())
+}
+
+// tsConn - источник MPEG-TS для serveTS: SRT соединение или UDP сокет
+type tsConn interface {
+	Read(p []byte) (int, error)
+	SetReadDeadline(t time.Time) error
+}
+
+// serveTS раздаёт MPEG-TS источника (SRT публикация, SRT caller, UDP/multicast)
+// до его обрыва. Возвращает ошибку чтения; nil - соединение закрыто штатно.
+func (s *SRTServer) serveTS(conn tsConn, inputCfg *InputCfg, source string, readTimeout time.Duration) error {
+	inputName := inputCfg.Name
+
+	// Ошибки continuity counter считаем по сырому потоку, до демуксинга
+	continuity := newTSContinuityChecker()
+	lastStats := time.Now()
+	var reportedErrors uint64
+	defer s.manager.SetTSStats(inputName, nil)
+
+	// Поток демуксится один раз и идёт в общий конвейер (RTMP, exec, mp4/flv файлы),
+	// а SRT выходы и .ts файлы получают исходный MPEG-TS без перепаковки
+	pipeReader, pipeWriter := io.Pipe()
+	pipelineDone := make(chan struct{})
+	go func() {
+		defer close(pipelineDone)
+		demuxer := newTSDemuxer(pipeReader, s.manager, inputName)
+		servePublish(s.manager, inputCfg, demuxer, source, isRawTSOutput)
+		// Конвейер завершился (например, кодеки не найдены) - дальнейшая запись в pipe не нужна
+		pipeReader.CloseWithError(io.ErrClosedPipe)
+	}()
+
+	// Конвейер получает данные через свой буфер, как сырые выходы: медленный демуксинг
+	// не должен останавливать чтение SRT и раздачу сырых выходов
+	pipelineCh := make(chan []byte, 1000)
+	feederDone := make(chan struct{})
+	go func() {
+		defer close(feederDone)
+		failed := false
+		for data := range pipelineCh {
+			if failed {
+				continue
+			}
+			if _, err := pipeWriter.Write(data); err != nil {
+				log.Printf("[SRT] Packet pipeline for %s stopped: %v", inputName, err)
+				failed = true
+			}
 		}
-	}
+		pipeWriter.Close()
+	}()
 
-	// Создаем каналы для каждого выхода
+	// Каналы сырых выходов
 	outputChannels := make(map[string]chan []byte)
 	stopChannels := make(map[string]chan struct{})
+	var outputsMu sync.Mutex
 
 	// Функция для создания выхода
 	createOutput := func(outputURL string) {
+		outputsMu.Lock()
+		defer outputsMu.Unlock()
 		if _, exists := outputChannels[outputURL]; exists {
 			return // Выход уже создан
 		}
 
 		ch := make(chan []byte, 1000)
-		if strings.HasPrefix(outputURL, "rtmp://") {
-			ch = make(chan []byte, 5000)
-		}
 		stop := make(chan struct{})
 		outputChannels[outputURL] = ch
 		stopChannels[outputURL] = stop
 
+		s.manager.RegisterOutput(inputName, outputURL)
 		s.wg.Add(1)
 		if strings.HasPrefix(outputURL, "srt://") {
 			go s.handleSRTOutput(inputName, outputURL, ch, stop)
-		} else if strings.HasPrefix(outputURL, "rtmp://") {
-			go s.handleRTMPOutput(inputName, outputURL, ch, stop)
-		} else if strings.HasPrefix(outputURL, "file://") {
+		} else {
 			go s.handleFileOutput(inputName, outputURL, ch, stop)
 		}
 	}
 
-	// Создаем начальные выходы
-	for _, outputURL := range srtOutputs {
-		createOutput(outputURL)
-	}
-	for _, outputURL := range rtmpOutputs {
-		createOutput(outputURL)
-	}
-	for _, outputURL := range fileOutputs {
-		createOutput(outputURL)
+	for _, outputURL := range s.manager.GetInputOutputs(inputName) {
+		if isRawTSOutput(outputURL) {
+			createOutput(outputURL)
+		}
 	}
 
-	// Горутина для динамического обновления выходов
+	// Горутина для динамического обновления сырых выходов (остальные обновляет servePublish)
 	updateTicker := time.NewTicker(2 * time.Second)
 	defer updateTicker.Stop()
 
@@ -231,17 +337,16 @@ func (s *SRTServer) handleConnection(conn srt.Conn) {
 			case <-stopUpdateChan:
 				return
 			case <-updateTicker.C:
-				// Получаем актуальный список выходов
 				currentOutputs := make(map[string]struct{})
 				for _, url := range s.manager.GetInputOutputs(inputName) {
-					if strings.HasPrefix(url, "srt://") || strings.HasPrefix(url, "rtmp://") || strings.HasPrefix(url, "file://") {
+					if isRawTSOutput(url) {
 						currentOutputs[url] = struct{}{}
-						s.manager.RegisterOutput(inputName, url)
 						createOutput(url)
 					}
 				}
 
 				// Удаляем неактуальные выходы
+				outputsMu.Lock()
 				for url, stopCh := range stopChannels {
 					if _, exists := currentOutputs[url]; !exists {
 						close(stopCh)
@@ -249,33 +354,29 @@ func (s *SRTServer) handleConnection(conn srt.Conn) {
 						delete(stopChannels, url)
 					}
 				}
+				outputsMu.Unlock()
 			}
 		}
 	}()
 
-	// Читаем данные из входящего SRT соединения и отправляем во все выходы
+	// Читаем данные из входящего SRT соединения и отправляем в конвейер и сырые выходы
 	buffer := make([]byte, 1316)
-	var totalBytes int64
-	var packetCount int64
-	startTime := time.Now()
-	lastLogTime := time.Now()
+	var readErr error
 
 	for {
-		select {
-		case <-s.ctx.Done():
+		if s.ctx.Err() != nil {
 			log.Printf("[SRT] Context cancelled, stopping connection")
-			close(stopUpdateChan)
-			return
-		default:
+			break
 		}
 
-		conn.SetReadDeadline(time.Now().Add(30 * time.Second))
+		conn.SetReadDeadline(time.Now().Add(readTimeout))
 		n, err := conn.Read(buffer)
 		if err != nil {
 			if err == io.EOF {
-				log.Printf("[SRT] Connection closed by client")
+				log.Printf("[SRT] Connection closed by peer")
 			} else {
 				log.Printf("[SRT] Read error: %v", err)
+				readErr = err
 			}
 			break
 		}
@@ -287,38 +388,54 @@ func (s *SRTServer) handleConnection(conn srt.Conn) {
 		data := make([]byte, n)
 		copy(data, buffer[:n])
 
-		totalBytes += int64(n)
-		packetCount++
+		continuity.Process(data)
+		if time.Since(lastStats) >= time.Second {
+			stats := continuity.Stats()
+			if stats.CCErrors > reportedErrors {
+				log.Printf("[TS] Input '%s': %d continuity errors (total %d)", inputName, stats.CCErrors-reportedErrors, stats.CCErrors)
+				reportedErrors = stats.CCErrors
+			}
+			s.manager.SetTSStats(inputName, stats)
+			lastStats = time.Now()
+		}
+
+		select {
+		case pipelineCh <- data:
+		default:
+			log.Printf("[SRT] Pipeline buffer full for %s, dropping packet", inputName)
+		}
 
+		outputsMu.Lock()
 		for outputURL, ch := range outputChannels {
 			select {
 			case ch <- data:
 				// ok
 			default:
-				if strings.HasPrefix(outputURL, "rtmp://") {
-					log.Printf("[SRT] RTMP Output buffer full for %s, dropping packet", outputURL)
-				} else {
-					log.Printf("[SRT] Output buffer full for %s, dropping packet", outputURL)
-				}
-			}
-		}
-
-		if time.Since(lastLogTime) >= 5*time.Second {
-			elapsed := time.Since(startTime).Seconds()
-			if elapsed > 0 {
-				// log.Printf("[SRT] Input stats - Packets: %d, Bytes: %d, Bitrate: %.1f kbps, AvgPacketSize: %.1f bytes",
-				// 	packetCount, totalBytes, bitrate, avgPacketSize)
+				log.Printf("[SRT] Output buffer full for %s, dropping packet", outputURL)
 			}
-			lastLogTime = time.Now()
 		}
+		outputsMu.Unlock()
 	}
 
 	close(stopUpdateChan)
+	outputsMu.Lock()
 	for _, stop := range stopChannels {
 		close(stop)
 	}
+	outputsMu.Unlock()
 
-	log.Printf("[SRT] Connection closed: %s", conn.RemoteAddr())
+	close(pipelineCh)
+	<-feederDone
+	<-pipelineDone
+	return readErr
+}
+
+// isRawTSOutput - выходы, которым SRT вход отдаёт исходный MPEG-TS без перепаковки
+func isRawTSOutput(url string) bool {
+	if strings.HasPrefix(url, "srt://") {
+		return true
+	}
+	return strings.HasPrefix(url, "file://") && strings.HasSuffix(strings.ToLower(url), ".ts")
 }
 
 func (s *SRTServer) handleSRTOutput(inputName, outputURL string, dataCh <-chan []byte, stopCh <-chan struct{}) {
@@ -372,6 +489,12 @@ func (s *SRTServer) handleSRTOutput(inputName, outputURL string, dataCh <-chan [
 		log.Printf("[SRT] Connected to SRT output: %s", outputURL)
 		s.manager.SetOutputActive(inputName, outputURL, true)
 
+		// Для нового подключения - свежий инжектор: PES, начатый в прошлом соединении, не нужен
+		var injector *tsParamSetInjector
+		if s.config.RepeatParamSetsFor(outputURL) {
+			injector = newTSParamSetInjector(s.manager.GetInputByName(inputName))
+		}
+
 		// Отправляем данные
 	srtWriteLoop:
 		for {
@@ -387,6 +510,13 @@ func (s *SRTServer) handleSRTOutput(inputName, outputURL string, dataCh <-chan [
 					return
 				}
 
+				if injector != nil {
+					data = injector.Process(data)
+					if len(data) == 0 {
+						continue
+					}
+				}
+
 				// Отправляем данные с таймаутом
 				conn.SetWriteDeadline(time.Now().Add(1 * time.Second))
 				_, err := conn.Write(data)
@@ -412,332 +542,21 @@ func (s *SRTServer) handleSRTOutput(inputName, outputURL string, dataCh <-chan [
 	}
 }
 
-// RTMP output: repack TS to FLV and send to RTMP server
-func (s *SRTServer) handleRTMPOutput(inputName, outputURL string, dataCh <-chan []byte, stopCh <-chan struct{}) {
-	defer s.wg.Done()
-
-	reconnectInterval := 5 // seconds
-	log.Printf("[SRT] Starting RTMP output to %s", outputURL)
-
-	for {
-		select {
-		case <-stopCh:
-			log.Printf("[SRT] RTMP output stopped: %s", outputURL)
-			s.manager.SetOutputActive(inputName, outputURL, false)
-			return
-		default:
-		}
-
-		dstConn, err := rtmp.Dial(outputURL, rtmp.DialOptions{})
-		if err != nil {
-			log.Printf("[SRT] RTMP Dial error for %s: %v", outputURL, err)
-			s.manager.SetOutputActive(inputName, outputURL, false)
-			s.manager.IncrementOutputError(inputName, outputURL)
-			select {
-			case <-stopCh:
-				return
-			case <-time.After(time.Duration(reconnectInterval) * time.Second):
-			}
-			continue
-		}
-		s.manager.SetOutputActive(inputName, outputURL, true)
-		log.Printf("[SRT] Connected to RTMP output: %s", outputURL)
-
-		pipeReader, pipeWriter := io.Pipe()
-
-		writerDone := make(chan struct{})
-		go func() {
-			defer close(writerDone)
-			defer pipeWriter.Close()
-			for {
-				select {
-				case <-stopCh:
-					return
-				case data, ok := <-dataCh:
-					if !ok {
-						return
-					}
-					_, err := pipeWriter.Write(data)
-					if err != nil {
-						// Pipe closed, probably by the reader.
-						return
-					}
-				}
-			}
-		}()
-
-		err = s.processRTMPStream(pipeReader, dstConn, inputName, outputURL)
-		if err != nil {
-			log.Printf("[SRT] RTMP stream processing error for %s: %v. Reconnecting...", outputURL, err)
-		}
-
-		dstConn.Close()
-		pipeReader.Close()
-		<-writerDone // Wait for writer to finish before looping to reconnect
-
-		s.manager.SetOutputActive(inputName, outputURL, false)
-		s.manager.IncrementOutputError(inputName, outputURL)
-
-		select {
-		case <-stopCh:
-			log.Printf("[SRT] RTMP output stopped during reconnect wait: %s", outputURL)
-			return
-		case <-time.After(time.Duration(reconnectInterval) * time.Second):
-		}
-	}
-}
-
-func (s *SRTServer) processRTMPStream(reader io.Reader, dstConn *rtmp.Conn, inputName, outputURL string) error {
-	demuxer := astits.NewDemuxer(context.Background(), reader)
-	var videoPID, audioPID uint16
-	var videoCodecData av.VideoCodecData
-	var audioCodecData av.AudioCodecData
-	var streams []av.CodecData
-	var flvHeaderWritten bool
-	detectStart := time.Now()
-
-	var baseTime time.Duration
-	var baseTimeSet bool
-
-	var lastVideoTime time.Duration
-	var lastAudioTime time.Duration
-
-	var totalBytes int64
-
-	for {
-		data, err := demuxer.NextData()
-		if err != nil {
-			if err == io.EOF || err == io.ErrClosedPipe {
-				return fmt.Errorf("demuxer stopped: %w", err)
-			}
-			return fmt.Errorf("demuxer error: %w", err)
-		}
-
-		if data == nil {
-			continue
-		}
-
-		// First, we need to detect PIDs and create codec data before processing any packets.
-		// This part runs until the RTMP header is written.
-		if !flvHeaderWritten {
-			// 1. Detect PIDs from PMT
-			if data.PMT != nil {
-				for _, es := range data.PMT.ElementaryStreams {
-					if es.StreamType == astits.StreamTypeH264Video {
-						videoPID = es.ElementaryPID
-					} else if es.StreamType == astits.StreamTypeAACAudio {
-						audioPID = es.ElementaryPID
-					}
-				}
-			}
-
-			if data.PES != nil {
-				// 2. Fallback PID detection
-				if videoPID == 0 || audioPID == 0 {
-					pes := data.PES.Data
-					if videoPID == 0 && len(pes) > 4 && pes[0] == 0x00 && pes[1] == 0x00 && pes[2] == 0x00 && pes[3] == 0x01 {
-						nalType := pes[4] & 0x1F
-						if nalType >= 1 && nalType <= 12 { // Valid H264 NAL types
-							videoPID = data.PID
-						}
-					} else if audioPID == 0 && len(pes) > 2 && (pes[0] == 0xFF) && ((pes[1] & 0xF0) == 0xF0) {
-						audioPID = data.PID
-					}
-				}
-
-				// 3. Create CodecData
-				if data.PID == videoPID && videoCodecData == nil {
-					nalus, _ := h264parser.SplitNALUs(data.PES.Data)
-					var sps, pps []byte
-					for _, nalu := range nalus {
-						if len(nalu) == 0 {
-							continue
-						}
-						naluType := nalu[0] & 0x1f
-						switch naluType {
-						case 7: // SPS
-							sps = nalu
-						case 8: // PPS
-							pps = nalu
-						}
-					}
-					if sps != nil && pps != nil {
-						vcd, err := h264parser.NewCodecDataFromSPSAndPPS(sps, pps)
-						if err == nil {
-							videoCodecData = vcd
-						}
-					}
-				} else if data.PID == audioPID && audioCodecData == nil {
-					if cfg, _, _, _, err := aacparser.ParseADTSHeader(data.PES.Data); err == nil {
-						acd, err := aacparser.NewCodecDataFromMPEG4AudioConfig(cfg)
-						if err == nil {
-							audioCodecData = acd
-						}
-					}
-				}
-			}
-
-			// 4. Записываем заголовок, когда готовы оба кодека ИЛИ после таймаута в 3 секунды при наличии хотя бы одного
-			hasVideo := videoCodecData != nil
-			hasAudio := audioCodecData != nil
-			if (hasVideo && hasAudio) || (time.Since(detectStart) > 3*time.Second && (hasVideo || hasAudio)) {
-				if hasVideo && hasAudio {
-					streams = []av.CodecData{videoCodecData, audioCodecData}
-				} else if hasVideo {
-					streams = []av.CodecData{videoCodecData}
-				} else {
-					streams = []av.CodecData{audioCodecData}
-				}
-				if err := dstConn.WriteHeader(streams); err != nil {
-					return fmt.Errorf("failed to write RTMP header: %w", err)
-				}
-				flvHeaderWritten = true
-			}
-		}
-
-		// If the header hasn't been written, or we don't have a PES packet, skip to the next data.
-		if !flvHeaderWritten || data.PES == nil {
-			continue
-		}
-
-		// Now, process the packets.
-		// We must wait for the first keyframe to set the base timestamp.
-		// All packets before the first keyframe will be dropped.
-
-		var isKeyFrame bool
-		if data.PID == videoPID {
-			nalus, _ := h264parser.SplitNALUs(data.PES.Data)
-			for _, nalu := range nalus {
-				if len(nalu) > 0 && (nalu[0]&0x1F) == 5 {
-					isKeyFrame = true
-					break
-				}
-			}
-		}
-
-		if !baseTimeSet {
-			if isKeyFrame {
-				if data.PES.Header.OptionalHeader != nil && data.PES.Header.OptionalHeader.PTS != nil {
-					pts := data.PES.Header.OptionalHeader.PTS.Base
-					baseTime = time.Duration(pts/90) * time.Millisecond
-					baseTimeSet = true
-				} else {
-					continue // Keyframe without a timestamp, drop it.
-				}
-			} else {
-				continue // Not a keyframe, and we are not started yet. Drop it.
-			}
-		}
-
-		// At this point, baseTime is set, and we can process all packets.
-		var pkt av.Packet
-		var streamIndex int8
-
-		if data.PID == videoPID {
-			streamIndex = 0
-		} else if data.PID == audioPID {
-			streamIndex = 1
-		} else {
-			continue // Not a stream we are interested in
-		}
-
-		if data.PES.Header.OptionalHeader == nil || data.PES.Header.OptionalHeader.PTS == nil {
-			continue // No timestamp
-		}
-		pts := data.PES.Header.OptionalHeader.PTS.Base
-		tsMilli := time.Duration(pts/90) * time.Millisecond
-
-		// Normalize timestamp against baseTime
-		pkt.Time = tsMilli - baseTime
-		if pkt.Time < 0 {
-			// This can happen if audio packets arrive with an earlier timestamp than the first keyframe.
-			// Set their timestamp to 0 to ensure they are sent immediately with the first video frame.
-			pkt.Time = 0
-		}
-
-		pkt.Idx = streamIndex
-		pkt.Data = data.PES.Data
-
-		if pkt.Idx == 0 { // Video
-			if pkt.Time < lastVideoTime {
-				pkt.Time = lastVideoTime
-			}
-			lastVideoTime = pkt.Time
-			pkt.IsKeyFrame = isKeyFrame
-		} else { // Audio
-			if pkt.Time < lastAudioTime {
-				pkt.Time = lastAudioTime
-			}
-			lastAudioTime = pkt.Time
-			// Strip ADTS header from audio packet
-			headerLen := 7
-			if len(pkt.Data) > 1 && (pkt.Data[1]&0x01) == 0 {
-				headerLen = 9
-			}
-			if len(pkt.Data) > headerLen {
-				pkt.Data = pkt.Data[headerLen:]
-			}
-		}
-
-		if err := dstConn.WritePacket(pkt); err != nil {
-			return fmt.Errorf("failed to write RTMP packet: %w", err)
-		}
-
-		totalBytes += int64(len(pkt.Data))
-		s.manager.UpdateOutputBitrate(inputName, outputURL, totalBytes)
-	}
-}
-
-// Функция для обработки записи в файл
+// Запись исходного MPEG-TS в .ts файл (mp4/flv пишет общий конвейер servePublish)
 func (s *SRTServer) handleFileOutput(inputName, outputURL string, dataCh <-chan []byte, stopCh <-chan struct{}) {
 	defer s.wg.Done()
 
 	filePath := strings.TrimPrefix(outputURL, "file://")
-	isMp4 := strings.HasSuffix(strings.ToLower(filePath), ".mp4")
 
-	var ffmpegCmd *exec.Cmd
-	var writeCloser io.WriteCloser
-	var file *os.File
-
-	if isMp4 {
-		ffmpegPath := "ffmpeg"
-		if _, err := os.Stat("./bin/ffmpeg.exe"); err == nil {
-			ffmpegPath = "./bin/ffmpeg.exe"
-		}
-		args := []string{
-			"-y",
-			"-f", "mpegts",
-			"-i", "pipe:0",
-			"-c", "copy",
-			"-movflags", "frag_keyframe+empty_moov",
-			filePath,
-		}
-		ffmpegCmd = exec.Command(ffmpegPath, args...)
-		var err error
-		writeCloser, err = ffmpegCmd.StdinPipe()
-		if err != nil {
-			log.Printf("[SRT] Failed to create ffmpeg stdin pipe for %s: %v", filePath, err)
-			s.manager.SetOutputActive(inputName, outputURL, false)
-			return
-		}
-		if err := ffmpegCmd.Start(); err != nil {
-			log.Printf("[SRT] Failed to start ffmpeg for %s: %v", filePath, err)
-			s.manager.SetOutputActive(inputName, outputURL, false)
-			return
-		}
-		log.Printf("[SRT] Writing fragmented MP4 via ffmpeg to: %s", filePath)
-	} else {
-		log.Printf("[SRT] Creating file: %s", filePath)
-		var err error
-		file, err = os.Create(filePath)
-		if err != nil {
-			log.Printf("[SRT] Failed to create file %s: %v", filePath, err)
-			s.manager.SetOutputActive(inputName, outputURL, false)
-			return
-		}
-		defer file.Close()
-		log.Printf("[SRT] Writing raw MPEG-TS to file: %s", filePath)
+	log.Printf("[SRT] Creating file: %s", filePath)
+	file, err := os.Create(filePath)
+	if err != nil {
+		log.Printf("[SRT] Failed to create file %s: %v", filePath, err)
+		s.manager.SetOutputActive(inputName, outputURL, false)
+		return
 	}
+	defer file.Close()
+	log.Printf("[SRT] Writing raw MPEG-TS to file: %s", filePath)
 
 	s.manager.SetOutputActive(inputName, outputURL, true)
 
@@ -747,37 +566,18 @@ func (s *SRTServer) handleFileOutput(inputName, outputURL string, dataCh <-chan
 		select {
 		case <-stopCh:
 			log.Printf("[SRT] File output stopped: %s", filePath)
-			if isMp4 {
-				writeCloser.Close()
-				ffmpegCmd.Wait()
-			}
 			s.manager.SetOutputActive(inputName, outputURL, false)
 			return
 		case data, ok := <-dataCh:
 			if !ok {
-				if isMp4 {
-					writeCloser.Close()
-					ffmpegCmd.Wait()
-				}
 				s.manager.SetOutputActive(inputName, outputURL, false)
 				return
 			}
-			if isMp4 {
-				_, err := writeCloser.Write(data)
-				if err != nil {
-					log.Printf("[SRT] Write error to ffmpeg pipe: %v", err)
-					writeCloser.Close()
-					ffmpegCmd.Wait()
-					s.manager.SetOutputActive(inputName, outputURL, false)
-					return
-				}
-			} else {
-				_, err := file.Write(data)
-				if err != nil {
-					log.Printf("[SRT] Write error to file %s: %v", filePath, err)
-					s.manager.SetOutputActive(inputName, outputURL, false)
-					return
-				}
+			_, err := file.Write(data)
+			if err != nil {
+				log.Printf("[SRT] Write error to file %s: %v", filePath, err)
+				s.manager.SetOutputActive(inputName, outputURL, false)
+				return
 			}
 			totalBytes += int64(len(data))
 			s.manager.UpdateOutputBitrate(inputName, outputURL, totalBytes)
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"testing"
+
+	srt "github.com/datarhei/gosrt"
+)
+
+// srtTestRequest - запрос на подключение, зашифрованный ключом key (пусто - без шифрования)
+type srtTestRequest struct {
+	srt.ConnRequest
+	key      string
+	rejected srt.RejectionReason
+}
+
+func (r *srtTestRequest) RemoteAddr() net.Addr {
+	return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 9000}
+}
+
+func (r *srtTestRequest) IsEncrypted() bool { return r.key != "" }
+
+func (r *srtTestRequest) SetPassphrase(p string) error {
+	if p != r.key {
+		return errors.New("wrong passphrase")
+	}
+	return nil
+}
+
+func (r *srtTestRequest) Reject(reason srt.RejectionReason) { r.rejected = reason }
+
+func TestGetInputSRTPassphrase(t *testing.T) {
+	sm := NewStreamManager([]InputCfg{
+		{Name: "open", URLPath: "/live/open"},
+		{Name: "own", URLPath: "/live/own", SRTPassphrase: "input-secret"},
+		{Name: "users", URLPath: "/live/users", SRTPassphrase: "input-secret", SRTUsers: map[string]string{"alice": "alice-secret"}},
+	}, &Config{})
+
+	tests := []struct {
+		input, user, fallback string
+		want                  string
+		ok                    bool
+	}{
+		{"open", "", "shared-secret", "shared-secret", true},
+		{"open", "", "", "", true},
+		{"own", "", "shared-secret", "input-secret", true},
+		{"own", "bob", "shared-secret", "input-secret", true},
+		{"users", "alice", "shared-secret", "alice-secret", true},
+		{"users", "bob", "shared-secret", "", false},
+		{"users", "", "shared-secret", "", false},
+		{"missing", "", "shared-secret", "", false},
+	}
+	for _, tt := range tests {
+		got, ok := sm.GetInputSRTPassphrase(tt.input, tt.user, tt.fallback)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("GetInputSRTPassphrase(%q, %q) = %q, %v; want %q, %v", tt.input, tt.user, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestCheckInputPassphrase(t *testing.T) {
+	s := &SRTServer{manager: NewStreamManager([]InputCfg{
+		{Name: "open", URLPath: "/live/open"},
+		{Name: "own", URLPath: "/live/own", SRTPassphrase: "input-secret"},
+		{Name: "users", URLPath: "/live/users", SRTUsers: map[string]string{"alice": "alice-secret"}},
+	}, &Config{})}
+
+	tests := []struct {
+		name            string
+		input, user     string
+		fallback, key   string
+		accept          bool
+		rejectionReason srt.RejectionReason
+	}{
+		{"без пароля", "open", "", "", "", true, 0},
+		{"общий пароль", "open", "", "shared-secret", "shared-secret", true, 0},
+		{"без шифрования при общем пароле", "open", "", "shared-secret", "", false, srt.REJX_UNAUTHORIZED},
+		{"шифрование без пароля", "open", "", "", "shared-secret", false, srt.REJ_BADSECRET},
+		{"пароль входа", "own", "", "shared-secret", "input-secret", true, 0},
+		{"общий пароль вместо пароля входа", "own", "", "shared-secret", "shared-secret", false, srt.REJ_BADSECRET},
+		{"пароль пользователя", "users", "alice", "", "alice-secret", true, 0},
+		{"чужой пароль пользователя", "users", "alice", "", "input-secret", false, srt.REJ_BADSECRET},
+		{"неизвестный пользователь", "users", "bob", "", "alice-secret", false, srt.REJX_UNAUTHORIZED},
+		{"без пользователя", "users", "", "", "alice-secret", false, srt.REJX_UNAUTHORIZED},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := &srtTestRequest{key: tt.key}
+			if got := s.checkInputPassphrase(req, tt.input, tt.user, tt.fallback); got != tt.accept {
+				t.Errorf("accepted = %v, want %v", got, tt.accept)
+			}
+			if req.rejected != tt.rejectionReason {
+				t.Errorf("rejection reason %v, want %v", req.rejected, tt.rejectionReason)
+			}
+		})
+	}
+}
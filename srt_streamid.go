@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// srtStreamID - разобранный SRT stream ID.
+// Поддерживается синтаксис SRT Access Control (#!::r=live/stream,m=publish,u=user,s=session)
+// и простые идентификаторы вида live/stream или /live/stream (весь ID - ресурс).
+type srtStreamID struct {
+	Resource string            // r= (или весь ID в простом виде)
+	Mode     string            // m=: publish, request, bidirectional
+	User     string            // u=
+	Session  string            // s=
+	Params   map[string]string // остальные ключи (h=, t= и пользовательские)
+}
+
+const srtAccessControlPrefix = "#!::"
+
+// Режим по умолчанию, если m= не указан. По спецификации это request, но сервер
+// только принимает потоки, а большинство энкодеров m= не передают.
+const srtDefaultMode = "publish"
+
+func parseSRTStreamID(id string) (*srtStreamID, error) {
+	sid := &srtStreamID{Mode: srtDefaultMode, Params: make(map[string]string)}
+	id = strings.TrimSpace(id)
+
+	if !strings.HasPrefix(id, srtAccessControlPrefix) {
+		sid.Resource = id
+		return sid, nil
+	}
+
+	body := strings.TrimPrefix(id, srtAccessControlPrefix)
+	for _, pair := range strings.Split(body, ",") {
+		if pair == "" {
+			continue
+		}
+		key, value, ok := strings.Cut(pair, "=")
+		if !ok || key == "" {
+			return nil, fmt.Errorf("invalid stream ID element %q", pair)
+		}
+		switch key {
+		case "r":
+			sid.Resource = value
+		case "m":
+			sid.Mode = strings.ToLower(value)
+		case "u":
+			sid.User = value
+		case "s":
+			sid.Session = value
+		default:
+			sid.Params[key] = value
+		}
+	}
+	return sid, nil
+}
+
+// findInputForStreamID ищет вход по имени или url_path из ресурса stream ID.
+// Пустой ресурс допустим, только если настроен единственный вход.
+func (sm *StreamManager) findInputForStreamID(resource string) *InputCfg {
+	resource = strings.Trim(resource, "/")
+
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+
+	if resource == "" {
+		if len(sm.inputs) == 1 {
+			for _, input := range sm.inputs {
+				return input
+			}
+		}
+		return nil
+	}
+
+	if input, ok := sm.inputs[resource]; ok {
+		return input
+	}
+	for _, input := range sm.inputs {
+		if strings.EqualFold(strings.Trim(input.URLPath, "/"), resource) {
+			return input
+		}
+	}
+	return nil
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseSRTStreamID(t *testing.T) {
+	tests := []struct {
+		id      string
+		want    srtStreamID
+		wantErr bool
+	}{
+		{id: "live/stream", want: srtStreamID{Resource: "live/stream", Mode: "publish", Params: map[string]string{}}},
+		{id: "  /live/stream ", want: srtStreamID{Resource: "/live/stream", Mode: "publish", Params: map[string]string{}}},
+		{id: "", want: srtStreamID{Mode: "publish", Params: map[string]string{}}},
+		{
+			id:   "#!::r=live/obs,m=Publish,u=alice,s=abc123",
+			want: srtStreamID{Resource: "live/obs", Mode: "publish", User: "alice", Session: "abc123", Params: map[string]string{}},
+		},
+		{
+			id:   "#!::u=bob,r=cam,h=example.com,t=stream,custom=1",
+			want: srtStreamID{Resource: "cam", Mode: "publish", User: "bob", Params: map[string]string{"h": "example.com", "t": "stream", "custom": "1"}},
+		},
+		{id: "#!::m=request,,r=x", want: srtStreamID{Resource: "x", Mode: "request", Params: map[string]string{}}},
+		{id: "#!::r=a=b", want: srtStreamID{Resource: "a=b", Mode: "publish", Params: map[string]string{}}},
+		{id: "#!::r=live,broken", wantErr: true},
+		{id: "#!::=value", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.id, func(t *testing.T) {
+			got, err := parseSRTStreamID(tt.id)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected error, got %+v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(*got, tt.want) {
+				t.Errorf("got %+v, want %+v", *got, tt.want)
+			}
+		})
+	}
+}
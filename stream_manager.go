@@ -40,8 +40,26 @@ type StreamStatus struct {
 	Connections int             `json:"connections"`
 	ErrorCount  int             `json:"error_count"`
 	Outputs     []*OutputStatus `json:"outputs,omitempty"`
+	Events      []InputEvent    `json:"events,omitempty"`
+
+	// Статистика приёма активной WHIP сессии
+	WHIP *WHIPSessionStats `json:"whip,omitempty"`
+	// Состояние подключения pull-входа к источнику
+	Pull *PullStatus `json:"pull,omitempty"`
+	// Счётчики входящего MPEG-TS (SRT, UDP)
+	TS *TSIngestStats `json:"ts,omitempty"`
+}
+
+// InputEvent - запись в истории событий входа (например, смена параметров кодека)
+type InputEvent struct {
+	Time    time.Time `json:"time"`
+	Type    string    `json:"type"`
+	Message string    `json:"message"`
 }
 
+// Сколько последних событий хранить для каждого входа
+const maxInputEvents = 50
+
 type OutputStatus struct {
 	URL         string  `json:"url"`
 	Active      bool    `json:"active"`
@@ -49,6 +67,12 @@ type OutputStatus struct {
 	ErrorCount  int     `json:"error_count"`
 	Uptime      string  `json:"uptime"`
 
+	// Состояние внешнего процесса для exec:// выходов
+	ProcessState    string `json:"process_state,omitempty"`
+	ProcessPID      int    `json:"process_pid,omitempty"`
+	ProcessRestarts int    `json:"process_restarts,omitempty"`
+	ProcessLastExit string `json:"process_last_exit,omitempty"`
+
 	// Внутренние поля для подсчёта битрейта
 	prevBytes int64
 	prevTime  time.Time
@@ -61,6 +85,11 @@ type StreamManager struct {
 	status  map[string]*StreamStatus
 	outputs map[string]map[string]*OutputStatus // inputName -> url -> OutputStatus
 	config  *Config                             // ссылка на глобальную конфигурацию
+
+	programs  map[string][]TSProgramInfo // inputName -> программы MPEG-TS из последнего анализа
+	whipStats map[string]*WHIPSessionStats
+	pulls     map[string]*PullStatus // состояние pull-входов
+	tsStats   map[string]*TSIngestStats
 }
 
 func validateRTMPURL(rawURL string) error {
@@ -81,6 +110,11 @@ func NewStreamManager(cfgs []InputCfg, cfg *Config) *StreamManager {
 		status:  make(map[string]*StreamStatus),
 		outputs: make(map[string]map[string]*OutputStatus),
 		config:  cfg,
+
+		programs:  make(map[string][]TSProgramInfo),
+		whipStats: make(map[string]*WHIPSessionStats),
+		pulls:     make(map[string]*PullStatus),
+		tsStats:   make(map[string]*TSIngestStats),
 	}
 	for _, c := range cfgs {
 		c := c
@@ -112,6 +146,9 @@ func (sm *StreamManager) RemoveInput(name string) {
 	delete(sm.inputs, name)
 	delete(sm.status, name)
 	delete(sm.outputs, name)
+	delete(sm.programs, name)
+	delete(sm.pulls, name)
+	delete(sm.tsStats, name)
 	log.Printf("[API] Removed input %s", name)
 }
 
@@ -166,7 +203,6 @@ func (sm *StreamManager) GetInputOutputs(name string) []string {
 	return outputs
 }
 
-
 func (sm *StreamManager) SetStatusActive(name string, active bool) {
 	sm.mu.Lock()
 	defer sm.mu.Unlock()
@@ -180,6 +216,21 @@ func (sm *StreamManager) SetStatusActive(name string, active bool) {
 	}
 }
 
+// TryAcquirePublish занимает вход под публикацию, если его никто не публикует.
+// Проверка и отметка делаются под одной блокировкой, поэтому из двух одновременных
+// издателей проходит один. Освобождение - SetStatusActive(name, false).
+func (sm *StreamManager) TryAcquirePublish(name string) bool {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	s, ok := sm.status[name]
+	if !ok || s.Connections > 0 {
+		return false
+	}
+	s.Connections = 1
+	s.Active = true
+	return true
+}
+
 func (sm *StreamManager) IncrementError(name string) {
 	sm.mu.Lock()
 	defer sm.mu.Unlock()
@@ -188,12 +239,31 @@ func (sm *StreamManager) IncrementError(name string) {
 	}
 }
 
+// AddInputEvent добавляет событие в историю входа
+func (sm *StreamManager) AddInputEvent(name, eventType, message string) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	s, ok := sm.status[name]
+	if !ok {
+		return
+	}
+	s.Events = append(s.Events, InputEvent{Time: time.Now(), Type: eventType, Message: message})
+	if len(s.Events) > maxInputEvents {
+		s.Events = append([]InputEvent(nil), s.Events[len(s.Events)-maxInputEvents:]...)
+	}
+	log.Printf("[EVENT] Input '%s' %s: %s", name, eventType, message)
+}
+
 func (sm *StreamManager) GetStatus(name string) *StreamStatus {
 	sm.mu.RLock()
 	defer sm.mu.RUnlock()
 	if s, ok := sm.status[name]; ok {
 		copy := *s
 		copy.Outputs = sm.getOutputsStatusLocked(name)
+		copy.Events = append([]InputEvent(nil), s.Events...)
+		copy.WHIP = sm.whipStats[name]
+		copy.Pull = sm.pulls[name]
+		copy.TS = sm.tsStats[name]
 		return &copy
 	}
 	return nil
@@ -216,6 +286,10 @@ func (sm *StreamManager) GetAllStatuses() []*StreamStatus {
 		s := sm.status[name]
 		copy := *s
 		copy.Outputs = sm.getOutputsStatusLocked(s.Name)
+		copy.Events = append([]InputEvent(nil), s.Events...)
+		copy.WHIP = sm.whipStats[s.Name]
+		copy.Pull = sm.pulls[s.Name]
+		copy.TS = sm.tsStats[s.Name]
 		list = append(list, &copy)
 	}
 	return list
@@ -262,6 +336,25 @@ func (sm *StreamManager) IncrementOutputError(inputName, url string) {
 	}
 }
 
+// SetOutputProcess обновляет состояние процесса exec:// выхода.
+// Пустой lastExit не затирает предыдущий результат завершения.
+func (sm *StreamManager) SetOutputProcess(inputName, url, state string, pid int, lastExit string) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	if outMap, ok := sm.outputs[inputName]; ok {
+		if out, ok2 := outMap[url]; ok2 {
+			if state == processStarting && out.ProcessState == processRestarting {
+				out.ProcessRestarts++
+			}
+			out.ProcessState = state
+			out.ProcessPID = pid
+			if lastExit != "" {
+				out.ProcessLastExit = lastExit
+			}
+		}
+	}
+}
+
 // Корректный подсчёт битрейта
 func (sm *StreamManager) UpdateOutputBitrate(inputName, url string, bytes int64) {
 	sm.mu.Lock()
@@ -423,6 +516,13 @@ func (sm *StreamManager) GetGlobalSettings() *Config {
 	return sm.config
 }
 
+// ExecAllowed сообщает, разрешён ли запуск команд (allow_exec)
+func (sm *StreamManager) ExecAllowed() bool {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+	return sm.config != nil && sm.config.AllowExec
+}
+
 func (sm *StreamManager) UpdateGlobalSettings(srtSettings SRTSettings) {
 	sm.mu.Lock()
 	defer sm.mu.Unlock()
@@ -575,11 +675,111 @@ func (sm *StreamManager) GetInputsCopy() map[string]*InputCfg {
 	for k, v := range sm.inputs {
 		copyOutputs := make([]string, len(v.Outputs))
 		copy(copyOutputs, v.Outputs)
-		copyMap[k] = &InputCfg{
-			Name:    v.Name,
-			URLPath: v.URLPath,
-			Outputs: copyOutputs,
-		}
+		input := *v
+		input.Outputs = copyOutputs
+		copyMap[k] = &input
 	}
 	return copyMap
 }
+
+// SetInputWHIPLayer выбирает слой simulcast WHIP для входа (пусто - самый высокий)
+func (sm *StreamManager) SetInputWHIPLayer(name, rid string) bool {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	input, ok := sm.inputs[name]
+	if !ok {
+		return false
+	}
+	input.WHIPLayer = rid
+	return true
+}
+
+// SetInputSRTPassphrase задаёт пароль SRT публикации входа и пароли пользователей stream ID
+func (sm *StreamManager) SetInputSRTPassphrase(name, passphrase string, users map[string]string) bool {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	input, ok := sm.inputs[name]
+	if !ok {
+		return false
+	}
+	input.SRTPassphrase = passphrase
+	input.SRTUsers = users
+	return true
+}
+
+// GetInputSRTPassphrase возвращает пароль SRT публикации во вход для пользователя
+// stream ID; ok=false - вход требует известного пользователя (srt_users), а его нет
+func (sm *StreamManager) GetInputSRTPassphrase(name, user, fallback string) (passphrase string, ok bool) {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+	input, exists := sm.inputs[name]
+	if !exists {
+		return "", false
+	}
+	if len(input.SRTUsers) > 0 {
+		passphrase, ok = input.SRTUsers[user]
+		return passphrase, ok && user != ""
+	}
+	if input.SRTPassphrase != "" {
+		return input.SRTPassphrase, true
+	}
+	return fallback, true
+}
+
+// GetInputWHIPLayer возвращает выбранный слой simulcast WHIP входа
+func (sm *StreamManager) GetInputWHIPLayer(name string) string {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+	if input, ok := sm.inputs[name]; ok {
+		return input.WHIPLayer
+	}
+	return ""
+}
+
+// SetInputPrograms сохраняет найденные в MPEG-TS программы для API анализа
+func (sm *StreamManager) SetInputPrograms(name string, programs []TSProgramInfo) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	sm.programs[name] = programs
+}
+
+// SetWHIPStats сохраняет статистику WHIP сессии входа (nil - сессия завершена)
+func (sm *StreamManager) SetWHIPStats(name string, stats *WHIPSessionStats) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	if stats == nil {
+		delete(sm.whipStats, name)
+		return
+	}
+	sm.whipStats[name] = stats
+}
+
+// SetPullStatus сохраняет копию состояния pull-входа (nil - pull остановлен)
+func (sm *StreamManager) SetPullStatus(name string, status *PullStatus) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	if status == nil {
+		delete(sm.pulls, name)
+		return
+	}
+	copy := *status
+	sm.pulls[name] = &copy
+}
+
+// SetTSStats сохраняет счётчики входящего MPEG-TS (nil - приём завершён)
+func (sm *StreamManager) SetTSStats(name string, stats *TSIngestStats) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	if stats == nil {
+		delete(sm.tsStats, name)
+		return
+	}
+	sm.tsStats[name] = stats
+}
+
+// GetInputPrograms возвращает программы MPEG-TS входа из последнего анализа
+func (sm *StreamManager) GetInputPrograms(name string) []TSProgramInfo {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+	return sm.programs[name]
+}
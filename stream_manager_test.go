@@ -0,0 +1,44 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestTryAcquirePublish(t *testing.T) {
+	sm := NewStreamManager([]InputCfg{{Name: "cam", URLPath: "/live/cam"}}, &Config{})
+
+	// Одновременные издатели (RTMP, WHIP, SRT, ...) - проходит ровно один
+	var acquired int32
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if sm.TryAcquirePublish("cam") {
+				atomic.AddInt32(&acquired, 1)
+			}
+		}()
+	}
+	wg.Wait()
+	if acquired != 1 {
+		t.Fatalf("%d publishers acquired the input", acquired)
+	}
+	if s := sm.GetStatus("cam"); !s.Active || s.Connections != 1 {
+		t.Errorf("status %+v", s)
+	}
+
+	sm.SetStatusActive("cam", false)
+	if s := sm.GetStatus("cam"); s.Active || s.Connections != 0 {
+		t.Errorf("status after release %+v", s)
+	}
+	// Лишнее освобождение отклонённого издателя не уводит счётчик в минус
+	sm.SetStatusActive("cam", false)
+	if !sm.TryAcquirePublish("cam") {
+		t.Error("input not acquired after release")
+	}
+	if sm.TryAcquirePublish("unknown") {
+		t.Error("unknown input acquired")
+	}
+}
@@ -13,7 +13,6 @@ const (
 	defaultCTS          = 2 * time.Millisecond
 	maxDrift            = 10 * time.Millisecond
 	ptsClockRate        = 90000
-	maxPTSDuration      = time.Duration(maxPTS) * time.Second / time.Duration(ptsClockRate)
 	warnBuffer          = 80 * time.Millisecond
 	minKeyframeInterval = 2 * time.Second
 )
@@ -122,10 +121,8 @@ func (tp *TimingProcessor) enforceMonotonicity(pkt *av.Packet) {
 }
 
 func (tp *TimingProcessor) validateFinalTiming(pkt *av.Packet) {
-	if pkt.Time > maxPTSDuration {
-		pkt.Time %= maxPTSDuration
-		log.Printf("[Timing] PTS wrap: %v", pkt.Time)
-	}
+	// Время не сворачивается по 33 битам: метки MPEG-TS уже развёрнуты mpegtsClock,
+	// FLV хранит 32-битные миллисекунды, а TS муксер сам переводит время в 33 бита
 
 	if pkt.CompositionTime > 0 && pkt.Time < pkt.CompositionTime {
 		pkt.CompositionTime = 0
@@ -206,6 +203,47 @@ func (tp *TimingProcessor) GetStats() TimingStats {
 	return tp.stats
 }
 
+// mpegtsClock разворачивает 33-битные метки PTS/DTS (90 кГц) в непрерывную шкалу.
+// Переполнение счётчика (~26.5 часа) и старт около точки переполнения
+// не приводят к скачкам: каждая новая метка приводится к ближайшей к предыдущей.
+type mpegtsClock struct {
+	last    int64
+	started bool
+}
+
+const ptsWrap = int64(1) << 33
+
+// Unwrap возвращает метку в тиках 90 кГц без переполнения (может быть отрицательной,
+// если поток стартовал сразу после точки переполнения)
+func (c *mpegtsClock) Unwrap(ts int64) int64 {
+	ts &= maxPTS
+	if !c.started {
+		c.started = true
+		c.last = ts
+		return ts
+	}
+	// Кандидат в той же "эпохе", что и предыдущая метка
+	candidate := (c.last &^ maxPTS) + ts
+	if candidate-c.last > ptsWrap/2 {
+		candidate -= ptsWrap
+	} else if c.last-candidate > ptsWrap/2 {
+		candidate += ptsWrap
+	}
+	c.last = candidate
+	return candidate
+}
+
+// ticksToDuration точно переводит тики 90 кГц во время без округления до миллисекунд
+func ticksToDuration(ticks int64) time.Duration {
+	return time.Duration(ticks/ptsClockRate)*time.Second +
+		time.Duration(ticks%ptsClockRate)*time.Second/ptsClockRate
+}
+
+// durationToTicks - обратное преобразование: время в тики 90 кГц
+func durationToTicks(d time.Duration) int64 {
+	return int64(d/time.Second)*ptsClockRate + int64(d%time.Second)*ptsClockRate/int64(time.Second)
+}
+
 func absDuration(d time.Duration) time.Duration {
 	if d < 0 {
 		return -d
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/datarhei/joy4/av"
+)
+
+func TestMPEGTSClockUnwrap(t *testing.T) {
+	tests := []struct {
+		name string
+		in   []int64
+		want []int64
+	}{
+		{"без переполнения", []int64{0, 3600, 7200}, []int64{0, 3600, 7200}},
+		{"переполнение", []int64{maxPTS - 1000, maxPTS, 500, 90000}, []int64{maxPTS - 1000, maxPTS, ptsWrap + 500, ptsWrap + 90000}},
+		{"B-кадр до точки переполнения", []int64{100, maxPTS - 100, 200}, []int64{100, -101, 200}},
+		{"лишние старшие биты", []int64{ptsWrap + 5, ptsWrap + 10}, []int64{5, 10}},
+		{"второе переполнение", []int64{maxPTS, 1 << 31, 1 << 32, 3 << 31, maxPTS, 1}, []int64{maxPTS, ptsWrap + 1<<31, ptsWrap + 1<<32, ptsWrap + 3<<31, 2*ptsWrap - 1, 2*ptsWrap + 1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var c mpegtsClock
+			for i, ts := range tt.in {
+				if got := c.Unwrap(ts); got != tt.want[i] {
+					t.Errorf("Unwrap(%d) #%d = %d, want %d", ts, i, got, tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+// Поток дольше 26.5 часов: время на выходе TimingProcessor продолжает расти
+func TestTimingProcessorAcrossPTSWrap(t *testing.T) {
+	var clock mpegtsClock
+	tp := NewTimingProcessor()
+
+	const start = 90000 // база - первый ключевой кадр на 1 с
+	var last time.Duration
+	var corrected uint64
+	for ticks := int64(start); ticks < 2*ptsWrap; ticks += 3600 * ptsClockRate {
+		for _, frame := range []int64{0, 3600, 7200} { // три кадра по 40 мс
+			raw := (ticks + frame) & maxPTS
+			pkt := av.Packet{Idx: 0, IsKeyFrame: frame == 0, Time: ticksToDuration(clock.Unwrap(raw))}
+			tp.Process(&pkt)
+
+			if want := ticksToDuration(ticks + frame - start); pkt.Time != want {
+				t.Fatalf("ticks %d: time %v, want %v", ticks+frame, pkt.Time, want)
+			}
+			if pkt.Time < last {
+				t.Fatalf("time went back from %v to %v", last, pkt.Time)
+			}
+			last = pkt.Time
+			if ticks == start && frame == 0 {
+				// CTS первого ключевого кадра больше его времени - это исправление ожидаемо
+				corrected = tp.GetStats().CorrectedPackets
+			}
+		}
+	}
+	if last <= ticksToDuration(ptsWrap) {
+		t.Errorf("last time %v did not pass a PTS wrap", last)
+	}
+	if stats := tp.GetStats(); stats.CorrectedPackets != corrected {
+		t.Errorf("corrected %d packets", stats.CorrectedPackets-corrected)
+	}
+
+	// RTMP выходы проверяют время через validateTiming
+	pkt := av.Packet{Time: 30 * time.Hour}
+	validateTiming(&pkt)
+	if pkt.Time != 30*time.Hour {
+		t.Errorf("validateTiming changed 30h to %v", pkt.Time)
+	}
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"encoding/binary"
+	"io"
+	"time"
+)
+
+// Подсчёт ошибок continuity counter во входящем MPEG-TS (ETR 290, 1.4 CC_error):
+// пропуск пакетов в сети видно ещё до демуксинга, по каждому PID отдельно.
+
+// TSIngestStats - статистика входящего MPEG-TS для API (GET /api/status)
+type TSIngestStats struct {
+	Packets     uint64     `json:"packets"`
+	CCErrors    uint64     `json:"cc_errors"`
+	LastCCError *time.Time `json:"last_cc_error,omitempty"`
+	UpdatedAt   time.Time  `json:"updated_at"`
+}
+
+type tsContinuityChecker struct {
+	last      map[uint16]uint8
+	duplicate map[uint16]bool
+	rest      []byte
+
+	packets   uint64
+	errors    uint64
+	lastError time.Time
+}
+
+func newTSContinuityChecker() *tsContinuityChecker {
+	return &tsContinuityChecker{
+		last:      make(map[uint16]uint8),
+		duplicate: make(map[uint16]bool),
+	}
+}
+
+// Process проверяет пакеты из очередного куска потока. Пакет может быть разрезан
+// между кусками, поэтому хвост сохраняется до следующего вызова.
+func (c *tsContinuityChecker) Process(chunk []byte) {
+	data := chunk
+	if len(c.rest) > 0 {
+		data = append(c.rest, chunk...)
+		c.rest = nil
+	}
+	for len(data) >= tsPacketSize {
+		if data[0] != 0x47 {
+			// Потеряна синхронизация - ищем следующий sync byte
+			data = data[1:]
+			continue
+		}
+		c.checkPacket(data[:tsPacketSize])
+		data = data[tsPacketSize:]
+	}
+	if len(data) > 0 {
+		c.rest = append([]byte(nil), data...)
+	}
+}
+
+func (c *tsContinuityChecker) checkPacket(pkt []byte) {
+	pid := uint16(pkt[1]&0x1f)<<8 | uint16(pkt[2])
+	if pid == 0x1fff {
+		return // null пакеты не нумеруются
+	}
+	c.packets++
+
+	afc := (pkt[3] >> 4) & 0x3
+	cc := pkt[3] & 0x0f
+	hasPayload := afc&0x1 != 0
+	discontinuity := afc&0x2 != 0 && pkt[4] > 0 && pkt[5]&0x80 != 0
+
+	last, seen := c.last[pid]
+	c.last[pid] = cc
+	if !seen || discontinuity || !hasPayload {
+		// Без payload счётчик не растёт, после discontinuity_indicator начинается заново
+		c.duplicate[pid] = false
+		return
+	}
+	if cc == last {
+		// Один повтор пакета допустим
+		if c.duplicate[pid] {
+			c.addError()
+		}
+		c.duplicate[pid] = true
+		return
+	}
+	c.duplicate[pid] = false
+	if cc != (last+1)&0x0f {
+		c.addError()
+	}
+}
+
+func (c *tsContinuityChecker) addError() {
+	c.errors++
+	c.lastError = time.Now()
+}
+
+// Stats возвращает текущие счётчики
+func (c *tsContinuityChecker) Stats() *TSIngestStats {
+	stats := &TSIngestStats{
+		Packets:   c.packets,
+		CCErrors:  c.errors,
+		UpdatedAt: time.Now(),
+	}
+	if !c.lastError.IsZero() {
+		t := c.lastError
+		stats.LastCCError = &t
+	}
+	return stats
+}
+
+// tsContinuityWriter стоит между TS муксером joy4 и выходом. При смене параметров
+// кодека муксер пересоздаётся: его continuity counter начинаются с нуля, а PMT
+// уходит с прежним version_number, и декодер видит потерю пакетов и старую PMT.
+// Писатель продолжает счётчики каждого PID, после Restart увеличивает версию PMT
+// и ставит discontinuity_indicator в первом пакете PID, где есть adaptation field.
+// Ещё он дописывает в PMT потоки, которые пишутся в обход муксера (Opus), и
+// запоминает DTS последнего видео PES, чтобы такие потоки шли в той же шкале.
+type tsContinuityWriter struct {
+	w    io.Writer
+	rest []byte
+
+	cc      map[uint16]uint8
+	pmtPIDs map[uint16]bool
+	version uint8
+	fresh   map[uint16]bool // PID'ы, ещё не получившие discontinuity_indicator после Restart
+
+	extraPMT []byte // описания потоков, добавляемые в PMT
+	videoDTS int64
+	hasDTS   bool
+}
+
+func newTSContinuityWriter(w io.Writer) *tsContinuityWriter {
+	return &tsContinuityWriter{
+		w:       w,
+		cc:      make(map[uint16]uint8),
+		pmtPIDs: make(map[uint16]bool),
+		fresh:   make(map[uint16]bool),
+	}
+}
+
+// Restart вызывается перед WriteHeader нового муксера
+func (t *tsContinuityWriter) Restart() {
+	t.version = (t.version + 1) & 0x1F
+	for pid := range t.cc {
+		t.fresh[pid] = true
+	}
+}
+
+// SetExtraPMTStreams задаёт описания потоков (stream_type, PID, ES info),
+// которые дописываются в каждую PMT муксера
+func (t *tsContinuityWriter) SetExtraPMTStreams(entries []byte) {
+	t.extraPMT = entries
+}
+
+// VideoDTS возвращает DTS (или PTS) последнего видео PES в тиках 90 кГц
+func (t *tsContinuityWriter) VideoDTS() (int64, bool) {
+	return t.videoDTS, t.hasDTS
+}
+
+// Write пишет только целые TS пакеты: муксер может отдавать пакет по частям
+func (t *tsContinuityWriter) Write(p []byte) (int, error) {
+	data := append(t.rest, p...)
+	t.rest = nil
+	n := len(data) - len(data)%tsPacketSize
+	if n < len(data) {
+		t.rest = append([]byte(nil), data[n:]...)
+	}
+	for off := 0; off < n; off += tsPacketSize {
+		t.fixPacket(data[off : off+tsPacketSize])
+	}
+	if n > 0 {
+		if _, err := t.w.Write(data[:n]); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+func (t *tsContinuityWriter) fixPacket(pkt []byte) {
+	if pkt[0] != 0x47 {
+		return
+	}
+	pid := uint16(pkt[1]&0x1f)<<8 | uint16(pkt[2])
+	if pid == 0x1fff {
+		return
+	}
+	if pid == 0 {
+		parsePATPMTPIDs(pkt, t.pmtPIDs)
+	} else if t.pmtPIDs[pid] {
+		t.rewritePMT(pkt)
+	} else if pkt[1]&0x40 != 0 {
+		t.readVideoDTS(pkt)
+	}
+
+	afc := (pkt[3] >> 4) & 0x3
+	cc := pkt[3] & 0x0f
+	if last, seen := t.cc[pid]; seen {
+		// Без payload счётчик не растёт
+		cc = last
+		if afc&0x1 != 0 {
+			cc = (last + 1) & 0x0f
+		}
+	}
+	t.cc[pid] = cc
+	pkt[3] = pkt[3]&0xf0 | cc
+
+	if t.fresh[pid] && afc&0x2 != 0 && pkt[4] > 0 {
+		pkt[5] |= 0x80
+		delete(t.fresh, pid)
+	}
+}
+
+// rewritePMT ставит version_number секции PMT, дописывает дополнительные
+// потоки и пересчитывает CRC
+func (t *tsContinuityWriter) rewritePMT(pkt []byte) {
+	section := psiSection(pkt)
+	if len(section) < 12 || section[0] != 0x02 {
+		return
+	}
+	sectionLen := int(binary.BigEndian.Uint16(section[1:3]) & 0x0FFF)
+	end := 3 + sectionLen - 4
+	if end < 8 || end+4+len(t.extraPMT) > len(section) {
+		return
+	}
+	copy(section[end:], t.extraPMT)
+	end += len(t.extraPMT)
+	sectionLen = end + 4 - 3
+	section[1] = section[1]&0xF0 | byte(sectionLen>>8)&0x0F
+	section[2] = byte(sectionLen)
+	section[5] = section[5]&0xC1 | t.version<<1
+	binary.BigEndian.PutUint32(section[end:end+4], mpegCRC32(section[:end]))
+}
+
+// readVideoDTS берёт метку из заголовка видео PES (stream_id 0xE0-0xEF)
+func (t *tsContinuityWriter) readVideoDTS(pkt []byte) {
+	pes, _ := tsPayload(pkt)
+	if len(pes) < 14 || pes[0] != 0 || pes[1] != 0 || pes[2] != 1 || pes[3]&0xF0 != 0xE0 {
+		return
+	}
+	flags := pes[7] >> 6
+	switch flags {
+	case 2:
+		t.videoDTS = parsePESTimestamp(pes[9:14])
+	case 3:
+		if len(pes) < 19 {
+			return
+		}
+		t.videoDTS = parsePESTimestamp(pes[14:19])
+	default:
+		return
+	}
+	t.hasDTS = true
+}
+
+// parsePESTimestamp разбирает 33-битную метку PTS/DTS из 5 байт заголовка PES
+func parsePESTimestamp(b []byte) int64 {
+	return int64(b[0]>>1&0x07)<<30 | int64(b[1])<<22 | int64(b[2]>>1)<<15 | int64(b[3])<<7 | int64(b[4]>>1)
+}
+
+// mpegCRC32 - CRC-32/MPEG-2 для PSI секций
+func mpegCRC32(data []byte) uint32 {
+	crc := uint32(0xFFFFFFFF)
+	for _, b := range data {
+		crc ^= uint32(b) << 24
+		for i := 0; i < 8; i++ {
+			if crc&0x80000000 != 0 {
+				crc = crc<<1 ^ 0x04C11DB7
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+// tsTestPacket собирает TS пакет; afc: 1 - только payload, 2 - только adaptation field, 3 - оба
+func tsTestPacket(pid uint16, pusi bool, afc, cc byte, discontinuity bool, payload []byte) []byte {
+	pkt := bytes.Repeat([]byte{0xFF}, tsPacketSize)
+	pkt[0] = 0x47
+	pkt[1] = byte(pid>>8) & 0x1F
+	if pusi {
+		pkt[1] |= 0x40
+	}
+	pkt[2] = byte(pid)
+	pkt[3] = afc<<4 | cc&0x0F
+	off := 4
+	if afc&0x2 != 0 {
+		pkt[4] = 1
+		pkt[5] = 0
+		if discontinuity {
+			pkt[5] = 0x80
+		}
+		off = 6
+	}
+	copy(pkt[off:], payload)
+	return pkt
+}
+
+func TestTSContinuityChecker(t *testing.T) {
+	type pkt struct {
+		pid           uint16
+		afc, cc       byte
+		discontinuity bool
+	}
+	tests := []struct {
+		name    string
+		packets []pkt
+		errors  uint64
+	}{
+		{"непрерывный поток", []pkt{{0x100, 1, 14, false}, {0x100, 1, 15, false}, {0x100, 1, 0, false}, {0x100, 1, 1, false}}, 0},
+		{"пропуск пакета", []pkt{{0x100, 1, 0, false}, {0x100, 1, 2, false}}, 1},
+		{"один повтор допустим", []pkt{{0x100, 1, 0, false}, {0x100, 1, 0, false}, {0x100, 1, 1, false}}, 0},
+		{"два повтора - ошибка", []pkt{{0x100, 1, 0, false}, {0x100, 1, 0, false}, {0x100, 1, 0, false}}, 1},
+		{"без payload счётчик не растёт", []pkt{{0x100, 1, 3, false}, {0x100, 2, 3, false}, {0x100, 1, 4, false}}, 0},
+		{"discontinuity_indicator", []pkt{{0x100, 1, 3, false}, {0x100, 3, 9, true}, {0x100, 1, 10, false}}, 0},
+		{"PID считаются отдельно", []pkt{{0x100, 1, 0, false}, {0x101, 1, 7, false}, {0x100, 1, 1, false}, {0x101, 1, 8, false}}, 0},
+		{"null пакеты не считаются", []pkt{{0x100, 1, 0, false}, {0x1FFF, 1, 5, false}, {0x1FFF, 1, 5, false}, {0x100, 1, 1, false}}, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var stream []byte
+			for _, p := range tt.packets {
+				stream = append(stream, tsTestPacket(p.pid, false, p.afc, p.cc, p.discontinuity, nil)...)
+			}
+			c := newTSContinuityChecker()
+			// Пакеты режутся между кусками - хвост должен дождаться продолжения
+			c.Process(stream[:100])
+			c.Process(stream[100:])
+			if c.errors != tt.errors {
+				t.Errorf("errors = %d, want %d", c.errors, tt.errors)
+			}
+		})
+	}
+}
+
+func TestTSContinuityWriter(t *testing.T) {
+	pat := []byte{0x00, 0x00, 0xB0, 0x0D, 0x00, 0x01, 0xC1, 0x00, 0x00, 0x00, 0x01, 0xF0, 0x00, 0x2A, 0xB1, 0x04, 0xB2}
+	pmt := []byte{0x00, 0x02, 0xB0, 0x12, 0x00, 0x01, 0xC1, 0x00, 0x00, 0xE1, 0x00, 0xF0, 0x00, 0x1B, 0xE1, 0x00, 0xF0, 0x00}
+	crc := mpegCRC32(pmt[1:])
+	pmt = append(pmt, byte(crc>>24), byte(crc>>16), byte(crc>>8), byte(crc))
+
+	// Так пишет новый муксер: счётчики каждого PID с нуля
+	muxerOutput := func() []byte {
+		return concatBytes(
+			tsTestPacket(0, true, 1, 0, false, pat),
+			tsTestPacket(0x1000, true, 1, 0, false, pmt),
+			tsTestPacket(0x100, true, 3, 0, false, []byte{0, 0, 1, 0xE0}),
+			tsTestPacket(0x100, false, 1, 1, false, nil),
+		)
+	}
+
+	var out bytes.Buffer
+	w := newTSContinuityWriter(&out)
+	first := muxerOutput()
+	w.Write(first[:50])
+	w.Write(first[50:])
+	w.Restart()
+	w.Write(muxerOutput())
+
+	if mpegCRC32(pat[1:13]) != 0x2AB104B2 {
+		t.Fatalf("CRC32 of the reference PAT = %08x", mpegCRC32(pat[1:13]))
+	}
+	data := out.Bytes()
+	if len(data) != 8*tsPacketSize {
+		t.Fatalf("written %d bytes", len(data))
+	}
+
+	c := newTSContinuityChecker()
+	c.Process(data)
+	if c.errors != 0 {
+		t.Errorf("continuity errors after muxer restart: %d", c.errors)
+	}
+
+	packet := func(i int) []byte { return data[i*tsPacketSize : (i+1)*tsPacketSize] }
+	for i, want := range []byte{0, 1} {
+		section := psiSection(packet(1 + i*4))
+		if v := section[5] >> 1 & 0x1F; v != want {
+			t.Errorf("PMT %d: version %d, want %d", i, v, want)
+		}
+		if mpegCRC32(section[:3+0x12]) != 0 {
+			t.Errorf("PMT %d: CRC does not match", i)
+		}
+	}
+	if packet(2)[5]&0x80 != 0 {
+		t.Error("discontinuity_indicator set before restart")
+	}
+	if packet(6)[5]&0x80 == 0 {
+		t.Error("discontinuity_indicator not set after restart")
+	}
+}
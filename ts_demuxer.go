@@ -0,0 +1,309 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/asticode/go-astits"
+	"github.com/datarhei/joy4/av"
+	"github.com/datarhei/joy4/codec/aacparser"
+	"github.com/datarhei/joy4/codec/h264parser"
+)
+
+// Сколько ждать второй кодек, если в потоке уже найден один
+const tsCodecDetectTimeout = 3 * time.Second
+
+// tsDemuxer разбирает MPEG-TS в av.Packet'ы для общего конвейера servePublish.
+// H.264 отдаётся в AVCC (без AUD), AAC - по одному кадру без ADTS заголовка.
+// Программа и PID'ы выбираются по настройкам входа, без PAT/PMT - по содержимому.
+type tsDemuxer struct {
+	sm        *StreamManager
+	inputName string
+
+	demuxer  *astits.Demuxer
+	selector *tsProgramSelector
+	videoPID uint16
+	audioPID uint16
+
+	streams  []av.CodecData
+	videoIdx int
+	audioIdx int
+
+	// Метки времени считаем в тиках 90 кГц с разворотом 33-битного переполнения
+	clock         mpegtsClock
+	baseTicks     int64
+	baseTimeSet   bool
+	resumeTicks   int64 // метка первого кадра после разрыва (resumeAt)
+	audioSplitter adtsSplitter
+	lastVideoTime time.Duration
+	lastAudioTime time.Duration
+	videoStep     time.Duration // интервал между последними кадрами видео
+
+	queue []av.Packet
+}
+
+func newTSDemuxer(r io.Reader, sm *StreamManager, inputName string) *tsDemuxer {
+	selector := newTSProgramSelector(sm.GetInputByName(inputName))
+	return &tsDemuxer{
+		sm:        sm,
+		inputName: inputName,
+		demuxer:   astits.NewDemuxer(context.Background(), r),
+		selector:  selector,
+		videoPID:  selector.VideoPID(),
+		audioPID:  selector.AudioPID(),
+		videoIdx:  -1,
+		audioIdx:  -1,
+	}
+}
+
+// nextData читает следующий элемент TS и обновляет список программ для API анализа
+func (d *tsDemuxer) nextData() (*astits.DemuxerData, error) {
+	for {
+		data, err := d.demuxer.NextData()
+		if err != nil {
+			return nil, fmt.Errorf("demuxer stopped: %w", err)
+		}
+		if data == nil {
+			continue
+		}
+		if data.PAT != nil && d.selector.HandlePAT(data.PAT) {
+			d.sm.SetInputPrograms(d.inputName, d.selector.Programs())
+		}
+		if data.PMT != nil && d.selector.HandlePMT(data.PMT) {
+			d.sm.SetInputPrograms(d.inputName, d.selector.Programs())
+		}
+		return data, nil
+	}
+}
+
+// Streams читает поток, пока не найдены кодеки: оба или хотя бы один через 3 секунды
+func (d *tsDemuxer) Streams() ([]av.CodecData, error) {
+	if d.streams != nil {
+		return d.streams, nil
+	}
+
+	var videoCodecData av.VideoCodecData
+	var audioCodecData av.AudioCodecData
+	detectStart := time.Now()
+
+	for {
+		data, err := d.nextData()
+		if err != nil {
+			return nil, err
+		}
+
+		// 1. PID'ы из PMT (program/video_pid/audio_pid/audio_lang входа)
+		if !d.selector.NeedsFallback() {
+			d.videoPID, d.audioPID = d.selector.VideoPID(), d.selector.AudioPID()
+		}
+
+		if data.PES != nil {
+			pes := data.PES.Data
+			// 2. Поиск PID'ов по содержимому (только для потоков без PAT/PMT)
+			if d.selector.NeedsFallback() && (d.videoPID == 0 || d.audioPID == 0) {
+				if d.videoPID == 0 && len(pes) > 4 && pes[0] == 0x00 && pes[1] == 0x00 && pes[2] == 0x00 && pes[3] == 0x01 {
+					nalType := pes[4] & 0x1F
+					if nalType >= 1 && nalType <= 12 {
+						d.videoPID = data.PID
+					}
+				} else if d.audioPID == 0 && len(pes) > 2 && pes[0] == 0xFF && (pes[1]&0xF0) == 0xF0 {
+					d.audioPID = data.PID
+				}
+			}
+
+			// 3. CodecData
+			if data.PID == d.videoPID && videoCodecData == nil {
+				nalus, _ := h264parser.SplitNALUs(pes)
+				var sps, pps []byte
+				for _, nalu := range nalus {
+					if len(nalu) == 0 {
+						continue
+					}
+					switch nalu[0] & 0x1f {
+					case 7:
+						sps = nalu
+					case 8:
+						pps = nalu
+					}
+				}
+				if sps != nil && pps != nil {
+					if vcd, err := h264parser.NewCodecDataFromSPSAndPPS(sps, pps); err == nil {
+						videoCodecData = vcd
+					}
+				}
+			} else if data.PID == d.audioPID && audioCodecData == nil {
+				if cfg, _, _, _, err := aacparser.ParseADTSHeader(pes); err == nil {
+					if acd, err := aacparser.NewCodecDataFromMPEG4AudioConfig(cfg); err == nil {
+						audioCodecData = acd
+					}
+				}
+			}
+		}
+
+		hasVideo := videoCodecData != nil
+		hasAudio := audioCodecData != nil
+		if (hasVideo && hasAudio) || (time.Since(detectStart) > tsCodecDetectTimeout && (hasVideo || hasAudio)) {
+			if hasVideo {
+				d.videoIdx = len(d.streams)
+				d.streams = append(d.streams, videoCodecData)
+			}
+			if hasAudio {
+				d.audioIdx = len(d.streams)
+				d.streams = append(d.streams, audioCodecData)
+			}
+			return d.streams, nil
+		}
+	}
+}
+
+// resumeAt продолжает уже начатый поток в новом демуксере после разрыва меток
+// (EXT-X-DISCONTINUITY в HLS): кодеки известны, первый кадр получает метку at
+func (d *tsDemuxer) resumeAt(streams []av.CodecData, at time.Duration) {
+	d.streams = streams
+	for i, stream := range streams {
+		switch stream.Type() {
+		case av.H264:
+			d.videoIdx = i
+		case av.AAC:
+			d.audioIdx = i
+		}
+	}
+	d.resumeTicks = durationToTicks(at)
+	d.lastVideoTime, d.lastAudioTime = at, at
+}
+
+// nextTime - метка, с которой продолжится поток после разрыва
+func (d *tsDemuxer) nextTime() time.Duration {
+	next := d.lastVideoTime + d.videoStep
+	if d.lastAudioTime > next {
+		next = d.lastAudioTime
+	}
+	return next
+}
+
+// ReadPacket возвращает следующий пакет. Всё, что пришло до первого ключевого кадра, отбрасывается.
+func (d *tsDemuxer) ReadPacket() (av.Packet, error) {
+	if d.streams == nil {
+		if _, err := d.Streams(); err != nil {
+			return av.Packet{}, err
+		}
+	}
+
+	for len(d.queue) == 0 {
+		data, err := d.nextData()
+		if err != nil {
+			return av.Packet{}, err
+		}
+		// После resumeAt PID'ы ещё не выбраны - берём их из PMT
+		if d.videoPID == 0 && d.audioPID == 0 && !d.selector.NeedsFallback() {
+			d.videoPID, d.audioPID = d.selector.VideoPID(), d.selector.AudioPID()
+		}
+		if data.PES != nil {
+			d.handlePES(data)
+		}
+	}
+
+	pkt := d.queue[0]
+	d.queue = d.queue[1:]
+	return pkt, nil
+}
+
+func (d *tsDemuxer) handlePES(data *astits.DemuxerData) {
+	isVideo := data.PID == d.videoPID && d.videoIdx >= 0
+	isAudio := data.PID == d.audioPID && d.audioIdx >= 0
+	if !isVideo && !isAudio {
+		return
+	}
+
+	optHeader := data.PES.Header.OptionalHeader
+	if optHeader == nil || optHeader.PTS == nil {
+		return
+	}
+	ptsTicks := d.clock.Unwrap(optHeader.PTS.Base)
+	dtsTicks := ptsTicks
+	if optHeader.DTS != nil {
+		dtsTicks = d.clock.Unwrap(optHeader.DTS.Base)
+	}
+
+	if isVideo {
+		payload, isKeyFrame := annexBToAVCC(data.PES.Data)
+		// Базовое время - DTS первого ключевого кадра, всё до него отбрасываем
+		if !d.baseTimeSet {
+			if !isKeyFrame {
+				return
+			}
+			d.baseTicks = dtsTicks - d.resumeTicks
+			d.baseTimeSet = true
+		}
+		pkt := av.Packet{
+			Idx:        int8(d.videoIdx),
+			Data:       payload,
+			IsKeyFrame: isKeyFrame,
+			Time:       ticksToDuration(dtsTicks - d.baseTicks),
+		}
+		if ptsTicks > dtsTicks {
+			pkt.CompositionTime = ticksToDuration(ptsTicks - dtsTicks)
+		}
+		if pkt.Time < d.lastVideoTime {
+			pkt.Time = d.lastVideoTime
+		}
+		if pkt.Time > d.lastVideoTime {
+			d.videoStep = pkt.Time - d.lastVideoTime
+		}
+		d.lastVideoTime = pkt.Time
+		d.queue = append(d.queue, pkt)
+		return
+	}
+
+	// Аудио без видео: базовое время - первый аудиокадр
+	if !d.baseTimeSet {
+		if d.videoIdx >= 0 {
+			return
+		}
+		d.baseTicks = ptsTicks - d.resumeTicks
+		d.baseTimeSet = true
+	}
+	for _, frame := range d.audioSplitter.Split(data.PES.Data, ptsTicks) {
+		pkt := av.Packet{
+			Idx:  int8(d.audioIdx),
+			Data: frame.Payload,
+			Time: ticksToDuration(frame.Ticks - d.baseTicks),
+		}
+		// Аудио с меткой раньше первого ключевого кадра отправляем сразу с ним
+		if pkt.Time < 0 {
+			pkt.Time = 0
+		}
+		if pkt.Time < d.lastAudioTime {
+			pkt.Time = d.lastAudioTime
+		}
+		d.lastAudioTime = pkt.Time
+		d.queue = append(d.queue, pkt)
+	}
+}
+
+// annexBToAVCC переводит кадр H.264 из Annex B в AVCC, убирая AUD.
+// SPS/PPS остаются в кадре - по ним servePublish замечает смену параметров.
+func annexBToAVCC(data []byte) ([]byte, bool) {
+	nalus, _ := h264parser.SplitNALUs(data)
+	size := 0
+	for _, nalu := range nalus {
+		size += 4 + len(nalu)
+	}
+	out := make([]byte, 0, size)
+	isKeyFrame := false
+	for _, nalu := range nalus {
+		if len(nalu) == 0 {
+			continue
+		}
+		switch nalu[0] & 0x1f {
+		case 9: // AUD
+			continue
+		case 5:
+			isKeyFrame = true
+		}
+		out = appendAVCCNALU(out, nalu)
+	}
+	return out, isKeyFrame
+}
@@ -0,0 +1,489 @@
+package main
+
+import (
+	"encoding/binary"
+
+	"github.com/datarhei/joy4/av"
+	"github.com/datarhei/joy4/codec/h264parser"
+)
+
+// Параметры кодека на TS/SRT выходах.
+// Декодеры (IRD, VLC), подключившиеся к выходу посреди потока, не могут начать
+// декодирование, пока не увидят SPS/PPS. Муксер joy4 сам пишет AUD перед каждым
+// кадром и SPS/PPS из CodecData перед каждым ключевым кадром, поэтому на путях
+// через муксер достаточно правильно выставить IsKeyFrame и убрать внутрипотоковые
+// копии. Для сырого MPEG-TS (pass-through SRT → SRT) параметры вставляет
+// tsParamSetInjector, его включает repeat_param_sets.
+
+const tsPacketSize = 188
+
+var (
+	annexBStartCode = []byte{0, 0, 0, 1}
+	annexBAUD       = []byte{0, 0, 0, 1, 0x09, 0xF0}
+)
+
+// normalizeTSVideoPacket готовит H.264 av.Packet для TS муксера joy4:
+// выставляет IsKeyFrame, если в пакете есть IDR, и убирает внутрипотоковые
+// SPS/PPS/AUD - муксер пишет их сам, иначе в потоке будут дубли.
+// Возвращает false, если в пакете не осталось данных (были только параметры).
+func normalizeTSVideoPacket(pkt *av.Packet) bool {
+	nalus, _ := h264parser.SplitNALUs(pkt.Data)
+	stripped := false
+	size := 0
+	for _, nalu := range nalus {
+		if len(nalu) == 0 {
+			continue
+		}
+		switch nalu[0] & 0x1f {
+		case 5:
+			pkt.IsKeyFrame = true
+		case 7, 8, 9: // SPS, PPS, AUD
+			stripped = true
+			continue
+		}
+		size += 4 + len(nalu)
+	}
+	if !stripped {
+		return true
+	}
+	if size == 0 {
+		return false
+	}
+
+	data := make([]byte, 0, size)
+	for _, nalu := range nalus {
+		if len(nalu) == 0 {
+			continue
+		}
+		switch nalu[0] & 0x1f {
+		case 7, 8, 9:
+			continue
+		}
+		data = appendAVCCNALU(data, nalu)
+	}
+	pkt.Data = data
+	return true
+}
+
+func appendAVCCNALU(dst, nalu []byte) []byte {
+	var size [4]byte
+	binary.BigEndian.PutUint32(size[:], uint32(len(nalu)))
+	dst = append(dst, size[:]...)
+	return append(dst, nalu...)
+}
+
+// tsParamSetInjector делает то же самое для сырого MPEG-TS (pass-through SRT → SRT):
+// находит H.264 PID по PAT/PMT, запоминает последние SPS/PPS и, если PES с IDR
+// пришёл без них, вставляет AUD+SPS+PPS в начало PES. Переупаковывается только
+// начало такого PES, остальные пакеты идут без изменений (со сдвигом continuity counter).
+// В MPTS инжектор работает с одной программой: заданной в program входа или первой в PAT.
+type tsParamSetInjector struct {
+	partial []byte // неполный TS пакет с прошлого вызова
+
+	program    uint16 // program из настроек входа (0 - первая программа в PAT)
+	fixedVideo uint16 // video_pid из настроек входа
+	pmtProgram uint16 // номер выбранной программы по PAT
+	pmtPID     uint16 // PID её PMT
+	videoPID   uint16
+
+	sps, pps []byte
+	ccShift  map[uint16]uint8 // сколько пакетов добавлено на PID (по модулю 16)
+	held     [][]byte         // начало текущего видео PES, пока не ясно, нужен ли повтор
+}
+
+// Сколько пакетов начала PES можно удерживать в ожидании первого слайса
+const maxHeldTSPackets = 8
+
+func newTSParamSetInjector(inputCfg *InputCfg) *tsParamSetInjector {
+	t := &tsParamSetInjector{ccShift: make(map[uint16]uint8)}
+	if inputCfg != nil {
+		t.program = uint16(inputCfg.Program)
+		t.fixedVideo = uint16(inputCfg.VideoPID)
+	}
+	// Явно заданный PID работает и без PMT
+	t.videoPID = t.fixedVideo
+	return t
+}
+
+// Process принимает очередной кусок TS и возвращает данные для отправки.
+// Возвращаемый срез может быть короче входного (пакеты видео удерживаются)
+// или длиннее (добавлены пакеты с параметрами).
+func (t *tsParamSetInjector) Process(chunk []byte) []byte {
+	data := chunk
+	if len(t.partial) > 0 {
+		data = append(t.partial, chunk...)
+		t.partial = nil
+	}
+
+	out := make([]byte, 0, len(data)+tsPacketSize)
+	for len(data) >= tsPacketSize {
+		if data[0] != 0x47 {
+			// Потеряна синхронизация - отдаём как есть до следующего байта синхронизации
+			out = append(out, data[0])
+			data = data[1:]
+			continue
+		}
+		pkt := data[:tsPacketSize]
+		data = data[tsPacketSize:]
+		out = t.processPacket(out, pkt)
+	}
+	if len(data) > 0 {
+		t.partial = append([]byte(nil), data...)
+	}
+	return out
+}
+
+func (t *tsParamSetInjector) processPacket(out, pkt []byte) []byte {
+	pid := uint16(pkt[1]&0x1f)<<8 | uint16(pkt[2])
+	pusi := pkt[1]&0x40 != 0
+
+	switch {
+	case pid == 0:
+		t.parsePAT(pkt)
+	case pid == t.pmtPID && t.pmtPID != 0:
+		prevVideoPID := t.videoPID
+		t.parsePMT(pkt)
+		if t.videoPID != prevVideoPID {
+			// Сдвиг старого PID сохраняется: его пакеты уже ушли со сдвинутым счётчиком
+			out = t.flushHeld(out)
+		}
+	}
+
+	if pid != t.videoPID || t.videoPID == 0 {
+		return append(out, t.shiftCC(pkt)...)
+	}
+
+	if pusi {
+		// Новый PES - незаконченное решение по предыдущему сбрасываем как есть
+		out = t.flushHeld(out)
+		t.held = append(t.held, append([]byte(nil), pkt...))
+		return t.tryDecide(out)
+	}
+	if len(t.held) > 0 {
+		t.held = append(t.held, append([]byte(nil), pkt...))
+		return t.tryDecide(out)
+	}
+	return append(out, t.shiftCC(pkt)...)
+}
+
+// shiftCC сдвигает continuity counter пакета на число пакетов, добавленных на его PID
+func (t *tsParamSetInjector) shiftCC(pkt []byte) []byte {
+	shift := t.ccShift[uint16(pkt[1]&0x1f)<<8|uint16(pkt[2])]
+	if shift == 0 {
+		return pkt
+	}
+	res := append([]byte(nil), pkt...)
+	res[3] = res[3]&0xF0 | (res[3]+shift)&0x0F
+	return res
+}
+
+func (t *tsParamSetInjector) flushHeld(out []byte) []byte {
+	for _, pkt := range t.held {
+		out = append(out, t.shiftCC(pkt)...)
+	}
+	t.held = nil
+	return out
+}
+
+// tsPayload возвращает полезную нагрузку TS пакета и смещение её начала
+func tsPayload(pkt []byte) ([]byte, int) {
+	afc := (pkt[3] >> 4) & 0x3
+	offset := 4
+	if afc == 2 || afc == 0 {
+		return nil, tsPacketSize
+	}
+	if afc == 3 {
+		offset += 1 + int(pkt[4])
+	}
+	if offset >= tsPacketSize {
+		return nil, tsPacketSize
+	}
+	return pkt[offset:], offset
+}
+
+// tryDecide смотрит на начало PES и решает, нужно ли добавить параметры
+func (t *tsParamSetInjector) tryDecide(out []byte) []byte {
+	var pes []byte
+	for i, pkt := range t.held {
+		payload, _ := tsPayload(pkt)
+		if i > 0 && pkt[3]&0x20 != 0 {
+			// Adaptation field посреди PES (например, PCR) при переупаковке
+			// потерялся бы - такие PES не трогаем
+			return t.flushHeld(out)
+		}
+		pes = append(pes, payload...)
+	}
+
+	if len(pes) < 9 || pes[0] != 0 || pes[1] != 0 || pes[2] != 1 {
+		return t.flushHeld(out)
+	}
+	hdrLen := 9 + int(pes[8])
+	if len(pes) < hdrLen {
+		return t.holdOrFlush(out)
+	}
+	es := pes[hdrLen:]
+
+	nals := scanAnnexBNALs(es)
+	var hasAUD, hasSPS, hasPPS bool
+	firstVCL := -1
+	insertAt := 0
+	for i, nal := range nals {
+		complete := i+1 < len(nals)
+		switch nal.typ {
+		case 9:
+			if i == 0 {
+				hasAUD = true
+				if complete {
+					insertAt = nals[i+1].start
+				}
+			}
+		case 7:
+			hasSPS = true
+			if complete {
+				t.sps = append([]byte(nil), es[nal.payload:nals[i+1].start]...)
+			}
+		case 8:
+			hasPPS = true
+			if complete {
+				t.pps = append([]byte(nil), es[nal.payload:nals[i+1].start]...)
+			}
+		case 1, 5:
+			firstVCL = nal.typ
+		}
+		if firstVCL != -1 {
+			break
+		}
+	}
+	if firstVCL == -1 || (hasAUD && insertAt == 0) {
+		// Первый слайс ещё не пришёл
+		return t.holdOrFlush(out)
+	}
+	if firstVCL != 5 || (hasSPS && hasPPS) || t.sps == nil || t.pps == nil {
+		return t.flushHeld(out)
+	}
+
+	// Собираем новую полезную нагрузку: PES заголовок + [AUD] + SPS + PPS + исходные данные
+	inject := make([]byte, 0, len(annexBAUD)+8+len(t.sps)+len(t.pps))
+	if !hasAUD {
+		inject = append(inject, annexBAUD...)
+	}
+	inject = append(inject, annexBStartCode...)
+	inject = append(inject, t.sps...)
+	inject = append(inject, annexBStartCode...)
+	inject = append(inject, t.pps...)
+
+	newPES := make([]byte, 0, len(pes)+len(inject))
+	newPES = append(newPES, pes[:hdrLen]...)
+	newPES = append(newPES, es[:insertAt]...)
+	newPES = append(newPES, inject...)
+	newPES = append(newPES, es[insertAt:]...)
+	if pesLen := int(binary.BigEndian.Uint16(pes[4:6])); pesLen != 0 {
+		pesLen += len(inject)
+		if pesLen > 0xFFFF {
+			pesLen = 0 // для видео допустима неограниченная длина
+		}
+		binary.BigEndian.PutUint16(newPES[4:6], uint16(pesLen))
+	}
+
+	packets := t.packetize(t.held[0], newPES)
+	added := len(packets) - len(t.held)
+	for _, pkt := range packets {
+		out = append(out, t.shiftCC(pkt)...)
+	}
+	t.ccShift[t.videoPID] = uint8((int(t.ccShift[t.videoPID]) + added) & 0x0F)
+	t.held = nil
+	return out
+}
+
+func (t *tsParamSetInjector) holdOrFlush(out []byte) []byte {
+	if len(t.held) >= maxHeldTSPackets {
+		return t.flushHeld(out)
+	}
+	return out
+}
+
+// packetize режет PES на TS пакеты. Первый пакет сохраняет заголовок и adaptation field
+// (PCR, random access) исходного первого пакета, последний добивается stuffing'ом.
+func (t *tsParamSetInjector) packetize(first, pes []byte) [][]byte {
+	var packets [][]byte
+	cc := first[3] & 0x0F
+
+	_, firstOffset := tsPayload(first)
+	pkt := make([]byte, 0, tsPacketSize)
+	pkt = append(pkt, first[:firstOffset]...)
+	n := tsPacketSize - firstOffset
+	if n > len(pes) {
+		n = len(pes)
+	}
+	pkt = append(pkt, pes[:n]...)
+	pes = pes[n:]
+	packets = append(packets, padTSPacket(pkt))
+
+	for len(pes) > 0 {
+		cc = (cc + 1) & 0x0F
+		header := []byte{0x47, first[1] &^ 0x40, first[2], 0x10 | cc}
+		n := tsPacketSize - 4
+		if n > len(pes) {
+			n = len(pes)
+		}
+		pkt := append(header, pes[:n]...)
+		pes = pes[n:]
+		packets = append(packets, padTSPacket(pkt))
+	}
+	return packets
+}
+
+// padTSPacket добивает пакет до 188 байт stuffing'ом в adaptation field
+func padTSPacket(pkt []byte) []byte {
+	if len(pkt) == tsPacketSize {
+		return pkt
+	}
+	stuffing := tsPacketSize - len(pkt)
+	afc := (pkt[3] >> 4) & 0x3
+	res := make([]byte, 0, tsPacketSize)
+	if afc == 3 {
+		// Adaptation field уже есть - увеличиваем его длину
+		afLen := int(pkt[4])
+		res = append(res, pkt[:5+afLen]...)
+		res[4] = byte(afLen + stuffing)
+		if afLen == 0 {
+			// Пустое поле: нужен байт флагов
+			res = append(res, 0x00)
+			stuffing--
+		}
+		for i := 0; i < stuffing; i++ {
+			res = append(res, 0xFF)
+		}
+		return append(res, pkt[5+afLen:]...)
+	}
+
+	res = append(res, pkt[:4]...)
+	res[3] |= 0x20
+	res = append(res, byte(stuffing-1))
+	if stuffing > 1 {
+		res = append(res, 0x00) // флаги adaptation field
+		for i := 0; i < stuffing-2; i++ {
+			res = append(res, 0xFF)
+		}
+	}
+	return append(res, pkt[4:]...)
+}
+
+type annexBNAL struct {
+	start   int // начало стартового кода
+	payload int // первый байт NAL (заголовок)
+	typ     int
+}
+
+// scanAnnexBNALs находит NAL'ы в Annex B потоке
+func scanAnnexBNALs(data []byte) []annexBNAL {
+	var nals []annexBNAL
+	for i := 0; i+3 <= len(data); i++ {
+		if data[i] != 0 || data[i+1] != 0 || data[i+2] != 1 {
+			continue
+		}
+		start := i
+		if i > 0 && data[i-1] == 0 {
+			start = i - 1
+		}
+		if i+3 >= len(data) {
+			break
+		}
+		nals = append(nals, annexBNAL{start: start, payload: i + 3, typ: int(data[i+3] & 0x1f)})
+		i += 2
+	}
+	return nals
+}
+
+// parsePAT выбирает PMT программы входа: заданной в program или первой в PAT
+func (t *tsParamSetInjector) parsePAT(pkt []byte) {
+	for _, p := range parsePATPrograms(pkt) {
+		if t.program == 0 || p.number == t.program {
+			t.pmtProgram, t.pmtPID = p.number, p.pmtPID
+			return
+		}
+	}
+}
+
+// tsPATProgram - запись программы в PAT
+type tsPATProgram struct {
+	number uint16
+	pmtPID uint16
+}
+
+// parsePATPrograms возвращает программы из PAT в порядке следования, без NIT
+// (секция должна помещаться в один пакет)
+func parsePATPrograms(pkt []byte) []tsPATProgram {
+	section := psiSection(pkt)
+	if len(section) < 12 || section[0] != 0x00 {
+		return nil
+	}
+	sectionLen := int(binary.BigEndian.Uint16(section[1:3]) & 0x0FFF)
+	end := 3 + sectionLen - 4 // без CRC
+	if end > len(section) {
+		return nil
+	}
+	var programs []tsPATProgram
+	for i := 8; i+4 <= end; i += 4 {
+		number := binary.BigEndian.Uint16(section[i : i+2])
+		pid := binary.BigEndian.Uint16(section[i+2:i+4]) & 0x1FFF
+		if number != 0 {
+			programs = append(programs, tsPATProgram{number: number, pmtPID: pid})
+		}
+	}
+	return programs
+}
+
+// parsePATPMTPIDs добавляет в pids PID'ы PMT из PAT
+func parsePATPMTPIDs(pkt []byte, pids map[uint16]bool) {
+	for _, p := range parsePATPrograms(pkt) {
+		pids[p.pmtPID] = true
+	}
+}
+
+// parsePMT находит первый H.264 поток выбранной программы
+func (t *tsParamSetInjector) parsePMT(pkt []byte) {
+	if t.fixedVideo != 0 {
+		return
+	}
+	section := psiSection(pkt)
+	if len(section) < 16 || section[0] != 0x02 {
+		return
+	}
+	if binary.BigEndian.Uint16(section[3:5]) != t.pmtProgram {
+		// PID PMT может быть общим для нескольких программ
+		return
+	}
+	sectionLen := int(binary.BigEndian.Uint16(section[1:3]) & 0x0FFF)
+	end := 3 + sectionLen - 4
+	if end > len(section) {
+		return
+	}
+	programInfoLen := int(binary.BigEndian.Uint16(section[10:12]) & 0x0FFF)
+	for i := 12 + programInfoLen; i+5 <= end; {
+		streamType := section[i]
+		pid := binary.BigEndian.Uint16(section[i+1:i+3]) & 0x1FFF
+		esInfoLen := int(binary.BigEndian.Uint16(section[i+3:i+5]) & 0x0FFF)
+		if streamType == 0x1B {
+			t.videoPID = pid
+			return
+		}
+		i += 5 + esInfoLen
+	}
+}
+
+// psiSection возвращает начало PSI секции из пакета с PUSI
+func psiSection(pkt []byte) []byte {
+	if pkt[1]&0x40 == 0 {
+		return nil
+	}
+	payload, _ := tsPayload(pkt)
+	if len(payload) < 1 {
+		return nil
+	}
+	pointer := int(payload[0])
+	if 1+pointer >= len(payload) {
+		return nil
+	}
+	return payload[1+pointer:]
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+// tsTestPSI собирает PSI секцию с pointer field и CRC
+func tsTestPSI(tableID byte, id uint16, body []byte) []byte {
+	sectionLen := 5 + len(body) + 4
+	section := concatBytes([]byte{tableID, 0xB0 | byte(sectionLen>>8), byte(sectionLen), byte(id >> 8), byte(id), 0xC1, 0x00, 0x00}, body)
+	crc := mpegCRC32(section)
+	return concatBytes([]byte{0x00}, section, []byte{byte(crc >> 24), byte(crc >> 16), byte(crc >> 8), byte(crc)})
+}
+
+// tsTestVideoPES - PES без PTS, целиком в одном TS пакете
+func tsTestVideoPES(nals ...[]byte) []byte {
+	pes := concatBytes([]byte{0, 0, 1, 0xE0, 0, 0, 0x80, 0, 0}, annexBAUD)
+	for _, nal := range nals {
+		pes = concatBytes(pes, annexBStartCode, nal)
+	}
+	return pes
+}
+
+func TestTSParamSetInjectorMPTS(t *testing.T) {
+	pat := tsTestPSI(0x00, 1, []byte{0x00, 0x01, 0xF0, 0x00, 0x00, 0x02, 0xF0, 0x01})
+	pmt1 := tsTestPSI(0x02, 1, []byte{0xE1, 0x00, 0xF0, 0x00, 0x1B, 0xE1, 0x00, 0xF0, 0x00})
+	pmt2 := tsTestPSI(0x02, 2, []byte{0xE2, 0x00, 0xF0, 0x00, 0x1B, 0xE2, 0x00, 0xF0, 0x00})
+
+	sps := []byte{0x67, 0x42, 0x00, 0x1F, 0xE9, 0x01, 0x40}
+	pps := []byte{0x68, 0xCE, 0x3C, 0x80}
+	// Слайс заполняет пакет почти целиком - вставка параметров добавит пакет
+	idr := append([]byte{0x65, 0x88}, bytes.Repeat([]byte{0x11}, 150)...)
+	slice := []byte{0x41, 0x9A, 0x22}
+
+	cc := make(map[uint16]byte)
+	packet := func(pid uint16, pusi bool, payload []byte) []byte {
+		pkt := tsTestPacket(pid, pusi, 1, cc[pid], false, payload)
+		cc[pid]++
+		return pkt
+	}
+	psi := func() []byte {
+		return concatBytes(packet(0, true, pat), packet(0x1000, true, pmt1), packet(0x1001, true, pmt2))
+	}
+
+	program2 := concatBytes(
+		packet(0x200, true, tsTestVideoPES(sps, pps, idr)),
+		packet(0x200, true, tsTestVideoPES(idr)),
+	)
+	input := concatBytes(
+		psi(),
+		packet(0x100, true, tsTestVideoPES(sps, pps, idr)),
+		program2[:tsPacketSize],
+		psi(),
+		packet(0x100, true, tsTestVideoPES(idr)),
+		packet(0x100, false, bytes.Repeat([]byte{0x22}, 184)),
+		program2[tsPacketSize:],
+		psi(),
+		packet(0x100, true, tsTestVideoPES(slice)),
+		psi(),
+		packet(0x100, true, tsTestVideoPES(idr)),
+	)
+
+	injector := newTSParamSetInjector(nil)
+	var out []byte
+	for i := 0; i < len(input); i += 1000 {
+		end := i + 1000
+		if end > len(input) {
+			end = len(input)
+		}
+		out = append(out, injector.Process(input[i:end])...)
+	}
+
+	if len(out) <= len(input) {
+		t.Fatalf("nothing injected: %d bytes in, %d out", len(input), len(out))
+	}
+	c := newTSContinuityChecker()
+	c.Process(out)
+	if c.errors != 0 {
+		t.Errorf("continuity errors: %d", c.errors)
+	}
+
+	// Вторая программа проходит без изменений
+	var got []byte
+	var injected int
+	for i := 0; i+tsPacketSize <= len(out); i += tsPacketSize {
+		pkt := out[i : i+tsPacketSize]
+		switch uint16(pkt[1]&0x1F)<<8 | uint16(pkt[2]) {
+		case 0x200:
+			got = append(got, pkt...)
+		case 0x100:
+			if payload, _ := tsPayload(pkt); bytes.Contains(payload, sps) {
+				injected++
+			}
+		}
+	}
+	if !bytes.Equal(got, program2) {
+		t.Error("program 2 video was modified")
+	}
+	// Исходные SPS/PPS первого IDR и две вставки
+	if injected != 3 {
+		t.Errorf("SPS found in %d program 1 packets, want 3", injected)
+	}
+}
+
+func TestTSParamSetInjectorProgram(t *testing.T) {
+	pat := tsTestPSI(0x00, 1, []byte{0x00, 0x01, 0xF0, 0x00, 0x00, 0x02, 0xF0, 0x01})
+	pmt2 := tsTestPSI(0x02, 2, []byte{0xE2, 0x00, 0xF0, 0x00, 0x1B, 0xE2, 0x00, 0xF0, 0x00})
+
+	injector := newTSParamSetInjector(&InputCfg{Program: 2})
+	injector.Process(concatBytes(tsTestPacket(0, true, 1, 0, false, pat), tsTestPacket(0x1001, true, 1, 0, false, pmt2)))
+	if injector.videoPID != 0x200 {
+		t.Errorf("video PID %#x, want 0x200", injector.videoPID)
+	}
+
+	injector = newTSParamSetInjector(&InputCfg{VideoPID: 0x300})
+	injector.Process(concatBytes(tsTestPacket(0, true, 1, 0, false, pat), tsTestPacket(0x1001, true, 1, 0, false, pmt2)))
+	if injector.videoPID != 0x300 {
+		t.Errorf("video PID %#x, want 0x300", injector.videoPID)
+	}
+}
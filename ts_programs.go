@@ -0,0 +1,238 @@
+package main
+
+import (
+	"log"
+	"sort"
+	"strings"
+
+	"github.com/asticode/go-astits"
+)
+
+// TSProgramInfo описывает программу MPEG-TS, найденную во входящем потоке
+type TSProgramInfo struct {
+	Number   uint16         `json:"number"`
+	PMTPID   uint16         `json:"pmt_pid"`
+	PCRPID   uint16         `json:"pcr_pid"`
+	Selected bool           `json:"selected"`
+	Streams  []TSStreamInfo `json:"streams"`
+}
+
+// TSStreamInfo описывает элементарный поток программы
+type TSStreamInfo struct {
+	PID        uint16 `json:"pid"`
+	StreamType uint8  `json:"stream_type"`
+	Codec      string `json:"codec"`
+	Language   string `json:"language,omitempty"`
+	Selected   bool   `json:"selected"`
+}
+
+// tsProgramSelector отслеживает PAT/PMT и выбирает программу и PID'ы
+// видео/аудио согласно настройкам входа (program, video_pid, audio_pid, audio_lang).
+// Без настроек берётся первая программа из PAT и первые H.264/AAC потоки в ней.
+type tsProgramSelector struct {
+	inputName string
+	program   uint16
+	videoPID  uint16
+	audioPID  uint16
+	audioLang string
+
+	patOrder []uint16                   // номера программ в порядке PAT
+	pmtPIDs  map[uint16]uint16          // номер программы -> PID PMT
+	pmts     map[uint16]*astits.PMTData // номер программы -> PMT
+	selected uint16                     // номер выбранной программы (0 - ещё не выбрана)
+	video    uint16
+	audio    uint16
+
+	missingLogged bool // уже сообщили, что заданной программы нет в PAT
+}
+
+func newTSProgramSelector(inputCfg *InputCfg) *tsProgramSelector {
+	ps := &tsProgramSelector{
+		pmtPIDs: make(map[uint16]uint16),
+		pmts:    make(map[uint16]*astits.PMTData),
+	}
+	if inputCfg != nil {
+		ps.inputName = inputCfg.Name
+		ps.program = uint16(inputCfg.Program)
+		ps.videoPID = uint16(inputCfg.VideoPID)
+		ps.audioPID = uint16(inputCfg.AudioPID)
+		ps.audioLang = strings.ToLower(strings.TrimSpace(inputCfg.AudioLang))
+	}
+	// Явно заданные PID'ы работают даже без PMT
+	ps.video = ps.videoPID
+	ps.audio = ps.audioPID
+	return ps
+}
+
+// HandlePAT запоминает список программ. Возвращает true, если список изменился.
+func (ps *tsProgramSelector) HandlePAT(pat *astits.PATData) bool {
+	var order []uint16
+	pmtPIDs := make(map[uint16]uint16)
+	for _, p := range pat.Programs {
+		if p.ProgramNumber == 0 { // NIT
+			continue
+		}
+		order = append(order, p.ProgramNumber)
+		pmtPIDs[p.ProgramNumber] = p.ProgramMapID
+	}
+
+	changed := len(order) != len(ps.patOrder)
+	for i := 0; !changed && i < len(order); i++ {
+		changed = order[i] != ps.patOrder[i] || pmtPIDs[order[i]] != ps.pmtPIDs[order[i]]
+	}
+	if !changed {
+		return false
+	}
+
+	ps.patOrder = order
+	ps.pmtPIDs = pmtPIDs
+	for number := range ps.pmts {
+		if _, ok := pmtPIDs[number]; !ok {
+			delete(ps.pmts, number)
+		}
+	}
+	ps.checkProgramInPAT()
+	ps.reselect()
+	return true
+}
+
+// checkProgramInPAT один раз сообщает, что заданной program нет в PAT -
+// иначе вход молча ждёт PMT, которая никогда не придёт
+func (ps *tsProgramSelector) checkProgramInPAT() {
+	if ps.program == 0 {
+		return
+	}
+	if _, ok := ps.pmtPIDs[ps.program]; ok {
+		ps.missingLogged = false
+		return
+	}
+	if !ps.missingLogged {
+		log.Printf("[TS] Input %s: program %d is not in the PAT (programs: %v)", ps.inputName, ps.program, ps.patOrder)
+		ps.missingLogged = true
+	}
+}
+
+// HandlePMT обновляет описание программы. Возвращает true, если изменились
+// состав программ или выбранные PID'ы.
+func (ps *tsProgramSelector) HandlePMT(pmt *astits.PMTData) bool {
+	prevVideo, prevAudio := ps.video, ps.audio
+	_, known := ps.pmts[pmt.ProgramNumber]
+	ps.pmts[pmt.ProgramNumber] = pmt
+	ps.reselect()
+	return !known || prevVideo != ps.video || prevAudio != ps.audio
+}
+
+// NeedsFallback сообщает, что PSI в потоке не найдены и PID'ы нужно искать по содержимому.
+// Если PAT/PMT есть, поиск по содержимому отключается - в MPTS он выбрал бы случайный поток.
+func (ps *tsProgramSelector) NeedsFallback() bool {
+	return len(ps.patOrder) == 0 && len(ps.pmts) == 0
+}
+
+func (ps *tsProgramSelector) VideoPID() uint16 { return ps.video }
+func (ps *tsProgramSelector) AudioPID() uint16 { return ps.audio }
+
+func (ps *tsProgramSelector) reselect() {
+	pmt := ps.targetPMT()
+	if pmt == nil {
+		return
+	}
+	ps.selected = pmt.ProgramNumber
+
+	var video, audio, langAudio uint16
+	for _, es := range pmt.ElementaryStreams {
+		switch es.StreamType {
+		case astits.StreamTypeH264Video:
+			if ps.videoPID != 0 && es.ElementaryPID == ps.videoPID {
+				video = es.ElementaryPID
+			} else if video == 0 && ps.videoPID == 0 {
+				video = es.ElementaryPID
+			}
+		case astits.StreamTypeAACAudio:
+			if ps.audioPID != 0 {
+				if es.ElementaryPID == ps.audioPID {
+					audio = es.ElementaryPID
+				}
+				continue
+			}
+			if audio == 0 {
+				audio = es.ElementaryPID
+			}
+			if langAudio == 0 && ps.audioLang != "" && streamLanguage(es) == ps.audioLang {
+				langAudio = es.ElementaryPID
+			}
+		}
+	}
+	if langAudio != 0 {
+		audio = langAudio
+	}
+
+	// Явно заданный PID, которого нет в PMT, всё равно используем -
+	// оператор знает свой поток лучше, чем PMT
+	if video == 0 {
+		video = ps.videoPID
+	}
+	if audio == 0 {
+		audio = ps.audioPID
+	}
+	ps.video, ps.audio = video, audio
+}
+
+// targetPMT возвращает PMT программы, которую нужно использовать
+func (ps *tsProgramSelector) targetPMT() *astits.PMTData {
+	if ps.program != 0 {
+		return ps.pmts[ps.program]
+	}
+	if len(ps.patOrder) > 0 {
+		// Ждём PMT первой программы из PAT, чтобы выбор не зависел от порядка прихода PMT
+		return ps.pmts[ps.patOrder[0]]
+	}
+	// PAT ещё не пришёл - берём программу с наименьшим номером
+	var best *astits.PMTData
+	for _, pmt := range ps.pmts {
+		if best == nil || pmt.ProgramNumber < best.ProgramNumber {
+			best = pmt
+		}
+	}
+	return best
+}
+
+// Programs возвращает описание всех известных программ для API анализа
+func (ps *tsProgramSelector) Programs() []TSProgramInfo {
+	numbers := make([]uint16, 0, len(ps.pmts))
+	for number := range ps.pmts {
+		numbers = append(numbers, number)
+	}
+	sort.Slice(numbers, func(i, j int) bool { return numbers[i] < numbers[j] })
+
+	programs := make([]TSProgramInfo, 0, len(numbers))
+	for _, number := range numbers {
+		pmt := ps.pmts[number]
+		info := TSProgramInfo{
+			Number:   number,
+			PMTPID:   ps.pmtPIDs[number],
+			PCRPID:   pmt.PCRPID,
+			Selected: number == ps.selected,
+		}
+		for _, es := range pmt.ElementaryStreams {
+			info.Streams = append(info.Streams, TSStreamInfo{
+				PID:        es.ElementaryPID,
+				StreamType: uint8(es.StreamType),
+				Codec:      es.StreamType.String(),
+				Language:   streamLanguage(es),
+				Selected:   info.Selected && (es.ElementaryPID == ps.video || es.ElementaryPID == ps.audio),
+			})
+		}
+		programs = append(programs, info)
+	}
+	return programs
+}
+
+// streamLanguage достаёт код языка из ISO 639 дескриптора потока
+func streamLanguage(es *astits.PMTElementaryStream) string {
+	for _, d := range es.ElementaryStreamDescriptors {
+		if d.ISO639LanguageAndAudioType != nil {
+			return strings.ToLower(strings.TrimRight(string(d.ISO639LanguageAndAudioType.Language), "\x00 "))
+		}
+	}
+	return ""
+}
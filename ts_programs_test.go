@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/asticode/go-astits"
+)
+
+func tsTestPAT(programs ...uint16) *astits.PATData {
+	pat := &astits.PATData{Programs: []*astits.PATProgram{{ProgramNumber: 0, ProgramMapID: 0x10}}} // NIT
+	for _, number := range programs {
+		pat.Programs = append(pat.Programs, &astits.PATProgram{ProgramNumber: number, ProgramMapID: 0x1000 + number})
+	}
+	return pat
+}
+
+// tsTestPMT - программа с H.264 на PID number*0x100 и AAC дорожками с языками langs
+func tsTestPMT(number uint16, langs ...string) *astits.PMTData {
+	pmt := &astits.PMTData{ProgramNumber: number, PCRPID: number * 0x100}
+	pmt.ElementaryStreams = append(pmt.ElementaryStreams, &astits.PMTElementaryStream{ElementaryPID: number * 0x100, StreamType: astits.StreamTypeH264Video})
+	for i, lang := range langs {
+		es := &astits.PMTElementaryStream{ElementaryPID: number*0x100 + 1 + uint16(i), StreamType: astits.StreamTypeAACAudio}
+		if lang != "" {
+			es.ElementaryStreamDescriptors = []*astits.Descriptor{{ISO639LanguageAndAudioType: &astits.DescriptorISO639LanguageAndAudioType{Language: []byte(lang)}}}
+		}
+		pmt.ElementaryStreams = append(pmt.ElementaryStreams, es)
+	}
+	return pmt
+}
+
+func TestTSProgramSelector(t *testing.T) {
+	tests := []struct {
+		name         string
+		cfg          *InputCfg
+		video, audio uint16
+	}{
+		{"первая программа из PAT", nil, 0x300, 0x301},
+		{"program", &InputCfg{Program: 1}, 0x100, 0x101},
+		{"audio_lang", &InputCfg{Program: 1, AudioLang: "ENG"}, 0x100, 0x102},
+		{"audio_lang без совпадения", &InputCfg{Program: 1, AudioLang: "fra"}, 0x100, 0x101},
+		{"audio_pid важнее audio_lang", &InputCfg{Program: 1, AudioPID: 0x103, AudioLang: "eng"}, 0x100, 0x103},
+		{"PID'ы не из PMT", &InputCfg{VideoPID: 0x500, AudioPID: 0x501}, 0x500, 0x501},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ps := newTSProgramSelector(tt.cfg)
+			ps.HandlePAT(tsTestPAT(3, 1))
+			// PMT приходят не в порядке PAT
+			ps.HandlePMT(tsTestPMT(1, "rus", "eng", ""))
+			ps.HandlePMT(tsTestPMT(3, "rus"))
+			if ps.NeedsFallback() {
+				t.Error("fallback with PAT/PMT present")
+			}
+			if ps.VideoPID() != tt.video || ps.AudioPID() != tt.audio {
+				t.Errorf("video %#x audio %#x, want %#x %#x", ps.VideoPID(), ps.AudioPID(), tt.video, tt.audio)
+			}
+		})
+	}
+
+	t.Run("ждёт PMT первой программы", func(t *testing.T) {
+		ps := newTSProgramSelector(nil)
+		ps.HandlePAT(tsTestPAT(3, 1))
+		ps.HandlePMT(tsTestPMT(1, "rus"))
+		if ps.VideoPID() != 0 {
+			t.Errorf("selected %#x before PMT of program 3", ps.VideoPID())
+		}
+		ps.HandlePMT(tsTestPMT(3, "rus"))
+		if ps.VideoPID() != 0x300 {
+			t.Errorf("video %#x, want 0x300", ps.VideoPID())
+		}
+	})
+
+	t.Run("Programs", func(t *testing.T) {
+		ps := newTSProgramSelector(&InputCfg{Program: 1, AudioLang: "eng"})
+		ps.HandlePAT(tsTestPAT(3, 1))
+		ps.HandlePMT(tsTestPMT(1, "rus", "eng"))
+		ps.HandlePMT(tsTestPMT(3))
+		programs := ps.Programs()
+		if len(programs) != 2 || programs[0].Number != 1 || !programs[0].Selected || programs[1].Selected {
+			t.Fatalf("programs %+v", programs)
+		}
+		if p := programs[0]; p.PMTPID != 0x1001 || len(p.Streams) != 3 || p.Streams[2].Language != "eng" ||
+			!p.Streams[0].Selected || p.Streams[1].Selected || !p.Streams[2].Selected {
+			t.Errorf("program 1 %+v", p)
+		}
+	})
+}
+
+func TestTSProgramSelectorMissingProgram(t *testing.T) {
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	ps := newTSProgramSelector(&InputCfg{Name: "mpts", Program: 5})
+	ps.HandlePAT(tsTestPAT(3, 1))
+	ps.HandlePMT(tsTestPMT(1))
+	ps.HandlePAT(tsTestPAT(3, 1, 2))
+	if ps.VideoPID() != 0 {
+		t.Errorf("selected %#x from another program", ps.VideoPID())
+	}
+	if n := strings.Count(logs.String(), "program 5 is not in the PAT"); n != 1 {
+		t.Errorf("logged %d times:\n%s", n, logs.String())
+	}
+	if !strings.Contains(logs.String(), "Input mpts") || !strings.Contains(logs.String(), "[3 1]") {
+		t.Errorf("log does not name input and programs: %s", logs.String())
+	}
+
+	// Программа появилась - выбирается, и при новом пропадании снова сообщаем
+	ps.HandlePAT(tsTestPAT(3, 5))
+	ps.HandlePMT(tsTestPMT(5))
+	if ps.VideoPID() != 0x500 {
+		t.Errorf("video %#x, want 0x500", ps.VideoPID())
+	}
+	ps.HandlePAT(tsTestPAT(3))
+	if n := strings.Count(logs.String(), "program 5 is not in the PAT"); n != 2 {
+		t.Errorf("logged %d times after program disappeared", n)
+	}
+}
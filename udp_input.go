@@ -0,0 +1,234 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"runtime"
+	"strconv"
+	"time"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// Приём MPEG-TS по UDP для pull: udp://... - unicast на локальный порт или
+// multicast группа (в том числе source-specific) на выбранном интерфейсе.
+// Датаграммы RTP (RFC 2250) тоже принимаются, заголовок RTP снимается.
+
+const (
+	// Буфер сокета с запасом на всплески битрейта от плейаута/IRD
+	udpReadBuffer  = 4 << 20
+	udpMaxDatagram = 65536
+)
+
+// udpSource - разобранный udp:// URL: udp://[группа|адрес]:порт?source=IP&interface=имя
+type udpSource struct {
+	addr   *net.UDPAddr
+	source net.IP
+	iface  string
+}
+
+func parseUDPSource(raw string) (*udpSource, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(u.Port())
+	if err != nil || port < 1 || port > 65535 {
+		return nil, errors.New("udp URL must have a port")
+	}
+	src := &udpSource{addr: &net.UDPAddr{Port: port}}
+	if host := u.Hostname(); host != "" {
+		if src.addr.IP = net.ParseIP(host); src.addr.IP == nil {
+			return nil, fmt.Errorf("udp host %q must be an IP address", host)
+		}
+	}
+
+	q := u.Query()
+	if s := q.Get("source"); s != "" {
+		if src.source = net.ParseIP(s); src.source == nil {
+			return nil, fmt.Errorf("invalid source address %q", s)
+		}
+		if !src.multicast() {
+			return nil, errors.New("source is only valid for a multicast group")
+		}
+	}
+	src.iface = q.Get("interface")
+	return src, nil
+}
+
+func (s *udpSource) multicast() bool {
+	return s.addr.IP != nil && s.addr.IP.IsMulticast()
+}
+
+// listen открывает сокет и подписывается на группу. Интерфейс ищется при каждом
+// подключении: после перезапуска сети он может появиться не сразу.
+func (s *udpSource) listen() (*net.UDPConn, error) {
+	if !s.multicast() {
+		conn, err := net.ListenUDP("udp", s.addr)
+		if err != nil {
+			return nil, err
+		}
+		conn.SetReadBuffer(udpReadBuffer)
+		return conn, nil
+	}
+
+	var ifi *net.Interface
+	if s.iface != "" {
+		var err error
+		if ifi, err = net.InterfaceByName(s.iface); err != nil {
+			return nil, err
+		}
+	}
+
+	network := "udp4"
+	if s.addr.IP.To4() == nil {
+		network = "udp6"
+	}
+	// Привязка к адресу группы отсекает чужие группы на том же порту; Windows так не умеет
+	bind := &net.UDPAddr{IP: s.addr.IP, Port: s.addr.Port}
+	if runtime.GOOS == "windows" {
+		bind = &net.UDPAddr{Port: s.addr.Port}
+	}
+	conn, err := net.ListenUDP(network, bind)
+	if err != nil {
+		return nil, err
+	}
+
+	group := &net.UDPAddr{IP: s.addr.IP}
+	if network == "udp4" {
+		pc := ipv4.NewPacketConn(conn)
+		if s.source != nil {
+			err = pc.JoinSourceSpecificGroup(ifi, group, &net.UDPAddr{IP: s.source})
+		} else {
+			err = pc.JoinGroup(ifi, group)
+		}
+	} else {
+		pc := ipv6.NewPacketConn(conn)
+		if s.source != nil {
+			err = pc.JoinSourceSpecificGroup(ifi, group, &net.UDPAddr{IP: s.source})
+		} else {
+			err = pc.JoinGroup(ifi, group)
+		}
+	}
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to join %s: %w", s.addr.IP, err)
+	}
+	conn.SetReadBuffer(udpReadBuffer)
+	return conn, nil
+}
+
+// udpTSConn отдаёт serveTS содержимое датаграмм без RTP заголовков
+type udpTSConn struct {
+	conn    *net.UDPConn
+	buf     []byte
+	pending []byte
+}
+
+func (c *udpTSConn) Read(p []byte) (int, error) {
+	for len(c.pending) == 0 {
+		n, err := c.conn.Read(c.buf)
+		if err != nil {
+			return 0, err
+		}
+		c.pending = stripRTPHeader(c.buf[:n])
+	}
+	n := copy(p, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+func (c *udpTSConn) SetReadDeadline(t time.Time) error {
+	return c.conn.SetReadDeadline(t)
+}
+
+// waitData ждёт первую датаграмму без таймаута
+func (c *udpTSConn) waitData() error {
+	c.conn.SetReadDeadline(time.Time{})
+	for len(c.pending) == 0 {
+		n, err := c.conn.Read(c.buf)
+		if err != nil {
+			return err
+		}
+		c.pending = stripRTPHeader(c.buf[:n])
+	}
+	return nil
+}
+
+// stripRTPHeader снимает RTP заголовок, если датаграмма - RTP с MPEG-TS внутри
+func stripRTPHeader(b []byte) []byte {
+	if len(b) < 12 || b[0] == 0x47 || b[0]>>6 != 2 {
+		return b
+	}
+	headerLen := 12 + int(b[0]&0x0f)*4
+	if b[0]&0x10 != 0 {
+		if len(b) < headerLen+4 {
+			return b
+		}
+		headerLen += 4 + int(binary.BigEndian.Uint16(b[headerLen+2:]))*4
+	}
+	if len(b) <= headerLen || b[headerLen] != 0x47 {
+		return b
+	}
+	return b[headerLen:]
+}
+
+// pullUDP принимает MPEG-TS из UDP сокета. Сокет живёт всё время работы входа:
+// пауза в потоке (нет данных pullStallTimeout) гасит вход, но не переоткрывает подписку.
+func (p *PullManager) pullUDP(ctx context.Context, inputCfg *InputCfg, pullURL string, status *PullStatus) error {
+	if p.srt == nil {
+		return errors.New("SRT server is not available")
+	}
+	src, err := parseUDPSource(pullURL)
+	if err != nil {
+		return err
+	}
+	conn, err := src.listen()
+	if err != nil {
+		return err
+	}
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+	defer conn.Close()
+
+	name := inputCfg.Name
+	log.Printf("[UDP] Input '%s' listening on %s", name, status.URL)
+	tc := &udpTSConn{conn: conn, buf: make([]byte, udpMaxDatagram)}
+
+	for {
+		status.State = pullStateWaiting
+		p.manager.SetPullStatus(name, status)
+		if err := tc.waitData(); err != nil {
+			return err
+		}
+
+		if !p.manager.TryAcquirePublish(name) {
+			return errors.New("input is already being published")
+		}
+		p.markPlaying(name, status)
+		err := p.srt.serveTS(tc, inputCfg, status.URL, pullStallTimeout)
+		p.manager.SetStatusActive(name, false)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		var netErr net.Error
+		if !errors.As(err, &netErr) || !netErr.Timeout() {
+			if err == nil {
+				err = errors.New("socket closed")
+			}
+			return err
+		}
+		message := fmt.Sprintf("no data for %v", pullStallTimeout)
+		log.Printf("[UDP] Input '%s' stalled: %s", name, message)
+		p.manager.AddInputEvent(name, "stall", message)
+		status.LastError = message
+		status.ConnectedAt = nil
+	}
+}
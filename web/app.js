@@ -78,7 +78,7 @@ const I18N = (() => {
             'outputs.addError': 'Ошибка добавления выхода',
             'outputs.removeError': 'Ошибка удаления выхода',
             'outputs.reconnectError': 'Ошибка реконнекта',
-            'outputs.urlPlaceholder': 'srt:// · rtmp:// · file://',
+            'outputs.urlPlaceholder': 'srt:// · rtmp:// · file:// · exec://',
             'outputs.editTitle': 'Редактировать выход',
             'outputs.urlLabel': 'URL выхода:',
             'outputs.editSuccess': 'Выход изменён',
@@ -136,6 +136,7 @@ const I18N = (() => {
             'help.outputs.ex.srt': 'Ретрансляция по SRT',
             'help.outputs.ex.flv': 'Запись в файл FLV (нативно, ffmpeg не нужен)',
             'help.outputs.ex.mp4': 'Запись в файл MP4 (требует ffmpeg в PATH или bin/)',
+            'help.outputs.ex.exec': 'Поток в stdin внешней команды (FLV или MPEG-TS)',
             'help.outputs.mp4note': 'Для записи MP4 необходим ffmpeg. FLV пишется нативно без внешних зависимостей.',
             'help.ffmpeg.title': 'ffmpeg для записи файлов',
             'help.ffmpeg.body': 'Запись в MP4 использует ffmpeg как внешний процесс (stdin pipe). Бинарный файл ffmpeg должен находиться в папке <code>bin/</code> рядом с сервером или быть доступен в системном PATH. FLV запись не требует ffmpeg.',
@@ -230,7 +231,7 @@ const I18N = (() => {
             'outputs.addError': 'Error adding output',
             'outputs.removeError': 'Error removing output',
             'outputs.reconnectError': 'Reconnect error',
-            'outputs.urlPlaceholder': 'srt:// · rtmp:// · file://',
+            'outputs.urlPlaceholder': 'srt:// · rtmp:// · file:// · exec://',
             'outputs.editTitle': 'Edit Output',
             'outputs.urlLabel': 'Output URL:',
             'outputs.editSuccess': 'Output modified',
@@ -288,6 +289,7 @@ const I18N = (() => {
             'help.outputs.ex.srt': 'Relay via SRT',
             'help.outputs.ex.flv': 'Record to FLV file (native, no ffmpeg required)',
             'help.outputs.ex.mp4': 'Record to MP4 file (requires ffmpeg in PATH or bin/)',
+            'help.outputs.ex.exec': 'Pipe the stream into an external command (FLV or MPEG-TS)',
             'help.outputs.mp4note': 'MP4 recording requires ffmpeg. FLV is written natively.',
             'help.ffmpeg.title': 'ffmpeg for File Recording',
             'help.ffmpeg.body': 'MP4 recording uses ffmpeg as an external process. The ffmpeg binary must be located in the <code>bin/</code> folder or in the system PATH.',
@@ -438,6 +440,7 @@ const Formatters = (() => {
         if (u.includes('twitch.tv')) return { name: 'TW', cls: 'tw' };
         if (u.startsWith('srt://')) return { name: 'SRT', cls: 'srt' };
         if (u.startsWith('file://')) return { name: 'FILE', cls: 'file' };
+        if (u.startsWith('exec://')) return { name: 'EXEC', cls: 'file' };
         if (u.startsWith('rtmp://')) return { name: 'RTMP', cls: 'rtmp' };
         return { name: 'URL', cls: 'rtmp' };
     };
@@ -1031,8 +1034,8 @@ const Dashboard = (() => {
                 const url = target.getAttribute('data-url');
                 showEditOutputModal(name, url, async (newUrl) => {
                     if (newUrl === url) return;
-                    if (!newUrl.startsWith('rtmp://') && !newUrl.startsWith('srt://') && !newUrl.startsWith('file://')) {
-                        throw new Error('URL must start with srt://, rtmp:// or file://');
+                    if (!newUrl.startsWith('rtmp://') && !newUrl.startsWith('srt://') && !newUrl.startsWith('file://') && !newUrl.startsWith('exec://')) {
+                        throw new Error('URL must start with srt://, rtmp://, file:// or exec://');
                     }
                     try {
                         await Api.removeOutput({ name, url });
@@ -1326,8 +1329,8 @@ const InputsPage = (() => {
                 const url = t.getAttribute('data-url');
                 showEditOutputModal(name, url, async (newUrl) => {
                     if (newUrl === url) return;
-                    if (!newUrl.startsWith('rtmp://') && !newUrl.startsWith('srt://') && !newUrl.startsWith('file://')) {
-                        throw new Error('URL must start with srt://, rtmp:// or file://');
+                    if (!newUrl.startsWith('rtmp://') && !newUrl.startsWith('srt://') && !newUrl.startsWith('file://') && !newUrl.startsWith('exec://')) {
+                        throw new Error('URL must start with srt://, rtmp://, file:// or exec://');
                     }
                     try {
                         await Api.removeOutput({ name, url });
@@ -1657,6 +1660,7 @@ const HelpPage = (() => {
                     'srt://relay.example.com:4000                 # ' + I18N.t('help.outputs.ex.srt'),
                     'file:///recordings/stream.flv                # ' + I18N.t('help.outputs.ex.flv'),
                     'file:///recordings/stream.mp4                # ' + I18N.t('help.outputs.ex.mp4'),
+                    'exec://ffmpeg?format=flv&args=-i+pipe:0+...  # ' + I18N.t('help.outputs.ex.exec'),
                 ])}
                 <p>${I18N.t('help.outputs.mp4note')}</p>
             </div>
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/interceptor/pkg/stats"
+	"github.com/pion/webrtc/v3"
+)
+
+// Кодеки, которые можно разрешить входу WHIP (whip_codecs).
+// Выходы (FLV/MPEG-TS) несут только H.264 и AAC: H.264 идёт без перекодирования,
+// остальные видеокодеки перекодируются ffmpeg в H.264, Opus - в AAC.
+const (
+	whipCodecH264 = "h264"
+	whipCodecH265 = "h265"
+	whipCodecVP8  = "vp8"
+	whipCodecVP9  = "vp9"
+	whipCodecAV1  = "av1"
+	whipCodecOpus = "opus"
+)
+
+// По умолчанию только то, что не требует перекодирования видео
+var defaultWHIPCodecs = []string{whipCodecH264, whipCodecOpus}
+
+var whipVideoFeedback = []webrtc.RTCPFeedback{
+	{Type: "goog-remb"},
+	{Type: "ccm", Parameter: "fir"},
+	{Type: "nack"},
+	{Type: "nack", Parameter: "pli"},
+}
+
+// whipCodecParameters возвращает варианты кодека для MediaEngine.
+// Payload type'ы совпадают с набором pion по умолчанию.
+func whipCodecParameters(name string) (webrtc.RTPCodecType, []webrtc.RTPCodecParameters, error) {
+	video := func(pt webrtc.PayloadType, mime, fmtp string) webrtc.RTPCodecParameters {
+		return webrtc.RTPCodecParameters{
+			RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: mime, ClockRate: 90000, SDPFmtpLine: fmtp, RTCPFeedback: whipVideoFeedback},
+			PayloadType:        pt,
+		}
+	}
+
+	switch strings.ToLower(name) {
+	case whipCodecH264:
+		return webrtc.RTPCodecTypeVideo, []webrtc.RTPCodecParameters{
+			video(102, webrtc.MimeTypeH264, "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=42001f"),
+			video(104, webrtc.MimeTypeH264, "level-asymmetry-allowed=1;packetization-mode=0;profile-level-id=42001f"),
+			video(106, webrtc.MimeTypeH264, "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=42e01f"),
+			video(108, webrtc.MimeTypeH264, "level-asymmetry-allowed=1;packetization-mode=0;profile-level-id=42e01f"),
+			video(127, webrtc.MimeTypeH264, "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=4d001f"),
+			video(39, webrtc.MimeTypeH264, "level-asymmetry-allowed=1;packetization-mode=0;profile-level-id=4d001f"),
+			video(112, webrtc.MimeTypeH264, "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=64001f"),
+		}, nil
+	case whipCodecH265:
+		return webrtc.RTPCodecTypeVideo, []webrtc.RTPCodecParameters{video(116, webrtc.MimeTypeH265, "")}, nil
+	case whipCodecVP8:
+		return webrtc.RTPCodecTypeVideo, []webrtc.RTPCodecParameters{video(96, webrtc.MimeTypeVP8, "")}, nil
+	case whipCodecVP9:
+		return webrtc.RTPCodecTypeVideo, []webrtc.RTPCodecParameters{
+			video(98, webrtc.MimeTypeVP9, "profile-id=0"),
+			video(100, webrtc.MimeTypeVP9, "profile-id=2"),
+		}, nil
+	case whipCodecAV1:
+		return webrtc.RTPCodecTypeVideo, []webrtc.RTPCodecParameters{video(45, webrtc.MimeTypeAV1, "")}, nil
+	case whipCodecOpus:
+		return webrtc.RTPCodecTypeAudio, []webrtc.RTPCodecParameters{{
+			RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus, ClockRate: 48000, Channels: 2, SDPFmtpLine: "minptime=10;useinbandfec=1"},
+			PayloadType:        111,
+		}}, nil
+	}
+	return 0, nil, fmt.Errorf("unsupported WHIP codec %q", name)
+}
+
+// whipCodecsFor возвращает список кодеков входа (по умолчанию H.264 + Opus)
+func whipCodecsFor(input *InputCfg) []string {
+	if input == nil || len(input.WHIPCodecs) == 0 {
+		return defaultWHIPCodecs
+	}
+	return input.WHIPCodecs
+}
+
+// newWHIPAPI создаёт webrtc.API, который предлагает только разрешённые входу кодеки.
+// Остальные кодеки из offer отклоняются при согласовании. se - общие сетевые настройки ICE,
+// onStats получает доступ к статистике приёма при создании PeerConnection.
+func newWHIPAPI(codecNames []string, se webrtc.SettingEngine, onStats func(stats.Getter)) (*webrtc.API, error) {
+	m := &webrtc.MediaEngine{}
+	for _, name := range codecNames {
+		kind, params, err := whipCodecParameters(name)
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range params {
+			if err := m.RegisterCodec(p, kind); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	// Без mid/rid расширений pion не различает слои simulcast
+	for _, uri := range whipSimulcastExtensions {
+		if err := m.RegisterHeaderExtension(webrtc.RTPHeaderExtensionCapability{URI: uri}, webrtc.RTPCodecTypeVideo); err != nil {
+			return nil, err
+		}
+	}
+
+	// NACK, RTCP отчёты и TWCC как у PeerConnection по умолчанию
+	registry := &interceptor.Registry{}
+	if err := webrtc.RegisterDefaultInterceptors(m, registry); err != nil {
+		return nil, err
+	}
+	statsFactory, err := stats.NewInterceptor()
+	if err != nil {
+		return nil, err
+	}
+	statsFactory.OnNewPeerConnection(func(_ string, getter stats.Getter) {
+		onStats(getter)
+	})
+	registry.Add(statsFactory)
+	return webrtc.NewAPI(webrtc.WithMediaEngine(m), webrtc.WithInterceptorRegistry(registry), webrtc.WithSettingEngine(se)), nil
+}
+
+// offeredCodecs возвращает имена кодеков из a=rtpmap offer'а по типам m= секций
+// (без служебных rtx/red/ulpfec/CN/telephone-event)
+func offeredCodecs(sdp string) map[webrtc.RTPCodecType][]string {
+	offered := make(map[webrtc.RTPCodecType][]string)
+	var kind webrtc.RTPCodecType
+	for _, line := range splitSDPLines(sdp) {
+		switch {
+		case strings.HasPrefix(line, "m=video "):
+			kind = webrtc.RTPCodecTypeVideo
+		case strings.HasPrefix(line, "m=audio "):
+			kind = webrtc.RTPCodecTypeAudio
+		case strings.HasPrefix(line, "m="):
+			kind = 0
+		case kind != 0 && strings.HasPrefix(line, "a=rtpmap:"):
+			fields := strings.Fields(strings.TrimPrefix(line, "a=rtpmap:"))
+			if len(fields) < 2 {
+				continue
+			}
+			name := strings.ToLower(strings.Split(fields[1], "/")[0])
+			switch name {
+			case "rtx", "red", "ulpfec", "flexfec-03", "cn", "telephone-event":
+				continue
+			}
+			offered[kind] = appendUnique(offered[kind], name)
+		}
+	}
+	return offered
+}
+
+// matchWHIPCodecs возвращает, какие типы треков offer'а можно принять с кодеками входа
+func matchWHIPCodecs(offered map[webrtc.RTPCodecType][]string, allowed []string) (video, audio bool) {
+	for _, name := range allowed {
+		name = strings.ToLower(name)
+		kind, _, err := whipCodecParameters(name)
+		if err != nil {
+			continue
+		}
+		for _, o := range offered[kind] {
+			if o == name {
+				if kind == webrtc.RTPCodecTypeVideo {
+					video = true
+				} else {
+					audio = true
+				}
+			}
+		}
+	}
+	return video, audio
+}
+
+func appendUnique(list []string, value string) []string {
+	for _, v := range list {
+		if v == value {
+			return list
+		}
+	}
+	return append(list, value)
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// Сетевые настройки ICE для WHIP: общие UDP/TCP порты для всех сессий,
+// адреса 1:1 NAT, ICE-lite и TURN серверы с учётными данными.
+
+// setupICE открывает общие ICE порты и готовит SettingEngine для всех сессий.
+// Порты и NAT настройки читаются при старте сервера.
+func (w *WHIPServer) setupICE() error {
+	w.manager.mu.RLock()
+	var settings WHIPSettings
+	if w.manager.config != nil {
+		settings = w.manager.config.WHIPSettings
+	}
+	w.manager.mu.RUnlock()
+
+	se := webrtc.SettingEngine{}
+	networkTypes := []webrtc.NetworkType{webrtc.NetworkTypeUDP4, webrtc.NetworkTypeUDP6}
+
+	if settings.ICEUDPPort > 0 {
+		conn, err := net.ListenUDP("udp", &net.UDPAddr{Port: settings.ICEUDPPort})
+		if err != nil {
+			return fmt.Errorf("failed to listen ICE UDP port %d: %w", settings.ICEUDPPort, err)
+		}
+		w.iceUDPConn = conn
+		se.SetICEUDPMux(webrtc.NewICEUDPMux(nil, conn))
+		log.Printf("[WHIP] ICE UDP mux on :%d", settings.ICEUDPPort)
+	}
+	if settings.ICETCPPort > 0 {
+		listener, err := net.ListenTCP("tcp", &net.TCPAddr{Port: settings.ICETCPPort})
+		if err != nil {
+			w.closeICE()
+			return fmt.Errorf("failed to listen ICE TCP port %d: %w", settings.ICETCPPort, err)
+		}
+		w.iceTCPListener = listener
+		se.SetICETCPMux(webrtc.NewICETCPMux(nil, listener, 8))
+		networkTypes = append(networkTypes, webrtc.NetworkTypeTCP4, webrtc.NetworkTypeTCP6)
+		log.Printf("[WHIP] ICE TCP mux on :%d", settings.ICETCPPort)
+	}
+	se.SetNetworkTypes(networkTypes)
+
+	if len(settings.NAT1To1IPs) > 0 {
+		se.SetNAT1To1IPs(settings.NAT1To1IPs, webrtc.ICECandidateTypeHost)
+		log.Printf("[WHIP] Announcing NAT 1:1 addresses %v", settings.NAT1To1IPs)
+	}
+	if settings.ICELite {
+		se.SetLite(true)
+		log.Printf("[WHIP] ICE-lite mode enabled")
+	}
+
+	w.settingEngine = se
+	return nil
+}
+
+// closeICE закрывает общие ICE порты
+func (w *WHIPServer) closeICE() {
+	if w.iceUDPConn != nil {
+		w.iceUDPConn.Close()
+		w.iceUDPConn = nil
+	}
+	if w.iceTCPListener != nil {
+		w.iceTCPListener.Close()
+		w.iceTCPListener = nil
+	}
+}
+
+// iceServers возвращает STUN/TURN серверы из whip_settings
+func (w *WHIPServer) iceServers() []webrtc.ICEServer {
+	w.manager.mu.RLock()
+	defer w.manager.mu.RUnlock()
+	if w.manager.config == nil {
+		return nil
+	}
+	settings := w.manager.config.WHIPSettings
+
+	var servers []webrtc.ICEServer
+	for _, url := range settings.ICEServers {
+		servers = append(servers, webrtc.ICEServer{URLs: []string{url}})
+	}
+	for _, turn := range settings.TURNServers {
+		server := webrtc.ICEServer{URLs: append([]string(nil), turn.URLs...)}
+		if turn.Username != "" || turn.Credential != "" {
+			server.Username = turn.Username
+			server.Credential = turn.Credential
+			server.CredentialType = webrtc.ICECredentialTypePassword
+		}
+		servers = append(servers, server)
+	}
+	return servers
+}
+
+// setICEServerLinks добавляет Link: rel="ice-server" для каждого ICE сервера (RFC 9725, 4.6).
+// Серверы с учётными данными отдаются только с credentials=true - в ответе на POST,
+// когда токен публикации уже проверен; иначе TURN стал бы открытым релеем для всех.
+func (w *WHIPServer) setICEServerLinks(wr http.ResponseWriter, credentials bool) {
+	for _, server := range w.iceServers() {
+		if server.Username != "" && !credentials {
+			continue
+		}
+		for _, url := range server.URLs {
+			link := fmt.Sprintf(`<%s>; rel="ice-server"`, url)
+			if server.Username != "" {
+				link += fmt.Sprintf(`; username="%s"; credential="%s"; credential-type="password"`,
+					quoteLinkParam(server.Username), quoteLinkParam(fmt.Sprint(server.Credential)))
+			}
+			wr.Header().Add("Link", link)
+		}
+	}
+}
+
+func quoteLinkParam(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s)
+}
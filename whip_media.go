@@ -0,0 +1,538 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"os/exec"
+	"sync"
+	"time"
+
+	"github.com/datarhei/joy4/av"
+	"github.com/datarhei/joy4/codec/aacparser"
+	"github.com/datarhei/joy4/codec/h264parser"
+	"github.com/pion/rtp"
+	"github.com/pion/rtp/codecs"
+	"github.com/pion/webrtc/v3"
+	"github.com/pion/webrtc/v3/pkg/media/oggwriter"
+	"github.com/pion/webrtc/v3/pkg/media/samplebuilder"
+)
+
+// Приём медиа WHIP внутри процесса: RTP -> буфер переупорядочивания -> кадры -> av.Packet
+// в session.outputMgr. Внешний процесс нужен только для перекодирования Opus в AAC.
+
+const (
+	defaultWHIPJitterBuffer = 200 * time.Millisecond
+	whipVideoClockRate      = 90000
+	whipMaxLatePackets      = 512
+	// Сколько ждать кодек второго трека, прежде чем начать без него
+	whipCodecWaitTimeout = 3 * time.Second
+	// Сколько пакетов держим, пока ждём кодеки всех треков
+	whipMaxPendingPackets = 1000
+)
+
+// Режимы аудио WHIP (whip_settings.audio)
+const (
+	whipAudioAAC  = "aac"  // Opus перекодируется в AAC через ffmpeg (по умолчанию)
+	whipAudioOpus = "opus" // Opus без перекодирования: есть на SRT выходах, остальные получают только видео
+	whipAudioNone = "none" // аудио отбрасывается
+)
+
+// rtpTimeline переводит 32-битные RTP метки трека во время от начала сессии.
+// У треков WebRTC независимые случайные смещения RTP, поэтому начало каждого
+// трека привязывается к моменту прихода его первого пакета.
+type rtpTimeline struct {
+	clockRate int64
+	offset    time.Duration
+	prev      uint32
+	ticks     int64
+	started   bool
+}
+
+func (t *rtpTimeline) Time(ts uint32, offset time.Duration) time.Duration {
+	if !t.started {
+		t.started = true
+		t.offset = offset
+		t.prev = ts
+	}
+	t.ticks += int64(int32(ts - t.prev))
+	t.prev = ts
+	// Делим по частям, чтобы не переполнить int64 на длинных сессиях
+	whole, frac := t.ticks/t.clockRate, t.ticks%t.clockRate
+	return t.offset + time.Duration(whole)*time.Second + time.Duration(frac)*time.Second/time.Duration(t.clockRate)
+}
+
+// whipMedia собирает пакеты треков сессии и отдаёт их в выходы,
+// когда известны CodecData всех треков
+type whipMedia struct {
+	session *WHIPSession
+
+	mu         sync.Mutex
+	start      time.Time
+	wantVideo  bool
+	wantAudio  bool
+	video      av.CodecData
+	audio      av.CodecData
+	firstCodec time.Time
+	ready      bool
+	videoIdx   int
+	audioIdx   int
+	pending    []whipPendingPacket
+
+	// Производные входы слоёв simulcast получают то же аудио
+	followers []*whipMedia
+}
+
+type whipPendingPacket struct {
+	kind webrtc.RTPCodecType
+	pkt  av.Packet
+}
+
+func newWHIPMedia(session *WHIPSession, wantVideo, wantAudio bool) *whipMedia {
+	return &whipMedia{
+		session:   session,
+		wantVideo: wantVideo,
+		wantAudio: wantAudio,
+		videoIdx:  -1,
+		audioIdx:  -1,
+	}
+}
+
+// since возвращает время от прихода первого медиапакета сессии
+func (m *whipMedia) since() time.Duration {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.start.IsZero() {
+		m.start = time.Now()
+	}
+	return time.Since(m.start)
+}
+
+// whipVideoSink получает кадры видеотрека: сама сессия или слой simulcast
+type whipVideoSink interface {
+	SetCodec(kind webrtc.RTPCodecType, codec av.CodecData)
+	Deliver(kind webrtc.RTPCodecType, pkt av.Packet)
+	since() time.Duration
+}
+
+// SetCodec сообщает CodecData трека. После отправки заголовков новые CodecData
+// попадают в выходы на ближайшем ключевом кадре.
+func (m *whipMedia) SetCodec(kind webrtc.RTPCodecType, codec av.CodecData) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if kind == webrtc.RTPCodecTypeAudio {
+		for _, f := range m.followers {
+			f.SetCodec(kind, codec)
+		}
+	}
+	if m.ready {
+		idx := m.audioIdx
+		if kind == webrtc.RTPCodecTypeVideo {
+			idx = m.videoIdx
+		}
+		m.session.header.Update(idx, codec)
+		return
+	}
+	if kind == webrtc.RTPCodecTypeVideo {
+		m.video = codec
+	} else {
+		m.audio = codec
+	}
+	if m.firstCodec.IsZero() {
+		m.firstCodec = time.Now()
+	}
+	m.tryReadyLocked()
+}
+
+// DisableAudio - аудио не будет (режим none или перекодировщик недоступен)
+func (m *whipMedia) DisableAudio() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, f := range m.followers {
+		f.DisableAudio()
+	}
+	m.wantAudio = false
+	m.tryReadyLocked()
+}
+
+// addFollower подключает производный вход, которому дублируется аудио сессии
+func (m *whipMedia) addFollower(f *whipMedia) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.followers = append(m.followers, f)
+}
+
+func (m *whipMedia) tryReadyLocked() {
+	if m.ready {
+		return
+	}
+	videoDone := !m.wantVideo || m.video != nil
+	audioDone := !m.wantAudio || m.audio != nil
+	timedOut := !m.firstCodec.IsZero() && time.Since(m.firstCodec) > whipCodecWaitTimeout
+	if !(videoDone && audioDone) && !timedOut {
+		return
+	}
+
+	var streams []av.CodecData
+	if m.video != nil {
+		m.videoIdx = len(streams)
+		streams = append(streams, m.video)
+	}
+	if m.audio != nil {
+		m.audioIdx = len(streams)
+		streams = append(streams, m.audio)
+	}
+	if len(streams) == 0 {
+		return
+	}
+	m.ready = true
+
+	m.session.streamsOnce.Do(func() {
+		m.session.header = newStreamHeader(streams)
+		close(m.session.streamsCh)
+		log.Printf("[WHIP] Codec data ready for stream '%s': %d stream(s)", m.session.inputName, len(streams))
+	})
+
+	pending := m.pending
+	m.pending = nil
+	for _, p := range pending {
+		m.sendLocked(p.kind, p.pkt)
+	}
+}
+
+// Deliver отдаёт пакет трека в выходы (или придерживает, пока не готовы заголовки)
+func (m *whipMedia) Deliver(kind webrtc.RTPCodecType, pkt av.Packet) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if kind == webrtc.RTPCodecTypeAudio {
+		for _, f := range m.followers {
+			f.Deliver(kind, pkt)
+		}
+	}
+	if !m.ready {
+		m.tryReadyLocked()
+	}
+	if !m.ready {
+		if len(m.pending) < whipMaxPendingPackets {
+			m.pending = append(m.pending, whipPendingPacket{kind: kind, pkt: pkt})
+		}
+		return
+	}
+	m.sendLocked(kind, pkt)
+}
+
+func (m *whipMedia) sendLocked(kind webrtc.RTPCodecType, pkt av.Packet) {
+	idx := m.audioIdx
+	if kind == webrtc.RTPCodecTypeVideo {
+		idx = m.videoIdx
+	}
+	if idx < 0 {
+		return // трек не попал в заголовок (кодек пришёл после таймаута)
+	}
+	pkt.Idx = int8(idx)
+
+	for _, w := range m.session.outputMgr.AllOutputs() {
+		select {
+		case w.ch <- pkt:
+		default:
+			// буфер заполнен — дропаем пакет для этого выхода
+		}
+	}
+}
+
+// handleVideoTrack собирает H.264 кадры из RTP (FU-A/STAP-A) и отдаёт их в AVCC
+func (w *WHIPServer) handleVideoTrack(track *webrtc.TrackRemote, sink whipVideoSink) {
+	log.Printf("[WHIP] Started handling video track: %s (%s)", track.ID(), track.Codec().MimeType)
+
+	builder := samplebuilder.New(whipMaxLatePackets, &codecs.H264Packet{IsAVC: true}, whipVideoClockRate,
+		samplebuilder.WithMaxTimeDelay(w.jitterBuffer()))
+	timeline := rtpTimeline{clockRate: whipVideoClockRate}
+	var sps, pps []byte
+	waitKeyFrame := true
+
+	for {
+		packet, _, err := track.ReadRTP()
+		if err != nil {
+			log.Printf("[WHIP] Video track %s ended: %v", track.ID(), err)
+			return
+		}
+		builder.Push(packet)
+
+		for sample := builder.Pop(); sample != nil; sample = builder.Pop() {
+			if sample.PrevDroppedPackets > 0 {
+				// После потерь кадры ссылаются на недостающие данные - ждём ключевой кадр
+				waitKeyFrame = true
+			}
+
+			nalus := splitAVCC(sample.Data)
+			isKeyFrame := false
+			newParams := false
+			for _, nalu := range nalus {
+				switch nalu[0] & 0x1f {
+				case 5:
+					isKeyFrame = true
+				case 7:
+					if string(nalu) != string(sps) {
+						sps = append([]byte(nil), nalu...)
+						newParams = true
+					}
+				case 8:
+					if string(nalu) != string(pps) {
+						pps = append([]byte(nil), nalu...)
+						newParams = true
+					}
+				}
+			}
+			if newParams && sps != nil && pps != nil {
+				if codec, err := h264parser.NewCodecDataFromSPSAndPPS(sps, pps); err == nil {
+					sink.SetCodec(webrtc.RTPCodecTypeVideo, codec)
+				}
+			}
+
+			t := timeline.Time(sample.PacketTimestamp, sink.since())
+			if waitKeyFrame {
+				if !isKeyFrame {
+					continue
+				}
+				waitKeyFrame = false
+			}
+			sink.Deliver(webrtc.RTPCodecTypeVideo, av.Packet{
+				IsKeyFrame: isKeyFrame,
+				Data:       sample.Data,
+				Time:       t,
+			})
+		}
+	}
+}
+
+// splitAVCC делит кадр AVCC на NAL'ы
+func splitAVCC(data []byte) [][]byte {
+	var nalus [][]byte
+	for len(data) >= 4 {
+		size := int(binary.BigEndian.Uint32(data))
+		data = data[4:]
+		if size <= 0 || size > len(data) {
+			break
+		}
+		nalus = append(nalus, data[:size])
+		data = data[size:]
+	}
+	return nalus
+}
+
+// whipAudioPath превращает Opus из WebRTC в то, что могут нести выходы.
+// Муксеры joy4 (RTMP/FLV, MPEG-TS) Opus не поддерживают, поэтому выбор - AAC,
+// Opus как есть (только SRT выходы) или без звука.
+type whipAudioPath interface {
+	WriteRTP(pkt *rtp.Packet) error
+	Close()
+}
+
+// newWHIPAudioPath создаёт обработчик аудио по режиму из whip_settings.audio
+func newWHIPAudioPath(mode string, track *webrtc.TrackRemote, session *WHIPSession, jitter time.Duration) (whipAudioPath, error) {
+	switch mode {
+	case whipAudioNone:
+		return nil, nil
+	case whipAudioOpus:
+		return newWHIPOpusPath(track, session, jitter), nil
+	case "", whipAudioAAC:
+		return newWHIPAACTranscoder(track, session)
+	default:
+		return nil, fmt.Errorf("unknown WHIP audio mode %q", mode)
+	}
+}
+
+// whipOpusPath отдаёт Opus в выходы как есть, без ffmpeg: RTP пакеты проходят
+// через буфер переупорядочивания, метки считаются по RTP как у видео
+type whipOpusPath struct {
+	session   *WHIPSession
+	builder   *samplebuilder.SampleBuilder
+	timeline  rtpTimeline
+	channels  int
+	codecSent bool
+}
+
+func newWHIPOpusPath(track *webrtc.TrackRemote, session *WHIPSession, jitter time.Duration) *whipOpusPath {
+	channels := int(track.Codec().Channels)
+	if channels == 0 {
+		channels = 2
+	}
+	return &whipOpusPath{
+		session: session,
+		builder: samplebuilder.New(whipMaxLatePackets, &codecs.OpusPacket{}, opusSampleRate,
+			samplebuilder.WithMaxTimeDelay(jitter)),
+		timeline: rtpTimeline{clockRate: opusSampleRate},
+		channels: channels,
+	}
+}
+
+func (p *whipOpusPath) WriteRTP(pkt *rtp.Packet) error {
+	if !p.codecSent {
+		p.session.media.SetCodec(webrtc.RTPCodecTypeAudio, opusCodecData{channels: p.channels})
+		p.codecSent = true
+	}
+	p.builder.Push(pkt)
+	for sample := p.builder.Pop(); sample != nil; sample = p.builder.Pop() {
+		p.session.media.Deliver(webrtc.RTPCodecTypeAudio, av.Packet{
+			Data: sample.Data,
+			Time: p.timeline.Time(sample.PacketTimestamp, p.session.media.since()),
+		})
+	}
+	return nil
+}
+
+func (p *whipOpusPath) Close() {}
+
+// whipAACTranscoder перекодирует Opus в AAC через ffmpeg: RTP пишется в stdin как Ogg,
+// из stdout читаются ADTS кадры. Метки времени считаются по числу сэмплов от первого кадра.
+type whipAACTranscoder struct {
+	cmd   *exec.Cmd
+	stdin io.WriteCloser
+	ogg   *oggwriter.OggWriter
+	done  chan struct{}
+}
+
+func newWHIPAACTranscoder(track *webrtc.TrackRemote, session *WHIPSession) (*whipAACTranscoder, error) {
+	codec := track.Codec()
+	channels := codec.Channels
+	if channels == 0 {
+		channels = 2
+	}
+	clockRate := codec.ClockRate
+	if clockRate == 0 {
+		clockRate = 48000
+	}
+
+	cmd := exec.Command(ffmpegBinary(),
+		"-loglevel", "error",
+		"-f", "ogg", "-i", "pipe:0",
+		"-c:a", "aac", "-b:a", "128k",
+		"-f", "adts", "pipe:1",
+	)
+	stdin, stdout, err := startWHIPFFmpeg(cmd, session.inputName, "audio")
+	if err != nil {
+		return nil, err
+	}
+	ogg, err := oggwriter.NewWith(stdin, clockRate, channels)
+	if err != nil {
+		stdin.Close()
+		cmd.Process.Kill()
+		cmd.Wait()
+		return nil, err
+	}
+
+	t := &whipAACTranscoder{cmd: cmd, stdin: stdin, ogg: ogg, done: make(chan struct{})}
+	go t.readADTS(stdout, session)
+	return t, nil
+}
+
+func (t *whipAACTranscoder) WriteRTP(pkt *rtp.Packet) error {
+	return t.ogg.WriteRTP(pkt)
+}
+
+func (t *whipAACTranscoder) Close() {
+	t.ogg.Close()
+	t.stdin.Close()
+	select {
+	case <-t.done:
+	case <-time.After(2 * time.Second):
+		t.cmd.Process.Kill()
+		<-t.done
+	}
+}
+
+// readADTS режет поток ADTS из ffmpeg на кадры и отдаёт их в сессию
+func (t *whipAACTranscoder) readADTS(stdout io.Reader, session *WHIPSession) {
+	defer func() {
+		t.cmd.Wait()
+		close(t.done)
+	}()
+
+	// stdout - непрерывный поток без PTS: splitter только режет кадры (они пересекают
+	// границы чтений), а метки считаются по общему счётчику сэмплов
+	var splitter adtsSplitter
+	var base time.Duration
+	var samples int64
+	codecSent := false
+
+	for {
+		chunk := make([]byte, 4096)
+		n, err := stdout.Read(chunk)
+		if n > 0 {
+			for _, frame := range splitter.Split(chunk[:n], 0) {
+				if !codecSent {
+					codec, cerr := aacparser.NewCodecDataFromMPEG4AudioConfig(frame.Config)
+					if cerr != nil {
+						log.Printf("[WHIP] Invalid AAC config from ffmpeg: %v", cerr)
+						session.media.DisableAudio()
+						return
+					}
+					session.media.SetCodec(webrtc.RTPCodecTypeAudio, codec)
+					base = session.media.since()
+					codecSent = true
+				}
+				var ticks int64
+				if frame.Config.SampleRate > 0 {
+					ticks = samples * ptsClockRate / int64(frame.Config.SampleRate)
+				}
+				samples += int64(frame.Samples)
+				session.media.Deliver(webrtc.RTPCodecTypeAudio, av.Packet{
+					Data: frame.Payload,
+					Time: base + ticksToDuration(ticks),
+				})
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// handleAudioTrack отдаёт Opus выбранному обработчику аудио
+func (w *WHIPServer) handleAudioTrack(track *webrtc.TrackRemote, session *WHIPSession) {
+	log.Printf("[WHIP] Started handling audio track: %s (%s)", track.ID(), track.Codec().MimeType)
+
+	path, err := newWHIPAudioPath(w.audioMode(), track, session, w.jitterBuffer())
+	if err != nil {
+		log.Printf("[WHIP] Audio disabled for '%s': %v", session.inputName, err)
+	}
+	if path == nil {
+		session.media.DisableAudio()
+		drainTrack(track)
+		return
+	}
+	defer path.Close()
+
+	for {
+		packet, _, err := track.ReadRTP()
+		if err != nil {
+			log.Printf("[WHIP] Audio track %s ended: %v", track.ID(), err)
+			return
+		}
+		if err := path.WriteRTP(packet); err != nil {
+			log.Printf("[WHIP] Audio transcoder for '%s' stopped: %v", session.inputName, err)
+			session.media.DisableAudio()
+			drainTrack(track)
+			return
+		}
+	}
+}
+
+func (w *WHIPServer) audioMode() string {
+	w.manager.mu.RLock()
+	defer w.manager.mu.RUnlock()
+	if w.manager.config == nil {
+		return whipAudioAAC
+	}
+	return w.manager.config.WHIPSettings.Audio
+}
+
+func (w *WHIPServer) jitterBuffer() time.Duration {
+	w.manager.mu.RLock()
+	defer w.manager.mu.RUnlock()
+	if w.manager.config == nil || w.manager.config.WHIPSettings.JitterBufferMs <= 0 {
+		return defaultWHIPJitterBuffer
+	}
+	return time.Duration(w.manager.config.WHIPSettings.JitterBufferMs) * time.Millisecond
+}
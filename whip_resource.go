@@ -0,0 +1,304 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// Ресурс WHIP сессии по RFC 9725: POST на endpoint входа создаёт сессию
+// с уникальным URL (url_path входа + /id), на который клиент шлёт PATCH
+// (trickle ICE и ICE restart) и DELETE (завершение).
+
+const (
+	sdpContentType      = "application/sdp"
+	sdpFragContentType  = "application/trickle-ice-sdpfrag"
+	whipAllowedMethods  = "OPTIONS, POST, PATCH, DELETE"
+	whipExposedHeaders  = "Location, ETag, Link, Accept-Patch, Accept-Post"
+	whipAllowedHeaders  = "Content-Type, If-Match, Authorization"
+	whipAnswerGatherCap = 500 * time.Millisecond // сколько ждать кандидатов до ответа
+)
+
+func newWHIPSessionID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(b)
+}
+
+func newWHIPETag() string {
+	return `"` + newWHIPSessionID()[:16] + `"`
+}
+
+// setCORSHeaders разрешает браузерным WHIP клиентам обращаться к серверу с другого origin
+func setCORSHeaders(wr http.ResponseWriter) {
+	h := wr.Header()
+	h.Set("Access-Control-Allow-Origin", "*")
+	h.Set("Access-Control-Allow-Methods", whipAllowedMethods)
+	h.Set("Access-Control-Allow-Headers", whipAllowedHeaders)
+	h.Set("Access-Control-Expose-Headers", whipExposedHeaders)
+}
+
+// sessionByResource ищет сессию по URL ресурса
+func (w *WHIPServer) sessionByResource(path string) *WHIPSession {
+	id := path[strings.LastIndex(path, "/")+1:]
+	w.sessionMu.RLock()
+	defer w.sessionMu.RUnlock()
+	session, ok := w.sessions[id]
+	if !ok || session.resourcePath != path {
+		return nil
+	}
+	return session
+}
+
+func (w *WHIPServer) handleWHIPOptions(wr http.ResponseWriter, r *http.Request) {
+	if w.sessionByResource(r.URL.Path) != nil {
+		wr.Header().Set("Accept-Patch", sdpFragContentType)
+	} else {
+		wr.Header().Set("Accept-Post", sdpContentType)
+		// OPTIONS не проверяет токен, поэтому без учётных данных TURN
+		w.setICEServerLinks(wr, false)
+	}
+	wr.WriteHeader(http.StatusNoContent)
+}
+
+func (w *WHIPServer) handleWHIPDelete(wr http.ResponseWriter, r *http.Request) {
+	session := w.sessionByResource(r.URL.Path)
+	if session == nil {
+		http.Error(wr, "Session not found", http.StatusNotFound)
+		return
+	}
+	log.Printf("[WHIP] Session %s for '%s' deleted by client", session.id, session.inputName)
+	w.removeSession(session)
+	wr.WriteHeader(http.StatusOK)
+}
+
+// removeSession останавливает сессию и убирает её из списка
+func (w *WHIPServer) removeSession(session *WHIPSession) {
+	w.sessionMu.Lock()
+	if w.sessions[session.id] == session {
+		delete(w.sessions, session.id)
+	}
+	w.sessionMu.Unlock()
+	w.stopSession(session)
+}
+
+// handleWHIPPatch принимает trickle ICE кандидаты клиента или выполняет ICE restart
+func (w *WHIPServer) handleWHIPPatch(wr http.ResponseWriter, r *http.Request) {
+	session := w.sessionByResource(r.URL.Path)
+	if session == nil {
+		http.Error(wr, "Session not found", http.StatusNotFound)
+		return
+	}
+	if ct := strings.TrimSpace(strings.Split(r.Header.Get("Content-Type"), ";")[0]); ct != sdpFragContentType {
+		http.Error(wr, "Content-Type must be "+sdpFragContentType, http.StatusUnsupportedMediaType)
+		return
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(wr, "Failed to read body", http.StatusBadRequest)
+		return
+	}
+	frag := parseSDPFrag(string(body))
+
+	session.mu.Lock()
+	defer session.mu.Unlock()
+
+	if ifMatch := r.Header.Get("If-Match"); ifMatch != "" && ifMatch != "*" && ifMatch != session.etag {
+		http.Error(wr, "ETag mismatch", http.StatusPreconditionFailed)
+		return
+	}
+
+	remote := session.peerConnection.RemoteDescription()
+	if remote == nil {
+		http.Error(wr, "Session has no remote description", http.StatusConflict)
+		return
+	}
+	restart := frag.ufrag != "" && frag.ufrag != sdpAttribute(remote.SDP, "ice-ufrag")
+
+	if restart {
+		if err := w.restartICE(session, remote.SDP, frag); err != nil {
+			log.Printf("[WHIP] ICE restart failed for '%s': %v", session.inputName, err)
+			http.Error(wr, "ICE restart failed", http.StatusInternalServerError)
+			return
+		}
+		log.Printf("[WHIP] ICE restart for '%s'", session.inputName)
+	}
+
+	for _, c := range frag.candidates {
+		mid := c.mid
+		if err := session.peerConnection.AddICECandidate(webrtc.ICECandidateInit{Candidate: c.candidate, SDPMid: &mid}); err != nil {
+			log.Printf("[WHIP] Failed to add ICE candidate for '%s': %v", session.inputName, err)
+		}
+	}
+
+	if restart {
+		wr.Header().Set("Content-Type", sdpFragContentType)
+		wr.Header().Set("ETag", session.etag)
+		wr.WriteHeader(http.StatusOK)
+		_, _ = wr.Write([]byte(session.localFragLocked(true)))
+		return
+	}
+
+	// Отдаём клиенту кандидаты сервера, найденные после отправки ответа
+	if fragment := session.localFragLocked(false); fragment != "" {
+		wr.Header().Set("Content-Type", sdpFragContentType)
+		wr.WriteHeader(http.StatusOK)
+		_, _ = wr.Write([]byte(fragment))
+		return
+	}
+	wr.WriteHeader(http.StatusNoContent)
+}
+
+// restartICE применяет новые ufrag/pwd клиента как повторный offer и создаёт новый answer
+func (w *WHIPServer) restartICE(session *WHIPSession, remoteSDP string, frag *sdpFrag) error {
+	var lines []string
+	for _, line := range splitSDPLines(remoteSDP) {
+		switch {
+		case strings.HasPrefix(line, "a=candidate:"), line == "a=end-of-candidates":
+			continue
+		case strings.HasPrefix(line, "a=ice-ufrag:"):
+			line = "a=ice-ufrag:" + frag.ufrag
+		case strings.HasPrefix(line, "a=ice-pwd:"):
+			line = "a=ice-pwd:" + frag.pwd
+		}
+		lines = append(lines, line)
+	}
+	offer := webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: strings.Join(lines, "\r\n") + "\r\n"}
+	if err := session.peerConnection.SetRemoteDescription(offer); err != nil {
+		return err
+	}
+	answer, err := session.peerConnection.CreateAnswer(nil)
+	if err != nil {
+		return err
+	}
+	gatherComplete := webrtc.GatheringCompletePromise(session.peerConnection)
+	if err := session.peerConnection.SetLocalDescription(answer); err != nil {
+		return err
+	}
+	waitGathering(gatherComplete)
+
+	session.etag = newWHIPETag()
+	session.sentCandidates = make(map[string]bool)
+	return nil
+}
+
+// waitGathering ждёт сбора кандидатов, но не дольше whipAnswerGatherCap:
+// хост-кандидаты готовы почти сразу, остальные клиент получит в ответах на PATCH
+func waitGathering(done <-chan struct{}) {
+	select {
+	case <-done:
+	case <-time.After(whipAnswerGatherCap):
+	}
+}
+
+// markCandidatesSent запоминает кандидаты, уже попавшие к клиенту в SDP
+func (s *WHIPSession) markCandidatesSent(sdp string) {
+	for _, line := range splitSDPLines(sdp) {
+		if strings.HasPrefix(line, "a=candidate:") {
+			s.sentCandidates[strings.TrimPrefix(line, "a=")] = true
+		}
+	}
+}
+
+// localFragLocked собирает sdpfrag с кандидатами сервера, которых клиент ещё не видел.
+// withCredentials - для ответа на ICE restart, там фрагмент нужен даже без кандидатов.
+func (s *WHIPSession) localFragLocked(withCredentials bool) string {
+	local := s.peerConnection.LocalDescription()
+	if local == nil {
+		return ""
+	}
+
+	// LocalDescription содержит все собранные на данный момент кандидаты
+	var candidates []string
+	for _, line := range splitSDPLines(local.SDP) {
+		if strings.HasPrefix(line, "a=candidate:") {
+			c := strings.TrimPrefix(line, "a=")
+			if !s.sentCandidates[c] {
+				candidates = append(candidates, c)
+			}
+		}
+	}
+	if len(candidates) == 0 && !withCredentials {
+		return ""
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "a=ice-ufrag:%s\r\n", sdpAttribute(local.SDP, "ice-ufrag"))
+	fmt.Fprintf(&b, "a=ice-pwd:%s\r\n", sdpAttribute(local.SDP, "ice-pwd"))
+	for _, line := range splitSDPLines(local.SDP) {
+		if strings.HasPrefix(line, "m=") {
+			b.WriteString(line + "\r\n")
+			break
+		}
+	}
+	fmt.Fprintf(&b, "a=mid:%s\r\n", sdpAttribute(local.SDP, "mid"))
+	for _, c := range candidates {
+		s.sentCandidates[c] = true
+		fmt.Fprintf(&b, "a=%s\r\n", c)
+	}
+	if s.peerConnection.ICEGatheringState() == webrtc.ICEGatheringStateComplete {
+		b.WriteString("a=end-of-candidates\r\n")
+	}
+	return b.String()
+}
+
+// sdpFrag - разобранный application/trickle-ice-sdpfrag (RFC 8840)
+type sdpFrag struct {
+	ufrag      string
+	pwd        string
+	candidates []sdpFragCandidate
+}
+
+type sdpFragCandidate struct {
+	mid       string
+	candidate string
+}
+
+func parseSDPFrag(body string) *sdpFrag {
+	frag := &sdpFrag{}
+	mid := "0"
+	for _, line := range splitSDPLines(body) {
+		switch {
+		case strings.HasPrefix(line, "a=ice-ufrag:"):
+			frag.ufrag = strings.TrimPrefix(line, "a=ice-ufrag:")
+		case strings.HasPrefix(line, "a=ice-pwd:"):
+			frag.pwd = strings.TrimPrefix(line, "a=ice-pwd:")
+		case strings.HasPrefix(line, "a=mid:"):
+			mid = strings.TrimPrefix(line, "a=mid:")
+		case strings.HasPrefix(line, "a=candidate:"):
+			frag.candidates = append(frag.candidates, sdpFragCandidate{mid: mid, candidate: strings.TrimPrefix(line, "a=")})
+		}
+	}
+	return frag
+}
+
+func splitSDPLines(sdp string) []string {
+	var lines []string
+	for _, line := range strings.Split(sdp, "\n") {
+		line = strings.TrimRight(line, "\r")
+		if line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+// sdpAttribute возвращает значение первого атрибута a=name: в SDP
+func sdpAttribute(sdp, name string) string {
+	prefix := "a=" + name + ":"
+	for _, line := range splitSDPLines(sdp) {
+		if strings.HasPrefix(line, prefix) {
+			return strings.TrimPrefix(line, prefix)
+		}
+	}
+	return ""
+}
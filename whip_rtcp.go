@@ -0,0 +1,200 @@
+package main
+
+import (
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/interceptor/pkg/stats"
+	"github.com/pion/rtcp"
+	"github.com/pion/webrtc/v3"
+)
+
+// RTCP обратная связь WHIP: запросы ключевых кадров (PLI/FIR) и статистика приёма.
+// Браузерные энкодеры часто делают GOP в десятки секунд, поэтому новый выход
+// без запроса ключевого кадра может долго ждать картинку.
+
+const (
+	// Не чаще одного запроса ключевого кадра за этот интервал
+	whipKeyframeMinGap = 500 * time.Millisecond
+	// Как часто обновлять статистику сессии в API
+	whipStatsInterval = 2 * time.Second
+)
+
+// WHIPSessionStats - статистика приёма WHIP сессии для API (GET /api/status)
+type WHIPSessionStats struct {
+	SessionID        string           `json:"session_id"`
+	ICEState         string           `json:"ice_state"`
+	KeyframeRequests int              `json:"keyframe_requests"`
+	SelectedLayer    string           `json:"selected_layer,omitempty"`
+	LastKeyframeReq  *time.Time       `json:"last_keyframe_request,omitempty"`
+	Tracks           []WHIPTrackStats `json:"tracks"`
+	UpdatedAt        time.Time        `json:"updated_at"`
+}
+
+// WHIPTrackStats - отчёт приёмника по одному треку
+type WHIPTrackStats struct {
+	Kind            string  `json:"kind"`
+	Codec           string  `json:"codec"`
+	RID             string  `json:"rid,omitempty"`
+	SSRC            uint32  `json:"ssrc"`
+	PacketsReceived uint64  `json:"packets_received"`
+	PacketsLost     int64   `json:"packets_lost"`
+	LossPercent     float64 `json:"loss_percent"`
+	JitterMs        float64 `json:"jitter_ms"`
+	BytesReceived   uint64  `json:"bytes_received"`
+	NACKCount       uint32  `json:"nack_count"`
+	PLICount        uint32  `json:"pli_count"`
+	FIRCount        uint32  `json:"fir_count"`
+}
+
+// whipRTCP хранит треки сессии и отправляет по ним RTCP
+type whipRTCP struct {
+	mu           sync.Mutex
+	tracks       []*webrtc.TrackRemote
+	statsGetter  stats.Getter
+	firSeq       uint8
+	lastRequest  time.Time
+	requestCount int
+}
+
+// AddTrack регистрирует трек для статистики и запросов ключевых кадров
+func (r *whipRTCP) AddTrack(track *webrtc.TrackRemote) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.tracks = append(r.tracks, track)
+}
+
+// requestKeyFrame отправляет PLI (или FIR, если клиент не согласовал PLI) по всем видеотрекам
+func (w *WHIPServer) requestKeyFrame(session *WHIPSession, reason string) {
+	// Производный вход слоя simulcast запрашивает кадр через основную сессию
+	if session.parent != nil {
+		session = session.parent
+	}
+	r := &session.rtcp
+	r.mu.Lock()
+	if time.Since(r.lastRequest) < whipKeyframeMinGap {
+		r.mu.Unlock()
+		return
+	}
+
+	var packets []rtcp.Packet
+	for _, track := range r.tracks {
+		if track.Kind() != webrtc.RTPCodecTypeVideo {
+			continue
+		}
+		ssrc := uint32(track.SSRC())
+		if supportsFeedback(track.Codec(), "nack", "pli") || !supportsFeedback(track.Codec(), "ccm", "fir") {
+			packets = append(packets, &rtcp.PictureLossIndication{MediaSSRC: ssrc})
+		} else {
+			r.firSeq++
+			packets = append(packets, &rtcp.FullIntraRequest{
+				MediaSSRC: ssrc,
+				FIR:       []rtcp.FIREntry{{SSRC: ssrc, SequenceNumber: r.firSeq}},
+			})
+		}
+	}
+	if len(packets) == 0 {
+		r.mu.Unlock()
+		return
+	}
+	r.lastRequest = time.Now()
+	r.requestCount++
+	r.mu.Unlock()
+
+	if err := session.peerConnection.WriteRTCP(packets); err != nil {
+		log.Printf("[WHIP] Failed to request keyframe for '%s': %v", session.inputName, err)
+		return
+	}
+	log.Printf("[WHIP] Keyframe requested for '%s' (%s)", session.inputName, reason)
+}
+
+func supportsFeedback(codec webrtc.RTPCodecParameters, typ, parameter string) bool {
+	for _, fb := range codec.RTCPFeedback {
+		if strings.EqualFold(fb.Type, typ) && strings.EqualFold(fb.Parameter, parameter) {
+			return true
+		}
+	}
+	return false
+}
+
+// runRTCPLoop периодически запрашивает ключевые кадры (whip_settings.keyframe_interval)
+// и публикует статистику приёма в StreamManager
+func (w *WHIPServer) runRTCPLoop(session *WHIPSession) {
+	statsTicker := time.NewTicker(whipStatsInterval)
+	defer statsTicker.Stop()
+	lastKeyframe := time.Now()
+
+	for {
+		select {
+		case <-session.stopCh:
+			return
+		case <-statsTicker.C:
+			if interval := w.keyframeInterval(); interval > 0 && time.Since(lastKeyframe) >= interval {
+				w.requestKeyFrame(session, "interval")
+				lastKeyframe = time.Now()
+			}
+			w.manager.SetWHIPStats(session.inputName, session.collectStats())
+		}
+	}
+}
+
+// collectStats собирает отчёт приёмника по трекам сессии
+func (s *WHIPSession) collectStats() *WHIPSessionStats {
+	r := &s.rtcp
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	result := &WHIPSessionStats{
+		SessionID:        s.id,
+		KeyframeRequests: r.requestCount,
+		UpdatedAt:        time.Now(),
+		ICEState:         s.peerConnection.ICEConnectionState().String(),
+	}
+	if s.simulcast != nil {
+		result.SelectedLayer = s.simulcast.Selected()
+	}
+	if !r.lastRequest.IsZero() {
+		t := r.lastRequest
+		result.LastKeyframeReq = &t
+	}
+
+	for _, track := range r.tracks {
+		codec := track.Codec()
+		ts := WHIPTrackStats{
+			Kind:  track.Kind().String(),
+			Codec: codec.MimeType,
+			RID:   track.RID(),
+			SSRC:  uint32(track.SSRC()),
+		}
+		if r.statsGetter != nil {
+			if st := r.statsGetter.Get(ts.SSRC); st != nil {
+				in := st.InboundRTPStreamStats
+				ts.PacketsReceived = in.PacketsReceived
+				ts.PacketsLost = in.PacketsLost
+				if expected := int64(in.PacketsReceived) + in.PacketsLost; expected > 0 && in.PacketsLost > 0 {
+					ts.LossPercent = float64(in.PacketsLost) * 100 / float64(expected)
+				}
+				if codec.ClockRate > 0 {
+					ts.JitterMs = in.Jitter * 1000 / float64(codec.ClockRate)
+				}
+				ts.BytesReceived = in.BytesReceived
+				ts.NACKCount = in.NACKCount
+				ts.PLICount = in.PLICount
+				ts.FIRCount = in.FIRCount
+			}
+		}
+		result.Tracks = append(result.Tracks, ts)
+	}
+	return result
+}
+
+func (w *WHIPServer) keyframeInterval() time.Duration {
+	w.manager.mu.RLock()
+	defer w.manager.mu.RUnlock()
+	if w.manager.config == nil || w.manager.config.WHIPSettings.KeyframeInterval <= 0 {
+		return 0
+	}
+	return time.Duration(w.manager.config.WHIPSettings.KeyframeInterval) * time.Second
+}
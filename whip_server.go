@@ -1,7 +1,6 @@
 package main
 
 import (
-	"bufio"
 	"bytes"
 	"encoding/json"
 	"fmt"
@@ -12,7 +11,6 @@ import (
 	"net/http"
 	"os"
 	"os/exec"
-	"path/filepath"
 	"strings"
 	"sync"
 	"time"
@@ -22,6 +20,7 @@ import (
 	"github.com/datarhei/joy4/format/flv"
 	"github.com/datarhei/joy4/format/rtmp"
 	"github.com/datarhei/joy4/format/ts"
+	"github.com/pion/interceptor/pkg/stats"
 	"github.com/pion/webrtc/v3"
 )
 
@@ -33,22 +32,40 @@ type WHIPServer struct {
 	sessions  map[string]*WHIPSession
 	sessionMu sync.RWMutex
 	stopCh    chan struct{} // Канал для сигнализации остановки сервера
+
+	// Общие ICE порты и сетевые настройки для всех сессий
+	iceUDPConn     *net.UDPConn
+	iceTCPListener *net.TCPListener
+	settingEngine  webrtc.SettingEngine
 }
 
 type WHIPSession struct {
-	inputName           string
-	combinedSdpFilename string
-	ffmpegCmd           *exec.Cmd
-	outputMgr           *OutputManager
-	stopCh              chan struct{}
-	peerConnection      *webrtc.PeerConnection
-
-	// Pipe для отправки RTP пакетов в ffmpeg
-	audioWriter io.WriteCloser
-	videoWriter io.WriteCloser
-
-	// Codec data для RTMP/SRT хэдеров
-	streams     []av.CodecData
+	id             string
+	resourcePath   string // URL ресурса сессии (Location)
+	inputName      string
+	outputMgr      *OutputManager
+	stopCh         chan struct{}
+	peerConnection *webrtc.PeerConnection
+
+	// Сборка кадров из RTP треков
+	media *whipMedia
+
+	// Слои simulcast (nil без simulcast) и производные входы слоёв (whip_layers).
+	// У производной сессии parent - основная сессия, своего PeerConnection нет.
+	simulcast *whipSimulcast
+	derived   []*WHIPSession
+	parent    *WHIPSession
+
+	// Запросы ключевых кадров и статистика приёма
+	rtcp whipRTCP
+
+	// Состояние ресурса WHIP: ETag и кандидаты сервера, уже отправленные клиенту
+	mu             sync.Mutex
+	etag           string
+	sentCandidates map[string]bool
+
+	// Codec data для RTMP/SRT хэдеров; версия растёт при смене параметров или слоя
+	header      *streamHeader
 	streamsOnce sync.Once
 	streamsCh   chan struct{}
 }
@@ -63,6 +80,10 @@ func NewWHIPServer(port int, manager *StreamManager) *WHIPServer {
 }
 
 func (w *WHIPServer) Start() error {
+	if err := w.setupICE(); err != nil {
+		return err
+	}
+
 	mux := http.NewServeMux()
 	mux.HandleFunc("/whip/", w.handleWHIP)
 
@@ -119,15 +140,29 @@ func (w *WHIPServer) Stop() error {
 		w.server.Close()
 	}
 	w.wg.Wait()
+	w.closeICE()
 	return nil
 }
 
 func (w *WHIPServer) handleWHIP(wr http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
+	setCORSHeaders(wr)
+
+	switch r.Method {
+	case http.MethodOptions:
+		w.handleWHIPOptions(wr, r)
+	case http.MethodPost:
+		w.handleWHIPOffer(wr, r)
+	case http.MethodPatch:
+		w.handleWHIPPatch(wr, r)
+	case http.MethodDelete:
+		w.handleWHIPDelete(wr, r)
+	default:
+		wr.Header().Set("Allow", whipAllowedMethods)
 		http.Error(wr, "Method not allowed", http.StatusMethodNotAllowed)
-		return
 	}
+}
 
+func (w *WHIPServer) handleWHIPOffer(wr http.ResponseWriter, r *http.Request) {
 	name := strings.TrimPrefix(r.URL.Path, "/whip/")
 	if name == "" {
 		http.Error(wr, "Missing stream name in URL", http.StatusBadRequest)
@@ -140,6 +175,16 @@ func (w *WHIPServer) handleWHIP(wr http.ResponseWriter, r *http.Request) {
 		http.Error(wr, "Input not found in config", http.StatusNotFound)
 		return
 	}
+	if inputCfg.Pull != "" {
+		http.Error(wr, "Input pulls from a remote source", http.StatusConflict)
+		return
+	}
+	if !publishTokenOK(inputCfg, httpPublishToken(r)) {
+		log.Printf("[WHIP] Rejecting %s: invalid publish token for input %s", r.RemoteAddr, inputCfg.Name)
+		wr.Header().Set("WWW-Authenticate", `Bearer realm="whip"`)
+		http.Error(wr, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
 
 	body, err := ioutil.ReadAll(r.Body)
 	if err != nil {
@@ -156,44 +201,62 @@ func (w *WHIPServer) handleWHIP(wr http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	webrtcCfg := webrtc.Configuration{}
-	w.manager.mu.RLock()
-	var iceServers []string
-	if w.manager.config != nil {
-		iceServers = w.manager.config.WHIPSettings.ICEServers
-	}
-	w.manager.mu.RUnlock()
-
-	if len(iceServers) > 0 {
-		var webrtcICEServers []webrtc.ICEServer
-		for _, server := range iceServers {
-			webrtcICEServers = append(webrtcICEServers, webrtc.ICEServer{
-				URLs: []string{server},
-			})
-		}
-		webrtcCfg.ICEServers = webrtcICEServers
+	// Принимаем только треки с разрешёнными входу кодеками; если не подходит ничего,
+	// сообщаем об этом клиенту, а не отдаём пустой поток
+	allowedCodecs := whipCodecsFor(inputCfg)
+	offered := offeredCodecs(sdpOffer)
+	wantVideo, wantAudio := matchWHIPCodecs(offered, allowedCodecs)
+	if !wantVideo && !wantAudio {
+		log.Printf("[WHIP] No acceptable codecs for '%s': offered video=%v audio=%v, allowed %v",
+			inputCfg.Name, offered[webrtc.RTPCodecTypeVideo], offered[webrtc.RTPCodecTypeAudio], allowedCodecs)
+		http.Error(wr, fmt.Sprintf("No supported codecs in offer (allowed: %s)", strings.Join(allowedCodecs, ", ")), http.StatusNotAcceptable)
+		return
 	}
-
-	peerConnection, err := webrtc.NewPeerConnection(webrtcCfg)
+	var statsGetter stats.Getter
+	api, err := newWHIPAPI(allowedCodecs, w.settingEngine, func(g stats.Getter) { statsGetter = g })
 	if err != nil {
-		http.Error(wr, "Failed to create PeerConnection", http.StatusInternalServerError)
+		http.Error(wr, "Failed to configure codecs", http.StatusInternalServerError)
 		return
 	}
 
-	// Создаём сессию
+	webrtcCfg := webrtc.Configuration{ICEServers: w.iceServers()}
+
+	// Создаём сессию. Второй публикатор на тот же вход получает 409, а не вытесняет первого.
+	// Вход занимается сразу через TryAcquirePublish - так же, как RTMP, SRT и HTTP/WS ingest;
+	// освобождает его stopSession.
+	id := newWHIPSessionID()
 	session := &WHIPSession{
+		id:             id,
+		resourcePath:   strings.TrimRight(r.URL.Path, "/") + "/" + id,
 		inputName:      inputCfg.Name,
 		outputMgr:      NewOutputManager(),
 		stopCh:         make(chan struct{}),
 		streamsCh:      make(chan struct{}),
-		peerConnection: peerConnection,
+		etag:           newWHIPETag(),
+		sentCandidates: make(map[string]bool),
 	}
+	w.sessionMu.Lock()
+	if w.inputBusyLocked(inputCfg.Name) || !w.manager.TryAcquirePublish(inputCfg.Name) {
+		w.sessionMu.Unlock()
+		http.Error(wr, "Stream is already being published", http.StatusConflict)
+		return
+	}
+	w.sessions[id] = session
+	w.sessionMu.Unlock()
 
-	// Запускаем ffmpeg pipeline
-	go w.startFFmpegPipeline(session, inputCfg)
+	peerConnection, err := api.NewPeerConnection(webrtcCfg)
+	if err != nil {
+		w.removeSession(session)
+		http.Error(wr, "Failed to create PeerConnection", http.StatusInternalServerError)
+		return
+	}
+	session.peerConnection = peerConnection
+	session.rtcp.statsGetter = statsGetter
 
-	// Ждём немного, чтобы ffmpeg запустился и pipe'ы создались
-	time.Sleep(200 * time.Millisecond)
+	if rids := offeredRIDs(sdpOffer); wantVideo && len(rids) > 0 {
+		session.simulcast = newWHIPSimulcast(w, session, rids)
+		log.Printf("[WHIP] Simulcast offer for '%s', layers: %v", inputCfg.Name, rids)
+	}
 
 	// Обработчик изменения состояния соединения
 	peerConnection.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
@@ -203,40 +266,40 @@ func (w *WHIPServer) handleWHIP(wr http.ResponseWriter, r *http.Request) {
 			state == webrtc.PeerConnectionStateDisconnected ||
 			state == webrtc.PeerConnectionStateFailed {
 			log.Printf("[WHIP] Connection ended, stopping session for '%s'", inputCfg.Name)
-
-			// Останавливаем сессию
-			w.sessionMu.Lock()
-			if session, exists := w.sessions[inputCfg.Name]; exists {
-				w.stopSession(session)
-				delete(w.sessions, inputCfg.Name)
-			}
-			w.sessionMu.Unlock()
+			w.removeSession(session)
 		}
 	})
 
-	// OnTrack - записываем RTP пакеты в pipe
+	// OnTrack - собираем кадры из RTP прямо в процессе
 	peerConnection.OnTrack(func(track *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
 		log.Printf("[WHIP] Received track: %s, kind: %s", track.ID(), track.Kind())
 
-		if track.Kind() == webrtc.RTPCodecTypeVideo {
-			// Обработка видео
-			writer := session.videoWriter
-			if writer == nil {
-				log.Printf("[WHIP] Video writer not ready for track %s", track.ID())
-				return
-			}
+		codec := track.Codec()
+		log.Printf("[WHIP] Negotiated %s payload type %d for '%s'", codec.MimeType, codec.PayloadType, session.inputName)
 
-			go w.handleVideoTrack(track, writer, session)
+		session.rtcp.AddTrack(track)
+		if track.Kind() == webrtc.RTPCodecTypeVideo {
+			// Не ждём первого ключевого кадра из длинного GOP браузера
+			w.requestKeyFrame(session, "session start")
+		}
 
-		} else if track.Kind() == webrtc.RTPCodecTypeAudio {
-			// Обработка аудио
-			writer := session.audioWriter
-			if writer == nil {
-				log.Printf("[WHIP] Audio writer not ready for track %s", track.ID())
-				return
-			}
+		// Слой simulcast идёт во вход только когда выбран
+		var sink whipVideoSink = session.media
+		if rid := track.RID(); rid != "" && session.simulcast != nil {
+			log.Printf("[WHIP] Simulcast layer '%s' for '%s'", rid, session.inputName)
+			sink = session.simulcast.Layer(rid)
+		}
 
-			go w.handleAudioTrack(track, writer, session)
+		switch {
+		case track.Kind() == webrtc.RTPCodecTypeVideo && strings.EqualFold(codec.MimeType, webrtc.MimeTypeH264):
+			go w.handleVideoTrack(track, sink)
+		case track.Kind() == webrtc.RTPCodecTypeVideo:
+			go w.handleTranscodedVideoTrack(track, session, sink)
+		case track.Kind() == webrtc.RTPCodecTypeAudio && strings.EqualFold(codec.MimeType, webrtc.MimeTypeOpus):
+			go w.handleAudioTrack(track, session)
+		default:
+			log.Printf("[WHIP] Unsupported codec %s for '%s', track ignored", codec.MimeType, session.inputName)
+			go drainTrack(track)
 		}
 	})
 
@@ -245,179 +308,67 @@ func (w *WHIPServer) handleWHIP(wr http.ResponseWriter, r *http.Request) {
 		SDP:  sdpOffer,
 	}
 	if err := peerConnection.SetRemoteDescription(offer); err != nil {
+		w.removeSession(session)
 		http.Error(wr, "Failed to set remote description", http.StatusBadRequest)
 		return
 	}
 
+	// Заголовки в выходы уходят, когда известны кодеки всех согласованных треков
+	session.media = newWHIPMedia(session, wantVideo, wantAudio)
+	if session.simulcast != nil {
+		w.attachDerivedInputs(session, inputCfg, wantAudio)
+	}
+
 	answer, err := peerConnection.CreateAnswer(nil)
 	if err != nil {
+		w.removeSession(session)
 		http.Error(wr, "Failed to create answer", http.StatusInternalServerError)
 		return
 	}
+	gatherComplete := webrtc.GatheringCompletePromise(peerConnection)
 	if err := peerConnection.SetLocalDescription(answer); err != nil {
+		w.removeSession(session)
 		http.Error(wr, "Failed to set local description", http.StatusInternalServerError)
 		return
 	}
 
-	gatherComplete := webrtc.GatheringCompletePromise(peerConnection)
-	<-gatherComplete
+	// Не ждём полного сбора кандидатов (STUN может идти секундами) -
+	// оставшиеся кандидаты клиент получит в ответ на PATCH
+	waitGathering(gatherComplete)
 
-	// Сохраняем сессию
-	w.sessionMu.Lock()
-	w.sessions[inputCfg.Name] = session
-	w.sessionMu.Unlock()
+	w.startOutputs(session, inputCfg)
 
+	session.mu.Lock()
 	resp := peerConnection.LocalDescription().SDP
-	wr.Header().Set("Location", r.URL.Path)
-	wr.Header().Set("Content-Type", "application/sdp")
+	session.markCandidatesSent(resp)
+	etag := session.etag
+	session.mu.Unlock()
+
+	wr.Header().Set("Location", session.resourcePath)
+	wr.Header().Set("ETag", etag)
+	wr.Header().Set("Accept-Patch", sdpFragContentType)
+	wr.Header().Set("Content-Type", sdpContentType)
+	w.setICEServerLinks(wr, true)
 	wr.WriteHeader(http.StatusCreated)
 	_, _ = wr.Write([]byte(resp))
 
-	log.Printf("[WHIP] SDP answer sent for stream '%s'", inputCfg.Name)
+	log.Printf("[WHIP] SDP answer sent for stream '%s' (session %s)", inputCfg.Name, id)
 }
 
-func getRandomFreeUDPPort() (int, error) {
-	addr, err := net.ResolveUDPAddr("udp", "127.0.0.1:0")
-	if err != nil {
-		return 0, err
-	}
-	conn, err := net.ListenUDP("udp", addr)
-	if err != nil {
-		return 0, err
-	}
-	defer conn.Close()
-	localAddr := conn.LocalAddr().(*net.UDPAddr)
-	return localAddr.Port, nil
-}
-
-func (w *WHIPServer) startFFmpegPipeline(session *WHIPSession, inputCfg *InputCfg) {
-	defer w.stopSession(session)
-
-	videoUDPPort, err := getRandomFreeUDPPort()
-	if err != nil {
-		log.Printf("[WHIP] Failed to get free UDP port for video: %v", err)
-		return
-	}
-	audioUDPPort, err := getRandomFreeUDPPort()
-	if err != nil {
-		log.Printf("[WHIP] Failed to get free UDP port for audio: %v", err)
-		return
-	}
-
-	session.combinedSdpFilename = filepath.Join(os.TempDir(), fmt.Sprintf("whip_combined_%s_%d.sdp", session.inputName, time.Now().UnixNano()))
-
-	// Создаём единый SDP файл для видео и аудио, чтобы ffmpeg понимал, что они связаны
-	combinedSdpContent := []byte(fmt.Sprintf(
-		"v=0\r\n"+
-			"o=- 0 0 IN IP4 127.0.0.1\r\n"+
-			"s=WHIP\r\n"+
-			"c=IN IP4 127.0.0.1\r\n"+
-			"t=0 0\r\n"+
-			"m=video %d RTP/AVP 96\r\n"+
-			"a=rtpmap:96 H264/90000\r\n"+
-			"m=audio %d RTP/AVP 111\r\n"+
-			"a=rtpmap:111 opus/48000/2\r\n",
-		videoUDPPort,
-		audioUDPPort,
-	))
-	if err := ioutil.WriteFile(session.combinedSdpFilename, combinedSdpContent, 0644); err != nil {
-		log.Printf("[WHIP] Failed to write Combined SDP file: %v", err)
-		return
-	}
-
-	args := []string{
-		"-y", // Перезаписывать существующие файлы
-		"-thread_queue_size", "1024",
-		"-rtbufsize", "2M",
-		"-protocol_whitelist", "file,udp,rtp",
-		"-i", session.combinedSdpFilename,
-		"-map", "0:v",
-		"-map", "0:a",
-		// Копируем видео, конвертируем аудио
-		"-c:v", "copy",
-		"-c:a", "aac",
-		"-bsf:v", "h264_mp4toannexb",
-	}
-
-	// Если есть хотя бы один выход, направляем ffmpeg в pipe
-	hasOutputs := len(inputCfg.Outputs) > 0
-	if hasOutputs {
-		args = append(args, "-f", "flv", "pipe:1")
-	}
-
-	ffmpegPath := "ffmpeg"
-	if _, err := os.Stat("./bin/ffmpeg.exe"); err == nil {
-		ffmpegPath = "./bin/ffmpeg.exe"
-	}
-	session.ffmpegCmd = exec.Command(ffmpegPath, args...)
-
-	// Создаём UDP соединение для видео
-	videoAddr, err := net.ResolveUDPAddr("udp", fmt.Sprintf("127.0.0.1:%d", videoUDPPort))
-	if err != nil {
-		log.Printf("[WHIP] Failed to resolve video UDP addr: %v", err)
-		return
-	}
-	videoConn, err := net.DialUDP("udp", nil, videoAddr)
-	if err != nil {
-		log.Printf("[WHIP] Failed to create video UDP connection: %v", err)
-		return
-	}
-	session.videoWriter = videoConn
-
-	// Создаём UDP соединение для аудио
-	audioAddr, err := net.ResolveUDPAddr("udp", fmt.Sprintf("127.0.0.1:%d", audioUDPPort))
-	if err != nil {
-		log.Printf("[WHIP] Failed to resolve audio UDP addr: %v", err)
-		return
-	}
-	audioConn, err := net.DialUDP("udp", nil, audioAddr)
-	if err != nil {
-		log.Printf("[WHIP] Failed to create audio UDP connection: %v", err)
-		return
-	}
-	session.audioWriter = audioConn
-
-	// Получаем stdout для FLV только если есть выходы
-	var stdout io.ReadCloser
-	if hasOutputs {
-		var err error
-		stdout, err = session.ffmpegCmd.StdoutPipe()
-		if err != nil {
-			log.Printf("[WHIP] Failed to create stdout pipe: %v", err)
-			return
-		}
-	}
-
-	stderr, err := session.ffmpegCmd.StderrPipe()
-	if err != nil {
-		log.Printf("[WHIP] Failed to create stderr pipe: %v", err)
-		return
-	}
-
-	// Логируем stderr
-	go func() {
-		// Просто читаем из stderr, чтобы не блокировать ffmpeg, но ничего не выводим
-		scanner := bufio.NewScanner(stderr)
-		for scanner.Scan() {
-		}
-	}()
-
-	if err := session.ffmpegCmd.Start(); err != nil {
-		log.Printf("[WHIP] Failed to start ffmpeg: %v", err)
-		return
-	}
-
-	log.Printf("[WHIP] FFmpeg started for stream '%s' (video + audio)", session.inputName)
-
-	// Инициализируем выходы
-	w.manager.SetStatusActive(session.inputName, true)
-
+// startOutputs запускает выходы сессии и их синхронизацию с конфигом.
+// Вход к этому моменту уже занят сессией через TryAcquirePublish.
+func (w *WHIPServer) startOutputs(session *WHIPSession, inputCfg *InputCfg) {
 	// Инициализируем ВСЕ выходы через наш менеджер
 	for _, url := range inputCfg.Outputs {
 		w.manager.RegisterOutput(session.inputName, url)
 		session.outputMgr.AddOutput(url, 500, w.createOutputPusher(session, url))
 	}
 
+	// RTCP и статистику ведёт основная сессия, производные входы слоёв только пишут выходы
+	if session.parent == nil {
+		go w.runRTCPLoop(session)
+	}
+
 	// Горутина для динамического обновления выходов
 	updateTicker := time.NewTicker(2 * time.Second)
 
@@ -428,6 +379,9 @@ func (w *WHIPServer) startFFmpegPipeline(session *WHIPSession, inputCfg *InputCf
 			case <-session.stopCh:
 				return
 			case <-updateTicker.C:
+				if session.simulcast != nil {
+					session.simulcast.Poll()
+				}
 				// Синхронизируем выходы с inputCfg.Outputs
 				current := make(map[string]struct{})
 				for _, url := range inputCfg.Outputs {
@@ -443,11 +397,6 @@ func (w *WHIPServer) startFFmpegPipeline(session *WHIPSession, inputCfg *InputCf
 			}
 		}
 	}()
-
-	// Читаем FLV из stdout и отправляем в выходы только если они есть
-	if hasOutputs && stdout != nil {
-		w.processFLVStream(stdout, session, inputCfg)
-	}
 }
 
 func (w *WHIPServer) createOutputPusher(session *WHIPSession, url string) func(<-chan av.Packet, <-chan struct{}) {
@@ -456,7 +405,7 @@ func (w *WHIPServer) createOutputPusher(session *WHIPSession, url string) func(<
 		var lastBitrateUpdateTime time.Time
 		inputName := session.inputName
 
-		// Ждём, пока появятся stream-данные от ffmpeg, прежде чем подключаться
+		// Ждём, пока станут известны кодеки треков, прежде чем подключаться
 		select {
 		case <-session.streamsCh:
 			// Данные готовы
@@ -477,6 +426,12 @@ func (w *WHIPServer) createOutputPusher(session *WHIPSession, url string) func(<
 			default:
 			}
 
+			if strings.HasPrefix(url, "exec://") {
+				w.requestKeyFrame(session, "output "+url)
+				runExecPacketOutput(w.manager, inputName, url, session.header, ch, stop)
+				return
+			}
+
 			log.Printf("[WHIP] Trying to connect to %s", url)
 
 			if strings.HasPrefix(url, "file://") {
@@ -489,10 +444,6 @@ func (w *WHIPServer) createOutputPusher(session *WHIPSession, url string) func(<
 				var muxer *flv.Muxer
 
 				if isMp4 {
-					ffmpegPath := "ffmpeg"
-					if _, err := os.Stat("./bin/ffmpeg.exe"); err == nil {
-						ffmpegPath = "./bin/ffmpeg.exe"
-					}
 					args := []string{
 						"-y",
 						"-f", "flv",
@@ -501,7 +452,7 @@ func (w *WHIPServer) createOutputPusher(session *WHIPSession, url string) func(<
 						"-movflags", "frag_keyframe+empty_moov",
 						filename,
 					}
-					ffmpegCmd = exec.Command(ffmpegPath, args...)
+					ffmpegCmd = exec.Command(ffmpegBinary(), args...)
 					var err error
 					writeCloser, err = ffmpegCmd.StdinPipe()
 					if err != nil {
@@ -530,7 +481,10 @@ func (w *WHIPServer) createOutputPusher(session *WHIPSession, url string) func(<
 				}
 
 				w.manager.SetOutputActive(inputName, url, true)
-				err := muxer.WriteHeader(session.streams)
+				// Opus (whip_settings.audio: opus) FLV не несёт - файл пишется без звука
+				fileStreams, _ := session.header.Get()
+				fileStreams = withoutOpus(fileStreams)
+				err := muxer.WriteHeader(fileStreams)
 				if err != nil {
 					log.Printf("[WHIP] Failed to write header: %v", err)
 					if isMp4 {
@@ -543,6 +497,7 @@ func (w *WHIPServer) createOutputPusher(session *WHIPSession, url string) func(<
 					time.Sleep(5 * time.Second)
 					continue
 				}
+				w.requestKeyFrame(session, "output "+url)
 
 				for {
 					select {
@@ -585,6 +540,9 @@ func (w *WHIPServer) createOutputPusher(session *WHIPSession, url string) func(<
 							w.manager.SetOutputActive(inputName, url, false)
 							return
 						}
+						if int(pkt.Idx) >= len(fileStreams) {
+							continue
+						}
 						err := muxer.WritePacket(pkt)
 						if err != nil {
 							log.Printf("[WHIP] Write error to output: %v", err)
@@ -621,7 +579,10 @@ func (w *WHIPServer) createOutputPusher(session *WHIPSession, url string) func(<
 				}
 				w.manager.SetOutputActive(inputName, url, true)
 
-				err = dstConn.WriteHeader(session.streams)
+				// Opus (whip_settings.audio: opus) RTMP не несёт - выход получает только видео
+				rtmpStreams, headerVersion := session.header.Get()
+				rtmpStreams = withoutOpus(rtmpStreams)
+				err = dstConn.WriteHeader(rtmpStreams)
 				if err != nil {
 					log.Printf("[WHIP] Failed to write header to %s: %v", url, err)
 					dstConn.Close()
@@ -632,6 +593,7 @@ func (w *WHIPServer) createOutputPusher(session *WHIPSession, url string) func(<
 					time.Sleep(time.Duration(reconnectInterval) * time.Second)
 					continue
 				}
+				w.requestKeyFrame(session, "output "+url)
 			rtmpWriteLoop:
 				for {
 					select {
@@ -650,6 +612,26 @@ func (w *WHIPServer) createOutputPusher(session *WHIPSession, url string) func(<
 							return
 						}
 
+						if int(pkt.Idx) >= len(rtmpStreams) {
+							continue
+						}
+
+						// Параметры кодека или слой simulcast сменились - новые заголовки перед ключевым кадром
+						if pkt.IsKeyFrame && session.header.Version() != headerVersion {
+							rtmpStreams, headerVersion = session.header.Get()
+							rtmpStreams = withoutOpus(rtmpStreams)
+							if err = dstConn.WriteHeader(rtmpStreams); err != nil {
+								log.Printf("[WHIP] Failed to write updated header to %s: %v", url, err)
+								dstConn.Close()
+								w.manager.SetOutputActive(inputName, url, false)
+								w.manager.mu.RLock()
+								reconnectInterval := w.manager.config.ReconnectInterval
+								w.manager.mu.RUnlock()
+								time.Sleep(time.Duration(reconnectInterval) * time.Second)
+								break rtmpWriteLoop
+							}
+						}
+
 						// Обработка временных меток для RTMP
 						validateTiming(&pkt)
 
@@ -726,9 +708,19 @@ func (w *WHIPServer) createOutputPusher(session *WHIPSession, url string) func(<
 				timingProcessor := NewTimingProcessor()
 
 				var tsBuf bytes.Buffer
-				muxer := ts.NewMuxer(&tsBuf)
-
-				err = muxer.WriteHeader(session.streams)
+				tsOut := newTSContinuityWriter(&tsBuf)
+				muxer := ts.NewMuxer(tsOut)
+
+				// Opus муксер joy4 не принимает: он пишется в тот же TS отдельно,
+				// с PTS в шкале видео, а в PMT добавляется его описание
+				tsStreams, headerVersion := session.header.Get()
+				opusIdx := opusStreamIndex(tsStreams)
+				if opusIdx >= 0 {
+					tsOut.SetExtraPMTStreams(opusPMTEntry(tsOpusPID, tsStreams[opusIdx].(opusCodecData).channels))
+				}
+				var ptsOffset int64
+				hasPTSOffset := false
+				err = muxer.WriteHeader(withoutOpus(tsStreams))
 				if err != nil {
 					log.Printf("[WHIP] TS WriteHeader error for %s: %v", url, err)
 					conn.Close()
@@ -736,6 +728,7 @@ func (w *WHIPServer) createOutputPusher(session *WHIPSession, url string) func(<
 					time.Sleep(time.Duration(reconnectInterval) * time.Second)
 					continue
 				}
+				w.requestKeyFrame(session, "output "+url)
 			srtWriteLoop:
 				for {
 					select {
@@ -778,9 +771,42 @@ func (w *WHIPServer) createOutputPusher(session *WHIPSession, url string) func(<
 						// Обработка временных меток для SRT с TimingProcessor
 						timingProcessor.Process(&pkt)
 
+						// Внутрипотоковые SPS/PPS/AUD убираем: муксер пишет их сам перед ключевыми кадрами
+						if int(pkt.Idx) < len(tsStreams) && tsStreams[pkt.Idx].Type() == av.H264 && !normalizeTSVideoPacket(&pkt) {
+							continue
+						}
+
+						// Opus до первого видеокадра пропускаем: его метки ещё не к чему привязать
+						if int(pkt.Idx) == opusIdx && !hasPTSOffset {
+							continue
+						}
+
+						// Параметры кодека или слой simulcast сменились - новый муксер пишет PAT/PMT
+						if pkt.IsKeyFrame && session.header.Version() != headerVersion {
+							tsStreams, headerVersion = session.header.Get()
+							tsOut.Restart()
+							muxer = ts.NewMuxer(tsOut)
+							if err = muxer.WriteHeader(withoutOpus(tsStreams)); err != nil {
+								log.Printf("[WHIP] TS WriteHeader error for %s: %v", url, err)
+								conn.Close()
+								w.manager.SetOutputActive(inputName, url, false)
+								time.Sleep(time.Duration(reconnectInterval) * time.Second)
+								break srtWriteLoop
+							}
+						}
+
 						// Сохраняем текущую позицию в буфере перед записью
 						bufferPosBefore := tsBuf.Len()
-						err = muxer.WritePacket(pkt)
+						if int(pkt.Idx) == opusIdx {
+							pts := durationToTicks(pkt.Time) + ptsOffset
+							_, err = tsOut.Write(opusTSPackets(tsOpusPID, pkt.Data, pts))
+						} else {
+							err = muxer.WritePacket(pkt)
+							if dts, ok := tsOut.VideoDTS(); err == nil && ok && int(pkt.Idx) < len(tsStreams) && tsStreams[pkt.Idx].Type() == av.H264 {
+								ptsOffset = dts - durationToTicks(pkt.Time)
+								hasPTSOffset = true
+							}
+						}
 						if err != nil {
 							log.Printf("[WHIP] TS WritePacket error for %s: %v", url, err)
 							conn.Close()
@@ -821,65 +847,6 @@ func (w *WHIPServer) createOutputPusher(session *WHIPSession, url string) func(<
 	}
 }
 
-func (w *WHIPServer) processFLVStream(reader io.Reader, session *WHIPSession, inputCfg *InputCfg) {
-	defer w.manager.SetStatusActive(session.inputName, false)
-
-	log.Printf("[WHIP] Starting FLV processing for '%s'", session.inputName)
-
-	flvReader := flv.NewDemuxer(reader)
-	streams, err := flvReader.Streams()
-	if err != nil {
-		log.Printf("[WHIP] Failed to read FLV streams: %v", err)
-		return
-	}
-
-	// Сохраняем streams и оповещаем все выходы, что хэдеры готовы
-	session.streamsOnce.Do(func() {
-		session.streams = streams
-		close(session.streamsCh)
-		log.Printf("[WHIP] Codec data ready for stream '%s'", session.inputName)
-	})
-
-	log.Printf("[WHIP] FLV streams detected: %d", len(streams))
-	for i, stream := range streams {
-		log.Printf("[WHIP] Stream %d: %T", i, stream)
-	}
-
-	packetCount := 0
-
-	for {
-		select {
-		case <-session.stopCh:
-			return
-		default:
-		}
-
-		pkt, err := flvReader.ReadPacket()
-		if err != nil {
-			if err == io.EOF {
-				log.Printf("[WHIP] FLV stream ended for '%s'", session.inputName)
-			} else {
-				log.Printf("[WHIP] FLV read error: %v", err)
-			}
-			return
-		}
-
-		packetCount++
-		if packetCount%100 == 0 {
-			// log.Printf("[WHIP] FLV packets processed: %d (stream idx: %d)", packetCount, pkt.Idx)
-		}
-
-		// Отправляем пакет во все выходы
-		for _, w := range session.outputMgr.AllOutputs() {
-			select {
-			case w.ch <- pkt:
-			default:
-				// буфер заполнен — дропаем пакет для этого выхода
-			}
-		}
-	}
-}
-
 func (w *WHIPServer) stopSession(session *WHIPSession) {
 	// Сначала закрываем канал остановки или выходим, если уже закрыто
 	select {
@@ -897,144 +864,19 @@ func (w *WHIPServer) stopSession(session *WHIPSession) {
 		log.Printf("[WHIP] PeerConnection closed for '%s'", session.inputName)
 	}
 
-	// Корректно закрываем writers чтобы FFmpeg получил EOF
-	if session.videoWriter != nil {
-		session.videoWriter.Close()
-		log.Printf("[WHIP] Video writer closed for '%s'", session.inputName)
-	}
-	if session.audioWriter != nil {
-		session.audioWriter.Close()
-		log.Printf("[WHIP] Audio writer closed for '%s'", session.inputName)
-	}
-
-	// Ждём немного чтобы FFmpeg корректно завершился
-	if session.ffmpegCmd != nil && session.ffmpegCmd.Process != nil {
-		// Даём FFmpeg 2 секунды на корректное завершение
-		done := make(chan error, 1)
-		go func() {
-			done <- session.ffmpegCmd.Wait()
-		}()
-
-		select {
-		case <-time.After(2 * time.Second):
-			log.Printf("[WHIP] FFmpeg timeout, killing process for '%s'", session.inputName)
-			session.ffmpegCmd.Process.Kill()
-		case err := <-done:
-			if err != nil {
-				log.Printf("[WHIP] FFmpeg finished with error for '%s': %v", session.inputName, err)
-			} else {
-				log.Printf("[WHIP] FFmpeg finished normally for '%s'", session.inputName)
-			}
-		}
-	}
-
 	// Останавливаем все выходы
 	for url := range session.outputMgr.AllOutputs() {
 		session.outputMgr.RemoveOutput(url)
 	}
 
+	// Производные входы слоёв живут, пока живёт основная сессия
+	for _, child := range session.derived {
+		w.stopSession(child)
+	}
+
 	// Обновляем статус в менеджере
 	w.manager.SetStatusActive(session.inputName, false)
-
-	// Удаляем временный SDP файл
-	if session.combinedSdpFilename != "" {
-		if err := os.Remove(session.combinedSdpFilename); err != nil {
-			// Это не критичная ошибка, просто логируем, т.к. файл мог быть удален вручную или не создаться
-			log.Printf("[WHIP] Failed to remove temporary SDP file %s: %v", session.combinedSdpFilename, err)
-		}
-	}
+	w.manager.SetWHIPStats(session.inputName, nil)
 
 	log.Printf("[WHIP] Session stopped for '%s'", session.inputName)
 }
-
-func (w *WHIPServer) handleVideoTrack(track *webrtc.TrackRemote, writer io.WriteCloser, session *WHIPSession) {
-	packetCount := 0
-	log.Printf("[WHIP] Started handling video track: %s", track.ID())
-
-	for {
-		select {
-		case <-session.stopCh:
-			return
-		default:
-		}
-
-		packet, _, err := track.ReadRTP()
-		if err != nil {
-			log.Printf("[WHIP] Video track %s ended: %v", track.ID(), err)
-			return
-		}
-
-		// Отправляем полный RTP пакет в ffmpeg по UDP, как ожидает SDP
-		payload, err := packet.Marshal()
-		if err != nil {
-			log.Printf("[WHIP] Failed to marshal video RTP packet: %v", err)
-			continue
-		}
-
-		if len(payload) > 0 {
-			_, err := writer.Write(payload)
-			if err != nil {
-				// Если сессия закрывается или сокет закрыт, завершаем горутину
-				select {
-				case <-session.stopCh:
-					return
-				default:
-				}
-				if strings.Contains(err.Error(), "use of closed") {
-					return
-				}
-			}
-
-			packetCount++
-			if packetCount%100 == 0 {
-				// log.Printf("[WHIP] Video packets written: %d (last payload size: %d)", packetCount, len(payload))
-			}
-		}
-	}
-}
-
-func (w *WHIPServer) handleAudioTrack(track *webrtc.TrackRemote, writer io.WriteCloser, session *WHIPSession) {
-	packetCount := 0
-	log.Printf("[WHIP] Started handling audio track: %s", track.ID())
-
-	for {
-		select {
-		case <-session.stopCh:
-			return
-		default:
-		}
-
-		packet, _, err := track.ReadRTP()
-		if err != nil {
-			log.Printf("[WHIP] Audio track %s ended: %v", track.ID(), err)
-			return
-		}
-
-		// Отправляем полный RTP пакет в ffmpeg по UDP, как ожидает SDP
-		payload, err := packet.Marshal()
-		if err != nil {
-			log.Printf("[WHIP] Failed to marshal audio RTP packet: %v", err)
-			continue
-		}
-
-		if len(payload) > 0 {
-			_, err := writer.Write(payload)
-			if err != nil {
-				// Если сессия закрывается или сокет закрыт, завершаем горутину
-				select {
-				case <-session.stopCh:
-					return
-				default:
-				}
-				if strings.Contains(err.Error(), "use of closed") {
-					return
-				}
-			}
-
-			packetCount++
-			if packetCount%200 == 0 {
-				// log.Printf("[WHIP] Audio packets written: %d (last payload size: %d)", packetCount, len(payload))
-			}
-		}
-	}
-}
@@ -0,0 +1,338 @@
+package main
+
+import (
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/datarhei/joy4/av"
+	"github.com/pion/webrtc/v3"
+)
+
+// Simulcast WHIP: браузер шлёт несколько кодировок видео с разными RID.
+// Во вход идёт один слой (whip_layer, по умолчанию самый высокий), переключение
+// происходит на ключевом кадре нового слоя. Слои из whip_layers дополнительно
+// отдаются в свои входы как отдельные публикации.
+
+// Слой без пакетов дольше этого считается приостановленным (браузер отключает
+// верхние слои при нехватке полосы) и не выбирается автоматически
+const whipLayerTimeout = 2 * time.Second
+
+// Расширения заголовка RTP, по которым pion распознаёт слои simulcast
+var whipSimulcastExtensions = []string{
+	"urn:ietf:params:rtp-hdrext:sdes:mid",
+	"urn:ietf:params:rtp-hdrext:sdes:rtp-stream-id",
+	"urn:ietf:params:rtp-hdrext:sdes:repaired-rtp-stream-id",
+}
+
+// whipSimulcast выбирает, какой слой видео идёт в сессию
+type whipSimulcast struct {
+	server  *WHIPServer
+	session *WHIPSession
+
+	mu         sync.Mutex
+	rids       []string // слои из offer в порядке a=rid
+	layers     map[string]*whipLayer
+	firstCodec time.Time
+	selected   string        // слой, который сейчас идёт во вход
+	target     string        // слой, на который переключаемся на ближайшем ключевом кадре
+	lastTime   time.Duration // последняя метка, отданная во вход
+}
+
+// whipLayer - один слой simulcast; реализует whipVideoSink для обработчика трека
+type whipLayer struct {
+	sim     *whipSimulcast
+	rid     string
+	derived *WHIPSession // производный вход слоя (whip_layers) или nil
+
+	codec      av.CodecData
+	lastPacket time.Time
+}
+
+func newWHIPSimulcast(server *WHIPServer, session *WHIPSession, rids []string) *whipSimulcast {
+	s := &whipSimulcast{
+		server:  server,
+		session: session,
+		rids:    rids,
+		layers:  make(map[string]*whipLayer),
+	}
+	for _, rid := range rids {
+		s.layers[rid] = &whipLayer{sim: s, rid: rid}
+	}
+	return s
+}
+
+// offeredRIDs возвращает RID'ы отправляемых слоёв видео из offer (a=rid:<id> send)
+func offeredRIDs(sdp string) []string {
+	var rids []string
+	inVideo := false
+	for _, line := range splitSDPLines(sdp) {
+		switch {
+		case strings.HasPrefix(line, "m="):
+			inVideo = strings.HasPrefix(line, "m=video ")
+		case inVideo && strings.HasPrefix(line, "a=rid:"):
+			fields := strings.Fields(strings.TrimPrefix(line, "a=rid:"))
+			if len(fields) >= 2 && fields[1] == "send" {
+				rids = appendUnique(rids, fields[0])
+			}
+		}
+	}
+	return rids
+}
+
+// Layer возвращает слой по RID (слой, не объявленный в offer, добавляется)
+func (s *whipSimulcast) Layer(rid string) *whipLayer {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	layer, ok := s.layers[rid]
+	if !ok {
+		layer = &whipLayer{sim: s, rid: rid}
+		s.layers[rid] = layer
+		s.rids = append(s.rids, rid)
+	}
+	return layer
+}
+
+// offered - слой объявлен в offer
+func (s *whipSimulcast) offered(rid string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.layers[rid]
+	return ok
+}
+
+// Selected возвращает RID слоя, который сейчас идёт во вход
+func (s *whipSimulcast) Selected() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.selected
+}
+
+// Poll применяет выбор слоя из API и уходит с приостановленного слоя
+func (s *whipSimulcast) Poll() {
+	s.mu.Lock()
+	if s.selected != "" || s.target != "" {
+		s.retargetLocked()
+	}
+	target := s.target
+	s.mu.Unlock()
+
+	// Пока нет ключевого кадра нового слоя, повторяем запрос
+	if target != "" {
+		s.server.requestKeyFrame(s.session, "simulcast layer "+target)
+	}
+}
+
+// retargetLocked выбирает слой для входа; если он не текущий, ждём его ключевой кадр.
+// Возвращает true, если нужен запрос ключевого кадра.
+func (s *whipSimulcast) retargetLocked() bool {
+	want := s.chooseLocked()
+	switch want {
+	case "", s.target:
+		return false
+	case s.selected:
+		s.target = ""
+		return false
+	}
+	s.target = want
+	log.Printf("[WHIP] Switching '%s' to simulcast layer '%s'", s.session.inputName, want)
+	return true
+}
+
+// chooseLocked возвращает запрошенный через API слой, если он активен,
+// иначе активный слой с наибольшим разрешением
+func (s *whipSimulcast) chooseLocked() string {
+	requested := s.server.manager.GetInputWHIPLayer(s.session.inputName)
+	if layer, ok := s.layers[requested]; ok && layer.activeLocked() {
+		return requested
+	}
+	best, bestPixels := "", -1
+	for _, rid := range s.rids {
+		layer := s.layers[rid]
+		if !layer.activeLocked() {
+			continue
+		}
+		pixels := 0
+		if video, ok := layer.codec.(av.VideoCodecData); ok {
+			pixels = video.Width() * video.Height()
+		}
+		if pixels > bestPixels {
+			best, bestPixels = rid, pixels
+		}
+	}
+	return best
+}
+
+// layersReadyLocked - кодеки всех слоёв из offer известны или ждать их дальше нет смысла
+func (s *whipSimulcast) layersReadyLocked() bool {
+	if s.firstCodec.IsZero() {
+		return false
+	}
+	if time.Since(s.firstCodec) > whipCodecWaitTimeout {
+		return true
+	}
+	for _, layer := range s.layers {
+		if layer.codec == nil {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *whipSimulcast) setCodec(layer *whipLayer, codec av.CodecData) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	layer.codec = codec
+	if s.firstCodec.IsZero() {
+		s.firstCodec = time.Now()
+	}
+	if s.selected == layer.rid {
+		s.session.media.SetCodec(webrtc.RTPCodecTypeVideo, codec)
+	}
+}
+
+func (s *whipSimulcast) deliver(layer *whipLayer, pkt av.Packet) {
+	s.mu.Lock()
+	layer.lastPacket = time.Now()
+
+	// Первый выбор - когда видны все слои, чтобы сразу взять самый высокий
+	requestKey := false
+	if s.selected == "" && s.target == "" && s.layersReadyLocked() {
+		requestKey = s.retargetLocked()
+	}
+
+	if s.target == layer.rid && pkt.IsKeyFrame && layer.codec != nil {
+		if s.selected != "" {
+			log.Printf("[WHIP] Simulcast layer for '%s' switched from '%s' to '%s'", s.session.inputName, s.selected, layer.rid)
+		} else {
+			log.Printf("[WHIP] Simulcast layer '%s' selected for '%s'", layer.rid, s.session.inputName)
+		}
+		s.selected, s.target = layer.rid, ""
+		s.session.media.SetCodec(webrtc.RTPCodecTypeVideo, layer.codec)
+	}
+
+	if s.selected == layer.rid {
+		// У слоёв свои RTP часы, метки после переключения не должны идти назад
+		if s.lastTime > 0 && pkt.Time <= s.lastTime {
+			pkt.Time = s.lastTime + time.Millisecond
+		}
+		s.lastTime = pkt.Time
+		s.session.media.Deliver(webrtc.RTPCodecTypeVideo, pkt)
+	}
+	target := s.target
+	s.mu.Unlock()
+
+	if requestKey {
+		s.server.requestKeyFrame(s.session, "simulcast layer "+target)
+	}
+}
+
+func (l *whipLayer) activeLocked() bool {
+	return l.codec != nil && time.Since(l.lastPacket) < whipLayerTimeout
+}
+
+func (l *whipLayer) SetCodec(kind webrtc.RTPCodecType, codec av.CodecData) {
+	if l.derived != nil {
+		l.derived.media.SetCodec(kind, codec)
+	}
+	l.sim.setCodec(l, codec)
+}
+
+func (l *whipLayer) Deliver(kind webrtc.RTPCodecType, pkt av.Packet) {
+	if l.derived != nil {
+		l.derived.media.Deliver(kind, pkt)
+	}
+	l.sim.deliver(l, pkt)
+}
+
+func (l *whipLayer) since() time.Duration {
+	return l.sim.session.media.since()
+}
+
+// attachDerivedInputs создаёт сессии входов из whip_layers. Они получают видео своего
+// слоя и аудио основной сессии, а останавливаются вместе с ней.
+func (w *WHIPServer) attachDerivedInputs(session *WHIPSession, inputCfg *InputCfg, wantAudio bool) {
+	sim := session.simulcast
+	for rid, target := range inputCfg.WHIPLayers {
+		if !sim.offered(rid) {
+			log.Printf("[WHIP] Layer '%s' for input '%s' is not in the offer of '%s'", rid, target, session.inputName)
+			continue
+		}
+		targetCfg := w.manager.GetInputByName(target)
+		if targetCfg == nil {
+			log.Printf("[WHIP] Derived input '%s' for layer '%s' of '%s' not found", target, rid, session.inputName)
+			continue
+		}
+		w.sessionMu.Lock()
+		busy := w.inputBusyLocked(target) || !w.manager.TryAcquirePublish(target)
+		child := &WHIPSession{
+			id:        session.id + "-" + rid,
+			inputName: target,
+			parent:    session,
+			outputMgr: NewOutputManager(),
+			stopCh:    make(chan struct{}),
+			streamsCh: make(chan struct{}),
+		}
+		if !busy {
+			session.derived = append(session.derived, child)
+		}
+		w.sessionMu.Unlock()
+		if busy {
+			log.Printf("[WHIP] Derived input '%s' is already being published, layer '%s' not attached", target, rid)
+			continue
+		}
+
+		child.media = newWHIPMedia(child, true, wantAudio)
+		session.media.addFollower(child.media)
+		sim.Layer(rid).derived = child
+		w.startOutputs(child, targetCfg)
+		log.Printf("[WHIP] Simulcast layer '%s' of '%s' feeds input '%s'", rid, session.inputName, target)
+	}
+}
+
+// SimulcastLayers возвращает RID'ы слоёв simulcast сессии, публикующей во вход;
+// ok = false, если такой сессии сейчас нет
+func (w *WHIPServer) SimulcastLayers(name string) (rids []string, ok bool) {
+	w.sessionMu.RLock()
+	defer w.sessionMu.RUnlock()
+	for _, session := range w.sessions {
+		if session.inputName != name || session.simulcast == nil {
+			continue
+		}
+		session.simulcast.mu.Lock()
+		rids = append(rids, session.simulcast.rids...)
+		session.simulcast.mu.Unlock()
+		return rids, true
+	}
+	return nil, false
+}
+
+// validWHIPRID - RID из букв, цифр, '-' и '_' (RFC 8851), не длиннее 16 байт
+// расширения заголовка RTP rtp-stream-id
+func validWHIPRID(rid string) bool {
+	if rid == "" || len(rid) > 16 {
+		return false
+	}
+	for _, c := range rid {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+// inputBusyLocked - во вход уже публикует сессия или он занят слоем другой сессии
+func (w *WHIPServer) inputBusyLocked(name string) bool {
+	for _, other := range w.sessions {
+		if other.inputName == name {
+			return true
+		}
+		for _, child := range other.derived {
+			if child.inputName == name {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"log"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/datarhei/joy4/av"
+	"github.com/datarhei/joy4/format/flv"
+	"github.com/pion/rtp"
+	"github.com/pion/rtp/codecs"
+	"github.com/pion/webrtc/v3"
+	"github.com/pion/webrtc/v3/pkg/media/samplebuilder"
+)
+
+// Видео WHIP, которое выходы не могут нести (VP8, VP9, AV1, H.265), перекодируется в H.264:
+// кадры из RTP пишутся в ffmpeg как IVF с RTP метками, из stdout читается FLV.
+
+const (
+	ivfHeaderSize      = 32
+	ivfFrameHeaderSize = 12
+)
+
+// whipTranscodeDepacketizer возвращает депакетизатор RTP и IVF fourcc для кодека
+func whipTranscodeDepacketizer(mimeType string) (rtp.Depacketizer, string, bool) {
+	switch {
+	case strings.EqualFold(mimeType, webrtc.MimeTypeVP8):
+		return &codecs.VP8Packet{}, "VP80", true
+	case strings.EqualFold(mimeType, webrtc.MimeTypeVP9):
+		return &codecs.VP9Packet{}, "VP90", true
+	case strings.EqualFold(mimeType, webrtc.MimeTypeAV1):
+		return &codecs.AV1Depacketizer{}, "AV01", true
+	case strings.EqualFold(mimeType, webrtc.MimeTypeH265):
+		return &codecs.H265Packet{}, "HEVC", true
+	}
+	return nil, "", false
+}
+
+// handleTranscodedVideoTrack перекодирует не-H.264 видео в H.264 через ffmpeg
+func (w *WHIPServer) handleTranscodedVideoTrack(track *webrtc.TrackRemote, session *WHIPSession, sink whipVideoSink) {
+	mimeType := track.Codec().MimeType
+	log.Printf("[WHIP] Started handling video track: %s (%s, transcoding to H.264)", track.ID(), mimeType)
+
+	depacketizer, fourcc, ok := whipTranscodeDepacketizer(mimeType)
+	if !ok {
+		log.Printf("[WHIP] No depacketizer for %s, video track of '%s' ignored", mimeType, session.inputName)
+		drainTrack(track)
+		return
+	}
+
+	cmd := ivfTranscodeCommand()
+	stdin, stdout, err := startWHIPFFmpeg(cmd, session.inputName, "video")
+	if err != nil {
+		log.Printf("[WHIP] Cannot transcode %s for '%s': %v", mimeType, session.inputName, err)
+		drainTrack(track)
+		return
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		readTranscodedFLV(stdout, session.inputName, sink)
+		cmd.Wait()
+	}()
+
+	w.writeIVF(track, depacketizer, fourcc, stdin, session)
+	stdin.Close()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		cmd.Process.Kill()
+		<-done
+	}
+}
+
+// ivfTranscodeCommand - ffmpeg, перекодирующий IVF из stdin в H.264 FLV в stdout
+func ivfTranscodeCommand() *exec.Cmd {
+	return exec.Command(ffmpegBinary(),
+		"-loglevel", "error",
+		"-f", "ivf", "-i", "pipe:0",
+		"-an",
+		"-c:v", "libx264", "-preset", "veryfast", "-tune", "zerolatency", "-pix_fmt", "yuv420p",
+		"-force_key_frames", "expr:gte(t,n_forced*2)",
+		"-f", "flv", "pipe:1",
+	)
+}
+
+// startWHIPFFmpeg запускает ffmpeg перекодировщика сессии и пишет его stderr в лог
+func startWHIPFFmpeg(cmd *exec.Cmd, inputName, kind string) (io.WriteCloser, io.ReadCloser, error) {
+	return startFFmpegPipes(cmd, "[WHIP]", inputName, kind)
+}
+
+func startFFmpegPipes(cmd *exec.Cmd, logPrefix, inputName, kind string) (io.WriteCloser, io.ReadCloser, error) {
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, nil, err
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, nil, err
+	}
+	go func() {
+		scanner := bufio.NewScanner(stderr)
+		for scanner.Scan() {
+			log.Printf("%s ffmpeg %s (%s): %s", logPrefix, kind, inputName, scanner.Text())
+		}
+	}()
+	return stdin, stdout, nil
+}
+
+// writeIVF собирает кадры из RTP и пишет их в ffmpeg как IVF (метки в тиках 90 кГц)
+func (w *WHIPServer) writeIVF(track *webrtc.TrackRemote, depacketizer rtp.Depacketizer, fourcc string, out io.Writer, session *WHIPSession) {
+	if err := writeIVFHeader(out, fourcc); err != nil {
+		drainTrack(track)
+		return
+	}
+
+	builder := samplebuilder.New(whipMaxLatePackets, depacketizer, whipVideoClockRate,
+		samplebuilder.WithMaxTimeDelay(w.jitterBuffer()))
+	timeline := rtpTimeline{clockRate: whipVideoClockRate}
+
+	for {
+		packet, _, err := track.ReadRTP()
+		if err != nil {
+			log.Printf("[WHIP] Video track %s ended: %v", track.ID(), err)
+			return
+		}
+		builder.Push(packet)
+
+		for sample := builder.Pop(); sample != nil; sample = builder.Pop() {
+			if len(sample.Data) == 0 {
+				continue
+			}
+			timeline.Time(sample.PacketTimestamp, 0)
+			if err := writeIVFFrame(out, timeline.ticks, sample.Data); err != nil {
+				log.Printf("[WHIP] Video transcoder for '%s' stopped: %v", session.inputName, err)
+				drainTrack(track)
+				return
+			}
+		}
+	}
+}
+
+// writeIVFHeader пишет заголовок IVF с timebase 1/90000
+func writeIVFHeader(out io.Writer, fourcc string) error {
+	header := make([]byte, ivfHeaderSize)
+	copy(header[0:], "DKIF")
+	binary.LittleEndian.PutUint16(header[6:], ivfHeaderSize)
+	copy(header[8:], fourcc)
+	binary.LittleEndian.PutUint32(header[16:], whipVideoClockRate)
+	binary.LittleEndian.PutUint32(header[20:], 1)
+	_, err := out.Write(header)
+	return err
+}
+
+// writeIVFFrame пишет кадр IVF с меткой в тиках 90 кГц
+func writeIVFFrame(out io.Writer, ticks int64, data []byte) error {
+	frameHeader := make([]byte, ivfFrameHeaderSize)
+	binary.LittleEndian.PutUint32(frameHeader[0:], uint32(len(data)))
+	binary.LittleEndian.PutUint64(frameHeader[4:], uint64(ticks))
+	if _, err := out.Write(frameHeader); err != nil {
+		return err
+	}
+	_, err := out.Write(data)
+	return err
+}
+
+// readTranscodedFLV отдаёт H.264 из ffmpeg в сессию или слой simulcast
+func readTranscodedFLV(r io.Reader, inputName string, sink whipVideoSink) {
+	demuxer := flv.NewDemuxer(r)
+	streams, err := demuxer.Streams()
+	if err != nil {
+		log.Printf("[WHIP] Failed to read transcoded video for '%s': %v", inputName, err)
+		return
+	}
+	videoIdx := -1
+	for i, stream := range streams {
+		if stream.Type() == av.H264 {
+			videoIdx = i
+			sink.SetCodec(webrtc.RTPCodecTypeVideo, stream)
+			break
+		}
+	}
+	if videoIdx < 0 {
+		log.Printf("[WHIP] Transcoder produced no H.264 for '%s'", inputName)
+		return
+	}
+
+	var base time.Duration
+	baseSet := false
+	for {
+		pkt, err := demuxer.ReadPacket()
+		if err != nil {
+			return
+		}
+		if int(pkt.Idx) != videoIdx {
+			continue
+		}
+		// Привязываем выход ffmpeg ко времени сессии по первому кадру
+		if !baseSet {
+			base = sink.since() - pkt.Time
+			if base < 0 {
+				base = 0
+			}
+			baseSet = true
+		}
+		pkt.Time += base
+		sink.Deliver(webrtc.RTPCodecTypeVideo, pkt)
+	}
+}
+
+// drainTrack читает трек до конца, чтобы пакеты не копились в буфере pion
+func drainTrack(track *webrtc.TrackRemote) {
+	for {
+		if _, _, err := track.ReadRTP(); err != nil {
+			return
+		}
+	}
+}
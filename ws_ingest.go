@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/datarhei/joy4/av"
+	"github.com/datarhei/joy4/format/flv"
+	"golang.org/x/net/websocket"
+)
+
+// Приём потока по WebSocket: ws://server:8080/ws/{url_path}?token=...
+// Бинарные сообщения складываются в один поток FLV, fMP4 или WebM (как их отдаёт
+// MediaRecorder браузера). WebM (VP8/VP9/Opus) перекодируется ffmpeg в H.264/AAC.
+
+const (
+	wsIngestReadTimeout = 30 * time.Second
+	// Предел размера одного бокса fMP4 (moov или фрагмент)
+	wsMaxFMP4Box = 64 << 20
+)
+
+// wsIngestConn - сообщения WebSocket как непрерывный поток байт
+type wsIngestConn struct {
+	r  *bufio.Reader
+	ws *websocket.Conn
+}
+
+func (c *wsIngestConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+func (c *wsIngestConn) SetReadDeadline(t time.Time) error {
+	return c.ws.SetReadDeadline(t)
+}
+
+// handleWSIngest проверяет вход и токен до апгрейда, чтобы клиент получил HTTP ошибку
+func (api *APIServer) handleWSIngest(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/ws")
+	inputCfg := api.SM.GetInputByPath(path)
+	if inputCfg == nil {
+		http.Error(w, "Input not found in config", http.StatusNotFound)
+		return
+	}
+	if inputCfg.Pull != "" {
+		http.Error(w, "Input pulls from a remote source", http.StatusConflict)
+		return
+	}
+	// Браузер не может задать заголовок Authorization для WebSocket - токен в ?token=
+	if !publishTokenOK(inputCfg, httpPublishToken(r)) {
+		log.Printf("[WS] Rejecting %s: invalid publish token for input %s", r.RemoteAddr, inputCfg.Name)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	// Вход занимается до апгрейда и освобождается, когда ServeHTTP вернётся (он ждёт Handler)
+	if !api.SM.TryAcquirePublish(inputCfg.Name) {
+		http.Error(w, "Stream is already being published", http.StatusConflict)
+		return
+	}
+	defer api.SM.SetStatusActive(inputCfg.Name, false)
+
+	// Origin не проверяем: страница публикации может быть на другом домене, доступ - по токену
+	server := websocket.Server{
+		Handler: func(ws *websocket.Conn) {
+			api.serveWSIngest(ws, inputCfg, r.RemoteAddr)
+		},
+	}
+	server.ServeHTTP(w, r)
+}
+
+func (api *APIServer) serveWSIngest(ws *websocket.Conn, inputCfg *InputCfg, remote string) {
+	defer ws.Close()
+	conn := &wsIngestConn{r: bufio.NewReaderSize(ws, 64*1024), ws: ws}
+	reader := &deadlineReader{conn: conn, timeout: wsIngestReadTimeout}
+	source := fmt.Sprintf("ws://%s (%s)", remote, inputCfg.Name)
+
+	conn.SetReadDeadline(time.Now().Add(wsIngestReadTimeout))
+	head, err := conn.r.Peek(8)
+	if err != nil {
+		log.Printf("[WS] No data from %s for input %s: %v", remote, inputCfg.Name, err)
+		return
+	}
+
+	var demuxer av.Demuxer
+	var transcoder *exec.Cmd
+	switch {
+	case string(head[:3]) == "FLV":
+		log.Printf("[WS] FLV stream from %s to input %s", remote, inputCfg.Name)
+		demuxer = flv.NewDemuxer(reader)
+	case string(head[4:8]) == "ftyp":
+		log.Printf("[WS] fMP4 stream from %s to input %s", remote, inputCfg.Name)
+		demuxer = &fmp4StreamDemuxer{r: bufio.NewReader(reader)}
+	case binary.BigEndian.Uint32(head) == 0x1A45DFA3:
+		log.Printf("[WS] WebM stream from %s to input %s, transcoding to H.264/AAC", remote, inputCfg.Name)
+		cmd := webmTranscodeCommand()
+		stdin, stdout, err := startFFmpegPipes(cmd, "[WS]", inputCfg.Name, "webm")
+		if err != nil {
+			log.Printf("[WS] Failed to start ffmpeg for input %s: %v", inputCfg.Name, err)
+			return
+		}
+		go func() {
+			io.Copy(stdin, reader)
+			stdin.Close()
+		}()
+		transcoder = cmd
+		demuxer = flv.NewDemuxer(stdout)
+	default:
+		log.Printf("[WS] Unknown stream format from %s for input %s", remote, inputCfg.Name)
+		return
+	}
+
+	servePublish(api.SM, inputCfg, demuxer, source, nil)
+
+	if transcoder != nil {
+		ws.Close()
+		transcoder.Process.Kill()
+		transcoder.Wait()
+	}
+	log.Printf("[WS] Stream from %s to input %s finished", remote, inputCfg.Name)
+}
+
+// webmTranscodeCommand - ffmpeg, перекодирующий WebM из stdin в H.264/AAC FLV в stdout
+func webmTranscodeCommand() *exec.Cmd {
+	return exec.Command(ffmpegBinary(),
+		"-loglevel", "error",
+		"-f", "matroska", "-i", "pipe:0",
+		"-c:v", "libx264", "-preset", "veryfast", "-tune", "zerolatency", "-pix_fmt", "yuv420p",
+		"-force_key_frames", "expr:gte(t,n_forced*2)",
+		"-c:a", "aac", "-b:a", "128k", "-ar", "48000",
+		"-f", "flv", "pipe:1",
+	)
+}
+
+// fmp4StreamDemuxer читает фрагментированный MP4 как поток боксов:
+// ftyp+moov дают дорожки, каждая пара moof+mdat - фрагмент
+type fmp4StreamDemuxer struct {
+	r      *bufio.Reader
+	tracks []*fmp4Track
+	p      *fmp4Packetizer
+	moof   []byte
+	queue  []av.Packet
+}
+
+// readBox читает бокс целиком вместе с заголовком
+func (d *fmp4StreamDemuxer) readBox() (string, []byte, error) {
+	header := make([]byte, 8, 16)
+	if _, err := io.ReadFull(d.r, header); err != nil {
+		return "", nil, err
+	}
+	size := uint64(binary.BigEndian.Uint32(header))
+	typ := string(header[4:8])
+	switch size {
+	case 0:
+		return "", nil, fmt.Errorf("box %q without size is not supported", typ)
+	case 1:
+		header = header[:16]
+		if _, err := io.ReadFull(d.r, header[8:]); err != nil {
+			return "", nil, err
+		}
+		size = binary.BigEndian.Uint64(header[8:])
+	}
+	if size < uint64(len(header)) || size > wsMaxFMP4Box {
+		return "", nil, fmt.Errorf("invalid size %d of box %q", size, typ)
+	}
+	box := make([]byte, size)
+	copy(box, header)
+	if _, err := io.ReadFull(d.r, box[len(header):]); err != nil {
+		return "", nil, err
+	}
+	return typ, box, nil
+}
+
+func (d *fmp4StreamDemuxer) Streams() ([]av.CodecData, error) {
+	if d.p != nil {
+		return d.p.streams, nil
+	}
+	for {
+		typ, box, err := d.readBox()
+		if err != nil {
+			return nil, err
+		}
+		if typ != "moov" {
+			continue
+		}
+		if d.tracks, err = parseFMP4Init(box); err != nil {
+			return nil, err
+		}
+		d.p = newFMP4Packetizer(d.tracks, nil, 0)
+		if len(d.p.streams) == 0 {
+			return nil, errors.New("no H.264 or AAC tracks")
+		}
+		return d.p.streams, nil
+	}
+}
+
+func (d *fmp4StreamDemuxer) ReadPacket() (av.Packet, error) {
+	if _, err := d.Streams(); err != nil {
+		return av.Packet{}, err
+	}
+	for len(d.queue) == 0 {
+		typ, box, err := d.readBox()
+		if err != nil {
+			return av.Packet{}, err
+		}
+		switch typ {
+		case "moof":
+			d.moof = box
+		case "mdat":
+			if d.moof == nil {
+				continue
+			}
+			samples, err := parseFMP4Segment(append(d.moof, box...), d.tracks)
+			d.moof = nil
+			if err != nil {
+				log.Printf("[WS] Bad fMP4 fragment: %v", err)
+				continue
+			}
+			d.queue = d.p.packets(samples)
+		}
+	}
+	pkt := d.queue[0]
+	d.queue = d.queue[1:]
+	return pkt, nil
+}